@@ -4,6 +4,12 @@ import { createRenderer } from '@pkg/renderer'
 type ENAR = { en: string; ar: string }
 type Attribute = { key: string; default_position?: number }
 
+// Sets the email action's digest schedule; undefined sends an email per submission.
+const withEmailDigest = (actions: any[], digest: any) =>
+  actions.map((x: any) =>
+    x.type === 'email' ? { ...x, email: { ...x.email, digest } } : x,
+  )
+
 export const FormBuilder: React.FC = () => {
   const [formId, setFormId] = React.useState('')
   const [title, setTitle] = React.useState<ENAR>({ en: '', ar: '' })
@@ -11,6 +17,7 @@ export const FormBuilder: React.FC = () => {
   const [selected, setSelected] = React.useState<string[]>([])
   const [locale, setLocale] = React.useState<'en' | 'ar'>('en')
   const [attrSearch, setAttrSearch] = React.useState('')
+  const [copyWebhooks, setCopyWebhooks] = React.useState(true)
   const [thank, setThank] = React.useState<{
     show: boolean
     title: ENAR
@@ -21,6 +28,16 @@ export const FormBuilder: React.FC = () => {
       { type: 'native_bridge', enabled: false },
       { type: 'server_persist', enabled: false },
       { type: 'webhooks', enabled: false },
+      {
+        type: 'email',
+        enabled: false,
+        email: {
+          to: [],
+          to_field: '',
+          subject: { en: '', ar: '' },
+          body: { en: '', ar: '' },
+        },
+      },
       { type: 'nextjs_post', enabled: false },
       { type: 'redirect', enabled: false, url: '' },
       {
@@ -49,6 +66,7 @@ export const FormBuilder: React.FC = () => {
       'native_bridge',
       'server_persist',
       'webhooks',
+      'email',
       'nextjs_post',
       'redirect',
       'purchase_authenticated',
@@ -149,6 +167,7 @@ export const FormBuilder: React.FC = () => {
       attributes: selected,
       thankYou: thank,
       submit,
+      copyWebhooks,
     }
     const res = await fetch('/api/forms/publish', {
       method: 'POST',
@@ -164,8 +183,19 @@ export const FormBuilder: React.FC = () => {
         `A form with the same configuration already exists!\n\nForm ID: ${j.formId}\nVersion: ${j.version}\n\nURLs:\nEN: ${j.urls.en}\nAR: ${j.urls.ar}`,
       )
     } else {
+      let carried = ''
+      if (j.webhooks?.copied?.length) {
+        carried = `\n\nWebhooks copied from version ${j.webhooks.fromVersion}:`
+        for (const w of j.webhooks.copied) {
+          carried += `\n${w.endpointUrl}`
+          if (w.droppedFields?.length)
+            carried += ` (dropped fields: ${w.droppedFields.join(', ')})`
+          if (w.disabledReason) carried += ` - disabled: ${w.disabledReason}`
+          if (w.fieldErrors?.length) carried += `\n  ${w.fieldErrors.join('\n  ')}`
+        }
+      }
       alert(
-        `Form published successfully!\n\nForm ID: ${j.formId}\nVersion: ${j.version}\n\nURLs:\nEN: ${j.urls.en}\nAR: ${j.urls.ar}`,
+        `Form published successfully!\n\nForm ID: ${j.formId}\nVersion: ${j.version}\n\nURLs:\nEN: ${j.urls.en}\nAR: ${j.urls.ar}${carried}`,
       )
     }
   }
@@ -409,6 +439,7 @@ export const FormBuilder: React.FC = () => {
             'native_bridge',
             'server_persist',
             'webhooks',
+            'email',
             'nextjs_post',
             'redirect',
             'purchase_authenticated',
@@ -433,7 +464,9 @@ export const FormBuilder: React.FC = () => {
                     ? 'Save responses'
                     : t === 'webhooks'
                       ? 'Trigger webhooks'
-                      : t === 'nextjs_post'
+                      : t === 'email'
+                        ? 'Send email'
+                        : t === 'nextjs_post'
                         ? 'Post to Next.js'
                         : t === 'purchase_authenticated'
                           ? 'Authenticated Purchase'
@@ -465,6 +498,175 @@ export const FormBuilder: React.FC = () => {
                     }}
                   />
                 )}
+              {t === 'email' &&
+                submit.actions.find((a: any) => a.type === 'email')
+                  ?.enabled && (
+                  <div className="mt-2 p-3 border rounded bg-slate-50 dark:bg-slate-900 dark:border-slate-600 space-y-2">
+                    <input
+                      className="border p-1 w-full text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100"
+                      placeholder="Recipients, comma-separated"
+                      value={(
+                        submit.actions.find((a: any) => a.type === 'email')
+                          ?.email?.to || []
+                      ).join(', ')}
+                      onChange={(e) => {
+                        const to = e.target.value
+                          .split(',')
+                          .map((s) => s.trim())
+                          .filter(Boolean)
+                        const a = submit.actions.map((x: any) =>
+                          x.type === 'email'
+                            ? { ...x, email: { ...x.email, to } }
+                            : x,
+                        )
+                        setSubmit((prev: any) => ({ ...prev, actions: a }))
+                      }}
+                    />
+                    <input
+                      className="border p-1 w-full text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100"
+                      placeholder="Also send to the address in field (optional)"
+                      value={
+                        submit.actions.find((a: any) => a.type === 'email')
+                          ?.email?.to_field || ''
+                      }
+                      onChange={(e) => {
+                        const a = submit.actions.map((x: any) =>
+                          x.type === 'email'
+                            ? {
+                                ...x,
+                                email: { ...x.email, to_field: e.target.value },
+                              }
+                            : x,
+                        )
+                        setSubmit((prev: any) => ({ ...prev, actions: a }))
+                      }}
+                    />
+                    {(['subject', 'body'] as const).map((part) =>
+                      (['en', 'ar'] as const).map((lang) => (
+                        <textarea
+                          key={part + lang}
+                          dir={lang === 'ar' ? 'rtl' : 'ltr'}
+                          rows={part === 'body' ? 4 : 1}
+                          className="border p-1 w-full text-xs font-mono dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100"
+                          placeholder={`${part === 'subject' ? 'Subject' : 'Body'} template (${lang.toUpperCase()}, optional)`}
+                          value={
+                            submit.actions.find((a: any) => a.type === 'email')
+                              ?.email?.[part]?.[lang] || ''
+                          }
+                          onChange={(e) => {
+                            const a = submit.actions.map((x: any) =>
+                              x.type === 'email'
+                                ? {
+                                    ...x,
+                                    email: {
+                                      ...x.email,
+                                      [part]: {
+                                        ...x.email?.[part],
+                                        [lang]: e.target.value,
+                                      },
+                                    },
+                                  }
+                                : x,
+                            )
+                            setSubmit((prev: any) => ({ ...prev, actions: a }))
+                          }}
+                        />
+                      )),
+                    )}
+                    <div className="flex flex-wrap gap-2 items-center text-xs">
+                      <span>Digest</span>
+                      <select
+                        className="border p-1 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100"
+                        value={
+                          submit.actions.find((a: any) => a.type === 'email')
+                            ?.email?.digest?.schedule || ''
+                        }
+                        onChange={(e) =>
+                          setSubmit((prev: any) => ({
+                            ...prev,
+                            actions: withEmailDigest(
+                              prev.actions,
+                              e.target.value
+                                ? {
+                                    schedule: e.target.value,
+                                    ...(e.target.value === 'daily'
+                                      ? { at: '09:00' }
+                                      : {}),
+                                    ...(e.target.value === 'count'
+                                      ? { every: 10 }
+                                      : {}),
+                                  }
+                                : undefined,
+                            ),
+                          }))
+                        }
+                      >
+                        <option value="">Off (one email per submission)</option>
+                        <option value="hourly">Hourly</option>
+                        <option value="daily">Daily</option>
+                        <option value="count">Every N submissions</option>
+                      </select>
+                      {(() => {
+                        const digest = submit.actions.find(
+                          (a: any) => a.type === 'email',
+                        )?.email?.digest
+                        if (!digest) return null
+                        const set = (patch: any) =>
+                          setSubmit((prev: any) => ({
+                            ...prev,
+                            actions: withEmailDigest(prev.actions, {
+                              ...digest,
+                              ...patch,
+                            }),
+                          }))
+                        return (
+                          <>
+                            {digest.schedule === 'daily' && (
+                              <input
+                                type="time"
+                                className="border p-1 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100"
+                                value={digest.at || ''}
+                                onChange={(e) => set({ at: e.target.value })}
+                              />
+                            )}
+                            {digest.schedule !== 'count' ? (
+                              <input
+                                className="border p-1 w-40 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100"
+                                placeholder="Timezone (UTC)"
+                                value={digest.timezone || ''}
+                                onChange={(e) =>
+                                  set({ timezone: e.target.value || undefined })
+                                }
+                              />
+                            ) : (
+                              <input
+                                type="number"
+                                min={1}
+                                className="border p-1 w-20 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100"
+                                value={digest.every || 1}
+                                onChange={(e) =>
+                                  set({ every: Number(e.target.value) || 1 })
+                                }
+                              />
+                            )}
+                            <label className="inline-flex items-center gap-1">
+                              <input
+                                type="checkbox"
+                                checked={digest.format === 'csv'}
+                                onChange={(e) =>
+                                  set({
+                                    format: e.target.checked ? 'csv' : undefined,
+                                  })
+                                }
+                              />
+                              Attach as CSV
+                            </label>
+                          </>
+                        )
+                      })()}
+                    </div>
+                  </div>
+                )}
               {t === 'purchase_authenticated' &&
                 submit.actions.find(
                   (a: any) => a.type === 'purchase_authenticated',
@@ -857,7 +1059,9 @@ export const FormBuilder: React.FC = () => {
                       ? 'Save'
                       : t === 'webhooks'
                         ? 'Webhooks'
-                        : t === 'nextjs_post'
+                        : t === 'email'
+                          ? 'Email'
+                          : t === 'nextjs_post'
                           ? 'Next.js'
                           : t === 'purchase_authenticated'
                             ? 'Purchase Auth'
@@ -909,7 +1113,9 @@ export const FormBuilder: React.FC = () => {
                         ? 'Save'
                         : t === 'webhooks'
                           ? 'Webhooks'
-                          : t === 'nextjs_post'
+                          : t === 'email'
+                            ? 'Email'
+                            : t === 'nextjs_post'
                             ? 'Next.js'
                             : t === 'purchase_authenticated'
                               ? 'Purchase'
@@ -922,7 +1128,7 @@ export const FormBuilder: React.FC = () => {
         </div>
       </div>
 
-      <div className="flex gap-2">
+      <div className="flex gap-2 items-center">
         <button
           className="bg-slate-700 text-white rounded px-3 py-1 dark:bg-slate-600 hover:bg-slate-800 dark:hover:bg-slate-500"
           onClick={preview}
@@ -935,6 +1141,14 @@ export const FormBuilder: React.FC = () => {
         >
           Publish
         </button>
+        <label className="text-sm">
+          <input
+            type="checkbox"
+            checked={copyWebhooks}
+            onChange={(e) => setCopyWebhooks(e.target.checked)}
+          />{' '}
+          Copy webhooks from the previous version
+        </label>
       </div>
 
       <div
@@ -11,6 +11,7 @@ type Submission = {
   attributes: Record<string, any>
   idempotencyKey?: string | null
   webhookStatus: string
+  externalRefs?: Record<string, any>
   createdAt: string
 }
 
@@ -27,6 +28,7 @@ export const Submissions: React.FC = () => {
   const [submissions, setSubmissions] = React.useState<Submission[]>([])
   const [loading, setLoading] = React.useState(false)
   const [expandedId, setExpandedId] = React.useState<number | null>(null)
+  const [refFilter, setRefFilter] = React.useState('')
 
   const loadForms = async () => {
     try {
@@ -55,6 +57,11 @@ export const Submissions: React.FC = () => {
       if (selectedVersion) {
         url += '&version=' + encodeURIComponent(selectedVersion)
       }
+      // "name=value", e.g. crm_ticket_id=T-123
+      const [refName, ...refValue] = refFilter.split('=')
+      if (refName.trim() && refValue.length > 0) {
+        url += '&ref.' + encodeURIComponent(refName.trim()) + '=' + encodeURIComponent(refValue.join('=').trim())
+      }
       
       const r = await fetch(url, { headers: { Authorization: 'Bearer dev-admin-token' } })
       if (!r.ok) {
@@ -134,6 +141,17 @@ export const Submissions: React.FC = () => {
           </div>
         )}
 
+        <div>
+          <label className="block text-sm mb-1">External ref</label>
+          <input
+            className="border px-3 py-1 rounded dark:border-slate-600 dark:bg-slate-800"
+            placeholder="crm_ticket_id=T-123"
+            value={refFilter}
+            onChange={(e) => setRefFilter(e.target.value)}
+            onKeyDown={(e) => { if (e.key === 'Enter') loadSubmissions() }}
+          />
+        </div>
+
         <button
           className="bg-blue-600 text-white px-3 py-1 rounded hover:bg-blue-700"
           onClick={loadSubmissions}
@@ -217,6 +235,14 @@ export const Submissions: React.FC = () => {
                               </pre>
                             </div>
                           )}
+                          {s.externalRefs && Object.keys(s.externalRefs).length > 0 && (
+                            <div>
+                              <h3 className="font-semibold mb-2">External Refs</h3>
+                              <pre className="bg-white dark:bg-slate-800 p-3 rounded border overflow-x-auto text-xs dark:border-slate-600">
+                                {formatJson(s.externalRefs)}
+                              </pre>
+                            </div>
+                          )}
                           {s.idempotencyKey && (
                             <div>
                               <h3 className="font-semibold mb-2">Idempotency Key</h3>
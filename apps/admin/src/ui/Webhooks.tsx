@@ -1,14 +1,30 @@
 import React from 'react'
 
-type Item = { id: number; type: 'http'; endpoint_url: string; http_method: string; content_type?: string; headers: Record<string,string>; body_template?: string; selected_fields?: string[]; mode: 'raw'; enabled: boolean }
+type Item = { id: number; type: 'http'; endpoint_url: string; http_method: string; content_type?: string; headers: Record<string,string>; query_params?: Record<string,string>; body_template?: string; selected_fields?: string[]; retry_policy?: Record<string, any> | null; filter?: string; mapping?: Record<string, any> | null; mode: 'raw' | 'mapping' | 'slack' | 'teams' | 'discord'; events?: string[]; digest?: { schedule: 'hourly' | 'daily' | 'count'; at?: string; timezone?: string; every?: number; format?: 'json' | 'csv' } | null; enabled: boolean; position?: number; depends_on?: number[]; response_extract?: Record<string,string>; external_refs?: Record<string,string>; rate_limit?: { max_concurrent?: number; requests_per_second?: number; burst?: number } | null; auth?: Record<string, any> | null }
 
 type FormSnapshot = { formId: string; version: number; title: { en:string; ar:string }; createdAt: string }
 
 type FormField = { name: string; type: string; label_json?: { en?: string; ar?: string }; props?: any }
 
+// Form-level webhooks fire for every version of the form
+const ALL_VERSIONS = -1
+
+// Event types a webhook can subscribe to; submission.created is the default
+const EVENT_TYPES = ['submission.created', 'submission.updated', 'submission.deleted', 'form.published', 'form.deleted', 'question.updated', 'webhook.delivery_failed']
+
+const webhooksPath = (formId: string, version: number) =>
+  version === ALL_VERSIONS
+    ? `/api/forms/${encodeURIComponent(formId)}/webhooks`
+    : `/api/forms/${encodeURIComponent(formId)}/${version}/webhooks`
+
 function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; onCancel: ()=>void; onSaved: ()=>void; formId: string; version: number }) {
-  const [w, setW] = React.useState<Item>(value || { id: 0, type:'http', endpoint_url:'', http_method:'POST', content_type:'application/json', headers:{}, body_template:'', selected_fields:[], mode:'raw', enabled:true })
+  const [w, setW] = React.useState<Item>(value || { id: 0, type:'http', endpoint_url:'', http_method:'POST', content_type:'application/json', headers:{}, body_template:'', selected_fields:[], filter:'', mode:'raw', enabled:true })
   const [headersText, setHeadersText] = React.useState<string>(value? JSON.stringify(value.headers, null, 2): '{\n  "X-Auth": ""\n}')
+  const [queryText, setQueryText] = React.useState<string>(value?.query_params ? JSON.stringify(value.query_params, null, 2) : '{}')
+  const [extractText, setExtractText] = React.useState<string>(value?.response_extract ? JSON.stringify(value.response_extract, null, 2) : '{}')
+  const [authText, setAuthText] = React.useState<string>(value?.auth ? JSON.stringify(value.auth, null, 2) : '')
+  const [refsText, setRefsText] = React.useState<string>(value?.external_refs ? JSON.stringify(value.external_refs, null, 2) : '{}')
+  const [mappingText, setMappingText] = React.useState<string>(value?.mapping ? JSON.stringify(value.mapping, null, 2) : '{\n  "phone": "answers.phone_number.e164",\n  "locale": "meta.locale"\n}')
   const [formFields, setFormFields] = React.useState<FormField[]>([])
   const [err, setErr] = React.useState('')
   const [testing, setTesting] = React.useState(false)
@@ -21,6 +37,11 @@ function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; o
     if (value) {
       setW(value)
       setHeadersText(JSON.stringify(value.headers || {}, null, 2))
+      setQueryText(JSON.stringify(value.query_params || {}, null, 2))
+      setExtractText(JSON.stringify(value.response_extract || {}, null, 2))
+      setRefsText(JSON.stringify(value.external_refs || {}, null, 2))
+      setAuthText(value.auth ? JSON.stringify(value.auth, null, 2) : '')
+      if (value.mapping) setMappingText(JSON.stringify(value.mapping, null, 2))
       // Debug: log what we're receiving
       console.log('Editor: received value', { body_template: value.body_template, selected_fields: value.selected_fields })
     }
@@ -29,7 +50,8 @@ function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; o
   // Load form fields when formId/version changes
   React.useEffect(() => {
     if (!formId || !version) return
-    fetch(`/api/forms/${encodeURIComponent(formId)}/${version}`, { headers:{ Authorization:'Bearer dev-admin-token' } })
+    // Form-level webhooks are edited against the latest version's fields
+    fetch(`/api/forms/${encodeURIComponent(formId)}/${version === ALL_VERSIONS ? 'latest' : version}`, { headers:{ Authorization:'Bearer dev-admin-token' } })
       .then(r => r.json())
       .then(data => {
         if (data.fields && Array.isArray(data.fields)) {
@@ -56,13 +78,32 @@ function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; o
       }
     }
     
-    const body = { type: w.type, endpoint_url: w.endpoint_url, http_method: w.http_method||'POST', content_type: w.content_type || 'application/json', headers: (headersText.trim()? JSON.parse(headersText): {}), body_template: w.body_template || '', selected_fields: usedFields, mode: w.mode, enabled: w.enabled }
-    const url = `/api/forms/${encodeURIComponent(formId)}/${version}/webhooks` + (value? `/${value.id}`: '')
+    let query_params: Record<string,string> = {}
+    try { query_params = queryText.trim()? JSON.parse(queryText): {} } catch { setErr('Query params must be valid JSON'); return }
+    let response_extract: Record<string,string> = {}
+    try { response_extract = extractText.trim()? JSON.parse(extractText): {} } catch { setErr('Response extract must be valid JSON'); return }
+    let external_refs: Record<string,string> = {}
+    try { external_refs = refsText.trim()? JSON.parse(refsText): {} } catch { setErr('External refs must be valid JSON'); return }
+    let auth: Record<string, any> | undefined = undefined
+    try { auth = authText.trim()? JSON.parse(authText): undefined } catch { setErr('Auth must be valid JSON'); return }
+    const rl = w.rate_limit || {}
+    const rateLimit = (rl.max_concurrent || rl.requests_per_second) ? { max_concurrent: rl.max_concurrent || 0, requests_per_second: rl.requests_per_second || 0, burst: rl.requests_per_second ? rl.burst : undefined } : undefined
+    let mapping: any = undefined
+    if (w.mode === 'mapping') {
+      try { mapping = JSON.parse(mappingText) } catch (e: any) { setErr(`Mapping is not valid JSON: ${e.message}`); return }
+    }
+    const body = { mapping, query_params, type: w.type, endpoint_url: w.endpoint_url, http_method: w.http_method||'POST', content_type: w.content_type || 'application/json', headers: (headersText.trim()? JSON.parse(headersText): {}), body_template: w.body_template || '', selected_fields: usedFields, retry_policy: w.retry_policy || undefined, rate_limit: rateLimit, filter: w.filter || '', position: w.position || 0, depends_on: w.depends_on || [], response_extract, external_refs, auth, mode: w.mode, events: w.events && w.events.length ? w.events : undefined, digest: w.digest || undefined, enabled: w.enabled }
+    const url = webhooksPath(formId, version) + (value? `/${value.id}`: '')
     const res = await fetch(url, { method: value? 'PUT':'POST', headers:{ 'Content-Type':'application/json', Authorization:'Bearer dev-admin-token' }, body: JSON.stringify(body) })
     if (!res.ok) { 
       const errorText = await res.text()
       setErr(`Save failed: ${errorText}`)
-      return 
+      return
+    }
+    if (!value) {
+      // The signing secret is only returned once, on create
+      const created = await res.json().catch(() => null)
+      if (created?.signing_secret) alert(`Signing secret for this webhook (shown only once):\n\n${created.signing_secret}`)
     }
     onSaved()
   }
@@ -73,7 +114,7 @@ function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; o
     setTesting(true)
     setErr('')
     try {
-      const res = await fetch(`/api/forms/${encodeURIComponent(formId)}/${version}/webhooks/${value.id}/test`, {
+      const res = await fetch(`${webhooksPath(formId, version)}/${value.id}/test`, {
         method: 'POST',
         headers: { Authorization: 'Bearer dev-admin-token' }
       })
@@ -197,7 +238,7 @@ function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; o
     // Build mock context (similar to what backend provides)
     const mockContext: Record<string, any> = {
       formId: formId || 'example-form',
-      version: version || 1,
+      version: version > 0 ? version : 1,
       submissionId: 12345,
       submittedAt: Date.now(),
       meta: {
@@ -585,8 +626,8 @@ function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; o
           <label className="block">Enabled<select className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={String(w.enabled)} onChange={e=>setW(prev=>({ ...prev, enabled: e.target.value==='true' }))}><option value="true">true</option><option value="false">false</option></select></label>
           <label className="block col-span-2">Endpoint URL<input className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.endpoint_url} onChange={e=>setW(prev=>({ ...prev, endpoint_url:e.target.value }))} /></label>
           <label className="block">HTTP Method<select className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.http_method} onChange={e=>setW(prev=>({ ...prev, http_method:e.target.value }))}><option>POST</option><option>PUT</option><option>PATCH</option></select></label>
-          <label className="block">Mode<select className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.mode} onChange={e=>setW(prev=>({ ...prev, mode:e.target.value as any }))}><option value="raw">raw</option></select></label>
-          <label className="block">Content Type<select className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.content_type || 'application/json'} onChange={e=>setW(prev=>({ ...prev, content_type:e.target.value }))}><option value="application/json">application/json</option><option value="text/plain">text/plain</option></select></label>
+          <label className="block">Mode<select className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.mode} onChange={e=>setW(prev=>({ ...prev, mode:e.target.value as any }))}><option value="raw">raw (template)</option><option value="mapping">mapping</option><option value="slack">Slack message</option><option value="teams">Teams card</option><option value="discord">Discord embed</option></select></label>
+          <label className="block">Content Type<select className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.content_type || 'application/json'} onChange={e=>setW(prev=>({ ...prev, content_type:e.target.value }))}><option value="application/json">application/json</option><option value="text/plain">text/plain</option><option value="application/x-www-form-urlencoded">application/x-www-form-urlencoded</option><option value="multipart/form-data">multipart/form-data</option></select></label>
           <label className="block col-span-2">Available Fields (click to insert into body template)
             <div className="text-xs text-gray-500 dark:text-gray-400 mb-2">
               Click a field pill to insert its placeholder at your cursor position in the body template below.
@@ -615,9 +656,101 @@ function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; o
               Fields insert as {'{'}{'{'}.fieldName{'}'}{'}'}. To use {'{'}{'{'}.answers.fieldName{'}'}{'}'}, type it manually.
             </div>
           </label>
+          <div className="block col-span-2">Events
+            <div className="flex flex-wrap gap-3 mt-1">
+              {EVENT_TYPES.map(ev => {
+                const events = w.events && w.events.length ? w.events : ['submission.created']
+                return (
+                  <label key={ev} className="inline-flex items-center gap-1 text-sm font-mono">
+                    <input type="checkbox" checked={events.includes(ev)} onChange={e=>setW(prev=>({ ...prev, events: e.target.checked ? [...events, ev] : events.filter(x => x !== ev) }))} />
+                    {ev}
+                  </label>
+                )
+              })}
+            </div>
+            <div className="text-xs text-gray-500 dark:text-gray-400 mt-1">
+              Events other than submission.created are sent as a JSON envelope with the details under "data"; the body settings, filter and dependencies below only apply to new submissions.
+            </div>
+          </div>
+          <div className="block col-span-2">Digest
+            <div className="flex flex-wrap gap-2 items-center mt-1">
+              <select className="border p-1 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.digest?.schedule || ''} onChange={e=>{ const schedule = e.target.value as 'hourly' | 'daily' | 'count' | ''; setW(prev=>({ ...prev, digest: schedule ? { schedule, ...(schedule === 'daily' ? { at: '09:00' } : {}), ...(schedule === 'count' ? { every: 10 } : {}), format: prev.digest?.format } : null })) }}>
+                <option value="">Off (one delivery per submission)</option>
+                <option value="hourly">Hourly</option>
+                <option value="daily">Daily</option>
+                <option value="count">Every N submissions</option>
+              </select>
+              {w.digest?.schedule === 'daily' && (
+                <input type="time" className="border p-1 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.digest.at || ''} onChange={e=>setW(prev=>({ ...prev, digest: { ...prev.digest!, at: e.target.value } }))} />
+              )}
+              {w.digest && w.digest.schedule !== 'count' && (
+                <input className="border p-1 w-48 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" placeholder="Timezone, e.g. Asia/Kuwait (UTC)" value={w.digest.timezone || ''} onChange={e=>setW(prev=>({ ...prev, digest: { ...prev.digest!, timezone: e.target.value || undefined } }))} />
+              )}
+              {w.digest?.schedule === 'count' && (
+                <input type="number" min={1} className="border p-1 w-24 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.digest.every || 1} onChange={e=>setW(prev=>({ ...prev, digest: { ...prev.digest!, every: Number(e.target.value) || 1 } }))} />
+              )}
+              {w.digest && (
+                <select className="border p-1 dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.digest.format || 'json'} onChange={e=>{ const format = e.target.value as 'json' | 'csv'; setW(prev=>({ ...prev, content_type: format === 'csv' ? 'multipart/form-data' : 'application/json', digest: { ...prev.digest!, format } })) }}>
+                  <option value="json">JSON array</option>
+                  <option value="csv">CSV file (multipart/form-data)</option>
+                </select>
+              )}
+            </div>
+            <div className="text-xs text-gray-500 dark:text-gray-400 mt-1">
+              Digests batch new submissions into one submission.digest delivery per period; empty periods send nothing. Body template, filter and dependencies don't apply.
+            </div>
+          </div>
+          <label className="block col-span-2">Filter (optional - only fire when this matches)
+            <input className="border p-1 w-full font-mono text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" placeholder={`answers.contact_pref.value == "phone" && locale == "ar"`} value={w.filter || ''} onChange={e=>setW(prev=>({ ...prev, filter:e.target.value }))} />
+          </label>
+          <label className="block">Position
+            <input type="number" className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.position || 0} onChange={e=>setW(prev=>({ ...prev, position: Number(e.target.value) || 0 }))} />
+          </label>
+          <label className="block">Depends on (webhook IDs, comma-separated)
+            <input className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" placeholder="12, 14" value={(w.depends_on || []).join(', ')} onChange={e=>setW(prev=>({ ...prev, depends_on: e.target.value.split(',').map(s=>Number(s.trim())).filter(n=>n > 0) }))} />
+          </label>
+          <label className="block">Max concurrent requests (0 = no limit)
+            <input type="number" min={0} className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.rate_limit?.max_concurrent || 0} onChange={e=>setW(prev=>({ ...prev, rate_limit: { ...(prev.rate_limit || {}), max_concurrent: Number(e.target.value) || 0 } }))} />
+          </label>
+          <label className="block">Requests per second (0 = no limit)
+            <input type="number" min={0} step="0.1" className="border p-1 w-full dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={w.rate_limit?.requests_per_second || 0} onChange={e=>setW(prev=>({ ...prev, rate_limit: { ...(prev.rate_limit || {}), requests_per_second: Number(e.target.value) || 0 } }))} />
+          </label>
+          <label className="block col-span-2">Response extract (JSON, optional)
+            <div className="text-xs text-gray-500 dark:text-gray-400 mb-1">
+              Values from this webhook's JSON response for webhooks that depend on it, e.g. {'{'}"lead_id": "data.id"{'}'}; they use {'{'}{'{'}.responses.lead_id{'}'}{'}'}.
+            </div>
+            <textarea className="border p-1 w-full h-20 font-mono text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={extractText} onChange={e=>setExtractText(e.target.value)} />
+          </label>
+          <label className="block col-span-2">External refs (JSON, optional)
+            <div className="text-xs text-gray-500 dark:text-gray-400 mb-1">
+              Saved on the submission from a successful response, e.g. {'{'}"crm_ticket_id": "$.data.ticket_id"{'}'}.
+            </div>
+            <textarea className="border p-1 w-full h-20 font-mono text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={refsText} onChange={e=>setRefsText(e.target.value)} />
+          </label>
+          <label className="block col-span-2">Auth (JSON, optional)
+            <div className="text-xs text-gray-500 dark:text-gray-400 mb-1">
+              OAuth2 client credentials and/or a client certificate, e.g. {'{'}"oauth2": {'{'}"token_url": "https://auth.example.com/token", "client_id": "forms", "client_secret": "${'{'}secret:crm_client{'}'}", "scopes": ["leads.write"]{'}'}{'}'}. Use "mtls": {'{'}"client_cert", "client_key", "ca_bundle"{'}'} for mutual TLS.
+            </div>
+            <textarea className="border p-1 w-full h-24 font-mono text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={authText} onChange={e=>setAuthText(e.target.value)} />
+          </label>
           <label className="block col-span-2">Headers (JSON)
             <textarea className="border p-1 w-full h-32 font-mono text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={headersText} onChange={e=>setHeadersText(e.target.value)} />
           </label>
+          <label className="block col-span-2">Query params (JSON)
+            <div className="text-xs text-gray-500 dark:text-gray-400 mb-1">
+              Added to the endpoint URL. The URL, query param values and header values accept templates, e.g. {'{'}{'{'}.submissionId{'}'}{'}'}.
+            </div>
+            <textarea className="border p-1 w-full h-20 font-mono text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={queryText} onChange={e=>setQueryText(e.target.value)} />
+          </label>
+          {w.mode === 'mapping' && (
+          <label className="block col-span-2">Mapping (JSON)
+            <div className="text-xs text-gray-500 dark:text-gray-400 mb-1">
+              Each key is a source path (answers.phone_number.e164, meta.locale, submissionId), a constant ({'{"const": "web"}'}) or a path with a transform ({'{"path": "answers.city", "transform": "label"}'}; also join, lowercase, uppercase, trim, string, number).
+            </div>
+            <textarea className="border p-1 w-full h-40 font-mono text-xs dark:border-slate-600 dark:bg-slate-800 dark:text-slate-100" value={mappingText} onChange={e=>setMappingText(e.target.value)} />
+          </label>
+          )}
+          {w.mode === 'raw' && (
           <label className="block col-span-2">Body Template (required - design your own body using placeholders)
             <div className="text-xs text-gray-500 dark:text-gray-400 mb-1">
               Design your webhook body here. Use placeholders: formId, version, submissionId, submittedAt, selected fields ({'{'}{'{'}.fieldName{'}'}{'}'}), selected ({'{'}{'{'}.selected{'}'}{'}'}), answers ({'{'}{'{'}.answers{'}'}{'}'}), meta. For JSON injection use: {'{'}{'{'}json .fieldName{'}'}{'}'}. If left empty, webhook will send empty body: {'{}'}
@@ -632,6 +765,7 @@ function Editor({ value, onCancel, onSaved, formId, version }: { value?: Item; o
               onClick={handleBodyTemplateClick}
             />
           </label>
+          )}
         </div>
         <div className="mt-4 border-t pt-4 dark:border-slate-600">
           <h4 className="font-semibold mb-3">Preview</h4>
@@ -785,7 +919,7 @@ export const Webhooks: React.FC = () => {
     }
     setLoading(true)
     try {
-      const r = await fetch(`/api/forms/${encodeURIComponent(formId)}/${version}/webhooks`, { headers:{ Authorization:'Bearer dev-admin-token' } })
+      const r = await fetch(webhooksPath(formId, version), { headers:{ Authorization:'Bearer dev-admin-token' } })
       if (r.ok) {
         setItems(await r.json())
       } else {
@@ -828,7 +962,7 @@ export const Webhooks: React.FC = () => {
 
   // Reset version when formId changes
   React.useEffect(() => {
-    if (formId && versions.length > 0 && !versions.includes(version)) {
+    if (formId && versions.length > 0 && version !== ALL_VERSIONS && !versions.includes(version)) {
       setVersion(versions[0])
     }
   }, [formId, versions, version])
@@ -840,7 +974,7 @@ export const Webhooks: React.FC = () => {
     if (!formId || !version) return
     setTesting(webhook)
     try {
-      const res = await fetch(`/api/forms/${encodeURIComponent(formId)}/${version}/webhooks/${webhook.id}/test`, {
+      const res = await fetch(`${webhooksPath(formId, version)}/${webhook.id}/test`, {
         method: 'POST',
         headers: { Authorization: 'Bearer dev-admin-token' }
       })
@@ -864,7 +998,7 @@ export const Webhooks: React.FC = () => {
     }
   }
 
-  const canAddWebhook = formId && version > 0
+  const canAddWebhook = formId && (version > 0 || version === ALL_VERSIONS)
 
   return (
     <div className="space-y-3">
@@ -891,6 +1025,7 @@ export const Webhooks: React.FC = () => {
             disabled={!formId}
           >
             <option value="">-- Select --</option>
+            <option value={ALL_VERSIONS}>All versions</option>
             {versions.map(v => (
               <option key={v} value={v}>v{v}</option>
             ))}
@@ -906,26 +1041,28 @@ export const Webhooks: React.FC = () => {
       </div>
       {loading && <div className="text-sm text-gray-600 dark:text-gray-400">Loading webhooks...</div>}
       <table className="w-full border text-sm dark:border-slate-600">
-        <thead><tr className="bg-slate-50 dark:bg-slate-800"><th className="border p-2 text-left dark:border-slate-600">Type</th><th className="border p-2 text-left dark:border-slate-600">Endpoint</th><th className="border p-2 text-left dark:border-slate-600">Method</th><th className="border p-2 text-left dark:border-slate-600">Mode</th><th className="border p-2 text-left dark:border-slate-600">Enabled</th><th className="border p-2 dark:border-slate-600"></th></tr></thead>
+        <thead><tr className="bg-slate-50 dark:bg-slate-800"><th className="border p-2 text-left dark:border-slate-600">#</th><th className="border p-2 text-left dark:border-slate-600">Type</th><th className="border p-2 text-left dark:border-slate-600">Endpoint</th><th className="border p-2 text-left dark:border-slate-600">Method</th><th className="border p-2 text-left dark:border-slate-600">Mode</th><th className="border p-2 text-left dark:border-slate-600">Events</th><th className="border p-2 text-left dark:border-slate-600">Enabled</th><th className="border p-2 dark:border-slate-600"></th></tr></thead>
         <tbody>
           {items.length === 0 && !loading && (
             <tr>
-              <td colSpan={6} className="border p-4 text-center text-gray-500 dark:text-gray-400">
-                {formId && version ? 'No webhooks configured for this form snapshot' : 'Select a form and version to view webhooks'}
+              <td colSpan={8} className="border p-4 text-center text-gray-500 dark:text-gray-400">
+                {formId && version ? (version === ALL_VERSIONS ? 'No form-level webhooks configured' : 'No webhooks configured for this form snapshot') : 'Select a form and version to view webhooks'}
               </td>
             </tr>
           )}
           {items.map(i => (
             <tr key={i.id}>
+              <td className="border p-2 dark:border-slate-600" title={i.depends_on?.length ? `After ${i.depends_on.join(', ')}` : undefined}>{i.id}{i.depends_on?.length ? ` ← ${i.depends_on.join(', ')}` : ''}</td>
               <td className="border p-2 dark:border-slate-600">{i.type}</td>
               <td className="border p-2 truncate max-w-[320px] dark:border-slate-600" title={i.endpoint_url}>{i.endpoint_url}</td>
               <td className="border p-2 dark:border-slate-600">{i.http_method}</td>
               <td className="border p-2 dark:border-slate-600">{i.mode}</td>
+              <td className="border p-2 text-xs font-mono dark:border-slate-600">{(i.events || ['submission.created']).join(', ')}{i.digest ? ` (${i.digest.schedule} digest)` : ''}</td>
               <td className="border p-2 dark:border-slate-600">{String(i.enabled)}</td>
               <td className="border p-2 text-right space-x-2 dark:border-slate-600">
                 <button className="underline dark:text-blue-400" onClick={()=>{ setEditing(i); setShowEditor(true) }}>Edit</button>
                 <button className="underline text-green-600 dark:text-green-400" onClick={()=>{ testWebhook(i) }} disabled={!!testing}>Test</button>
-                <button className="underline text-red-600 dark:text-red-400" onClick={async ()=>{ if (!confirm('Delete webhook?')) return; await fetch(`/api/forms/${encodeURIComponent(formId)}/${version}/webhooks/${i.id}`, { method:'DELETE', headers:{ Authorization:'Bearer dev-admin-token' } }); loadWebhooks() }}>Delete</button>
+                <button className="underline text-red-600 dark:text-red-400" onClick={async ()=>{ if (!confirm('Delete webhook?')) return; const r = await fetch(`${webhooksPath(formId, version)}/${i.id}`, { method:'DELETE', headers:{ Authorization:'Bearer dev-admin-token' } }); if (r.status === 409) { const d = await r.json().catch(() => null); alert(`Webhooks ${(d?.dependents || []).join(', ')} depend on this one; remove the dependency first.`) } loadWebhooks() }}>Delete</button>
               </td>
             </tr>
           ))}
@@ -54,6 +54,14 @@ func main() {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
     _ = httpServer.Shutdown(ctx)
+    // drain in-flight webhook deliveries; anything left stays in the outbox.
+    // The drain gets its own deadline, one request timeout plus some slack,
+    // rather than whatever slow HTTP clients left of the one above
+    drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Duration(cfg.WebhookTimeout())*time.Millisecond+5*time.Second)
+    defer drainCancel()
+    if err := srv.Shutdown(drainCtx); err != nil {
+        logger.Warn("webhook dispatcher did not drain in time", zap.Error(err))
+    }
 }
 
 
@@ -33,6 +33,45 @@ type Config struct {
     WebhookTimeoutMs      int    `envconfig:"WEBHOOK_TIMEOUT_MS" default:"8000"`
     WebhookMaxRetries     int    `envconfig:"WEBHOOK_MAX_RETRIES" default:"3"`
     WebhookRetryBackoffMs int    `envconfig:"WEBHOOK_RETRY_BACKOFF_MS" default:"1500"`
+    WebhookWorkers        int    `envconfig:"WEBHOOK_WORKERS" default:"4"`
+    WebhookPollIntervalMs int    `envconfig:"WEBHOOK_POLL_INTERVAL_MS" default:"1000"`
+    WebhookDigestPollMs   int    `envconfig:"WEBHOOK_DIGEST_POLL_INTERVAL_MS" default:"30000"` // how often digest schedules are checked
+
+    // Webhook circuit breaker
+    WebhookBreakerThreshold       int     `envconfig:"WEBHOOK_BREAKER_THRESHOLD" default:"5"` // consecutive failures, 0 disables the breaker
+    WebhookBreakerFailureRate     float64 `envconfig:"WEBHOOK_BREAKER_FAILURE_RATE" default:"0.5"`
+    WebhookBreakerMinRequests     int     `envconfig:"WEBHOOK_BREAKER_MIN_REQUESTS" default:"20"`
+    WebhookBreakerWindowSec       int     `envconfig:"WEBHOOK_BREAKER_WINDOW_SECONDS" default:"300"`
+    WebhookBreakerCooldownSec     int     `envconfig:"WEBHOOK_BREAKER_COOLDOWN_SECONDS" default:"60"`
+    WebhookBreakerDisableAfterSec int     `envconfig:"WEBHOOK_BREAKER_DISABLE_AFTER_SECONDS" default:"86400"` // 0 never auto-disables
+
+    // Webhook destination limits, enforced per API process; 0 means unlimited.
+    // WEBHOOK_HOST_LIMITS overrides them per host: "host=max_concurrent[:rps[:burst]],..."
+    WebhookHostMaxConcurrent int     `envconfig:"WEBHOOK_HOST_MAX_CONCURRENT" default:"8"`
+    WebhookHostRatePerSec    float64 `envconfig:"WEBHOOK_HOST_RATE_PER_SEC" default:"0"`
+    WebhookHostBurst         int     `envconfig:"WEBHOOK_HOST_BURST" default:"0"`
+    WebhookHostLimits        string  `envconfig:"WEBHOOK_HOST_LIMITS" default:""`
+    WebhookLimitMaxWaitMs    int     `envconfig:"WEBHOOK_LIMIT_MAX_WAIT_MS" default:"2000"` // then the delivery goes back to the outbox
+
+    // SMTP for the email submit action. SMTP_TLS is "starttls", "tls" (implicit) or "none".
+    SMTPHost     string `envconfig:"SMTP_HOST" default:""`
+    SMTPPort     int    `envconfig:"SMTP_PORT" default:"587"`
+    SMTPUsername string `envconfig:"SMTP_USERNAME" default:""`
+    SMTPPassword string `envconfig:"SMTP_PASSWORD" default:""`
+    SMTPFrom     string `envconfig:"SMTP_FROM" default:""`
+    SMTPTLS      string `envconfig:"SMTP_TLS" default:"starttls"`
+
+    // Outbound calls (webhooks, purchase APIs, catalog, uploaded files): comma-separated
+    // hosts each may reach, "*.example.com" for subdomains, empty for any public host.
+    // Private, loopback and link-local addresses are refused unless OUTBOUND_ALLOW_PRIVATE is set.
+    OutboundAllowPrivate  bool   `envconfig:"OUTBOUND_ALLOW_PRIVATE" default:"false"`
+    OutboundWebhookHosts  string `envconfig:"OUTBOUND_WEBHOOK_HOSTS" default:""`
+    OutboundPurchaseHosts string `envconfig:"OUTBOUND_PURCHASE_HOSTS" default:""`
+    OutboundCatalogHosts  string `envconfig:"OUTBOUND_CATALOG_HOSTS" default:""`
+    OutboundUploadHosts   string `envconfig:"OUTBOUND_UPLOAD_HOSTS" default:"res.cloudinary.com"`
+
+    // Secret store: 32-byte AES key, base64 or hex. Empty disables ${secret:...} references.
+    SecretsMasterKey string `envconfig:"SECRETS_MASTER_KEY" default:""`
 
     // Next.js POST
     NextJSPostURL      string `envconfig:"NEXTJS_POST_URL" default:""`
@@ -60,6 +99,41 @@ func (c *Config) WebhookTimeout() int {
     return c.WebhookTimeoutMs
 }
 
+func (c *Config) WebhookWorkerCount() int {
+    if c.WebhookWorkers <= 0 {
+        return 4
+    }
+    return c.WebhookWorkers
+}
+
+func (c *Config) WebhookPollInterval() int {
+    if c.WebhookPollIntervalMs <= 0 {
+        return 1000
+    }
+    return c.WebhookPollIntervalMs
+}
+
+func (c *Config) WebhookDigestPollInterval() int {
+    if c.WebhookDigestPollMs <= 0 {
+        return 30000
+    }
+    return c.WebhookDigestPollMs
+}
+
+func (c *Config) WebhookBreakerCooldown() int {
+    if c.WebhookBreakerCooldownSec <= 0 {
+        return 60
+    }
+    return c.WebhookBreakerCooldownSec
+}
+
+func (c *Config) WebhookLimitMaxWait() int {
+    if c.WebhookLimitMaxWaitMs <= 0 {
+        return 2000
+    }
+    return c.WebhookLimitMaxWaitMs
+}
+
 func (c *Config) UploadTTLSeconds() int64 {
     if c.UploadTTL <= 0 {
         return 300
@@ -0,0 +1,520 @@
+// Package filterexpr parses and evaluates the small boolean expressions used to
+// decide whether a webhook fires for a submission, e.g.
+//
+//	answers.contact_pref.value == "phone" && locale == "ar"
+//	answers.number_of_units > 3
+//	"ac_repair" in answers.services
+//
+// Operands are dotted paths into the evaluation environment, string, number,
+// boolean and null literals, and [list] literals. Operators are == != < <= > >=,
+// in, && || ! and parentheses. Paths that don't resolve evaluate to null, and
+// comparisons that make no sense for their operands (a string ordered against
+// a number, say) are false rather than errors, so a filter never blocks a
+// delivery by failing at runtime.
+package filterexpr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SyntaxError reports where an expression stopped making sense.
+type SyntaxError struct {
+	Col int // 1-based
+	Msg string
+}
+
+func (e *SyntaxError) Error() string { return fmt.Sprintf("col %d: %s", e.Col, e.Msg) }
+
+// Expr is a parsed filter.
+type Expr struct {
+	src  string
+	root node
+}
+
+// String returns the source the expression was parsed from.
+func (e *Expr) String() string { return e.src }
+
+// Parse compiles src. Blank input is an error; callers treat "no filter" separately.
+func Parse(src string) (*Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	if p.peek().kind == tokEOF {
+		return nil, &SyntaxError{Col: 1, Msg: "empty expression"}
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &SyntaxError{Col: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// Match evaluates the expression against env and reports whether it holds.
+func (e *Expr) Match(env map[string]any) bool {
+	return truthy(e.root.eval(env))
+}
+
+// --- lexer
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokDot
+	tokComma
+	tokLParen
+	tokRParen
+	tokLBrack
+	tokRBrack
+)
+
+type token struct {
+	kind tokKind
+	text string
+	num  float64
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool { return isIdentStart(c) || c == '-' || (c >= '0' && c <= '9') }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		pos := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[j])
+					}
+					continue
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, &SyntaxError{Col: pos, Msg: "unterminated string"}
+			}
+			toks = append(toks, token{kind: tokString, text: sb.String(), pos: pos})
+			i = j + 1
+		case isDigit(c) || (c == '-' && i+1 < len(src) && isDigit(src[i+1])):
+			j := i + 1
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, &SyntaxError{Col: pos, Msg: fmt.Sprintf("invalid number %q", src[i:j])}
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[i:j], num: n, pos: pos})
+			i = j
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(src) && isIdentPart(src[j]) {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[i:j], pos: pos})
+			i = j
+		default:
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					toks = append(toks, token{kind: tokOp, text: two, pos: pos})
+					i += 2
+					continue
+				}
+			}
+			kinds := map[byte]tokKind{'.': tokDot, ',': tokComma, '(': tokLParen, ')': tokRParen, '[': tokLBrack, ']': tokRBrack, '<': tokOp, '>': tokOp, '!': tokOp}
+			k, ok := kinds[c]
+			if !ok {
+				return nil, &SyntaxError{Col: pos, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			toks = append(toks, token{kind: k, text: string(c), pos: pos})
+			i++
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src) + 1}), nil
+}
+
+// --- parser
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) expect(k tokKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != k {
+		return t, &SyntaxError{Col: t.pos, Msg: fmt.Sprintf("expected %s, got %s", what, t)}
+	}
+	return t, nil
+}
+
+func (p *parser) isOp(text string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == text
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") {
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && t.text != "&&" && t.text != "||" && t.text != "!":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return cmpNode{op: t.text, left: left, right: right}, nil
+	case t.kind == tokIdent && t.text == "in":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return inNode{left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return literal{t.text}, nil
+	case tokNumber:
+		return literal{t.num}, nil
+	case tokLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case tokLBrack:
+		var items []node
+		if p.peek().kind == tokRBrack {
+			p.next()
+			return listNode(items), nil
+		}
+		for {
+			n, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, n)
+			if p.peek().kind == tokComma {
+				p.next()
+				continue
+			}
+			if _, err := p.expect(tokRBrack, "']' or ','"); err != nil {
+				return nil, err
+			}
+			return listNode(items), nil
+		}
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		case "in":
+			return nil, &SyntaxError{Col: t.pos, Msg: "unexpected 'in'"}
+		}
+		path := []string{t.text}
+		for p.peek().kind == tokDot {
+			p.next()
+			seg := p.next()
+			if seg.kind != tokIdent && !(seg.kind == tokNumber && !strings.ContainsAny(seg.text, ".-")) {
+				return nil, &SyntaxError{Col: seg.pos, Msg: fmt.Sprintf("expected field name after '.', got %s", seg)}
+			}
+			path = append(path, seg.text)
+		}
+		return pathNode(path), nil
+	}
+	return nil, &SyntaxError{Col: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+}
+
+// --- evaluation
+
+type node interface {
+	eval(env map[string]any) any
+}
+
+type literal struct{ v any }
+
+func (n literal) eval(map[string]any) any { return n.v }
+
+type pathNode []string
+
+func (n pathNode) eval(env map[string]any) any {
+	var cur any = env
+	for _, seg := range n {
+		switch v := cur.(type) {
+		case map[string]any:
+			cur = v[seg]
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			cur = v[i]
+		default:
+			return nil
+		}
+	}
+	return cur
+}
+
+type listNode []node
+
+func (n listNode) eval(env map[string]any) any {
+	out := make([]any, len(n))
+	for i, item := range n {
+		out[i] = item.eval(env)
+	}
+	return out
+}
+
+type notNode struct{ n node }
+
+func (n notNode) eval(env map[string]any) any { return !truthy(n.n.eval(env)) }
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(env map[string]any) any {
+	return truthy(n.left.eval(env)) && truthy(n.right.eval(env))
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(env map[string]any) any {
+	return truthy(n.left.eval(env)) || truthy(n.right.eval(env))
+}
+
+type cmpNode struct {
+	op          string
+	left, right node
+}
+
+func (n cmpNode) eval(env map[string]any) any {
+	l, r := n.left.eval(env), n.right.eval(env)
+	switch n.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	}
+	c, ok := compare(l, r)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// inNode tests list membership, or substring for strings.
+type inNode struct{ left, right node }
+
+func (n inNode) eval(env map[string]any) any {
+	l, r := n.left.eval(env), n.right.eval(env)
+	switch v := r.(type) {
+	case []any:
+		for _, item := range v {
+			if equal(l, item) {
+				return true
+			}
+		}
+	case string:
+		if s, ok := l.(string); ok {
+			return strings.Contains(v, s)
+		}
+	case map[string]any:
+		if s, ok := l.(string); ok {
+			_, found := v[s]
+			return found
+		}
+	}
+	return false
+}
+
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case map[string]any:
+		return len(v) > 0
+	}
+	return true
+}
+
+// number converts JSON numbers and numeric strings; answers typed into text
+// inputs arrive as strings.
+func number(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+func equal(a, b any) bool {
+	_, aStr := a.(string)
+	_, bStr := b.(string)
+	// Compare numerically when at least one side is a real number
+	if !(aStr && bStr) {
+		if x, ok := number(a); ok {
+			if y, ok := number(b); ok {
+				return x == y
+			}
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compare(a, b any) (int, bool) {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return strings.Compare(as, bs), true
+	}
+	return 0, false
+}
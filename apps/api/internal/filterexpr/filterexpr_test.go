@@ -0,0 +1,79 @@
+package filterexpr
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	var env map[string]any
+	_ = json.Unmarshal([]byte(`{
+		"locale": "ar",
+		"answers": {
+			"contact_pref": {"value": "phone", "label": "Phone"},
+			"number_of_units": "4",
+			"services": ["ac_repair", "plumbing"],
+			"agree": true
+		}
+	}`), &env)
+
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{`answers.contact_pref.value == "phone"`, true},
+		{`answers.contact_pref.value != "phone"`, false},
+		{`locale == "ar"`, true},
+		{`locale == 'en' || locale == 'ar'`, true},
+		{`answers.number_of_units > 3`, true},
+		{`answers.number_of_units >= 5`, false},
+		{`answers.number_of_units == 4`, true},
+		{`"ac_repair" in answers.services`, true},
+		{`locale in ["en", "fr"]`, false},
+		{`answers.services.1 == "plumbing"`, true},
+		{`answers.agree && !(locale == "en")`, true},
+		{`answers.missing`, false},
+		{`answers.missing == null`, true},
+		{`answers.missing > 3`, false},
+		{`locale > 3`, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expr, func(t *testing.T) {
+			e, err := Parse(tc.expr)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got := e.Match(env); got != tc.want {
+				t.Fatalf("Match() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		col  int
+	}{
+		{``, 1},
+		{`locale ==`, 10},
+		{`locale = "ar"`, 8},
+		{`(locale == "ar"`, 16},
+		{`answers. == 1`, 10},
+		{`locale == "ar`, 11},
+		{`locale == "ar" locale`, 16},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expr, func(t *testing.T) {
+			_, err := Parse(tc.expr)
+			var se *SyntaxError
+			if !errors.As(err, &se) {
+				t.Fatalf("Parse() error = %v, want *SyntaxError", err)
+			}
+			if se.Col != tc.col {
+				t.Fatalf("col = %d, want %d (%v)", se.Col, tc.col, err)
+			}
+		})
+	}
+}
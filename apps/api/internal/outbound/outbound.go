@@ -0,0 +1,207 @@
+// Package outbound builds the HTTP clients for calls the API makes to URLs it
+// was given: webhooks, purchase APIs, the catalog. Those URLs come from admins
+// or straight from request bodies, so the clients only connect to public
+// addresses and, per purpose, to allowlisted hosts. Addresses are checked when
+// connecting, after DNS resolution, which also covers DNS rebinding and
+// redirects to internal hosts.
+package outbound
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Purpose names what a client is for; each has its own host allowlist.
+type Purpose string
+
+const (
+	Webhooks Purpose = "webhooks"
+	Purchase Purpose = "purchase"
+	Catalog  Purpose = "catalog"
+	Uploads  Purpose = "uploads"
+)
+
+// maxRedirects matches net/http's default limit.
+const maxRedirects = 10
+
+// Policy decides which destinations a client may reach.
+type Policy struct {
+	Purpose      Purpose
+	AllowedHosts []string // empty allows any public host; "*.example.com" matches its subdomains
+	AllowPrivate bool     // skips the address check, for local development
+}
+
+// BlockedError is a destination the policy doesn't allow.
+type BlockedError struct {
+	Purpose Purpose
+	Host    string
+	Reason  string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("outbound %s: %s %s", e.Purpose, e.Host, e.Reason)
+}
+
+// IsBlocked reports whether err came from a policy refusing a destination.
+func IsBlocked(err error) bool {
+	var b *BlockedError
+	return errors.As(err, &b)
+}
+
+// ParseHosts splits a comma-separated host list.
+func ParseHosts(s string) []string {
+	var out []string
+	for _, h := range strings.Split(s, ",") {
+		if h = normalizeHost(h); h != "" {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func normalizeHost(h string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+}
+
+// CheckURL checks the scheme and host of u. The address is checked later,
+// when connecting.
+func (p Policy) CheckURL(u *url.URL) error {
+	host := normalizeHost(u.Hostname())
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &BlockedError{Purpose: p.Purpose, Host: host, Reason: "is not an http(s) URL"}
+	}
+	if host == "" {
+		return &BlockedError{Purpose: p.Purpose, Host: u.String(), Reason: "has no host"}
+	}
+	if !p.hostAllowed(host) {
+		return &BlockedError{Purpose: p.Purpose, Host: host, Reason: "is not an allowed host"}
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !p.AllowPrivate && Blocked(ip) {
+		return &BlockedError{Purpose: p.Purpose, Host: host, Reason: "is not a public address"}
+	}
+	return nil
+}
+
+// CheckRawURL parses s and checks it like CheckURL.
+func (p Policy) CheckRawURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return &BlockedError{Purpose: p.Purpose, Host: s, Reason: "is not a valid URL"}
+	}
+	return p.CheckURL(u)
+}
+
+func (p Policy) hostAllowed(host string) bool {
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowedHosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// nonPublic are ranges the netip predicates don't cover.
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64, can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001::/32"), // Teredo
+	netip.MustParsePrefix("2002::/16"), // 6to4
+}
+
+// Blocked reports whether ip is private, loopback, link-local or otherwise not
+// a public unicast address.
+func Blocked(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, p := range nonPublic {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// control runs on every connection attempt with the resolved address.
+func (p Policy) control(network, address string, _ syscall.RawConn) error {
+	if p.AllowPrivate {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return &BlockedError{Purpose: p.Purpose, Host: address, Reason: "is not an IP address"}
+	}
+	if Blocked(ap.Addr()) {
+		return &BlockedError{Purpose: p.Purpose, Host: ap.Addr().String(), Reason: "is not a public address"}
+	}
+	return nil
+}
+
+// Transport returns a transport that only connects where the policy allows.
+// It never uses a proxy, which would hide the real destination. tlsConfig is
+// optional, e.g. for client certificates.
+func (p Policy) Transport(tlsConfig *tls.Config) http.RoundTripper {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: p.control}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+	t.TLSClientConfig = tlsConfig
+	return &guardedTransport{policy: p, base: t}
+}
+
+// Client returns a client using Transport. Redirects are followed, each one
+// checked again.
+func (p Policy) Client(timeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: p.Transport(tlsConfig),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return p.CheckURL(req.URL)
+		},
+	}
+}
+
+// guardedTransport checks each request's URL, redirects included, before
+// handing it to the dialling transport.
+type guardedTransport struct {
+	policy Policy
+	base   *http.Transport
+}
+
+func (g *guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := g.policy.CheckURL(req.URL); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return g.base.RoundTrip(req)
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the base transport.
+func (g *guardedTransport) CloseIdleConnections() { g.base.CloseIdleConnections() }
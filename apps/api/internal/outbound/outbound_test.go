@@ -0,0 +1,105 @@
+package outbound
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlocked(t *testing.T) {
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"8.8.8.8", false},
+		{"2606:4700::1111", false},
+	}
+	for _, tc := range cases {
+		if got := Blocked(netip.MustParseAddr(tc.ip)); got != tc.want {
+			t.Errorf("Blocked(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	p := Policy{Purpose: Purchase, AllowedHosts: ParseHosts("api.example.com, *.Pay.example.com.")}
+	cases := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://api.example.com/v1", true},
+		{"https://eu.pay.example.com/", true},
+		{"https://pay.example.com/", false},
+		{"https://evil.com/?api.example.com", false},
+		{"ftp://api.example.com/", false},
+		{"/relative", false},
+	}
+	for _, tc := range cases {
+		err := p.CheckRawURL(tc.url)
+		if (err == nil) != tc.allowed {
+			t.Errorf("CheckRawURL(%q) = %v, want allowed=%v", tc.url, err, tc.allowed)
+		}
+		if err != nil && !IsBlocked(err) {
+			t.Errorf("CheckRawURL(%q) error is not a BlockedError: %v", tc.url, err)
+		}
+	}
+
+	open := Policy{Purpose: Webhooks}
+	if err := open.CheckRawURL("http://169.254.169.254/latest/meta-data"); !IsBlocked(err) {
+		t.Errorf("metadata address allowed: %v", err)
+	}
+	if err := open.CheckRawURL("https://hooks.example.com/x"); err != nil {
+		t.Errorf("public host blocked: %v", err)
+	}
+}
+
+func TestClientBlocksLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// localhost isn't an IP literal, so it is caught when dialling
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	_, err := Policy{Purpose: Webhooks}.Client(time.Second, nil).Get(url)
+	if !IsBlocked(err) {
+		t.Fatalf("expected blocked error, got %v", err)
+	}
+
+	resp, err := Policy{Purpose: Webhooks, AllowPrivate: true}.Client(time.Second, nil).Get(url)
+	if err != nil {
+		t.Fatalf("AllowPrivate: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestClientRechecksRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	// The first hop is allowed by its host name; the redirect to the IP
+	// literal isn't on the allowlist
+	p := Policy{Purpose: Webhooks, AllowedHosts: []string{"localhost"}, AllowPrivate: true}
+	url := strings.Replace(redirector.URL, "127.0.0.1", "localhost", 1)
+	_, err := p.Client(time.Second, nil).Get(url)
+	if !IsBlocked(err) {
+		t.Fatalf("expected redirect to be blocked, got %v", err)
+	}
+}
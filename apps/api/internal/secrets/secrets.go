@@ -0,0 +1,305 @@
+// Package secrets stores named values encrypted at rest with AES-GCM and
+// resolves ${secret:name} references in configuration at the point of use.
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("secret not found")
+	ErrDisabled = errors.New("secret store disabled: SECRETS_MASTER_KEY is not set")
+)
+
+// refPattern matches ${secret:name}, or $${ which stands for a literal ${
+// (the first submatch is then empty).
+var refPattern = regexp.MustCompile(`\$\$\{|\$\{secret:([A-Za-z0-9_.-]+)\}`)
+
+// namePattern is what a secret may be called.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,191}$`)
+
+// Meta describes a secret without exposing its value.
+type Meta struct {
+	Name        string    `json:"name"`
+	Description *string   `json:"description"`
+	Masked      string    `json:"masked"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+type Store struct {
+	db   *sql.DB
+	aead cipher.AEAD
+}
+
+// New opens the store. masterKey is 32 bytes, base64 or hex encoded; an empty
+// key yields a disabled store where every operation returns ErrDisabled.
+func New(db *sql.DB, masterKey string) (*Store, error) {
+	s := &Store{db: db}
+	if masterKey == "" {
+		return s, nil
+	}
+	key, err := decodeKey(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func decodeKey(k string) ([]byte, error) {
+	if b, err := base64.StdEncoding.DecodeString(k); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := hex.DecodeString(k); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, errors.New("SECRETS_MASTER_KEY must be 32 bytes, base64 or hex encoded")
+}
+
+func (s *Store) Enabled() bool { return s != nil && s.aead != nil }
+
+// ValidName reports whether name can be used for a secret.
+func ValidName(name string) bool { return namePattern.MatchString(name) }
+
+// seal encrypts value; the name is bound as additional data so ciphertexts
+// can't be swapped between rows.
+func (s *Store) seal(name, value string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, []byte(value), []byte(name)), nil
+}
+
+func (s *Store) open(name string, sealed []byte) (string, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return "", fmt.Errorf("secret %q: ciphertext too short", name)
+	}
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret %q: decrypt failed", name)
+	}
+	return string(plain), nil
+}
+
+// Get returns the decrypted value.
+func (s *Store) Get(ctx context.Context, name string) (string, error) {
+	if !s.Enabled() {
+		return "", ErrDisabled
+	}
+	var sealed []byte
+	err := s.db.QueryRowContext(ctx, "SELECT value_enc FROM secrets WHERE name=?", name).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.open(name, sealed)
+}
+
+// Put creates or replaces a secret and reports whether it was created.
+func (s *Store) Put(ctx context.Context, name, value string, description *string) (bool, error) {
+	if !s.Enabled() {
+		return false, ErrDisabled
+	}
+	sealed, err := s.seal(name, value)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO secrets(name, value_enc, description) VALUES(?,?,?)
+		ON DUPLICATE KEY UPDATE value_enc=VALUES(value_enc), description=COALESCE(VALUES(description), description)`, name, sealed, description)
+	if err != nil {
+		return false, err
+	}
+	// MySQL reports 1 affected row for an insert and 2 for an update
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// Delete removes a secret and reports whether it existed.
+func (s *Store) Delete(ctx context.Context, name string) (bool, error) {
+	if !s.Enabled() {
+		return false, ErrDisabled
+	}
+	res, err := s.db.ExecContext(ctx, "DELETE FROM secrets WHERE name=?", name)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// List returns every secret's metadata, ordered by name.
+func (s *Store) List(ctx context.Context) ([]Meta, error) {
+	return s.query(ctx, "")
+}
+
+// Describe returns one secret's metadata.
+func (s *Store) Describe(ctx context.Context, name string) (Meta, error) {
+	out, err := s.query(ctx, name)
+	if err != nil {
+		return Meta{}, err
+	}
+	if len(out) == 0 {
+		return Meta{}, ErrNotFound
+	}
+	return out[0], nil
+}
+
+func (s *Store) query(ctx context.Context, name string) ([]Meta, error) {
+	if !s.Enabled() {
+		return nil, ErrDisabled
+	}
+	q := "SELECT name, value_enc, description, created_at, updated_at FROM secrets"
+	var args []any
+	if name != "" {
+		q += " WHERE name=?"
+		args = append(args, name)
+	}
+	rows, err := s.db.QueryContext(ctx, q+" ORDER BY name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Meta{}
+	for rows.Next() {
+		var m Meta
+		var sealed []byte
+		if err := rows.Scan(&m.Name, &sealed, &m.Description, &m.CreatedAt, &m.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if v, err := s.open(m.Name, sealed); err == nil {
+			m.Masked = Mask(v)
+		} else {
+			m.Masked = "(unreadable)"
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// Mask hides all but the last four characters of longer values.
+func Mask(v string) string {
+	if len(v) < 12 {
+		return "********"
+	}
+	return "********" + v[len(v)-4:]
+}
+
+// References lists the secret names referenced in v.
+func References(v string) []string {
+	var names []string
+	for _, m := range refPattern.FindAllStringSubmatch(v, -1) {
+		if m[1] != "" {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// HasReference reports whether v contains a ${secret:name} reference.
+func HasReference(v string) bool { return strings.Contains(v, "${secret:") && len(References(v)) > 0 }
+
+// Escape makes v resolve to itself, so references in it are kept literally.
+func Escape(v string) string { return strings.ReplaceAll(v, "${", "$${") }
+
+// RenderProtected renders a template whose static text may reference
+// secrets. References written in src are kept; everything else in the output,
+// such as values the template interpolates, is escaped so it can't name a
+// secret, even by splicing two values together.
+func RenderProtected(src string, render func(string) (string, error)) (string, error) {
+	if !strings.Contains(src, "${") {
+		out, err := render(src)
+		return Escape(out), err
+	}
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	tag := hex.EncodeToString(nonce[:])
+	var kept []string
+	src = refPattern.ReplaceAllStringFunc(src, func(ref string) string {
+		kept = append(kept, ref)
+		return fmt.Sprintf("secretref%s_%d_", tag, len(kept)-1)
+	})
+	out, err := render(src)
+	if err != nil {
+		return "", err
+	}
+	out = Escape(out)
+	for i, ref := range kept {
+		out = strings.ReplaceAll(out, fmt.Sprintf("secretref%s_%d_", tag, i), ref)
+	}
+	return out, nil
+}
+
+// Resolve replaces every ${secret:name} in v with the decrypted value, and
+// every $${ with ${.
+func (s *Store) Resolve(ctx context.Context, v string) (string, error) {
+	if !strings.Contains(v, "${") {
+		return v, nil
+	}
+	var firstErr error
+	out := refPattern.ReplaceAllStringFunc(v, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		name := refPattern.FindStringSubmatch(ref)[1]
+		val, err := s.Get(ctx, name)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("resolve ${secret:%s}: %w", name, err)
+		}
+		return val
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return out, nil
+}
+
+// Missing returns the referenced names in values that don't exist in the store.
+func (s *Store) Missing(ctx context.Context, values ...string) ([]string, error) {
+	var missing []string
+	seen := map[string]bool{}
+	for _, v := range values {
+		for _, name := range References(v) {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if !s.Enabled() {
+				return nil, ErrDisabled
+			}
+			var one int
+			err := s.db.QueryRowContext(ctx, "SELECT 1 FROM secrets WHERE name=?", name).Scan(&one)
+			if err == sql.ErrNoRows {
+				missing = append(missing, name)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return missing, nil
+}
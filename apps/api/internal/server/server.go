@@ -1,11 +1,13 @@
 package server
 
 import (
+    "context"
     "database/sql"
     "net/http"
     "time"
 
     "github.com/example/formrepo/apps/api/internal/config"
+    "github.com/example/formrepo/apps/api/internal/secrets"
     "github.com/example/formrepo/apps/api/internal/serverhandlers"
     "github.com/gin-contrib/cors"
     "github.com/gin-gonic/gin"
@@ -18,6 +20,8 @@ type Server struct {
     cfg    *config.Config
     db     *sql.DB
     log    *zap.Logger
+    disp   *serverhandlers.Dispatcher
+    secrets *secrets.Store
 }
 
 func New(cfg *config.Config, log *zap.Logger) *Server {
@@ -62,11 +66,29 @@ func New(cfg *config.Config, log *zap.Logger) *Server {
         log.Fatal("db ping", zap.Error(err))
     }
 
-    s := &Server{Engine: r, cfg: cfg, db: db, log: log}
+    store, err := secrets.New(db, cfg.SecretsMasterKey)
+    if err != nil {
+        log.Fatal("secret store", zap.Error(err))
+    }
+    if !store.Enabled() {
+        log.Warn("SECRETS_MASTER_KEY not set, ${secret:...} references are disabled")
+    }
+
+    s := &Server{Engine: r, cfg: cfg, db: db, log: log, secrets: store}
+    s.disp = serverhandlers.NewDispatcher(db, cfg, store, log)
     s.registerRoutes()
+    s.disp.Start()
     return s
 }
 
+// Shutdown drains the webhook dispatcher and closes the database.
+// Call it after the HTTP server has stopped accepting requests.
+func (s *Server) Shutdown(ctx context.Context) error {
+    err := s.disp.Shutdown(ctx)
+    _ = s.db.Close()
+    return err
+}
+
 func (s *Server) registerRoutes() {
     api := s.Engine.Group("/api")
 
@@ -92,14 +114,41 @@ func (s *Server) registerRoutes() {
     
     // Admin form webhooks - MUST be registered BEFORE any /forms/:formId/:version routes
     // Otherwise Gin will match /forms/:formId/:version/webhooks to /forms/:formId/:version
+    admin.GET("/forms/:formId/:version/config", serverhandlers.GetFormConfigAdminHandler(s.db, s.log))
     admin.GET("/forms/:formId/:version/webhooks", serverhandlers.ListWebhooksHandler(s.db, s.log))
-    admin.POST("/forms/:formId/:version/webhooks", serverhandlers.CreateWebhookHandler(s.db, s.log))
-    admin.PUT("/forms/:formId/:version/webhooks/:id", serverhandlers.UpdateWebhookHandler(s.db, s.log))
+    admin.POST("/forms/:formId/:version/webhooks", serverhandlers.CreateWebhookHandler(s.db, s.cfg, s.secrets, s.log))
+    admin.PUT("/forms/:formId/:version/webhooks/:id", serverhandlers.UpdateWebhookHandler(s.db, s.cfg, s.secrets, s.log))
     admin.DELETE("/forms/:formId/:version/webhooks/:id", serverhandlers.DeleteWebhookHandler(s.db, s.log))
-    admin.POST("/forms/:formId/:version/webhooks/:id/test", serverhandlers.TestWebhookHandler(s.db, s.cfg, s.log))
+    admin.POST("/forms/:formId/:version/webhooks/:id/test", serverhandlers.TestWebhookHandler(s.db, s.cfg, s.secrets, s.log))
+    admin.POST("/forms/:formId/:version/webhooks/:id/preview", serverhandlers.PreviewWebhookHandler(s.db, s.cfg, s.log))
+    admin.GET("/forms/:formId/:version/webhooks/:id/deliveries", serverhandlers.ListWebhookDeliveriesHandler(s.db, s.log))
+    admin.GET("/forms/:formId/:version/webhooks/:id/breaker", serverhandlers.GetWebhookBreakerHandler(s.db, s.log))
+    admin.POST("/forms/:formId/:version/webhooks/:id/breaker/reset", serverhandlers.ResetWebhookBreakerHandler(s.db, s.disp, s.log))
+    admin.GET("/forms/:formId/:version/webhooks/:id/secrets", serverhandlers.ListWebhookSecretsHandler(s.db, s.log))
+    admin.POST("/forms/:formId/:version/webhooks/:id/secrets/rotate", serverhandlers.RotateWebhookSecretHandler(s.db, s.log))
+    admin.DELETE("/forms/:formId/:version/webhooks/:id/secrets/:secretId", serverhandlers.RevokeWebhookSecretHandler(s.db, s.log))
+    // Form-level webhooks fire for every version; same handlers, no :version
+    admin.GET("/forms/:formId/webhooks", serverhandlers.ListWebhooksHandler(s.db, s.log))
+    admin.POST("/forms/:formId/webhooks", serverhandlers.CreateWebhookHandler(s.db, s.cfg, s.secrets, s.log))
+    admin.PUT("/forms/:formId/webhooks/:id", serverhandlers.UpdateWebhookHandler(s.db, s.cfg, s.secrets, s.log))
+    admin.DELETE("/forms/:formId/webhooks/:id", serverhandlers.DeleteWebhookHandler(s.db, s.log))
+    admin.POST("/forms/:formId/webhooks/:id/test", serverhandlers.TestWebhookHandler(s.db, s.cfg, s.secrets, s.log))
+    admin.POST("/forms/:formId/webhooks/:id/preview", serverhandlers.PreviewWebhookHandler(s.db, s.cfg, s.log))
+    admin.GET("/forms/:formId/webhooks/:id/deliveries", serverhandlers.ListWebhookDeliveriesHandler(s.db, s.log))
+    admin.GET("/forms/:formId/webhooks/:id/breaker", serverhandlers.GetWebhookBreakerHandler(s.db, s.log))
+    admin.POST("/forms/:formId/webhooks/:id/breaker/reset", serverhandlers.ResetWebhookBreakerHandler(s.db, s.disp, s.log))
+    admin.GET("/forms/:formId/webhooks/:id/secrets", serverhandlers.ListWebhookSecretsHandler(s.db, s.log))
+    admin.POST("/forms/:formId/webhooks/:id/secrets/rotate", serverhandlers.RotateWebhookSecretHandler(s.db, s.log))
+    admin.DELETE("/forms/:formId/webhooks/:id/secrets/:secretId", serverhandlers.RevokeWebhookSecretHandler(s.db, s.log))
+    admin.GET("/forms/:formId/:version/dead-letters", serverhandlers.ListDeadLettersHandler(s.db, s.log))
+    admin.DELETE("/forms/:formId/:version/dead-letters", serverhandlers.PurgeDeadLettersHandler(s.db, s.log))
+    admin.POST("/forms/:formId/:version/dead-letters/replay", serverhandlers.ReplayDeadLettersHandler(s.db, s.disp, s.log))
+    admin.GET("/forms/:formId/:version/dead-letters/:id", serverhandlers.GetDeadLetterHandler(s.db, s.log))
+    admin.DELETE("/forms/:formId/:version/dead-letters/:id", serverhandlers.DeleteDeadLetterHandler(s.db, s.log))
+    admin.POST("/forms/:formId/:version/dead-letters/:id/replay", serverhandlers.ReplayDeadLetterHandler(s.db, s.disp, s.log))
     
     // Admin form delete - must be AFTER webhooks routes to avoid conflicts
-    admin.DELETE("/forms/:formId/:version", serverhandlers.DeleteFormSnapshotHandler(s.db, s.log))
+    admin.DELETE("/forms/:formId/:version", serverhandlers.DeleteFormSnapshotHandler(s.db, s.disp, s.log))
     
     // Admin attributes
     admin.GET("/attributes", serverhandlers.ListAttributesHandler(s.db, s.log))
@@ -109,20 +158,38 @@ func (s *Server) registerRoutes() {
 
     // Admin questions
     admin.GET("/questions", serverhandlers.ListQuestionsHandler(s.db, s.log))
-    admin.POST("/questions", serverhandlers.UpsertQuestionHandler(s.db, s.log))
+    admin.POST("/questions", serverhandlers.UpsertQuestionHandler(s.db, s.disp, s.log))
     admin.DELETE("/questions/:id", serverhandlers.DeleteQuestionHandler(s.db, s.log))
 
     // Admin submissions - specific route first to avoid conflicts
     admin.GET("/submissions/:id", serverhandlers.GetSubmissionHandler(s.db, s.log))
+    admin.PATCH("/submissions/:id", serverhandlers.UpdateSubmissionHandler(s.db, s.disp, s.log))
+    admin.DELETE("/submissions/:id", serverhandlers.DeleteSubmissionHandler(s.db, s.disp, s.log))
+    admin.GET("/submissions/:id/deliveries", serverhandlers.ListSubmissionDeliveriesHandler(s.db, s.log))
+    admin.POST("/submissions/:id/redeliver", serverhandlers.RedeliverSubmissionHandler(s.db, s.disp, s.log))
+    admin.POST("/submissions/redeliver", serverhandlers.BulkRedeliverHandler(s.db, s.disp, s.log))
     admin.GET("/submissions", serverhandlers.ListSubmissionsHandler(s.db, s.log))
 
+    // Dispatcher destination limits and queues
+    admin.GET("/webhooks/limits", serverhandlers.WebhookLimitsHandler(s.db, s.disp, s.log))
+
+    // Admin secrets
+    admin.GET("/secrets", serverhandlers.ListSecretsHandler(s.secrets, s.log))
+    admin.POST("/secrets", serverhandlers.CreateSecretHandler(s.secrets, s.log))
+    admin.GET("/secrets/:name", serverhandlers.GetSecretHandler(s.secrets, s.log))
+    admin.PUT("/secrets/:name", serverhandlers.PutSecretHandler(s.secrets, s.log))
+    admin.DELETE("/secrets/:name", serverhandlers.DeleteSecretHandler(s.db, s.secrets, s.log))
+
     // Public endpoints - register AFTER admin routes
     api.POST("/uploads/sign", serverhandlers.UploadSignHandler(s.cfg, s.log))
     api.POST("/forms/generate", serverhandlers.GenerateFormHandler(s.db, s.cfg, s.log))
-    api.POST("/forms/publish", serverhandlers.PublishFormHandler(s.db, s.cfg, s.log))
-    api.POST("/submissions", serverhandlers.SubmitHandler(s.db, s.cfg, s.log))
-    api.POST("/purchase/proxy", serverhandlers.PurchaseProxyHandler(s.log))
-    api.POST("/cashier/item-variant", serverhandlers.ItemVariantProxyHandler(s.log))
+    api.POST("/forms/publish", serverhandlers.PublishFormHandler(s.db, s.cfg, s.secrets, s.disp, s.log))
+    api.POST("/submissions", serverhandlers.SubmitHandler(s.db, s.cfg, s.disp, s.log))
+    api.POST("/purchase/proxy", serverhandlers.PurchaseProxyHandler(s.cfg, s.log))
+    api.POST("/cashier/item-variant", serverhandlers.ItemVariantProxyHandler(s.cfg, s.log))
+    api.POST("/forms/:formId/:version/pre-purchase", serverhandlers.PrePurchaseWebhookHandler(s.db, s.cfg, s.secrets, s.log))
+    api.POST("/forms/:formId/:version/auth/login", serverhandlers.AuthLoginProxyHandler(s.db, s.cfg, s.secrets, s.log))
+    api.POST("/forms/:formId/:version/purchase-webhooks", serverhandlers.PurchaseWebhooksHandler(s.db, s.cfg, s.secrets, s.log))
     
     // Public form creation endpoint (with API key auth) - register BEFORE parameterized routes
     api.POST("/forms/create", func(c *gin.Context) {
@@ -131,7 +198,7 @@ func (s *Server) registerRoutes() {
         mw(c)
         if !c.IsAborted() {
             // Call the actual handler
-            handler := serverhandlers.PublishFormHandler(s.db, s.cfg, s.log)
+            handler := serverhandlers.PublishFormHandler(s.db, s.cfg, s.secrets, s.disp, s.log)
             handler(c)
         }
     })
@@ -5,6 +5,7 @@ import (
     "encoding/json"
     "net/http"
     "fmt"
+    "strconv"
 
     "github.com/gin-gonic/gin"
     "go.uber.org/zap"
@@ -134,7 +135,7 @@ func ListQuestionsHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
     }
 }
 
-func UpsertQuestionHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+func UpsertQuestionHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         var req questionReq
         if err := c.BindJSON(&req); err != nil {
@@ -197,8 +198,15 @@ func UpsertQuestionHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
                 return
             }
         }
+        // The question and its question.updated deliveries are committed together
+        tx, err := db.Begin()
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "db"})
+            return
+        }
+        defer tx.Rollback()
         // Enforce 1:1 via INSERT ... ON DUPLICATE KEY UPDATE
-        _, err := db.Exec(
+        res, err := tx.Exec(
             "INSERT INTO questions(attribute_key,type,name,label_json,props_json,status,version) VALUES(?,?,?,?,?, ?, 1) ON DUPLICATE KEY UPDATE type=VALUES(type), name=VALUES(name), label_json=VALUES(label_json), props_json=VALUES(props_json), status=VALUES(status), version=version+1",
             req.AttributeKey, req.Type, req.Name, string(l), string(p), req.Status,
         )
@@ -207,6 +215,29 @@ func UpsertQuestionHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
             c.JSON(http.StatusBadRequest, gin.H{"error": "upsert failed", "details": err.Error()})
             return
         }
+        // 2 rows affected means an existing question was updated
+        queued := int64(0)
+        if n, _ := res.RowsAffected(); n == 2 {
+            var version int
+            if err := tx.QueryRow("SELECT version FROM questions WHERE attribute_key=?", req.AttributeKey).Scan(&version); err != nil {
+                log.Error("failed to query question", zap.String("attribute_key", req.AttributeKey), zap.Error(err))
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "db"})
+                return
+            }
+            question := map[string]any{"attributeKey": req.AttributeKey, "type": req.Type, "name": req.Name, "label": req.Label, "status": req.Status, "version": version}
+            if queued, err = enqueueQuestionUpdated(tx, req.AttributeKey, question); err != nil {
+                log.Error("failed to queue question.updated", zap.String("attribute_key", req.AttributeKey), zap.Error(err))
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "db"})
+                return
+            }
+        }
+        if err := tx.Commit(); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "db"})
+            return
+        }
+        if queued > 0 {
+            disp.Notify()
+        }
         c.Status(http.StatusCreated)
     }
 }
@@ -257,12 +288,27 @@ func ListFormsAdminHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
     }
 }
 
-func DeleteFormSnapshotHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+func DeleteFormSnapshotHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         formId := c.Param("formId")
-        version := c.Param("version")
-        _, err := db.Exec("DELETE FROM form_snapshots WHERE form_id=? AND version=?", formId, version)
+        version, err := strconv.Atoi(c.Param("version"))
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"invalid version"}); return }
+        // The version's webhooks are still there to hear about it
+        tx, err := db.Begin()
+        if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error":"db"}); return }
+        defer tx.Rollback()
+        res, err := tx.Exec("DELETE FROM form_snapshots WHERE form_id=? AND version=?", formId, version)
         if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"delete"}); return }
+        queued := int64(0)
+        if n, _ := res.RowsAffected(); n > 0 {
+            if queued, err = enqueueEvent(tx, formId, version, 0, eventFormDeleted, gin.H{"formId": formId, "version": version}); err != nil {
+                log.Error("failed to queue form.deleted", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
+                c.JSON(http.StatusInternalServerError, gin.H{"error":"db"})
+                return
+            }
+        }
+        if err := tx.Commit(); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error":"db"}); return }
+        if queued > 0 { disp.Notify() }
         c.Status(http.StatusNoContent)
     }
 }
@@ -0,0 +1,242 @@
+package serverhandlers
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+)
+
+// breakerDeferReason marks deliveries that were queued behind an open breaker
+// so they can be brought forward as soon as the endpoint recovers.
+const breakerDeferReason = "circuit breaker open"
+
+// autoDisabledPrefix starts the disabled_reason of webhooks the breaker
+// switched off. Their deliveries keep waiting for a reset.
+const autoDisabledPrefix = "auto-disabled: "
+
+// breakerDisabled reports whether the breaker, not an admin, switched the webhook off.
+func breakerDisabled(wh *webhookRow) bool {
+    return !wh.Enabled && wh.DisabledReason != nil && strings.HasPrefix(*wh.DisabledReason, autoDisabledPrefix)
+}
+
+// breakerAllow reports whether a delivery to the webhook may be attempted now.
+// While the breaker is open deliveries wait; once the cooldown passes exactly one
+// worker wins the half-open probe. Errors fail open so the breaker never blocks
+// deliveries on its own.
+func (d *Dispatcher) breakerAllow(webhookId uint64) (bool, time.Duration) {
+    if d.cfg.WebhookBreakerThreshold <= 0 {
+        return true, 0
+    }
+    var state string
+    var waitUs sql.NullInt64
+    err := d.db.QueryRow("SELECT state, TIMESTAMPDIFF(MICROSECOND, NOW(3), next_probe_at) FROM webhook_breakers WHERE webhook_id=?", webhookId).Scan(&state, &waitUs)
+    if err != nil || state == "closed" {
+        return true, 0
+    }
+    if waitUs.Valid && waitUs.Int64 > 0 {
+        return false, time.Duration(waitUs.Int64) * time.Microsecond
+    }
+    // Probe is due, or the previous probe's lease ran out
+    res, err := d.db.Exec("UPDATE webhook_breakers SET state='half_open', next_probe_at=NOW(3) + INTERVAL ? MICROSECOND WHERE webhook_id=? AND state<>'closed' AND next_probe_at <= NOW(3)",
+        d.leaseDuration().Microseconds(), webhookId)
+    if err == nil {
+        if n, _ := res.RowsAffected(); n == 1 {
+            d.log.Info("circuit breaker half-open, probing", zap.Uint64("webhookId", webhookId))
+            return true, 0
+        }
+    }
+    return false, time.Duration(d.cfg.WebhookBreakerCooldown()) * time.Second
+}
+
+// breakerRecord feeds an attempt outcome into the webhook's breaker.
+func (d *Dispatcher) breakerRecord(wh *webhookRow, res attemptResult) {
+    if d.cfg.WebhookBreakerThreshold <= 0 {
+        return
+    }
+    log := d.log.With(zap.Uint64("webhookId", wh.ID))
+    if res.Err == nil {
+        r, err := d.db.Exec("UPDATE webhook_breakers SET state='closed', consecutive_failures=0, opened_at=NULL, next_probe_at=NULL, last_error=NULL WHERE webhook_id=? AND (state<>'closed' OR consecutive_failures>0)", wh.ID)
+        if err != nil {
+            log.Error("close circuit breaker", zap.Error(err))
+            return
+        }
+        if n, _ := r.RowsAffected(); n > 0 {
+            d.releaseDeferred(wh.ID)
+        }
+        return
+    }
+
+    _, err := d.db.Exec("INSERT INTO webhook_breakers(webhook_id, consecutive_failures, last_error) VALUES(?,1,?) ON DUPLICATE KEY UPDATE consecutive_failures=consecutive_failures+1, last_error=VALUES(last_error)",
+        wh.ID, res.Err.Error())
+    if err != nil {
+        log.Error("record circuit breaker failure", zap.Error(err))
+        return
+    }
+    var state string
+    var failures int
+    var openSecs sql.NullInt64
+    if err := d.db.QueryRow("SELECT state, consecutive_failures, TIMESTAMPDIFF(SECOND, opened_at, NOW(3)) FROM webhook_breakers WHERE webhook_id=?", wh.ID).Scan(&state, &failures, &openSecs); err != nil {
+        log.Error("read circuit breaker", zap.Error(err))
+        return
+    }
+    cooldown := (time.Duration(d.cfg.WebhookBreakerCooldown()) * time.Second).Microseconds()
+    switch state {
+    case "half_open":
+        // Probe failed: back to open, keeping opened_at so the outage length is tracked
+        _, _ = d.db.Exec("UPDATE webhook_breakers SET state='open', next_probe_at=NOW(3) + INTERVAL ? MICROSECOND WHERE webhook_id=?", cooldown, wh.ID)
+        if d.cfg.WebhookBreakerDisableAfterSec > 0 && openSecs.Valid && openSecs.Int64 >= int64(d.cfg.WebhookBreakerDisableAfterSec) {
+            d.autoDisable(wh, time.Duration(openSecs.Int64)*time.Second, res.Err)
+        }
+    case "closed":
+        if failures >= d.cfg.WebhookBreakerThreshold || d.failureRateExceeded(wh.ID) {
+            r, err := d.db.Exec("UPDATE webhook_breakers SET state='open', opened_at=NOW(3), next_probe_at=NOW(3) + INTERVAL ? MICROSECOND WHERE webhook_id=? AND state='closed'", cooldown, wh.ID)
+            if err == nil {
+                if n, _ := r.RowsAffected(); n == 1 {
+                    log.Warn("circuit breaker opened", zap.Int("consecutiveFailures", failures), zap.Error(res.Err))
+                }
+            }
+        }
+    }
+}
+
+// failureRateExceeded checks the attempt log over the configured window.
+func (d *Dispatcher) failureRateExceeded(webhookId uint64) bool {
+    if d.cfg.WebhookBreakerFailureRate <= 0 || d.cfg.WebhookBreakerWindowSec <= 0 {
+        return false
+    }
+    var total, failed int
+    err := d.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(error IS NOT NULL),0) FROM webhook_delivery_attempts WHERE webhook_id=? AND created_at >= NOW() - INTERVAL ? SECOND",
+        webhookId, d.cfg.WebhookBreakerWindowSec).Scan(&total, &failed)
+    if err != nil || total == 0 || total < d.cfg.WebhookBreakerMinRequests {
+        return false
+    }
+    return float64(failed)/float64(total) >= d.cfg.WebhookBreakerFailureRate
+}
+
+// autoDisable switches a webhook off after its breaker stayed open too long.
+func (d *Dispatcher) autoDisable(wh *webhookRow, openFor time.Duration, cause error) {
+    reason := fmt.Sprintf(autoDisabledPrefix+"circuit breaker open for %s (last error: %s)", openFor.Round(time.Second), cause.Error())
+    r, err := d.db.Exec("UPDATE form_webhooks SET enabled=0, disabled_reason=?, disabled_at=NOW() WHERE id=? AND enabled=1", reason, wh.ID)
+    if err != nil {
+        d.log.Error("auto-disable webhook", zap.Error(err), zap.Uint64("webhookId", wh.ID))
+        return
+    }
+    if n, _ := r.RowsAffected(); n == 1 {
+        d.log.Warn("webhook auto-disabled", zap.Uint64("webhookId", wh.ID), zap.String("formId", wh.FormID), zap.Int("version", wh.Version), zap.String("reason", reason))
+    }
+}
+
+// deferDelivery puts a claimed delivery back without counting the attempt.
+// The reason is kept in last_error so the delivery can be brought forward.
+func (d *Dispatcher) deferDelivery(dl *outboxDelivery, wait time.Duration, reason string) {
+    _, err := d.db.Exec("UPDATE webhook_deliveries SET status='pending', locked_until=NULL, attempts=GREATEST(attempts-1,0), next_attempt_at=NOW(3) + INTERVAL ? MICROSECOND, last_error=? WHERE id=?",
+        wait.Microseconds(), reason, dl.ID)
+    if err != nil {
+        d.log.Error("defer webhook delivery", zap.Error(err), zap.Uint64("deliveryId", dl.ID))
+    }
+}
+
+// releaseDeferred makes deliveries queued behind the breaker due immediately.
+func (d *Dispatcher) releaseDeferred(webhookId uint64) {
+    _, err := d.db.Exec("UPDATE webhook_deliveries SET next_attempt_at=NOW(3) WHERE webhook_id=? AND status='pending' AND last_error=?", webhookId, breakerDeferReason)
+    if err != nil {
+        d.log.Error("release deferred deliveries", zap.Error(err), zap.Uint64("webhookId", webhookId))
+        return
+    }
+    d.Notify()
+}
+
+type WebhookBreaker struct {
+    WebhookID           uint64     `json:"webhookId"`
+    State               string     `json:"state"`
+    ConsecutiveFailures int        `json:"consecutiveFailures"`
+    OpenedAt            *time.Time `json:"openedAt"`
+    NextProbeAt         *time.Time `json:"nextProbeAt"`
+    LastError           *string    `json:"lastError"`
+    Queued              int        `json:"queued"`
+    Enabled             bool       `json:"enabled"`
+    DisabledReason      *string    `json:"disabledReason"`
+    DisabledAt          *time.Time `json:"disabledAt"`
+}
+
+// webhookParams parses :formId/[:version/]:id and checks the webhook belongs to
+// that form version, or to the form itself on form-level routes.
+func webhookParams(c *gin.Context, db *sql.DB, log *zap.Logger) (uint64, bool) {
+    formId := c.Param("formId")
+    version, ok := webhookVersionParam(c)
+    if !ok {
+        return 0, false
+    }
+    webhookId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook id"})
+        return 0, false
+    }
+    var exists int
+    err = db.QueryRow("SELECT 1 FROM form_webhooks WHERE id=? AND form_id=? AND version=?", webhookId, formId, version).Scan(&exists)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+        return 0, false
+    }
+    if err != nil {
+        log.Error("failed to query webhook", zap.Error(err))
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query webhook"})
+        return 0, false
+    }
+    return webhookId, true
+}
+
+func GetWebhookBreakerHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        webhookId, ok := webhookParams(c, db, log)
+        if !ok {
+            return
+        }
+        b := WebhookBreaker{WebhookID: webhookId, State: "closed"}
+        err := db.QueryRow("SELECT enabled, disabled_reason, disabled_at FROM form_webhooks WHERE id=?", webhookId).Scan(&b.Enabled, &b.DisabledReason, &b.DisabledAt)
+        if err != nil {
+            log.Error("failed to query webhook", zap.Error(err))
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query webhook"})
+            return
+        }
+        err = db.QueryRow("SELECT state, consecutive_failures, opened_at, next_probe_at, last_error FROM webhook_breakers WHERE webhook_id=?", webhookId).
+            Scan(&b.State, &b.ConsecutiveFailures, &b.OpenedAt, &b.NextProbeAt, &b.LastError)
+        if err != nil && err != sql.ErrNoRows {
+            log.Error("failed to query circuit breaker", zap.Error(err))
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query circuit breaker"})
+            return
+        }
+        _ = db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id=? AND status IN ('pending','processing')", webhookId).Scan(&b.Queued)
+        c.JSON(http.StatusOK, b)
+    }
+}
+
+// ResetWebhookBreakerHandler closes the breaker, re-enables an auto-disabled
+// webhook and releases the deliveries queued behind it.
+func ResetWebhookBreakerHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        webhookId, ok := webhookParams(c, db, log)
+        if !ok {
+            return
+        }
+        if _, err := db.Exec("DELETE FROM webhook_breakers WHERE webhook_id=?", webhookId); err != nil {
+            log.Error("failed to reset circuit breaker", zap.Error(err))
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset circuit breaker"})
+            return
+        }
+        if _, err := db.Exec("UPDATE form_webhooks SET enabled=1, disabled_reason=NULL, disabled_at=NULL WHERE id=? AND disabled_reason IS NOT NULL", webhookId); err != nil {
+            log.Error("failed to re-enable webhook", zap.Error(err))
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to re-enable webhook"})
+            return
+        }
+        disp.releaseDeferred(webhookId)
+        log.Info("circuit breaker reset", zap.Uint64("webhookId", webhookId))
+        c.Status(http.StatusNoContent)
+    }
+}
@@ -0,0 +1,445 @@
+package serverhandlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/secrets"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type DeadLetter struct {
+	ID             uint64            `json:"id"`
+	DeliveryID     uint64            `json:"deliveryId"`
+	WebhookID      uint64            `json:"webhookId"`
+	SubmissionID   uint64            `json:"submissionId"`
+	FormID         string            `json:"formId"`
+	Version        int               `json:"version"`
+	RequestMethod  string            `json:"requestMethod"`
+	RequestURL     string            `json:"requestUrl"`
+	RequestHeaders map[string]string `json:"requestHeaders,omitempty"`
+	RequestBody    *string           `json:"requestBody,omitempty"`
+	Attempts       int               `json:"attempts"`
+	LastStatusCode *int              `json:"lastStatusCode"`
+	LastError      *string           `json:"lastError"`
+	Status         string            `json:"status"`
+	ReplayedAt     *time.Time        `json:"replayedAt"`
+	CreatedAt      string            `json:"createdAt"`
+}
+
+// sentRequest is the exact request handed to the HTTP client.
+type sentRequest struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+	Body    []byte
+}
+
+// captureRequest snapshots a request before it is sent, without consuming its
+// body. Plaintext credentials in headers are masked; replays put back the
+// webhook's own values (see restoreMaskedHeaders).
+func captureRequest(req *http.Request) (*sentRequest, error) {
+	s := &sentRequest{Method: req.Method, URL: req.URL.String(), Headers: map[string]string{}}
+	for k := range req.Header {
+		s.Headers[k] = req.Header.Get(k)
+	}
+	s.Headers = maskHeaders(s.Headers)
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		if s.Body, err = io.ReadAll(rc); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// deadLetter stores an exhausted delivery together with the request it kept failing on.
+func deadLetter(db *sql.DB, dl *outboxDelivery, sent *sentRequest, res attemptResult) error {
+	headers, _ := json.Marshal(sent.Headers)
+	var errStr string
+	if res.Err != nil {
+		errStr = res.Err.Error()
+	}
+	_, err := db.Exec(`INSERT INTO webhook_dead_letters(delivery_id,webhook_id,submission_id,form_id,version,request_method,request_url,request_headers_json,request_body,attempts,last_status_code,last_error)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?,?)`,
+		dl.ID, dl.WebhookID, dl.SubmissionID, dl.FormID, dl.Version, sent.Method, sent.URL, string(headers),
+		strings.ToValidUTF8(string(sent.Body), ""), dl.Attempts, nullIfZero(res.StatusCode), nullIfEmpty(errStr))
+	return err
+}
+
+// settleDeadLetter records the outcome of a replay: replayed on success,
+// otherwise back to dead with the replay's attempts added.
+func settleDeadLetter(db *sql.DB, dl *outboxDelivery, status string, code int, lastErr string) error {
+	if status == "succeeded" {
+		_, err := db.Exec("UPDATE webhook_dead_letters SET status='replayed', replayed_at=NOW(3) WHERE id=?", dl.DeadLetterID)
+		return err
+	}
+	_, err := db.Exec("UPDATE webhook_dead_letters SET status='dead', attempts=attempts+?, last_status_code=COALESCE(?, last_status_code), last_error=COALESCE(?, last_error) WHERE id=?",
+		dl.Attempts, nullIfZero(code), nullIfEmpty(lastErr), dl.DeadLetterID)
+	return err
+}
+
+// loadDeadLetterRequest rebuilds the stored request for a replay and returns its body.
+func loadDeadLetterRequest(ctx context.Context, db *sql.DB, id uint64) (*http.Request, []byte, error) {
+	var method, url, headersJSON, body string
+	err := db.QueryRow("SELECT request_method, request_url, request_headers_json, request_body FROM webhook_dead_letters WHERE id=?", id).
+		Scan(&method, &url, &headersJSON, &body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return nil, nil, err
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(headersJSON), &headers); err != nil {
+		return nil, nil, fmt.Errorf("invalid stored headers: %w", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req, []byte(body), nil
+}
+
+// restoreMaskedHeaders replaces the credentials masked when a dead letter was
+// captured with the webhook's current values. Headers the webhook no longer
+// sets are dropped rather than sent masked; signatures are added again when
+// the replay is signed.
+func restoreMaskedHeaders(req *http.Request, configured map[string]string) {
+	current := make(map[string]string, len(configured))
+	for k, v := range configured {
+		current[http.CanonicalHeaderKey(k)] = v
+	}
+	for k := range req.Header {
+		if !sensitiveHeader(k) || secrets.HasReference(req.Header.Get(k)) {
+			continue
+		}
+		if v, ok := current[k]; ok {
+			req.Header.Set(k, v)
+		} else {
+			req.Header.Del(k)
+		}
+	}
+}
+
+// formVersionParams parses :formId/:version.
+func formVersionParams(c *gin.Context) (string, int, bool) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return "", 0, false
+	}
+	return c.Param("formId"), version, true
+}
+
+// deadLetterFilter builds the WHERE clause shared by list and purge from query params.
+func deadLetterFilter(c *gin.Context, formId string, version int) (string, []any, bool) {
+	where := "form_id=? AND version=?"
+	args := []any{formId, version}
+	if s := c.Query("webhook_id"); s != "" {
+		webhookId, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook_id"})
+			return "", nil, false
+		}
+		where += " AND webhook_id=?"
+		args = append(args, webhookId)
+	}
+	if s := c.Query("status"); s != "" {
+		if s != "dead" && s != "replaying" && s != "replayed" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+			return "", nil, false
+		}
+		where += " AND status=?"
+		args = append(args, s)
+	}
+	return where, args, true
+}
+
+const deadLetterColumns = "id, delivery_id, webhook_id, submission_id, form_id, version, request_method, request_url, attempts, last_status_code, last_error, status, replayed_at, created_at"
+
+func scanDeadLetter(row interface{ Scan(...any) error }, dlq *DeadLetter, extra ...any) error {
+	var statusCode sql.NullInt64
+	dest := append([]any{&dlq.ID, &dlq.DeliveryID, &dlq.WebhookID, &dlq.SubmissionID, &dlq.FormID, &dlq.Version, &dlq.RequestMethod, &dlq.RequestURL,
+		&dlq.Attempts, &statusCode, &dlq.LastError, &dlq.Status, &dlq.ReplayedAt, &dlq.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	if statusCode.Valid {
+		code := int(statusCode.Int64)
+		dlq.LastStatusCode = &code
+	}
+	return nil
+}
+
+// ListDeadLettersHandler lists dead letters of a form version, newest first.
+// Optional filters: webhook_id, status.
+func ListDeadLettersHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		formId, version, ok := formVersionParams(c)
+		if !ok {
+			return
+		}
+		where, args, ok := deadLetterFilter(c, formId, version)
+		if !ok {
+			return
+		}
+		limit, offset := pageParams(c)
+
+		rows, err := db.Query("SELECT "+deadLetterColumns+" FROM webhook_dead_letters WHERE "+where+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+		if err != nil {
+			log.Error("failed to query dead letters", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query dead letters"})
+			return
+		}
+		defer rows.Close()
+
+		out := []DeadLetter{}
+		for rows.Next() {
+			var dlq DeadLetter
+			if err := scanDeadLetter(rows, &dlq); err != nil {
+				log.Error("failed to scan dead letter", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query dead letters"})
+				return
+			}
+			out = append(out, dlq)
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// deadLetterID parses the dead letter :id.
+func deadLetterID(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dead letter id"})
+		return 0, false
+	}
+	return id, true
+}
+
+// GetDeadLetterHandler returns one dead letter including the stored request headers and body.
+func GetDeadLetterHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		formId, version, ok := formVersionParams(c)
+		if !ok {
+			return
+		}
+		id, ok := deadLetterID(c)
+		if !ok {
+			return
+		}
+
+		var dlq DeadLetter
+		var headersJSON, body string
+		row := db.QueryRow("SELECT "+deadLetterColumns+", request_headers_json, request_body FROM webhook_dead_letters WHERE id=? AND form_id=? AND version=?", id, formId, version)
+		err := scanDeadLetter(row, &dlq, &headersJSON, &body)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+			return
+		}
+		if err != nil {
+			log.Error("failed to query dead letter", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query dead letter"})
+			return
+		}
+		_ = json.Unmarshal([]byte(headersJSON), &dlq.RequestHeaders)
+		// Dead letters captured before headers were masked still hold plaintext
+		dlq.RequestHeaders = maskHeaders(dlq.RequestHeaders)
+		dlq.RequestBody = &body
+		c.JSON(http.StatusOK, dlq)
+	}
+}
+
+type replayDeadLettersReq struct {
+	IDs       []uint64 `json:"ids,omitempty"`
+	WebhookID uint64   `json:"webhook_id,omitempty"`
+}
+
+// enqueueReplays queues an outbox row per matching dead letter that isn't
+// already being replayed and marks those dead letters replaying.
+func enqueueReplays(db *sql.DB, where string, args []any) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO webhook_deliveries(submission_id,webhook_id,event,event_id,occurred_at,dead_letter_id,form_id,version,payload_json)
+		SELECT l.submission_id, l.webhook_id, d.event, d.event_id, d.occurred_at, l.id, l.form_id, l.version, d.payload_json
+		FROM webhook_dead_letters l JOIN webhook_deliveries d ON d.id=l.delivery_id
+		WHERE l.status='dead' AND `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		_, err = tx.Exec(`UPDATE submissions s JOIN webhook_dead_letters l ON l.submission_id=s.id
+			JOIN webhook_deliveries d ON d.dead_letter_id=l.id AND d.status='pending' AND d.attempts=0 AND d.event='submission.created'
+			SET s.webhook_status='pending' WHERE l.status='dead' AND `+where, args...)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`UPDATE webhook_dead_letters l JOIN webhook_deliveries d ON d.dead_letter_id=l.id AND d.status='pending' AND d.attempts=0
+			SET l.status='replaying' WHERE l.status='dead' AND `+where, args...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+// ReplayDeadLetterHandler resends one dead letter through the outbox.
+func ReplayDeadLetterHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		formId, version, ok := formVersionParams(c)
+		if !ok {
+			return
+		}
+		id, ok := deadLetterID(c)
+		if !ok {
+			return
+		}
+
+		var status string
+		err := db.QueryRow("SELECT status FROM webhook_dead_letters WHERE id=? AND form_id=? AND version=?", id, formId, version).Scan(&status)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+			return
+		}
+		if err != nil {
+			log.Error("failed to query dead letter", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query dead letter"})
+			return
+		}
+		if status != "dead" {
+			c.JSON(http.StatusConflict, gin.H{"error": "dead letter is " + status})
+			return
+		}
+
+		n, err := enqueueReplays(db, "l.id=?", []any{id})
+		if err != nil {
+			log.Error("failed to enqueue dead letter replay", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enqueue replay"})
+			return
+		}
+		disp.Notify()
+		log.Info("dead letter replay queued", zap.Uint64("id", id))
+		c.JSON(http.StatusAccepted, gin.H{"queued": n})
+	}
+}
+
+// ReplayDeadLettersHandler resends dead letters of a form version in bulk:
+// the given ids, or every dead letter (optionally of one webhook).
+func ReplayDeadLettersHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		formId, version, ok := formVersionParams(c)
+		if !ok {
+			return
+		}
+		var req replayDeadLettersReq
+		if c.Request.ContentLength > 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+				return
+			}
+		}
+
+		where := "l.form_id=? AND l.version=?"
+		args := []any{formId, version}
+		if req.WebhookID != 0 {
+			where += " AND l.webhook_id=?"
+			args = append(args, req.WebhookID)
+		}
+		if len(req.IDs) > 0 {
+			where += " AND l.id IN (?" + strings.Repeat(",?", len(req.IDs)-1) + ")"
+			for _, id := range req.IDs {
+				args = append(args, id)
+			}
+		}
+
+		n, err := enqueueReplays(db, where, args)
+		if err != nil {
+			log.Error("failed to enqueue dead letter replays", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enqueue replay"})
+			return
+		}
+		disp.Notify()
+		log.Info("dead letter replays queued", zap.String("formId", formId), zap.Int("version", version), zap.Int64("queued", n))
+		c.JSON(http.StatusAccepted, gin.H{"queued": n})
+	}
+}
+
+// DeleteDeadLetterHandler purges one dead letter. Dead letters being replayed are kept.
+func DeleteDeadLetterHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		formId, version, ok := formVersionParams(c)
+		if !ok {
+			return
+		}
+		id, ok := deadLetterID(c)
+		if !ok {
+			return
+		}
+
+		var status string
+		err := db.QueryRow("SELECT status FROM webhook_dead_letters WHERE id=? AND form_id=? AND version=?", id, formId, version).Scan(&status)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+			return
+		}
+		if err != nil {
+			log.Error("failed to query dead letter", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query dead letter"})
+			return
+		}
+		if status == "replaying" {
+			c.JSON(http.StatusConflict, gin.H{"error": "dead letter is replaying"})
+			return
+		}
+		if _, err := db.Exec("DELETE FROM webhook_dead_letters WHERE id=? AND status<>'replaying'", id); err != nil {
+			log.Error("failed to delete dead letter", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete dead letter"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// PurgeDeadLettersHandler deletes the dead letters of a form version matching
+// the webhook_id/status filters, skipping any that are being replayed.
+func PurgeDeadLettersHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		formId, version, ok := formVersionParams(c)
+		if !ok {
+			return
+		}
+		where, args, ok := deadLetterFilter(c, formId, version)
+		if !ok {
+			return
+		}
+
+		res, err := db.Exec("DELETE FROM webhook_dead_letters WHERE "+where+" AND status<>'replaying'", args...)
+		if err != nil {
+			log.Error("failed to purge dead letters", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to purge dead letters"})
+			return
+		}
+		n, _ := res.RowsAffected()
+		log.Info("dead letters purged", zap.String("formId", formId), zap.Int("version", version), zap.Int64("purged", n))
+		c.JSON(http.StatusOK, gin.H{"purged": n})
+	}
+}
@@ -0,0 +1,121 @@
+package serverhandlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type DeliveryAttempt struct {
+	ID           uint64  `json:"id"`
+	DeliveryID   uint64  `json:"deliveryId"`
+	WebhookID    uint64  `json:"webhookId"`
+	SubmissionID uint64  `json:"submissionId"`
+	Attempt      int     `json:"attempt"`
+	StatusCode   *int    `json:"statusCode"`
+	DurationMs   int64   `json:"durationMs"`
+	ResponseBody *string `json:"responseBody"`
+	Error        *string `json:"error"`
+	CreatedAt    string  `json:"createdAt"`
+}
+
+// recordAttempt appends one row to the delivery attempt log.
+func recordAttempt(db *sql.DB, dl *outboxDelivery, res attemptResult) error {
+	var errStr string
+	if res.Err != nil {
+		errStr = res.Err.Error()
+	}
+	_, err := db.Exec("INSERT INTO webhook_delivery_attempts(delivery_id,webhook_id,submission_id,attempt,status_code,duration_ms,response_body,error) VALUES(?,?,?,?,?,?,?,?)",
+		dl.ID, dl.WebhookID, dl.SubmissionID, dl.Attempts, nullIfZero(res.StatusCode), res.Duration.Milliseconds(),
+		nullIfEmpty(strings.ToValidUTF8(res.ResponseBody, "")), nullIfEmpty(errStr))
+	return err
+}
+
+// pageParams reads limit/offset query params with the same defaults as ListSubmissionsHandler.
+func pageParams(c *gin.Context) (int, int) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+func queryDeliveryAttempts(db *sql.DB, where string, args ...interface{}) ([]DeliveryAttempt, error) {
+	rows, err := db.Query("SELECT id, delivery_id, webhook_id, submission_id, attempt, status_code, duration_ms, response_body, error, created_at FROM webhook_delivery_attempts WHERE "+where+" ORDER BY id DESC LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []DeliveryAttempt{}
+	for rows.Next() {
+		var a DeliveryAttempt
+		var statusCode sql.NullInt64
+		var responseBody, errStr sql.NullString
+		if err := rows.Scan(&a.ID, &a.DeliveryID, &a.WebhookID, &a.SubmissionID, &a.Attempt, &statusCode, &a.DurationMs, &responseBody, &errStr, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		if statusCode.Valid {
+			code := int(statusCode.Int64)
+			a.StatusCode = &code
+		}
+		if responseBody.Valid {
+			a.ResponseBody = &responseBody.String
+		}
+		if errStr.Valid {
+			a.Error = &errStr.String
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// ListSubmissionDeliveriesHandler returns the attempt log for one submission, newest first.
+func ListSubmissionDeliveriesHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid submission id"})
+			return
+		}
+		limit, offset := pageParams(c)
+
+		attempts, err := queryDeliveryAttempts(db, "submission_id=?", id, limit, offset)
+		if err != nil {
+			log.Error("failed to query delivery attempts", zap.Error(err), zap.Uint64("submissionId", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query deliveries"})
+			return
+		}
+		c.JSON(http.StatusOK, attempts)
+	}
+}
+
+// ListWebhookDeliveriesHandler returns the attempt log for one webhook of a form version, newest first.
+func ListWebhookDeliveriesHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookId, ok := webhookParams(c, db, log)
+		if !ok {
+			return
+		}
+		limit, offset := pageParams(c)
+
+		attempts, err := queryDeliveryAttempts(db, "webhook_id=?", webhookId, limit, offset)
+		if err != nil {
+			log.Error("failed to query delivery attempts", zap.Error(err), zap.Uint64("webhookId", webhookId))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query deliveries"})
+			return
+		}
+		c.JSON(http.StatusOK, attempts)
+	}
+}
@@ -0,0 +1,580 @@
+package serverhandlers
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/example/formrepo/apps/api/internal/config"
+    "github.com/example/formrepo/apps/api/internal/outbound"
+    "github.com/example/formrepo/apps/api/internal/secrets"
+    "github.com/example/formrepo/apps/api/internal/types"
+    "go.uber.org/zap"
+)
+
+// Dispatcher drains the webhook_deliveries outbox with a bounded pool of workers.
+// Deliveries are claimed with a lease, so rows held by a crashed process are
+// picked up again once the lease expires.
+type Dispatcher struct {
+    db     *sql.DB
+    cfg    *config.Config
+    log    *zap.Logger
+    secrets *secrets.Store
+    limits  *destLimits
+    auth    *webhookAuthenticator
+    files   *http.Client // fetches uploaded files for multipart bodies
+
+    wake   chan struct{}
+    quit   chan struct{}
+    ctx    context.Context
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+    stop   sync.Once
+}
+
+// outboxDelivery is a claimed webhook_deliveries row.
+type outboxDelivery struct {
+    ID           uint64
+    SubmissionID uint64 // 0 for events not about a submission
+    WebhookID    uint64 // 0 for email deliveries
+    Channel      string // "webhook" or "email"
+    Event        string
+    EventID      string
+    OccurredAt   time.Time
+    DeadLetterID uint64 // set when replaying a dead letter
+    FormID       string
+    Version      int
+    Payload      []byte
+    Attempts     int
+}
+
+func NewDispatcher(db *sql.DB, cfg *config.Config, store *secrets.Store, log *zap.Logger) *Dispatcher {
+    ctx, cancel := context.WithCancel(context.Background())
+    timeout := time.Duration(cfg.WebhookTimeout()) * time.Millisecond
+    return &Dispatcher{
+        db:     db,
+        cfg:    cfg,
+        log:    log,
+        secrets: store,
+        limits: newDestLimits(cfg, log),
+        auth:   newWebhookAuthenticator(store, outboundPolicy(cfg, outbound.Webhooks), timeout),
+        files:  newWebhookFileClient(cfg),
+        wake:   make(chan struct{}, 1),
+        quit:   make(chan struct{}),
+        ctx:    ctx,
+        cancel: cancel,
+    }
+}
+
+// Start launches the worker pool and the digest scheduler.
+func (d *Dispatcher) Start() {
+    n := d.cfg.WebhookWorkerCount()
+    for i := 0; i < n; i++ {
+        d.wg.Add(1)
+        go d.worker()
+    }
+    d.wg.Add(1)
+    go d.digester()
+    d.log.Info("webhook dispatcher started", zap.Int("workers", n))
+}
+
+// Notify wakes an idle worker so new deliveries don't wait for the next poll.
+func (d *Dispatcher) Notify() {
+    if d == nil {
+        return
+    }
+    select {
+    case d.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Shutdown stops claiming new deliveries and waits for in-flight ones to finish.
+// If ctx expires first, in-flight requests are cancelled and their rows are
+// released back to the outbox for the next process to pick up.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+    d.stop.Do(func() { close(d.quit) })
+    done := make(chan struct{})
+    go func() { d.wg.Wait(); close(done) }()
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        d.cancel()
+        <-done
+        return ctx.Err()
+    }
+}
+
+func (d *Dispatcher) worker() {
+    defer d.wg.Done()
+    ticker := time.NewTicker(time.Duration(d.cfg.WebhookPollInterval()) * time.Millisecond)
+    defer ticker.Stop()
+    for {
+        // Drain everything that is due before going idle
+        for {
+            select {
+            case <-d.quit:
+                return
+            default:
+            }
+            dl, err := d.claim()
+            if err != nil {
+                d.log.Error("claim webhook delivery", zap.Error(err))
+                break
+            }
+            if dl == nil {
+                break
+            }
+            stopRenewing := d.renewLease(dl.ID)
+            d.process(dl)
+            stopRenewing()
+        }
+        select {
+        case <-d.quit:
+            return
+        case <-d.wake:
+        case <-ticker.C:
+        }
+    }
+}
+
+// leaseDuration is how long a claimed row stays invisible to other workers.
+func (d *Dispatcher) leaseDuration() time.Duration {
+    return time.Duration(d.cfg.WebhookTimeout())*time.Millisecond + 30*time.Second
+}
+
+// renewLease keeps extending the lease of a claimed row until the returned
+// func is called. Large uploads, token fetches and limiter waits can take
+// longer than one lease, and an expired lease lets another worker send the
+// delivery again.
+func (d *Dispatcher) renewLease(id uint64) func() {
+    done, stopped := make(chan struct{}), make(chan struct{})
+    go func() {
+        defer close(stopped)
+        ticker := time.NewTicker(d.leaseDuration() / 3)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            }
+            if _, err := d.db.Exec("UPDATE webhook_deliveries SET locked_until=NOW(3) + INTERVAL ? MICROSECOND WHERE id=? AND status='processing'", d.leaseDuration().Microseconds(), id); err != nil {
+                d.log.Warn("renew delivery lease", zap.Error(err), zap.Uint64("deliveryId", id))
+            }
+        }
+    }()
+    return func() {
+        close(done)
+        <-stopped
+    }
+}
+
+// claim locks the next due delivery (or one whose lease expired) and marks it processing.
+func (d *Dispatcher) claim() (*outboxDelivery, error) {
+    tx, err := d.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+    var dl outboxDelivery
+    var payload string
+    var deadLetterId sql.NullInt64
+    var eventId sql.NullString
+    var occurredAt sql.NullTime
+    err = tx.QueryRow(`SELECT id, submission_id, webhook_id, channel, event, event_id, occurred_at, dead_letter_id, form_id, version, payload_json, attempts FROM webhook_deliveries
+        WHERE (status='pending' AND next_attempt_at <= NOW(3)) OR (status='processing' AND locked_until <= NOW(3))
+        ORDER BY next_attempt_at, id LIMIT 1 FOR UPDATE SKIP LOCKED`).
+        Scan(&dl.ID, &dl.SubmissionID, &dl.WebhookID, &dl.Channel, &dl.Event, &eventId, &occurredAt, &deadLetterId, &dl.FormID, &dl.Version, &payload, &dl.Attempts)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if _, err := tx.Exec("UPDATE webhook_deliveries SET status='processing', attempts=attempts+1, locked_until=NOW(3) + INTERVAL ? MICROSECOND WHERE id=?", d.leaseDuration().Microseconds(), dl.ID); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    dl.Payload = []byte(payload)
+    dl.DeadLetterID = uint64(deadLetterId.Int64)
+    dl.EventID = eventId.String
+    dl.OccurredAt = occurredAt.Time
+    dl.Attempts++
+    return &dl, nil
+}
+
+func (dl *outboxDelivery) envelope() eventEnvelope {
+    return eventEnvelope{Event: dl.Event, ID: dl.EventID, OccurredAt: formatOccurredAt(dl.OccurredAt)}
+}
+
+func (d *Dispatcher) process(dl *outboxDelivery) {
+    log := d.log.With(zap.Uint64("deliveryId", dl.ID), zap.Uint64("submissionId", dl.SubmissionID), zap.Uint64("webhookId", dl.WebhookID), zap.Int("attempt", dl.Attempts))
+    if dl.Channel == "email" {
+        d.processEmail(dl, log.With(zap.String("channel", "email")))
+        return
+    }
+
+    wh, err := loadWebhook(d.db, dl.WebhookID)
+    if err == nil && dl.DeadLetterID == 0 && breakerDisabled(wh) {
+        // Queued behind the breaker until an admin resets it
+        d.deferDelivery(dl, time.Duration(d.cfg.WebhookBreakerCooldown())*time.Second, breakerDeferReason)
+        return
+    }
+    // An admin replaying a dead letter goes through even if the webhook was switched off since
+    if err == sql.ErrNoRows || (err == nil && !wh.Enabled && dl.DeadLetterID == 0) {
+        log.Info("webhook removed or disabled, cancelling delivery")
+        d.complete(dl, "cancelled", 0, webhookCancelledReason)
+        return
+    }
+    if err != nil {
+        log.Error("load webhook", zap.Error(err))
+        d.fail(dl, defaultRetryPolicy(d.cfg), attemptResult{Err: err}, nil)
+        return
+    }
+    if wh.FormLevel {
+        wh.Version = dl.Version
+    }
+    // Dependencies and filters are about submissions
+    submission := dl.Event == eventSubmissionCreated
+    deps := &dependencyState{}
+    if submission {
+        if deps, err = d.checkDependencies(dl, wh); err != nil {
+            log.Error("check webhook dependencies", zap.Error(err))
+            d.fail(dl, defaultRetryPolicy(d.cfg), attemptResult{Err: err}, nil)
+            return
+        }
+    }
+    // Replays resend what was sent before, whatever became of the dependencies since
+    if submission && dl.DeadLetterID == 0 {
+        if deps.Wait {
+            d.deferDelivery(dl, dependencyPollInterval, dependencyWaitReason)
+            return
+        }
+        if deps.Skip != "" {
+            log.Info("webhook dependency did not succeed, skipping delivery", zap.String("reason", deps.Skip))
+            d.complete(dl, "skipped", 0, deps.Skip)
+            return
+        }
+    }
+    // Replays were filtered when first delivered; an admin asking again means send it
+    if submission && dl.DeadLetterID == 0 {
+        match, err := webhookFilterMatches(wh, dl.Payload)
+        if err != nil {
+            log.Warn("webhook filter no longer parses, delivering anyway", zap.Error(err))
+        }
+        if !match {
+            log.Info("webhook filter did not match, skipping delivery")
+            d.complete(dl, "skipped", 0, "filter did not match: "+*wh.Filter)
+            return
+        }
+    }
+    policy := wh.RetryPolicy.withDefaults(d.cfg)
+    if ok, wait := d.breakerAllow(wh.ID); !ok {
+        // Endpoint is failing: queue behind the breaker instead of attempting
+        d.deferDelivery(dl, wait, breakerDeferReason)
+        return
+    }
+
+    var req *http.Request
+    // Multipart dead letters don't keep the uploaded files, so those are rebuilt
+    if dl.DeadLetterID != 0 && !usesMultipartEncoder(wh) {
+        // Replays resend the stored request, re-signed so the timestamp is fresh
+        var body []byte
+        if req, body, err = loadDeadLetterRequest(d.ctx, d.db, dl.DeadLetterID); err != nil {
+            log.Error("load dead letter", zap.Error(err))
+            d.fail(dl, policy, attemptResult{Err: err}, nil)
+            return
+        }
+        restoreMaskedHeaders(req, wh.Headers)
+        signWebhookRequest(req, d.cfg, wh.Secrets, body)
+    } else if dl.Event == eventSubmissionDigest {
+        rendered, err := renderDigestWebhook(d.db, wh, dl.envelope(), dl.Payload)
+        if err != nil {
+            log.Error("render webhook digest", zap.Error(err))
+            // Loading the submissions may work next time; a broken template won't
+            var fieldErr *webhookFieldError
+            if errors.As(err, &fieldErr) {
+                d.complete(dl, "failed", 0, err.Error())
+            } else {
+                d.fail(dl, policy, attemptResult{Err: err}, nil)
+            }
+            return
+        }
+        setEventHeaders(rendered, dl.envelope())
+        if req, err = newWebhookRequest(d.ctx, d.cfg, d.files, wh, rendered); err != nil {
+            log.Error("build webhook request", zap.Error(err))
+            d.complete(dl, "failed", 0, err.Error())
+            return
+        }
+    } else if !submission {
+        rendered, err := renderEventWebhook(wh, dl.envelope(), dl.Payload)
+        if err != nil {
+            log.Error("render webhook", zap.Error(err))
+            d.complete(dl, "failed", 0, err.Error())
+            return
+        }
+        setEventHeaders(rendered, dl.envelope())
+        if req, err = newWebhookRequest(d.ctx, d.cfg, d.files, wh, rendered); err != nil {
+            log.Error("build webhook request", zap.Error(err))
+            d.complete(dl, "failed", 0, err.Error())
+            return
+        }
+    } else {
+        var fieldsJSON []byte
+        if err := d.db.QueryRow("SELECT fields_json FROM form_snapshots WHERE form_id=? AND version=?", dl.FormID, dl.Version).Scan(&fieldsJSON); err != nil {
+            log.Error("failed to fetch form fields", zap.Error(err))
+            d.fail(dl, policy, attemptResult{Err: err}, nil)
+            return
+        }
+        var fields []types.Field
+        _ = json.Unmarshal(fieldsJSON, &fields)
+
+        rendered, err := renderWebhook(wh, fields, dl.SubmissionID, withResponses(withEnvelope(dl.Payload, dl.envelope()), deps.Values))
+        if err != nil {
+            log.Error("render webhook", zap.Error(err))
+            d.complete(dl, "failed", 0, err.Error())
+            return
+        }
+        setEventHeaders(rendered, dl.envelope())
+        if req, err = newWebhookRequest(d.ctx, d.cfg, d.files, wh, rendered); err != nil {
+            var fileErr *webhookFileError
+            if errors.As(err, &fileErr) {
+                log.Warn("fetch webhook file", zap.Error(err))
+                d.fail(dl, policy, attemptResult{Err: err}, nil)
+                return
+            }
+            // A request that can't be built won't get better on retry
+            log.Error("build webhook request", zap.Error(err))
+            d.complete(dl, "failed", 0, err.Error())
+            return
+        }
+    }
+    // Removes a spooled multipart body even if the request is never sent
+    defer req.Body.Close()
+    // Captured before secrets are resolved so dead letters only keep the references
+    sent, err := captureRequest(req)
+    if err != nil {
+        log.Error("capture webhook request", zap.Error(err))
+    }
+    if err := resolveRequestSecrets(d.ctx, d.secrets, req); err != nil {
+        log.Error("resolve webhook secrets", zap.Error(err))
+        d.fail(dl, policy, attemptResult{Err: err}, nil)
+        return
+    }
+
+    // Waits for room at the destination host and webhook, or goes back in the outbox
+    releaseLimits, retryIn, err := d.limits.acquire(d.ctx, req.URL.Hostname(), wh.ID, wh.RateLimit)
+    if err != nil {
+        d.release(dl)
+        return
+    }
+    if releaseLimits == nil {
+        log.Info("webhook destination at its limit, deferring delivery", zap.Duration("retryIn", retryIn))
+        d.deferDelivery(dl, retryIn, rateLimitDeferReason)
+        return
+    }
+    res := d.send(req, wh.Auth)
+    releaseLimits()
+    if d.ctx.Err() != nil {
+        // Shutting down: hand the row back untouched
+        d.release(dl)
+        return
+    }
+    if err := recordAttempt(d.db, dl, res); err != nil {
+        log.Error("record webhook attempt", zap.Error(err))
+    }
+    if !outbound.IsBlocked(res.Err) {
+        // A refused destination says nothing about the endpoint's health
+        d.breakerRecord(wh, res)
+    }
+    if res.Err != nil {
+        log.Warn("webhook delivery failed", zap.Int("status", res.StatusCode), zap.Error(res.Err))
+        d.fail(dl, policy, res, sent)
+        return
+    }
+    if submission && len(wh.ExternalRefs) > 0 {
+        refs, missing := extractExternalRefs(wh.ExternalRefs, res.Body)
+        if len(missing) > 0 {
+            log.Warn("external refs not found in webhook response", zap.Strings("refs", missing))
+        }
+        if err := saveExternalRefs(d.db, dl.SubmissionID, refs); err != nil {
+            log.Error("save submission external refs", zap.Error(err))
+        }
+    }
+    if submission && len(wh.ResponseExtract) > 0 {
+        // The request went through, so resending it to get the values could duplicate it
+        values, err := extractResponseValues(wh.ResponseExtract, res.Body)
+        if err == nil {
+            err = d.saveResponseValues(dl, values)
+        }
+        if err != nil {
+            log.Warn("extract webhook response values", zap.Error(err))
+            d.complete(dl, "failed", res.StatusCode, err.Error())
+            return
+        }
+    }
+    d.complete(dl, "succeeded", res.StatusCode, "")
+}
+
+// maxLoggedResponseBytes caps how much of a response body is kept in the attempt log.
+const maxLoggedResponseBytes = 4096
+
+// attemptResult is the outcome of a single HTTP attempt.
+type attemptResult struct {
+    StatusCode   int
+    Duration     time.Duration
+    ResponseBody string // truncated for the attempt log
+    Body         []byte // up to maxResponseBytes, for response_extract
+    RetryAfter   time.Duration
+    Err          error
+}
+
+// send performs a single attempt with the webhook's auth applied. Non-2xx
+// responses are reported as errors.
+func (d *Dispatcher) send(req *http.Request, auth *WebhookAuth) attemptResult {
+    start := time.Now()
+    resp, err := d.auth.do(req, auth)
+    if err != nil {
+        return attemptResult{Duration: time.Since(start), Err: err}
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+    io.Copy(io.Discard, resp.Body)
+    logged := body
+    if len(logged) > maxLoggedResponseBytes {
+        logged = logged[:maxLoggedResponseBytes]
+    }
+    res := attemptResult{StatusCode: resp.StatusCode, Duration: time.Since(start), ResponseBody: string(logged), Body: body,
+        RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        res.Err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+    }
+    return res
+}
+
+// fail schedules another attempt per the webhook's retry policy, or marks the
+// delivery failed once attempts are exhausted or the response isn't retryable.
+// Failed deliveries that got as far as sending are moved to the dead-letter store.
+// Destinations the outbound policy refuses aren't retried.
+func (d *Dispatcher) fail(dl *outboxDelivery, policy RetryPolicy, res attemptResult, sent *sentRequest) {
+    if dl.Attempts >= policy.MaxAttempts || !policy.shouldRetry(res.StatusCode) || outbound.IsBlocked(res.Err) {
+        if sent != nil && dl.DeadLetterID == 0 {
+            if err := deadLetter(d.db, dl, sent, res); err != nil {
+                d.log.Error("dead-letter webhook delivery", zap.Error(err), zap.Uint64("deliveryId", dl.ID))
+            }
+        }
+        d.complete(dl, "failed", res.StatusCode, res.Err.Error())
+        return
+    }
+    backoff := policy.backoff(dl.Attempts, res.RetryAfter)
+    _, err := d.db.Exec("UPDATE webhook_deliveries SET status='pending', locked_until=NULL, next_attempt_at=NOW(3) + INTERVAL ? MICROSECOND, last_status_code=?, last_error=? WHERE id=?",
+        backoff.Microseconds(), nullIfZero(res.StatusCode), res.Err.Error(), dl.ID)
+    if err != nil {
+        d.log.Error("reschedule webhook delivery", zap.Error(err), zap.Uint64("deliveryId", dl.ID))
+    }
+}
+
+// complete records a terminal outcome and refreshes the submission's
+// webhook_status. Failures are announced as webhook.delivery_failed, except
+// for those events themselves so a failing subscriber can't feed itself.
+func (d *Dispatcher) complete(dl *outboxDelivery, status string, code int, lastErr string) {
+    _, err := d.db.Exec("UPDATE webhook_deliveries SET status=?, locked_until=NULL, completed_at=NOW(3), last_status_code=?, last_error=? WHERE id=?",
+        status, nullIfZero(code), nullIfEmpty(lastErr), dl.ID)
+    if err != nil {
+        d.log.Error("complete webhook delivery", zap.Error(err), zap.Uint64("deliveryId", dl.ID))
+        return
+    }
+    if dl.DeadLetterID != 0 {
+        if err := settleDeadLetter(d.db, dl, status, code, lastErr); err != nil {
+            d.log.Error("settle dead letter", zap.Error(err), zap.Uint64("deadLetterId", dl.DeadLetterID))
+        }
+    }
+    if status == "failed" && dl.Event != eventDeliveryFailed {
+        d.announceFailure(dl, code, lastErr)
+    }
+    // webhook_status and dependencies follow the deliveries of new submissions
+    if dl.Event != eventSubmissionCreated {
+        return
+    }
+    if err := refreshWebhookStatus(d.db, dl.SubmissionID); err != nil {
+        d.log.Error("refresh submission webhook_status", zap.Error(err), zap.Uint64("submissionId", dl.SubmissionID))
+    }
+    d.wakeDependents(dl.SubmissionID)
+}
+
+// announceFailure queues webhook.delivery_failed for the failed delivery's form version.
+func (d *Dispatcher) announceFailure(dl *outboxDelivery, code int, lastErr string) {
+    data := map[string]any{
+        "deliveryId": dl.ID,
+        "webhookId": dl.WebhookID,
+        "channel": dl.Channel,
+        "formId": dl.FormID,
+        "version": dl.Version,
+        "event": dl.Event,
+        "eventId": dl.EventID,
+        "attempts": dl.Attempts,
+        "lastStatusCode": nullIfZero(code),
+        "lastError": lastErr,
+    }
+    if dl.SubmissionID != 0 {
+        data["submissionId"] = dl.SubmissionID
+    }
+    n, err := enqueueEvent(d.db, dl.FormID, dl.Version, dl.SubmissionID, eventDeliveryFailed, data)
+    if err != nil {
+        d.log.Error("queue delivery_failed event", zap.Error(err), zap.Uint64("deliveryId", dl.ID))
+        return
+    }
+    if n > 0 {
+        d.Notify()
+    }
+}
+
+// release returns a claimed row to the outbox without counting the attempt.
+func (d *Dispatcher) release(dl *outboxDelivery) {
+    _, err := d.db.Exec("UPDATE webhook_deliveries SET status='pending', locked_until=NULL, attempts=GREATEST(attempts-1,0) WHERE id=? AND status='processing'", dl.ID)
+    if err != nil {
+        d.log.Error("release webhook delivery", zap.Error(err), zap.Uint64("deliveryId", dl.ID))
+    }
+}
+
+// Deliveries cancelled because an admin removed or switched off the webhook or
+// email action. Any other cancellation means the submission wasn't delivered.
+const (
+    webhookCancelledReason = "webhook removed or disabled"
+    emailCancelledReason   = "email action removed or disabled"
+)
+
+// refreshWebhookStatus derives submissions.webhook_status from its
+// submission.created deliveries. It stays pending while any delivery is
+// outstanding; a failure that a later redelivery or replay to the same webhook
+// fixed no longer counts. Cancelled deliveries count as failed unless an admin
+// removed or disabled their target.
+func refreshWebhookStatus(db *sql.DB, submissionId uint64) error {
+    var outstanding, failed sql.NullInt64
+    err := db.QueryRow(`SELECT SUM(d.status IN ('pending','processing')),
+        SUM((d.status='failed' OR (d.status='cancelled' AND COALESCE(d.last_error,'') NOT IN (?,?)))
+            AND NOT EXISTS (SELECT 1 FROM webhook_deliveries r WHERE r.submission_id=d.submission_id AND r.event=d.event AND r.webhook_id=d.webhook_id AND r.id>d.id AND r.status='succeeded'))
+        FROM webhook_deliveries d WHERE d.submission_id=? AND d.event='submission.created'`, webhookCancelledReason, emailCancelledReason, submissionId).Scan(&outstanding, &failed)
+    if err != nil {
+        return err
+    }
+    if outstanding.Int64 > 0 {
+        return nil
+    }
+    status := "success"
+    if failed.Int64 > 0 { status = "partial" }
+    _, err = db.Exec("UPDATE submissions SET webhook_status=? WHERE id=?", status, submissionId)
+    return err
+}
+
+func nullIfZero(i int) any { if i == 0 { return nil }; return i }
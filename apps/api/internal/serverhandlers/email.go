@@ -0,0 +1,394 @@
+package serverhandlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/config"
+	"github.com/example/formrepo/apps/api/internal/types"
+	"go.uber.org/zap"
+)
+
+// The email submit action sends a notification per submission over SMTP.
+// Its deliveries share the webhook outbox (channel 'email', webhook_id 0), so
+// they get the same leasing, retries and attempt log as webhooks.
+
+// emailMessage is a rendered notification.
+type emailMessage struct {
+	To          []string
+	Subject     string
+	Body        string
+	HTML        bool
+	Attachments []emailAttachment
+}
+
+type emailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// smtpTransientCodes are the SMTP replies worth retrying; other 5xx replies
+// (unknown mailbox, rejected message) won't get better.
+var smtpTransientCodes = []int{421, 450, 451, 452}
+
+func emailRetryPolicy(cfg *config.Config) RetryPolicy {
+	p := defaultRetryPolicy(cfg)
+	p.RetryOnStatus = smtpTransientCodes
+	return p
+}
+
+// emailActionOf returns the pipeline's enabled email action, or nil.
+func emailActionOf(submit *types.SubmitPipeline) *types.EmailActionConfig {
+	if submit == nil {
+		return nil
+	}
+	for _, a := range submit.Actions {
+		if a.Type == "email" && a.Enabled && a.Email != nil {
+			return a.Email
+		}
+	}
+	return nil
+}
+
+// validateEmailAction checks an email action's recipients and templates.
+func validateEmailAction(at string, ea *types.EmailActionConfig) []string {
+	if ea == nil {
+		return []string{at + ": required"}
+	}
+	var errs []string
+	if len(ea.To) == 0 && ea.ToField == "" {
+		errs = append(errs, at+": set to or to_field")
+	}
+	if ea.Digest != nil {
+		errs = append(errs, validateDigest(at+"/digest", ea.Digest)...)
+		if ea.ToField != "" {
+			errs = append(errs, at+"/to_field: digests go to the static recipients in to")
+		}
+	}
+	for i, addr := range ea.To {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			errs = append(errs, fmt.Sprintf("%s/to/%d: invalid address", at, i))
+		}
+	}
+	for _, t := range []struct {
+		name string
+		tpls types.LocaleString
+	}{{"subject", ea.Subject}, {"body", ea.Body}} {
+		for loc, src := range t.tpls {
+			if src == "" {
+				continue
+			}
+			if _, err := parseWebhookTemplate(src, nil, loc); err != nil {
+				errs = append(errs, at+"/"+t.name+"/"+loc+": "+err.Error())
+			}
+		}
+	}
+	return errs
+}
+
+// loadEmailAction reads the email action and fields of a form version's
+// snapshot. The action is nil when the form no longer has one enabled.
+func loadEmailAction(q queryRower, formId string, version int) (*types.EmailActionConfig, []types.Field, error) {
+	var submitRaw, fieldsRaw []byte
+	err := q.QueryRow("SELECT submit_json, fields_json FROM form_snapshots WHERE form_id=? AND version=?", formId, version).Scan(&submitRaw, &fieldsRaw)
+	if err != nil {
+		return nil, nil, err
+	}
+	var submit types.SubmitPipeline
+	_ = json.Unmarshal(submitRaw, &submit)
+	var fields []types.Field
+	_ = json.Unmarshal(fieldsRaw, &fields)
+	return emailActionOf(&submit), fields, nil
+}
+
+var emailSubjects = map[string]string{"en": "New submission", "ar": "طلب جديد"}
+
+// renderEmail builds the notification for a submission. Subject and body use
+// the submission's locale, then English; without a template the body is an
+// HTML table of question labels and answers.
+func renderEmail(ea *types.EmailActionConfig, fields []types.Field, formId string, version int, submissionId uint64, body []byte) (*emailMessage, error) {
+	wh := &webhookRow{FormID: formId, Version: version}
+	ctx, locale := webhookTemplateContext(wh, fields, submissionId, body)
+
+	msg := &emailMessage{To: append([]string(nil), ea.To...)}
+	if ea.ToField != "" {
+		answers, _ := ctx["answers"].(map[string]any)
+		addr := strings.TrimSpace(formatAnswer(answers[ea.ToField], locale))
+		if addr != "" {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return nil, fmt.Errorf("to_field %s: invalid address %q", ea.ToField, addr)
+			}
+			msg.To = append(msg.To, addr)
+		}
+	}
+	if len(msg.To) == 0 {
+		return nil, errors.New("no recipients")
+	}
+
+	pick := func(tpls types.LocaleString) string {
+		if s := tpls[locale]; s != "" {
+			return s
+		}
+		return tpls["en"]
+	}
+	render := func(name, src string) (string, error) {
+		t, err := parseWebhookTemplate(src, fields, locale)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		var buf strings.Builder
+		if err := t.Execute(&buf, ctx); err != nil {
+			return "", fmt.Errorf("%s: %w", name, toTemplateError(src, err))
+		}
+		return buf.String(), nil
+	}
+
+	var err error
+	if src := pick(ea.Subject); src != "" {
+		if msg.Subject, err = render("subject", src); err != nil {
+			return nil, err
+		}
+	} else {
+		subject, ok := emailSubjects[locale]
+		if !ok {
+			subject = emailSubjects["en"]
+		}
+		msg.Subject = fmt.Sprintf("%s: %s #%d", subject, formId, submissionId)
+	}
+	// Subjects are a single header line
+	msg.Subject = headerBreaks.Replace(msg.Subject)
+	if src := pick(ea.Body); src != "" {
+		if msg.Body, err = render("body", src); err != nil {
+			return nil, err
+		}
+	} else {
+		msg.Body = emailAnswerTable(newChatMessage(wh, fields, submissionId, body))
+		msg.HTML = true
+	}
+	return msg, nil
+}
+
+// emailAnswerTable is the default body: the same labelled answers as the chat
+// formats, as an HTML table.
+func emailAnswerTable(m *chatMessage) string {
+	dir := "ltr"
+	if m.Locale == "ar" {
+		dir = "rtl"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div dir="%s" style="font-family:sans-serif">`, dir)
+	fmt.Fprintf(&b, "<h2>%s</h2>\n", html.EscapeString(m.Title))
+	b.WriteString(`<table cellpadding="6" style="border-collapse:collapse">` + "\n")
+	for _, a := range m.Answers {
+		text := chatText(a, func(l chatLink) string {
+			return `<a href="` + html.EscapeString(l.URL) + `">` + html.EscapeString(l.Text) + "</a>"
+		})
+		if len(a.Links) == 0 {
+			text = strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+		} else {
+			text = strings.ReplaceAll(text, "\n", "<br>")
+		}
+		fmt.Fprintf(&b, `<tr><th style="border:1px solid #ddd;text-align:start;vertical-align:top">%s</th><td style="border:1px solid #ddd">%s</td></tr>`+"\n", html.EscapeString(a.Label), text)
+	}
+	b.WriteString("</table>\n")
+	fmt.Fprintf(&b, `<p style="color:#888;font-size:12px">%s</p></div>`, html.EscapeString(m.Footer))
+	return b.String()
+}
+
+// buildEmail formats the message as RFC 5322 with a base64 UTF-8 body, as
+// multipart/mixed when it has attachments.
+func buildEmail(from string, msg *emailMessage, now time.Time) []byte {
+	var b bytes.Buffer
+	contentType := "text/plain; charset=UTF-8"
+	if msg.HTML {
+		contentType = "text/html; charset=UTF-8"
+	}
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	if len(msg.Attachments) == 0 {
+		fmt.Fprintf(&b, "Content-Type: %s\r\n", contentType)
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		writeBase64Lines(&b, []byte(msg.Body))
+		return b.Bytes()
+	}
+	mw := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}, "Content-Transfer-Encoding": {"base64"}})
+	writeBase64Lines(part, []byte(msg.Body))
+	for _, a := range msg.Attachments {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", a.ContentType)
+		h.Set("Content-Transfer-Encoding", "base64")
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+		part, _ := mw.CreatePart(h)
+		writeBase64Lines(part, a.Data)
+	}
+	mw.Close()
+	return b.Bytes()
+}
+
+// writeBase64Lines writes data base64 encoded in lines of 76 characters.
+func writeBase64Lines(w io.Writer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		io.WriteString(w, enc[:76]+"\r\n")
+		enc = enc[76:]
+	}
+	io.WriteString(w, enc+"\r\n")
+}
+
+// sendEmail delivers msg through the configured SMTP server.
+func sendEmail(ctx context.Context, cfg *config.Config, msg *emailMessage) error {
+	timeout := time.Duration(cfg.WebhookTimeout()) * time.Millisecond
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if cfg.SMTPTLS == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: cfg.SMTPHost}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if cfg.SMTPTLS == "starttls" || cfg.SMTPTLS == "" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.SMTPHost}); err != nil {
+			return err
+		}
+	}
+	if cfg.SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)); err != nil {
+			return err
+		}
+	}
+	from := cfg.SMTPFrom
+	if from == "" {
+		from = cfg.SMTPUsername
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	if err := c.Mail(sender.Address); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		rcpt, err := mail.ParseAddress(to)
+		if err != nil {
+			return err
+		}
+		if err := c.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildEmail(sender.String(), msg, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// processEmail delivers an email outbox row.
+func (d *Dispatcher) processEmail(dl *outboxDelivery, log *zap.Logger) {
+	policy := emailRetryPolicy(d.cfg)
+	ea, fields, err := loadEmailAction(d.db, dl.FormID, dl.Version)
+	if err != nil {
+		log.Error("load email action", zap.Error(err))
+		d.fail(dl, policy, attemptResult{Err: err}, nil)
+		return
+	}
+	if ea == nil {
+		log.Info("email action removed or disabled, cancelling delivery")
+		d.complete(dl, "cancelled", 0, emailCancelledReason)
+		return
+	}
+	if d.cfg.SMTPHost == "" {
+		d.complete(dl, "failed", 0, "SMTP_HOST is not configured")
+		return
+	}
+	var msg *emailMessage
+	if dl.Event == eventSubmissionDigest {
+		var data digestData
+		var subs []digestSubmission
+		if err = json.Unmarshal(dl.Payload, &data); err == nil {
+			subs, err = loadDigestSubmissions(d.db, data.DigestID)
+			data.Count = len(subs)
+		}
+		if err != nil {
+			log.Error("load email digest", zap.Error(err))
+			d.fail(dl, policy, attemptResult{Err: err}, nil)
+			return
+		}
+		msg, err = renderDigestEmail(ea, data, subs, digestFields(d.db, dl.FormID))
+	} else {
+		msg, err = renderEmail(ea, fields, dl.FormID, dl.Version, dl.SubmissionID, dl.Payload)
+	}
+	if err != nil {
+		log.Error("render email", zap.Error(err))
+		d.complete(dl, "failed", 0, err.Error())
+		return
+	}
+
+	start := time.Now()
+	err = sendEmail(d.ctx, d.cfg, msg)
+	if d.ctx.Err() != nil {
+		// Shutting down: hand the row back untouched
+		d.release(dl)
+		return
+	}
+	res := attemptResult{Duration: time.Since(start), Err: err}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		res.StatusCode = reply.Code
+	}
+	if err == nil {
+		res.StatusCode = 250
+		res.ResponseBody = "sent to " + strings.Join(msg.To, ", ")
+	}
+	if err := recordAttempt(d.db, dl, res); err != nil {
+		log.Error("record email attempt", zap.Error(err))
+	}
+	if res.Err != nil {
+		log.Warn("email delivery failed", zap.Int("status", res.StatusCode), zap.Error(res.Err))
+		d.fail(dl, policy, res, nil)
+		return
+	}
+	d.complete(dl, "succeeded", res.StatusCode, "")
+}
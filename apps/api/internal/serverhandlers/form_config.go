@@ -0,0 +1,88 @@
+package serverhandlers
+
+import (
+    "database/sql"
+    "encoding/json"
+
+    "github.com/example/formrepo/apps/api/internal/secrets"
+    "github.com/example/formrepo/apps/api/internal/types"
+    "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
+)
+
+// additionalWebhook is one entry of PurchaseAuthConfig.AdditionalWebhooks.
+type additionalWebhook struct {
+    URL     string            `json:"url"`
+    Method  string            `json:"method"`
+    Headers map[string]string `json:"headers,omitempty"`
+}
+
+func additionalWebhooks(pc *types.PurchaseAuthConfig) []additionalWebhook {
+    raw, _ := json.Marshal(pc.AdditionalWebhooks)
+    var out []additionalWebhook
+    _ = json.Unmarshal(raw, &out)
+    return out
+}
+
+// publicSubmitPipeline strips what the renderer must not see. Credentials and
+// server-to-server endpoints are used by the API on the renderer's behalf
+// (login proxy, pre-purchase and purchase webhook endpoints).
+func publicSubmitPipeline(submit *types.SubmitPipeline) {
+    for i := range submit.Actions {
+        // Recipients and templates are only used server-side
+        submit.Actions[i].Email = nil
+        pc := submit.Actions[i].PurchaseAuthConfig
+        if pc == nil {
+            continue
+        }
+        pub := *pc
+        pub.DeviceID = ""
+        pub.AppSignature = ""
+        pub.AdditionalWebhooks = nil
+        if pc.PrePurchaseWebhook != nil {
+            // Only the field mapping; URL and key stay on the server
+            pub.PrePurchaseWebhook = &types.PrePurchaseWebhook{NameField: pc.PrePurchaseWebhook.NameField, NotesField: pc.PrePurchaseWebhook.NotesField}
+        }
+        submit.Actions[i].PurchaseAuthConfig = &pub
+    }
+}
+
+// maskSubmitSecrets keeps the full pipeline for admins but masks credentials
+// that aren't ${secret:...} references.
+func maskSubmitSecrets(submit *types.SubmitPipeline) {
+    mask := func(v string) string {
+        if v == "" || secrets.HasReference(v) {
+            return v
+        }
+        return secrets.Mask(v)
+    }
+    for i := range submit.Actions {
+        pc := submit.Actions[i].PurchaseAuthConfig
+        if pc == nil {
+            continue
+        }
+        pc.DeviceID = mask(pc.DeviceID)
+        pc.AppSignature = mask(pc.AppSignature)
+        if pc.PrePurchaseWebhook != nil {
+            pc.PrePurchaseWebhook.APIKey = mask(pc.PrePurchaseWebhook.APIKey)
+        }
+        if len(pc.AdditionalWebhooks) > 0 {
+            hooks := additionalWebhooks(pc)
+            pc.AdditionalWebhooks = make([]any, len(hooks))
+            for j, h := range hooks {
+                h.Headers = maskHeaders(h.Headers)
+                pc.AdditionalWebhooks[j] = h
+            }
+        }
+    }
+}
+
+// GetFormConfigAdminHandler returns the full (private) config of a form version.
+func GetFormConfigAdminHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        formId := c.Param("formId")
+        ver := c.Param("version")
+        row := db.QueryRow("SELECT version,title_json,fields_json,attributes_json,thank_you_json,submit_json,supported_locales_json,default_locale FROM form_snapshots WHERE form_id=? AND version=?", formId, ver)
+        respondFormRow(c, formId, row, maskSubmitSecrets)
+    }
+}
@@ -14,6 +14,7 @@ import (
     "strings"
 
     "github.com/example/formrepo/apps/api/internal/config"
+    "github.com/example/formrepo/apps/api/internal/secrets"
     "github.com/example/formrepo/apps/api/internal/types"
     "github.com/gin-gonic/gin"
     "go.uber.org/zap"
@@ -135,9 +136,11 @@ type publishReq struct {
     Attributes []string          `json:"attributes"`
     ThankYou   *types.ThankYou   `json:"thankYou"`
     Submit     *types.SubmitPipeline `json:"submit"`
+    // Copy the previous version's webhooks to the new version (default true)
+    CopyWebhooks *bool            `json:"copyWebhooks,omitempty"`
 }
 
-func PublishFormHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.HandlerFunc {
+func PublishFormHandler(db *sql.DB, cfg *config.Config, store *secrets.Store, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         var req publishReq
         if err := c.BindJSON(&req); err != nil {
@@ -164,6 +167,9 @@ func PublishFormHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.Han
         if verrs := validateSubmitJSON(req.Submit); len(verrs) > 0 {
             errs = append(errs, verrs...)
         }
+        if verrs := validatePurchaseSecrets(c, store, req.Submit); len(verrs) > 0 {
+            errs = append(errs, verrs...)
+        }
         if len(errs) > 0 {
             c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "bilingual required", "details": errs})
             return
@@ -211,27 +217,65 @@ func PublishFormHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.Han
             return
         }
 
-        // No duplicate found, create new form
-        _, err = db.Exec(`INSERT INTO form_snapshots(form_id,version,title_json,fields_json,attributes_json,thank_you_json,submit_json,config_hash,supported_locales_json,default_locale,status) VALUES(?,?,?,?,?,?,?,?,JSON_ARRAY('en','ar'),'en','active')`,
+        // Generate form URLs
+        baseURL := getBaseURL(c, cfg)
+        formIDEncoded := url.PathEscape(req.FormID)
+        urls := gin.H{
+            "en": fmt.Sprintf("%s/%s/%d?lang=en", baseURL, formIDEncoded, nextVersion),
+            "ar": fmt.Sprintf("%s/%s/%d?lang=ar", baseURL, formIDEncoded, nextVersion),
+        }
+
+        // No duplicate found, create new form; the snapshot, its copied
+        // webhooks and the form.published deliveries are committed together
+        tx, err := db.Begin()
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+            return
+        }
+        defer tx.Rollback()
+        _, err = tx.Exec(`INSERT INTO form_snapshots(form_id,version,title_json,fields_json,attributes_json,thank_you_json,submit_json,config_hash,supported_locales_json,default_locale,status) VALUES(?,?,?,?,?,?,?,?,JSON_ARRAY('en','ar'),'en','active')`,
             req.FormID, nextVersion, string(titleJSON), string(fieldsJSON), string(attrsJSON), string(thankJSON), string(submitJSON), configHash)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "insert failed"})
             return
         }
+        var carried *webhookCarryReport
+        if nextVersion > 1 && (req.CopyWebhooks == nil || *req.CopyWebhooks) {
+            carried, err = carryWebhooks(tx, req.FormID, nextVersion-1, nextVersion, fields)
+            if err != nil {
+                log.Error("failed to copy webhooks to new version", zap.Error(err), zap.String("formId", req.FormID), zap.Int("version", nextVersion))
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to copy webhooks"})
+                return
+            }
+        }
+        published := gin.H{"formId": req.FormID, "version": nextVersion, "previousVersion": nil, "title": req.Title, "urls": urls}
+        if nextVersion > 1 {
+            published["previousVersion"] = nextVersion - 1
+        }
+        if _, err := enqueueEvent(tx, req.FormID, nextVersion, 0, eventFormPublished, published); err != nil {
+            log.Error("failed to queue form.published", zap.Error(err), zap.String("formId", req.FormID), zap.Int("version", nextVersion))
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "insert failed"})
+            return
+        }
+        if err := tx.Commit(); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "insert failed"})
+            return
+        }
+        if carried != nil && len(carried.Copied) > 0 {
+            log.Info("webhooks copied to new version", zap.String("formId", req.FormID), zap.Int("from", carried.FromVersion), zap.Int("to", nextVersion), zap.Int("count", len(carried.Copied)))
+        }
+        disp.Notify()
         
-        // Generate form URLs
-        baseURL := getBaseURL(c, cfg)
-        formIDEncoded := url.PathEscape(req.FormID)
-        
-        c.JSON(http.StatusOK, gin.H{
+        out := gin.H{
             "formId": req.FormID,
             "version": nextVersion,
             "isDuplicate": false,
-            "urls": gin.H{
-                "en": fmt.Sprintf("%s/%s/%d?lang=en", baseURL, formIDEncoded, nextVersion),
-                "ar": fmt.Sprintf("%s/%s/%d?lang=ar", baseURL, formIDEncoded, nextVersion),
-            },
-        })
+            "urls": urls,
+        }
+        if carried != nil {
+            out["webhooks"] = carried
+        }
+        c.JSON(http.StatusOK, out)
     }
 }
 
@@ -293,6 +337,7 @@ var allowedActions = map[string]bool{
     "nextjs_post": true,
     "redirect": true,
     "purchase_authenticated": true,
+    "email": true,
 }
 
 func validateSubmitJSON(submit *types.SubmitPipeline) []string {
@@ -305,6 +350,7 @@ func validateSubmitJSON(submit *types.SubmitPipeline) []string {
         errs = append(errs, "/submit/actions: must have at least one action")
     }
     hasEnabled := false
+    emails := 0
     for i, a := range submit.Actions {
         if !allowedActions[a.Type] {
             errs = append(errs, "/submit/actions/"+itoa(i)+": unknown type")
@@ -316,6 +362,14 @@ func validateSubmitJSON(submit *types.SubmitPipeline) []string {
             }
         }
         // nextjs_post doesn't need URL validation - it uses environment variable
+        if a.Type == "email" {
+            if emails++; emails > 1 {
+                errs = append(errs, "/submit/actions/"+itoa(i)+": only one email action allowed")
+            }
+            if a.Enabled {
+                errs = append(errs, validateEmailAction("/submit/actions/"+itoa(i)+"/email", a.Email)...)
+            }
+        }
     }
     if !hasEnabled { errs = append(errs, "/submit/actions: at least one enabled required") }
     // ordering must be subset and unique
@@ -429,7 +483,7 @@ func GetFormLatestHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.H
     return func(c *gin.Context) {
         formId := c.Param("formId")
         row := db.QueryRow("SELECT version,title_json,fields_json,attributes_json,thank_you_json,submit_json,supported_locales_json,default_locale FROM form_snapshots WHERE form_id=? ORDER BY version DESC LIMIT 1", formId)
-        respondFormRow(c, formId, row)
+        respondFormRow(c, formId, row, publicSubmitPipeline)
     }
 }
 
@@ -438,11 +492,13 @@ func GetFormVersionHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.
         formId := c.Param("formId")
         ver := c.Param("version")
         row := db.QueryRow("SELECT version,title_json,fields_json,attributes_json,thank_you_json,submit_json,supported_locales_json,default_locale FROM form_snapshots WHERE form_id=? AND version=?", formId, ver)
-        respondFormRow(c, formId, row)
+        respondFormRow(c, formId, row, publicSubmitPipeline)
     }
 }
 
-func respondFormRow(c *gin.Context, formId string, row *sql.Row) {
+// respondFormRow writes a form snapshot; redact decides what of the submit
+// pipeline the caller may see.
+func respondFormRow(c *gin.Context, formId string, row *sql.Row, redact func(*types.SubmitPipeline)) {
     var version int
     var titleRaw, fieldsRaw, attrsRaw, thankRaw, submitRaw, localesRaw []byte
     var defaultLocale string
@@ -462,6 +518,7 @@ func respondFormRow(c *gin.Context, formId string, row *sql.Row) {
     _ = json.Unmarshal(thankRaw, &thank)
     var submit types.SubmitPipeline
     _ = json.Unmarshal(submitRaw, &submit)
+    redact(&submit)
     var locales []string
     _ = json.Unmarshal(localesRaw, &locales)
     cfg.FormID = formId
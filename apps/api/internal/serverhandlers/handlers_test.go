@@ -1,4 +1,4 @@
-package serverhandlers
+package serverhandlers_test
 
 import (
     "net/http"
@@ -0,0 +1,380 @@
+package serverhandlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/config"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// The dispatcher limits requests per destination host and per webhook: at
+// most max_concurrent in flight and requests_per_second through a token
+// bucket. A worker waits up to WEBHOOK_LIMIT_MAX_WAIT_MS for room, then puts
+// the delivery back in the outbox so it doesn't hold up other destinations.
+// Limits and their stats are per API process.
+
+// rateLimitDeferReason marks deliveries put back because their destination was
+// at its limit.
+const rateLimitDeferReason = "rate limited"
+
+// limitRetryDelay is how long a delivery deferred for a full destination waits
+// before it is claimed again.
+const limitRetryDelay = time.Second
+
+// RateLimit caps requests to a destination. Zero values mean unlimited.
+type RateLimit struct {
+	MaxConcurrent     int     `json:"max_concurrent,omitempty"`
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	Burst             int     `json:"burst,omitempty"` // bucket size, defaults to one second's worth
+}
+
+// validate returns admin-facing errors for an explicitly configured limit.
+func (l *RateLimit) validate() []string {
+	if l == nil {
+		return nil
+	}
+	var errs []string
+	if l.MaxConcurrent < 0 {
+		errs = append(errs, "/rate_limit/max_concurrent: must be positive")
+	}
+	if l.RequestsPerSecond < 0 {
+		errs = append(errs, "/rate_limit/requests_per_second: must be positive")
+	}
+	if l.Burst < 0 {
+		errs = append(errs, "/rate_limit/burst: must be positive")
+	} else if l.Burst > 0 && l.RequestsPerSecond == 0 {
+		errs = append(errs, "/rate_limit/burst: requires requests_per_second")
+	}
+	return errs
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.RequestsPerSecond))
+}
+
+// parseHostLimits parses WEBHOOK_HOST_LIMITS, returning the entries it could
+// read and an error for each it couldn't.
+func parseHostLimits(s string) (map[string]RateLimit, []error) {
+	out := map[string]RateLimit{}
+	var errs []error
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, spec, ok := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		parts := strings.Split(spec, ":")
+		if !ok || host == "" || len(parts) > 3 {
+			errs = append(errs, fmt.Errorf("%q: want host=max_concurrent[:rps[:burst]]", entry))
+			continue
+		}
+		var l RateLimit
+		var err error
+		if l.MaxConcurrent, err = strconv.Atoi(strings.TrimSpace(parts[0])); err == nil && len(parts) > 1 {
+			if l.RequestsPerSecond, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err == nil && len(parts) > 2 {
+				l.Burst, err = strconv.Atoi(strings.TrimSpace(parts[2]))
+			}
+		}
+		if err == nil && (l.MaxConcurrent < 0 || l.RequestsPerSecond < 0 || l.Burst < 0) {
+			err = fmt.Errorf("limits must be positive")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", entry, err))
+			continue
+		}
+		out[host] = l
+	}
+	return out, errs
+}
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	rate, burst, tokens float64
+	last                time.Time
+}
+
+// wait returns how long until a token is available.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// destLimiter is one host's or webhook's limit and usage.
+type destLimiter struct {
+	limit     RateLimit
+	bucket    *tokenBucket // nil without requests_per_second
+	active    int
+	waiting   int
+	acquired  uint64
+	deferred  uint64
+	waitTotal time.Duration
+	waitMax   time.Duration
+}
+
+func (l *destLimiter) setLimit(limit RateLimit, now time.Time) {
+	if l.limit == limit {
+		return
+	}
+	l.limit = limit
+	l.bucket = nil
+	if limit.RequestsPerSecond > 0 {
+		l.bucket = &tokenBucket{rate: limit.RequestsPerSecond, burst: limit.burst(), tokens: limit.burst(), last: now}
+	}
+}
+
+// room reports whether all concurrency slots are taken and, if not, how long
+// until the bucket has a token.
+func (l *destLimiter) room(now time.Time) (full bool, wait time.Duration) {
+	if l.limit.MaxConcurrent > 0 && l.active >= l.limit.MaxConcurrent {
+		return true, 0
+	}
+	if l.bucket != nil {
+		wait = l.bucket.wait(now)
+	}
+	return false, wait
+}
+
+func (l *destLimiter) done(waited time.Duration, acquired bool) {
+	l.waiting--
+	if !acquired {
+		l.deferred++
+		return
+	}
+	l.active++
+	l.acquired++
+	l.waitTotal += waited
+	if waited > l.waitMax {
+		l.waitMax = waited
+	}
+	if l.bucket != nil {
+		l.bucket.tokens--
+	}
+}
+
+// destLimits holds the dispatcher's host and webhook limiters.
+type destLimits struct {
+	mu            sync.Mutex
+	changed       chan struct{} // closed and replaced whenever a slot is freed
+	hosts         map[string]*destLimiter
+	webhooks      map[uint64]*destLimiter
+	hostDefault   RateLimit
+	hostOverrides map[string]RateLimit
+	maxWait       time.Duration
+	now           func() time.Time // time.Now, except in tests
+}
+
+func newDestLimits(cfg *config.Config, log *zap.Logger) *destLimits {
+	overrides, errs := parseHostLimits(cfg.WebhookHostLimits)
+	for _, err := range errs {
+		log.Warn("ignoring invalid WEBHOOK_HOST_LIMITS entry", zap.Error(err))
+	}
+	return &destLimits{
+		changed:       make(chan struct{}),
+		hosts:         map[string]*destLimiter{},
+		webhooks:      map[uint64]*destLimiter{},
+		hostDefault:   RateLimit{MaxConcurrent: cfg.WebhookHostMaxConcurrent, RequestsPerSecond: cfg.WebhookHostRatePerSec, Burst: cfg.WebhookHostBurst},
+		hostOverrides: overrides,
+		maxWait:       time.Duration(cfg.WebhookLimitMaxWait()) * time.Millisecond,
+		now:           time.Now,
+	}
+}
+
+// limiters returns the host's and webhook's limiters, refreshed with their
+// current limits. The caller holds ls.mu.
+func (ls *destLimits) limiters(host string, webhookId uint64, limit *RateLimit, now time.Time) (*destLimiter, *destLimiter) {
+	h := ls.hosts[host]
+	if h == nil {
+		h = &destLimiter{}
+		ls.hosts[host] = h
+	}
+	hostLimit, ok := ls.hostOverrides[host]
+	if !ok {
+		hostLimit = ls.hostDefault
+	}
+	h.setLimit(hostLimit, now)
+
+	w := ls.webhooks[webhookId]
+	if w == nil {
+		w = &destLimiter{}
+		ls.webhooks[webhookId] = w
+	}
+	var whLimit RateLimit
+	if limit != nil {
+		whLimit = *limit
+	}
+	w.setLimit(whLimit, now)
+	return h, w
+}
+
+// acquire waits for room at both the host and the webhook and returns a func
+// that frees the slots. With no room within maxWait it returns a nil func and
+// how long to put the delivery back for; it only errors when ctx is done.
+func (ls *destLimits) acquire(ctx context.Context, host string, webhookId uint64, limit *RateLimit) (func(), time.Duration, error) {
+	host = strings.ToLower(host)
+	start := ls.now()
+	deadline := start.Add(ls.maxWait)
+	ls.mu.Lock()
+	h, w := ls.limiters(host, webhookId, limit, start)
+	h.waiting++
+	w.waiting++
+	for {
+		now := ls.now()
+		hostFull, hostWait := h.room(now)
+		whFull, whWait := w.room(now)
+		full := hostFull || whFull
+		wait := hostWait
+		if whWait > wait {
+			wait = whWait
+		}
+		if !full && wait == 0 {
+			h.done(now.Sub(start), true)
+			w.done(now.Sub(start), true)
+			ls.mu.Unlock()
+			return func() { ls.release(h, w) }, 0, nil
+		}
+		if now.Add(wait).After(deadline) || !now.Before(deadline) {
+			h.done(0, false)
+			w.done(0, false)
+			ls.mu.Unlock()
+			if full || wait < limitRetryDelay {
+				wait = limitRetryDelay
+			}
+			return nil, wait, nil
+		}
+		if full {
+			// Woken by a freed slot, or gives up at the deadline
+			wait = deadline.Sub(now)
+		}
+		changed := ls.changed
+		ls.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			ls.mu.Lock()
+			h.waiting--
+			w.waiting--
+			ls.mu.Unlock()
+			return nil, 0, ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		ls.mu.Lock()
+	}
+}
+
+func (ls *destLimits) release(h, w *destLimiter) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	h.active--
+	w.active--
+	close(ls.changed)
+	ls.changed = make(chan struct{})
+}
+
+// DestinationStats is a host's or webhook's limit and how deliveries to it are
+// queueing in this process.
+type DestinationStats struct {
+	Host              string  `json:"host,omitempty"`
+	WebhookID         uint64  `json:"webhookId,omitempty"`
+	MaxConcurrent     int     `json:"maxConcurrent"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Active            int     `json:"active"`
+	Waiting           int     `json:"waiting"`      // workers waiting for room
+	Acquired          uint64  `json:"acquired"`     // requests let through
+	Deferred          uint64  `json:"deferred"`     // put back in the outbox after waiting the maximum
+	OutboxQueued      int     `json:"outboxQueued"` // deliveries currently deferred in the outbox
+	AvgWaitMs         float64 `json:"avgWaitMs"`
+	MaxWaitMs         float64 `json:"maxWaitMs"`
+}
+
+func (l *destLimiter) stats() DestinationStats {
+	s := DestinationStats{
+		MaxConcurrent:     l.limit.MaxConcurrent,
+		RequestsPerSecond: l.limit.RequestsPerSecond,
+		Active:            l.active,
+		Waiting:           l.waiting,
+		Acquired:          l.acquired,
+		Deferred:          l.deferred,
+		MaxWaitMs:         float64(l.waitMax) / float64(time.Millisecond),
+	}
+	if l.acquired > 0 {
+		s.AvgWaitMs = float64(l.waitTotal) / float64(l.acquired) / float64(time.Millisecond)
+	}
+	return s
+}
+
+func (ls *destLimits) stats() (hosts, webhooks []DestinationStats) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	hosts = []DestinationStats{}
+	for host, l := range ls.hosts {
+		s := l.stats()
+		s.Host = host
+		hosts = append(hosts, s)
+	}
+	webhooks = []DestinationStats{}
+	for id, l := range ls.webhooks {
+		s := l.stats()
+		s.WebhookID = id
+		webhooks = append(webhooks, s)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].WebhookID < webhooks[j].WebhookID })
+	return hosts, webhooks
+}
+
+// WebhookLimitsHandler reports the dispatcher's destination limits and queues.
+func WebhookLimitsHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hosts, webhooks := disp.limits.stats()
+		rows, err := db.Query("SELECT webhook_id, COUNT(*) FROM webhook_deliveries WHERE status='pending' AND last_error=? GROUP BY webhook_id", rateLimitDeferReason)
+		if err != nil {
+			log.Error("failed to count rate limited deliveries", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count rate limited deliveries"})
+			return
+		}
+		defer rows.Close()
+		index := map[uint64]int{}
+		for i, s := range webhooks {
+			index[s.WebhookID] = i
+		}
+		for rows.Next() {
+			var id uint64
+			var n int
+			if err := rows.Scan(&id, &n); err != nil {
+				log.Error("failed to scan rate limited deliveries", zap.Error(err))
+				continue
+			}
+			// Deferred by another process, or before this one started
+			if _, ok := index[id]; !ok {
+				index[id] = len(webhooks)
+				webhooks = append(webhooks, DestinationStats{WebhookID: id})
+			}
+			webhooks[index[id]].OutboxQueued = n
+		}
+		sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].WebhookID < webhooks[j].WebhookID })
+		c.JSON(http.StatusOK, gin.H{"maxWaitMs": disp.limits.maxWait.Milliseconds(), "hosts": hosts, "webhooks": webhooks})
+	}
+}
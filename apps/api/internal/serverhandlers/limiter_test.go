@@ -0,0 +1,252 @@
+package serverhandlers
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for destLimits.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestLimits(clock *fakeClock, maxWait time.Duration, hostDefault RateLimit, overrides map[string]RateLimit) *destLimits {
+	return &destLimits{
+		changed:       make(chan struct{}),
+		hosts:         map[string]*destLimiter{},
+		webhooks:      map[uint64]*destLimiter{},
+		hostDefault:   hostDefault,
+		hostOverrides: overrides,
+		maxWait:       maxWait,
+		now:           clock.now,
+	}
+}
+
+func TestParseHostLimits(t *testing.T) {
+	got, errs := parseHostLimits(" API.example.com=4, slow.example.com=1:0.5:2 ,, hooks.example.com=2:10")
+	want := map[string]RateLimit{
+		"api.example.com":   {MaxConcurrent: 4},
+		"slow.example.com":  {MaxConcurrent: 1, RequestsPerSecond: 0.5, Burst: 2},
+		"hooks.example.com": {MaxConcurrent: 2, RequestsPerSecond: 10},
+	}
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	for _, entry := range []string{"example.com", "=4", "a.example.com=x", "a.example.com=1:y", "a.example.com=1:2:z", "a.example.com=1:2:3:4", "a.example.com=-1"} {
+		got, errs := parseHostLimits(entry + ",ok.example.com=1")
+		if len(errs) != 1 {
+			t.Errorf("%q: got %d errors, want 1", entry, len(errs))
+		}
+		if _, ok := got["ok.example.com"]; !ok || len(got) != 1 {
+			t.Errorf("%q: valid entries should still parse, got %+v", entry, got)
+		}
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name    string
+		rate    float64
+		burst   float64
+		tokens  float64
+		after   time.Duration
+		want    time.Duration
+		tokens2 float64
+	}{
+		{"token available", 2, 2, 1, 0, 0, 1},
+		{"empty", 2, 2, 0, 0, 500 * time.Millisecond, 0},
+		{"partly refilled", 2, 2, 0, 250 * time.Millisecond, 250 * time.Millisecond, 0.5},
+		{"refilled", 2, 2, 0, 500 * time.Millisecond, 0, 1},
+		{"capped at burst", 2, 3, 0, time.Minute, 0, 3},
+		{"slow rate", 0.5, 1, 0, 0, 2 * time.Second, 0},
+	}
+	for _, tc := range cases {
+		b := &tokenBucket{rate: tc.rate, burst: tc.burst, tokens: tc.tokens, last: start}
+		if got := b.wait(start.Add(tc.after)); got != tc.want {
+			t.Errorf("%s: wait = %v, want %v", tc.name, got, tc.want)
+		}
+		if b.tokens != tc.tokens2 {
+			t.Errorf("%s: tokens = %v, want %v", tc.name, b.tokens, tc.tokens2)
+		}
+	}
+
+	// A clock going backwards doesn't refill or move last
+	b := &tokenBucket{rate: 1, burst: 1, tokens: 0, last: start}
+	if got := b.wait(start.Add(-time.Second)); got != time.Second || !b.last.Equal(start) {
+		t.Errorf("backwards clock: wait = %v, last = %v", got, b.last)
+	}
+}
+
+func TestAcquireConcurrency(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ls := newTestLimits(clock, 0, RateLimit{}, nil)
+	limit := &RateLimit{MaxConcurrent: 1}
+	ctx := context.Background()
+
+	release, wait, err := ls.acquire(ctx, "example.com", 1, limit)
+	if err != nil || release == nil || wait != 0 {
+		t.Fatalf("first acquire: release=%v wait=%v err=%v", release != nil, wait, err)
+	}
+	// Full, and no time to wait: put back for limitRetryDelay
+	release2, wait, err := ls.acquire(ctx, "example.com", 1, limit)
+	if err != nil || release2 != nil || wait != limitRetryDelay {
+		t.Fatalf("full acquire: release=%v wait=%v err=%v", release2 != nil, wait, err)
+	}
+	// Another webhook on the same host isn't held up
+	release3, _, _ := ls.acquire(ctx, "example.com", 2, limit)
+	if release3 == nil {
+		t.Fatal("other webhook should not share the limit")
+	}
+	release3()
+	release()
+	release, _, _ = ls.acquire(ctx, "example.com", 1, limit)
+	if release == nil {
+		t.Fatal("acquire after release should succeed")
+	}
+	release()
+
+	_, webhooks := ls.stats()
+	if s := webhooks[0]; s.Acquired != 2 || s.Deferred != 1 || s.Active != 0 || s.Waiting != 0 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestAcquireRate(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ls := newTestLimits(clock, 0, RateLimit{}, nil)
+	limit := &RateLimit{RequestsPerSecond: 2, Burst: 2}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		release, _, _ := ls.acquire(ctx, "example.com", 1, limit)
+		if release == nil {
+			t.Fatalf("acquire %d within burst should succeed", i)
+		}
+		release()
+	}
+	// The bucket refills in 500ms, but deferrals are never shorter than limitRetryDelay
+	release, wait, _ := ls.acquire(ctx, "example.com", 1, limit)
+	if release != nil || wait != limitRetryDelay {
+		t.Fatalf("empty bucket: release=%v wait=%v", release != nil, wait)
+	}
+	clock.advance(500 * time.Millisecond)
+	if release, _, _ = ls.acquire(ctx, "example.com", 1, limit); release == nil {
+		t.Fatal("refilled bucket should let one through")
+	}
+	release()
+
+	// A wait longer than the deadline allows is returned as is
+	slow := newTestLimits(clock, 5*time.Second, RateLimit{}, nil)
+	slowLimit := &RateLimit{RequestsPerSecond: 0.1, Burst: 1}
+	if release, _, _ = slow.acquire(ctx, "example.com", 1, slowLimit); release == nil {
+		t.Fatal("first request should use the burst")
+	}
+	release()
+	release, wait, _ = slow.acquire(ctx, "example.com", 1, slowLimit)
+	if release != nil || wait != 10*time.Second {
+		t.Fatalf("slow bucket: release=%v wait=%v, want 10s", release != nil, wait)
+	}
+}
+
+func TestAcquireHostLimits(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ls := newTestLimits(clock, 0, RateLimit{MaxConcurrent: 2}, map[string]RateLimit{"slow.example.com": {MaxConcurrent: 1}})
+	ctx := context.Background()
+
+	release, _, _ := ls.acquire(ctx, "SLOW.example.com", 1, nil)
+	if release == nil {
+		t.Fatal("first acquire should succeed")
+	}
+	// The override applies across webhooks and host case
+	if r, wait, _ := ls.acquire(ctx, "slow.example.com", 2, nil); r != nil || wait != limitRetryDelay {
+		t.Fatalf("override: release=%v wait=%v", r != nil, wait)
+	}
+	release()
+
+	var releases []func()
+	for i := uint64(1); i <= 2; i++ {
+		r, _, _ := ls.acquire(ctx, "fast.example.com", i, nil)
+		if r == nil {
+			t.Fatalf("default limit: acquire %d should succeed", i)
+		}
+		releases = append(releases, r)
+	}
+	if r, _, _ := ls.acquire(ctx, "fast.example.com", 3, nil); r != nil {
+		t.Fatal("default limit should be full")
+	}
+	for _, r := range releases {
+		r()
+	}
+}
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ls := newTestLimits(clock, time.Hour, RateLimit{}, nil)
+	limit := &RateLimit{MaxConcurrent: 1}
+	ctx := context.Background()
+
+	release, _, _ := ls.acquire(ctx, "example.com", 1, limit)
+	got := make(chan func())
+	go func() {
+		r, _, _ := ls.acquire(ctx, "example.com", 1, limit)
+		got <- r
+	}()
+	// Let the second worker start waiting before freeing the slot
+	for {
+		_, webhooks := ls.stats()
+		if webhooks[0].Waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	select {
+	case r := <-got:
+		if r == nil {
+			t.Fatal("waiting worker should get the freed slot")
+		}
+		r()
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting worker was not woken by release")
+	}
+}
+
+func TestAcquireCancelled(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ls := newTestLimits(clock, time.Hour, RateLimit{}, nil)
+	limit := &RateLimit{MaxConcurrent: 1}
+
+	release, _, _ := ls.acquire(context.Background(), "example.com", 1, limit)
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _, err := ls.acquire(ctx, "example.com", 1, limit)
+	if r != nil || err != context.Canceled {
+		t.Fatalf("release=%v err=%v, want context.Canceled", r != nil, err)
+	}
+	_, webhooks := ls.stats()
+	if s := webhooks[0]; s.Waiting != 0 || s.Deferred != 0 {
+		t.Errorf("cancelled waiter left stats %+v", s)
+	}
+}
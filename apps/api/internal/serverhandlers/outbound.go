@@ -0,0 +1,52 @@
+package serverhandlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/config"
+	"github.com/example/formrepo/apps/api/internal/outbound"
+)
+
+// outboundPolicy is the configured policy for calls made for purpose.
+func outboundPolicy(cfg *config.Config, purpose outbound.Purpose) outbound.Policy {
+	p := outbound.Policy{Purpose: purpose, AllowPrivate: cfg.OutboundAllowPrivate}
+	switch purpose {
+	case outbound.Webhooks:
+		p.AllowedHosts = outbound.ParseHosts(cfg.OutboundWebhookHosts)
+	case outbound.Purchase:
+		p.AllowedHosts = outbound.ParseHosts(cfg.OutboundPurchaseHosts)
+	case outbound.Catalog:
+		p.AllowedHosts = outbound.ParseHosts(cfg.OutboundCatalogHosts)
+	case outbound.Uploads:
+		p.AllowedHosts = outbound.ParseHosts(cfg.OutboundUploadHosts)
+	}
+	return p
+}
+
+// outboundClient returns a client for purpose with the webhook timeout. Build
+// it once per handler so connections are reused.
+func outboundClient(cfg *config.Config, purpose outbound.Purpose) *http.Client {
+	return outboundPolicy(cfg, purpose).Client(time.Duration(cfg.WebhookTimeout())*time.Millisecond, nil)
+}
+
+// webhookDestinationErrors checks a webhook's endpoint and token URL against
+// the webhook policy when saving it, so admins hear about a blocked host then
+// rather than from failed deliveries. Templated endpoints are only checked
+// when sent.
+func webhookDestinationErrors(cfg *config.Config, req webhookReq) []string {
+	p := outboundPolicy(cfg, outbound.Webhooks)
+	var errs []string
+	if req.Endpoint != "" && !strings.Contains(req.Endpoint, "{{") {
+		if err := p.CheckRawURL(req.Endpoint); err != nil {
+			errs = append(errs, "/endpoint_url: "+err.Error())
+		}
+	}
+	if req.Auth != nil && req.Auth.OAuth2 != nil && req.Auth.OAuth2.TokenURL != "" {
+		if err := p.CheckRawURL(req.Auth.OAuth2.TokenURL); err != nil {
+			errs = append(errs, "/auth/oauth2/token_url: "+err.Error())
+		}
+	}
+	return errs
+}
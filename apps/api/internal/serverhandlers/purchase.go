@@ -2,10 +2,18 @@ package serverhandlers
 
 import (
         "bytes"
+        "database/sql"
         "encoding/json"
+        "fmt"
         "io"
         "net/http"
+        "strconv"
+        "time"
 
+        "github.com/example/formrepo/apps/api/internal/config"
+        "github.com/example/formrepo/apps/api/internal/outbound"
+        "github.com/example/formrepo/apps/api/internal/secrets"
+        "github.com/example/formrepo/apps/api/internal/types"
         "github.com/gin-gonic/gin"
         "go.uber.org/zap"
 )
@@ -24,7 +32,11 @@ type PurchaseProxyRequest struct {
         PurchaseURL   string `json:"purchase_url"`
 }
 
-func PurchaseProxyHandler(log *zap.Logger) gin.HandlerFunc {
+// PurchaseProxyHandler forwards a purchase to purchase_url. The URL comes from
+// the request body, so only hosts the purchase policy allows are called.
+func PurchaseProxyHandler(cfg *config.Config, log *zap.Logger) gin.HandlerFunc {
+        policy := outboundPolicy(cfg, outbound.Purchase)
+        client := outboundClient(cfg, outbound.Purchase)
         return func(c *gin.Context) {
                 var req PurchaseProxyRequest
                 if err := c.ShouldBindJSON(&req); err != nil {
@@ -42,6 +54,10 @@ func PurchaseProxyHandler(log *zap.Logger) gin.HandlerFunc {
                         c.JSON(http.StatusBadRequest, gin.H{"error": "Purchase URL required"})
                         return
                 }
+                if err := policy.CheckRawURL(req.PurchaseURL); err != nil {
+                        destinationBlocked(c, log, err)
+                        return
+                }
 
                 payload := map[string]interface{}{
                         "items":          req.Items,
@@ -74,8 +90,11 @@ func PurchaseProxyHandler(log *zap.Logger) gin.HandlerFunc {
                 httpReq.Header.Set("Content-Type", "application/json")
                 httpReq.Header.Set("Accept", "application/json")
 
-                client := &http.Client{}
                 resp, err := client.Do(httpReq)
+                if outbound.IsBlocked(err) {
+                        destinationBlocked(c, log, err)
+                        return
+                }
                 if err != nil {
                         log.Error("purchase proxy: API call error", zap.Error(err))
                         c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to call purchase API: " + err.Error()})
@@ -111,7 +130,11 @@ type ItemVariantProxyRequest struct {
         VariantID string `json:"variant_id"`
 }
 
-func ItemVariantProxyHandler(log *zap.Logger) gin.HandlerFunc {
+// ItemVariantProxyHandler fetches an item variant from the catalog API at
+// base_url, which is checked against the catalog policy.
+func ItemVariantProxyHandler(cfg *config.Config, log *zap.Logger) gin.HandlerFunc {
+        policy := outboundPolicy(cfg, outbound.Catalog)
+        client := outboundClient(cfg, outbound.Catalog)
         return func(c *gin.Context) {
                 var req ItemVariantProxyRequest
                 if err := c.ShouldBindJSON(&req); err != nil {
@@ -136,6 +159,10 @@ func ItemVariantProxyHandler(log *zap.Logger) gin.HandlerFunc {
                         baseURL = "https://staging-services.q84sale.com/api/v1"
                 }
                 apiURL := baseURL + "/cashier/catalog/item_variants/" + req.VariantID
+                if err := policy.CheckRawURL(apiURL); err != nil {
+                        destinationBlocked(c, log, err)
+                        return
+                }
 
                 log.Info("item variant proxy: calling external API",
                         zap.String("url", apiURL),
@@ -152,8 +179,11 @@ func ItemVariantProxyHandler(log *zap.Logger) gin.HandlerFunc {
                 httpReq.Header.Set("Authorization", "Bearer "+req.AuthToken)
                 httpReq.Header.Set("Accept", "application/json")
 
-                client := &http.Client{}
                 resp, err := client.Do(httpReq)
+                if outbound.IsBlocked(err) {
+                        destinationBlocked(c, log, err)
+                        return
+                }
                 if err != nil {
                         log.Error("item variant proxy: API call error", zap.Error(err))
                         c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to call API: " + err.Error()})
@@ -182,3 +212,265 @@ func ItemVariantProxyHandler(log *zap.Logger) gin.HandlerFunc {
                 c.JSON(resp.StatusCode, result)
         }
 }
+
+// purchaseAuthConfig returns the purchase_authenticated action's config of a form version.
+func purchaseAuthConfig(db *sql.DB, formId string, version int) (*types.PurchaseAuthConfig, error) {
+        var submitRaw []byte
+        if err := db.QueryRow("SELECT submit_json FROM form_snapshots WHERE form_id=? AND version=?", formId, version).Scan(&submitRaw); err != nil {
+                return nil, err
+        }
+        var submit types.SubmitPipeline
+        _ = json.Unmarshal(submitRaw, &submit)
+        for _, a := range submit.Actions {
+                if a.Type == "purchase_authenticated" && a.PurchaseAuthConfig != nil {
+                        return a.PurchaseAuthConfig, nil
+                }
+        }
+        return nil, sql.ErrNoRows
+}
+
+// validatePurchaseSecrets checks that ${secret:name} references in purchase
+// configs point at existing secrets.
+func validatePurchaseSecrets(c *gin.Context, store *secrets.Store, submit *types.SubmitPipeline) []string {
+        if submit == nil {
+                return nil
+        }
+        errs := []string{}
+        check := func(path, v string) {
+                missing, err := store.Missing(c.Request.Context(), v)
+                if err != nil {
+                        errs = append(errs, path+": "+err.Error())
+                        return
+                }
+                for _, name := range missing {
+                        errs = append(errs, path+": unknown secret "+name)
+                }
+        }
+        for i, a := range submit.Actions {
+                pc := a.PurchaseAuthConfig
+                if pc == nil {
+                        continue
+                }
+                path := "/submit/actions/" + itoa(i) + "/purchase_auth_config"
+                check(path+"/device_id", pc.DeviceID)
+                check(path+"/app_signature", pc.AppSignature)
+                if pc.PrePurchaseWebhook != nil {
+                        check(path+"/pre_purchase_webhook/api_key", pc.PrePurchaseWebhook.APIKey)
+                }
+                for j, h := range additionalWebhooks(pc) {
+                        for k, v := range h.Headers {
+                                check(path+"/additional_webhooks/"+itoa(j)+"/headers/"+k, v)
+                        }
+                }
+        }
+        return errs
+}
+
+// purchaseConfigParams loads the purchase config for :formId/:version, writing
+// the error response itself when there isn't one.
+func purchaseConfigParams(c *gin.Context, db *sql.DB, log *zap.Logger) (*types.PurchaseAuthConfig, bool) {
+        formId := c.Param("formId")
+        version, err := strconv.Atoi(c.Param("version"))
+        if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+                return nil, false
+        }
+        pc, err := purchaseAuthConfig(db, formId, version)
+        if err == sql.ErrNoRows {
+                c.JSON(http.StatusNotFound, gin.H{"error": "purchase not configured"})
+                return nil, false
+        }
+        if err != nil {
+                log.Error("failed to load purchase config", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load form"})
+                return nil, false
+        }
+        return pc, true
+}
+
+type AuthLoginProxyRequest struct {
+        Phone    string `json:"phone"`
+        Password string `json:"password"`
+}
+
+// AuthLoginProxyHandler logs the user in against the form's auth API. The
+// device id comes from the private config and never reaches the browser.
+func AuthLoginProxyHandler(db *sql.DB, cfg *config.Config, store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+        client := outboundClient(cfg, outbound.Purchase)
+        return func(c *gin.Context) {
+                pc, ok := purchaseConfigParams(c, db, log)
+                if !ok {
+                        return
+                }
+                var req AuthLoginProxyRequest
+                if err := c.ShouldBindJSON(&req); err != nil || req.Phone == "" || req.Password == "" {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+                        return
+                }
+                if pc.AuthAPIBaseURL == "" {
+                        c.JSON(http.StatusNotFound, gin.H{"error": "auth not configured"})
+                        return
+                }
+                deviceId, err := store.Resolve(c.Request.Context(), pc.DeviceID)
+                if err != nil {
+                        log.Error("auth login proxy: failed to resolve device id", zap.Error(err))
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve device id"})
+                        return
+                }
+                if deviceId == "" {
+                        deviceId = fmt.Sprintf("web_%d", time.Now().UnixMilli())
+                }
+                versionNumber := pc.VersionNumber
+                if versionNumber == "" {
+                        versionNumber = "26.0.0"
+                }
+
+                jsonBody, _ := json.Marshal(req)
+                httpReq, err := http.NewRequestWithContext(c.Request.Context(), "POST", pc.AuthAPIBaseURL+"/users/auth/login", bytes.NewReader(jsonBody))
+                if err != nil {
+                        log.Error("auth login proxy: create request error", zap.Error(err))
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+                        return
+                }
+                httpReq.Header.Set("Accept", "application/json")
+                httpReq.Header.Set("Content-Type", "application/json")
+                httpReq.Header.Set("Accept-Language", "en")
+                httpReq.Header.Set("Version-Number", versionNumber)
+                httpReq.Header.Set("Device-Id", deviceId)
+
+                resp, err := client.Do(httpReq)
+                if outbound.IsBlocked(err) {
+                        destinationBlocked(c, log, err)
+                        return
+                }
+                if err != nil {
+                        log.Error("auth login proxy: API call error", zap.Error(err))
+                        c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to call auth API: " + err.Error()})
+                        return
+                }
+                defer resp.Body.Close()
+                body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+                c.Data(resp.StatusCode, "application/json", body)
+        }
+}
+
+// PurchaseWebhooksHandler calls the form's additional purchase webhooks with the
+// renderer's payload once a purchase succeeded. Header secrets are resolved here.
+func PurchaseWebhooksHandler(db *sql.DB, cfg *config.Config, store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+        client := outboundClient(cfg, outbound.Purchase)
+        return func(c *gin.Context) {
+                pc, ok := purchaseConfigParams(c, db, log)
+                if !ok {
+                        return
+                }
+                body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+                if err != nil || !json.Valid(body) {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+                        return
+                }
+
+                called, failed := 0, 0
+                for _, h := range additionalWebhooks(pc) {
+                        if h.URL == "" {
+                                continue
+                        }
+                        called++
+                        method := h.Method
+                        if method == "" {
+                                method = "POST"
+                        }
+                        httpReq, err := http.NewRequestWithContext(c.Request.Context(), method, h.URL, bytes.NewReader(body))
+                        if err != nil {
+                                log.Error("purchase webhook: create request error", zap.Error(err), zap.String("url", h.URL))
+                                failed++
+                                continue
+                        }
+                        httpReq.Header.Set("Content-Type", "application/json")
+                        for k, v := range h.Headers {
+                                httpReq.Header.Set(k, v)
+                        }
+                        if err := resolveRequestSecrets(c.Request.Context(), store, httpReq); err != nil {
+                                log.Error("purchase webhook: failed to resolve secrets", zap.Error(err), zap.String("url", h.URL))
+                                failed++
+                                continue
+                        }
+                        resp, err := client.Do(httpReq)
+                        if err != nil {
+                                log.Error("purchase webhook: call error", zap.Error(err), zap.String("url", h.URL))
+                                failed++
+                                continue
+                        }
+                        io.Copy(io.Discard, resp.Body)
+                        resp.Body.Close()
+                        if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+                                log.Warn("purchase webhook: non-2xx response", zap.String("url", h.URL), zap.Int("status", resp.StatusCode))
+                                failed++
+                                continue
+                        }
+                        log.Info("purchase webhook called", zap.String("url", h.URL), zap.Int("status", resp.StatusCode))
+                }
+                c.JSON(http.StatusOK, gin.H{"called": called, "failed": failed})
+        }
+}
+
+// PrePurchaseWebhookHandler forwards the renderer's pre-purchase payload to the
+// form's configured pre_purchase_webhook. The API key is resolved here, so a
+// ${secret:name} reference never reaches the browser as a value.
+func PrePurchaseWebhookHandler(db *sql.DB, cfg *config.Config, store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+        client := outboundClient(cfg, outbound.Purchase)
+        return func(c *gin.Context) {
+                pc, ok := purchaseConfigParams(c, db, log)
+                if !ok {
+                        return
+                }
+                if pc.PrePurchaseWebhook == nil || pc.PrePurchaseWebhook.URL == "" {
+                        c.JSON(http.StatusNotFound, gin.H{"error": "pre-purchase webhook not configured"})
+                        return
+                }
+                formId := c.Param("formId")
+
+                body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+                if err != nil || !json.Valid(body) {
+                        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+                        return
+                }
+                apiKey, err := store.Resolve(c.Request.Context(), pc.PrePurchaseWebhook.APIKey)
+                if err != nil {
+                        log.Error("pre-purchase: failed to resolve api key", zap.Error(err), zap.String("formId", formId))
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve api key"})
+                        return
+                }
+
+                httpReq, err := http.NewRequestWithContext(c.Request.Context(), "POST", pc.PrePurchaseWebhook.URL, bytes.NewReader(body))
+                if err != nil {
+                        log.Error("pre-purchase: create request error", zap.Error(err))
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+                        return
+                }
+                httpReq.Header.Set("Content-Type", "application/json")
+                httpReq.Header.Set("X-API-Key", apiKey)
+
+                resp, err := client.Do(httpReq)
+                if outbound.IsBlocked(err) {
+                        destinationBlocked(c, log, err)
+                        return
+                }
+                if err != nil {
+                        log.Error("pre-purchase: webhook call error", zap.Error(err))
+                        c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to call pre-purchase webhook: %v", err)})
+                        return
+                }
+                defer resp.Body.Close()
+                respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+                log.Info("pre-purchase: received response", zap.String("formId", formId), zap.Int("status", resp.StatusCode))
+                c.Data(resp.StatusCode, "application/json", respBody)
+        }
+}
+
+// destinationBlocked answers a proxy call whose destination the outbound
+// policy refused. The reason is logged, not returned.
+func destinationBlocked(c *gin.Context, log *zap.Logger, err error) {
+        log.Warn("outbound call blocked", zap.Error(err), zap.String("path", c.FullPath()))
+        c.JSON(http.StatusForbidden, gin.H{"error": "destination not allowed"})
+}
@@ -0,0 +1,139 @@
+package serverhandlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type redeliverReq struct {
+	WebhookID uint64 `json:"webhook_id,omitempty"`
+}
+
+type bulkRedeliverReq struct {
+	FormID    string `json:"formId"`
+	Version   int    `json:"version"`
+	From      int64  `json:"from"` // submitted_at lower bound (ms, inclusive)
+	To        int64  `json:"to"`   // submitted_at upper bound (ms, inclusive)
+	WebhookID uint64 `json:"webhook_id,omitempty"`
+}
+
+// redeliveryPayloadSQL rebuilds the submission body from the stored row, in the
+// same shape the renderer originally posted.
+const redeliveryPayloadSQL = `JSON_OBJECT('formId', s.form_id, 'version', s.version, 'submittedAt', s.submitted_at, 'answers', s.answers_json,
+	'meta', JSON_OBJECT('locale', s.locale, 'device', s.device, 'attributes', s.attributes_json))`
+
+// originalEventSQL selects a column of the first submission.created delivery
+// of submission s.
+func originalEventSQL(column string) string {
+	return `(SELECT o.` + column + ` FROM webhook_deliveries o WHERE o.submission_id=s.id AND o.event='submission.created' ORDER BY o.id LIMIT 1)`
+}
+
+// enqueueRedeliveries queues fresh outbox rows for every webhook that fires for
+// the matching submissions and subscribes to submission.created (optionally
+// just one webhook), other than digest webhooks, and resets their
+// webhook_status. Redeliveries keep the original event's id so receivers can
+// recognise them.
+func enqueueRedeliveries(db *sql.DB, where string, args []any, webhookId uint64) (int64, error) {
+	if webhookId != 0 {
+		where += " AND w.id=?"
+		args = append(args, webhookId)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	args = append([]any{eventSubmissionCreated}, args...)
+	res, err := tx.Exec(`INSERT INTO webhook_deliveries(submission_id,webhook_id,event_id,occurred_at,form_id,version,payload_json)
+		SELECT s.id, w.id, COALESCE(`+originalEventSQL("event_id")+`, UUID()), COALESCE(`+originalEventSQL("occurred_at")+`, s.created_at),
+			s.form_id, s.version, `+redeliveryPayloadSQL+`
+		FROM submissions s JOIN form_webhooks w ON `+webhookFiresSQL("s.form_id", "s.version")+` AND `+webhookSubscribedSQL+` AND w.digest_json IS NULL
+		WHERE `+where+` ORDER BY s.id, w.version, w.position, w.id`, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		_, err = tx.Exec(`UPDATE submissions s JOIN form_webhooks w ON `+webhookFiresSQL("s.form_id", "s.version")+` AND `+webhookSubscribedSQL+` AND w.digest_json IS NULL
+			SET s.webhook_status='pending' WHERE `+where, args...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+// RedeliverSubmissionHandler re-sends one submission to its webhooks.
+func RedeliverSubmissionHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid submission id"})
+			return
+		}
+		var req redeliverReq
+		if c.Request.ContentLength > 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+				return
+			}
+		}
+
+		var exists int
+		err = db.QueryRow("SELECT 1 FROM submissions WHERE id=?", id).Scan(&exists)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "submission not found"})
+			return
+		}
+		if err != nil {
+			log.Error("failed to query submission", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query submission"})
+			return
+		}
+
+		n, err := enqueueRedeliveries(db, "s.id=?", []any{id}, req.WebhookID)
+		if err != nil {
+			log.Error("failed to enqueue redelivery", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enqueue redelivery"})
+			return
+		}
+		disp.Notify()
+		log.Info("submission redelivery queued", zap.Uint64("id", id), zap.Uint64("webhookId", req.WebhookID), zap.Int64("queued", n))
+		c.JSON(http.StatusAccepted, gin.H{"queued": n})
+	}
+}
+
+// BulkRedeliverHandler re-sends every submission of a form version within a submitted_at range.
+func BulkRedeliverHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req bulkRedeliverReq
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+			return
+		}
+		if req.FormID == "" || req.Version <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "formId and version required"})
+			return
+		}
+		if req.From <= 0 || req.To <= 0 || req.To < req.From {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from/to range"})
+			return
+		}
+
+		n, err := enqueueRedeliveries(db, "s.form_id=? AND s.version=? AND s.submitted_at BETWEEN ? AND ?",
+			[]any{req.FormID, req.Version, req.From, req.To}, req.WebhookID)
+		if err != nil {
+			log.Error("failed to enqueue bulk redelivery", zap.Error(err), zap.String("formId", req.FormID), zap.Int("version", req.Version))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enqueue redelivery"})
+			return
+		}
+		disp.Notify()
+		log.Info("bulk redelivery queued", zap.String("formId", req.FormID), zap.Int("version", req.Version), zap.Int64("from", req.From), zap.Int64("to", req.To), zap.Int64("queued", n))
+		c.JSON(http.StatusAccepted, gin.H{"queued": n})
+	}
+}
@@ -0,0 +1,133 @@
+package serverhandlers
+
+import (
+    "fmt"
+    "math"
+    "math/rand"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/example/formrepo/apps/api/internal/config"
+)
+
+// RetryPolicy controls how failed deliveries of a webhook are rescheduled.
+// Zero values fall back to the server defaults (see defaultRetryPolicy).
+type RetryPolicy struct {
+    MaxAttempts       int      `json:"max_attempts,omitempty"`
+    BackoffBaseMs     int      `json:"backoff_base_ms,omitempty"`
+    BackoffMaxMs      int      `json:"backoff_max_ms,omitempty"`
+    Jitter            *float64 `json:"jitter,omitempty"`          // 0..1, fraction of the delay randomised
+    RetryOnStatus     []int    `json:"retry_on_status,omitempty"` // empty = 408, 425, 429 and 5xx
+    RespectRetryAfter *bool    `json:"respect_retry_after,omitempty"`
+}
+
+const (
+    defaultBackoffMaxMs = 60 * 60 * 1000 // 1h
+    defaultJitter       = 0.2
+    // maxRetryAfter caps how far a Retry-After header can push the next attempt.
+    maxRetryAfter = 24 * time.Hour
+)
+
+// defaultRetryPolicy derives the policy used when a webhook doesn't set one.
+func defaultRetryPolicy(cfg *config.Config) RetryPolicy {
+    respect, jitter := true, defaultJitter
+    return RetryPolicy{
+        MaxAttempts:       cfg.WebhookMaxRetries + 1,
+        BackoffBaseMs:     cfg.WebhookRetryBackoffMs,
+        BackoffMaxMs:      defaultBackoffMaxMs,
+        Jitter:            &jitter,
+        RespectRetryAfter: &respect,
+    }
+}
+
+// withDefaults fills unset fields from the server defaults.
+func (p *RetryPolicy) withDefaults(cfg *config.Config) RetryPolicy {
+    d := defaultRetryPolicy(cfg)
+    if p == nil {
+        return d
+    }
+    out := *p
+    if out.MaxAttempts <= 0 { out.MaxAttempts = d.MaxAttempts }
+    if out.BackoffBaseMs <= 0 { out.BackoffBaseMs = d.BackoffBaseMs }
+    if out.BackoffMaxMs <= 0 { out.BackoffMaxMs = d.BackoffMaxMs }
+    if out.Jitter == nil { out.Jitter = d.Jitter }
+    if out.RespectRetryAfter == nil { out.RespectRetryAfter = d.RespectRetryAfter }
+    return out
+}
+
+// validate returns admin-facing errors for an explicitly configured policy.
+func (p *RetryPolicy) validate() []string {
+    if p == nil {
+        return nil
+    }
+    errs := []string{}
+    if p.MaxAttempts < 0 || p.MaxAttempts > 50 {
+        errs = append(errs, "/retry_policy/max_attempts: must be between 0 (default) and 50")
+    }
+    if p.BackoffBaseMs < 0 {
+        errs = append(errs, "/retry_policy/backoff_base_ms: must be positive")
+    }
+    if p.BackoffMaxMs < 0 || (p.BackoffMaxMs > 0 && p.BackoffMaxMs < p.BackoffBaseMs) {
+        errs = append(errs, "/retry_policy/backoff_max_ms: must be >= backoff_base_ms")
+    }
+    if p.Jitter != nil && (*p.Jitter < 0 || *p.Jitter > 1) {
+        errs = append(errs, "/retry_policy/jitter: must be between 0 and 1")
+    }
+    for i, code := range p.RetryOnStatus {
+        if code < 100 || code > 599 {
+            errs = append(errs, fmt.Sprintf("/retry_policy/retry_on_status/%d: invalid status code", i))
+        }
+    }
+    return errs
+}
+
+// shouldRetry reports whether a failed attempt is worth retrying.
+// Transport errors (status 0) are always retried.
+func (p RetryPolicy) shouldRetry(status int) bool {
+    if status == 0 {
+        return true
+    }
+    if len(p.RetryOnStatus) == 0 {
+        return status == http.StatusRequestTimeout || status == http.StatusTooEarly || status == http.StatusTooManyRequests || status >= 500
+    }
+    for _, s := range p.RetryOnStatus {
+        if s == status {
+            return true
+        }
+    }
+    return false
+}
+
+// backoff returns the delay before the next attempt after `attempt` attempts.
+// The delay doubles each attempt up to BackoffMaxMs, with +/- Jitter randomisation.
+// A Retry-After hint wins when it asks for a longer wait.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+    exp := float64(p.BackoffBaseMs) * math.Pow(2, float64(attempt-1))
+    delay := time.Duration(math.Min(exp, float64(p.BackoffMaxMs))) * time.Millisecond
+    if p.Jitter != nil && *p.Jitter > 0 {
+        spread := float64(delay) * *p.Jitter
+        delay = time.Duration(float64(delay) - spread + rand.Float64()*2*spread)
+    }
+    if p.RespectRetryAfter != nil && *p.RespectRetryAfter && retryAfter > delay {
+        delay = retryAfter
+        if delay > maxRetryAfter {
+            delay = maxRetryAfter
+        }
+    }
+    return delay
+}
+
+// parseRetryAfter understands both delta-seconds and HTTP-date forms.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+    if v == "" {
+        return 0
+    }
+    if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+        return time.Duration(secs) * time.Second
+    }
+    if t, err := http.ParseTime(v); err == nil && t.After(now) {
+        return t.Sub(now)
+    }
+    return 0
+}
@@ -0,0 +1,244 @@
+package serverhandlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/example/formrepo/apps/api/internal/secrets"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type secretReq struct {
+	Name        string  `json:"name"`
+	Value       string  `json:"value"`
+	Description *string `json:"description,omitempty"`
+}
+
+// resolveRequestSecrets replaces ${secret:name} references in the request's
+// header values. It runs right before sending so plaintext never leaves the
+// request itself: not the attempt log, not the dead-letter store.
+func resolveRequestSecrets(ctx context.Context, store *secrets.Store, req *http.Request) error {
+	for k, vs := range req.Header {
+		for i, v := range vs {
+			resolved, err := store.Resolve(ctx, v)
+			if err != nil {
+				return err
+			}
+			req.Header[k][i] = resolved
+		}
+	}
+	return nil
+}
+
+// sensitiveHeader guesses whether a header carries a credential.
+func sensitiveHeader(name string) bool {
+	n := strings.ToLower(name)
+	for _, s := range []string{"auth", "token", "key", "secret", "password", "cookie", "signature"} {
+		if strings.Contains(n, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskHeaders hides plaintext credentials in admin reads. Secret references
+// are shown as-is since they carry no value.
+func maskHeaders(h map[string]string) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if sensitiveHeader(k) && !secrets.HasReference(v) {
+			v = secrets.Mask(v)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// unmaskHeaders puts back stored values for headers the admin UI echoed in
+// masked form, so saving a webhook doesn't overwrite credentials with asterisks.
+func unmaskHeaders(h, stored map[string]string) {
+	for k, v := range h {
+		if old, ok := stored[k]; ok && sensitiveHeader(k) && !secrets.HasReference(old) && v == secrets.Mask(old) {
+			h[k] = old
+		}
+	}
+}
+
+// checkHeaderSecrets rejects headers that reference secrets which don't exist.
+func checkHeaderSecrets(c *gin.Context, store *secrets.Store, log *zap.Logger, headers map[string]string) bool {
+	values := make([]string, 0, len(headers))
+	for _, v := range headers {
+		values = append(values, v)
+	}
+	return checkSecretReferences(c, store, log, "/headers", values)
+}
+
+// checkSecretReferences rejects values that reference secrets which don't
+// exist, reporting them under the setting at.
+func checkSecretReferences(c *gin.Context, store *secrets.Store, log *zap.Logger, at string, values []string) bool {
+	missing, err := store.Missing(c.Request.Context(), values...)
+	if err != nil {
+		secretStoreError(c, log, err, "failed to check secrets")
+		return false
+	}
+	if len(missing) > 0 {
+		details := make([]string, len(missing))
+		for i, name := range missing {
+			details[i] = at + ": unknown secret " + name
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown secret", "details": details})
+		return false
+	}
+	return true
+}
+
+func secretStoreError(c *gin.Context, log *zap.Logger, err error, msg string) {
+	switch {
+	case errors.Is(err, secrets.ErrDisabled):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "secret store disabled"})
+	case errors.Is(err, secrets.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "secret not found"})
+	default:
+		log.Error(msg, zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+	}
+}
+
+func ListSecretsHandler(store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out, err := store.List(c.Request.Context())
+		if err != nil {
+			secretStoreError(c, log, err, "failed to list secrets")
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func GetSecretHandler(store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m, err := store.Describe(c.Request.Context(), c.Param("name"))
+		if err != nil {
+			secretStoreError(c, log, err, "failed to query secret")
+			return
+		}
+		c.JSON(http.StatusOK, m)
+	}
+}
+
+// CreateSecretHandler adds a new secret; existing names are rejected with 409.
+func CreateSecretHandler(store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req secretReq
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+			return
+		}
+		if !secrets.ValidName(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid name", "details": []string{"/name: letters, digits, '_', '-' and '.' only"}})
+			return
+		}
+		if req.Value == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "value required"})
+			return
+		}
+		ctx := c.Request.Context()
+		if _, err := store.Describe(ctx, req.Name); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "secret already exists"})
+			return
+		} else if !errors.Is(err, secrets.ErrNotFound) {
+			secretStoreError(c, log, err, "failed to create secret")
+			return
+		}
+		if _, err := store.Put(ctx, req.Name, req.Value, req.Description); err != nil {
+			secretStoreError(c, log, err, "failed to create secret")
+			return
+		}
+		m, err := store.Describe(ctx, req.Name)
+		if err != nil {
+			secretStoreError(c, log, err, "failed to query secret")
+			return
+		}
+		log.Info("secret created", zap.String("name", req.Name))
+		c.JSON(http.StatusCreated, m)
+	}
+}
+
+// PutSecretHandler creates or replaces the value of :name.
+func PutSecretHandler(store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		if !secrets.ValidName(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+			return
+		}
+		var req secretReq
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+			return
+		}
+		if req.Value == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "value required"})
+			return
+		}
+		ctx := c.Request.Context()
+		created, err := store.Put(ctx, name, req.Value, req.Description)
+		if err != nil {
+			secretStoreError(c, log, err, "failed to save secret")
+			return
+		}
+		m, err := store.Describe(ctx, name)
+		if err != nil {
+			secretStoreError(c, log, err, "failed to query secret")
+			return
+		}
+		log.Info("secret saved", zap.String("name", name), zap.Bool("created", created))
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		c.JSON(status, m)
+	}
+}
+
+// DeleteSecretHandler removes a secret. Secrets still referenced by a webhook
+// or a form's submit config are kept unless ?force=true.
+func DeleteSecretHandler(db *sql.DB, store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		if c.Query("force") != "true" {
+			// LOCATE rather than LIKE: names may contain _, a LIKE wildcard
+			ref := "${secret:" + name + "}"
+			var webhooks, forms int
+			if err := db.QueryRow("SELECT COUNT(*) FROM form_webhooks WHERE LOCATE(?, headers_json) > 0 OR LOCATE(?, auth_json) > 0", ref, ref).Scan(&webhooks); err != nil {
+				log.Error("failed to check secret usage", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check secret usage"})
+				return
+			}
+			if err := db.QueryRow("SELECT COUNT(*) FROM form_snapshots WHERE LOCATE(?, submit_json) > 0", ref).Scan(&forms); err != nil {
+				log.Error("failed to check secret usage", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check secret usage"})
+				return
+			}
+			if webhooks+forms > 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": "secret in use", "webhooks": webhooks, "forms": forms})
+				return
+			}
+		}
+		found, err := store.Delete(c.Request.Context(), name)
+		if err != nil {
+			secretStoreError(c, log, err, "failed to delete secret")
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "secret not found"})
+			return
+		}
+		log.Info("secret deleted", zap.String("name", name))
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -2,10 +2,8 @@ package serverhandlers
 
 import (
     "bytes"
-    "crypto/hmac"
-    "crypto/sha256"
+    "context"
     "database/sql"
-    "encoding/hex"
     "encoding/json"
     "fmt"
     "io"
@@ -13,7 +11,6 @@ import (
     "strconv"
     "strings"
     "time"
-    "text/template"
 
     "github.com/example/formrepo/apps/api/internal/config"
     "github.com/example/formrepo/apps/api/internal/types"
@@ -30,7 +27,7 @@ type submissionReq struct {
     BridgeAck   bool           `json:"bridgeAck"`
 }
 
-func SubmitHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.HandlerFunc {
+func SubmitHandler(db *sql.DB, cfg *config.Config, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         var req submissionReq
         raw, _ := io.ReadAll(c.Request.Body)
@@ -59,6 +56,8 @@ func SubmitHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.HandlerF
         }
         var submitCfg map[string]any
         _ = json.Unmarshal(submitRaw, &submitCfg)
+        var pipeline types.SubmitPipeline
+        _ = json.Unmarshal(submitRaw, &pipeline)
 
         var idemKey string
         if idemp, ok := submitCfg["idempotency"].(map[string]any); ok {
@@ -79,10 +78,19 @@ func SubmitHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.HandlerF
         locale, _ := req.Meta["locale"].(string)
         device, _ := req.Meta["device"].(string)
 
+        // Submission and its webhook deliveries are written atomically
+        tx, err := db.Begin()
+        if err != nil {
+            log.Error("begin submission tx", zap.Error(err))
+            c.JSON(http.StatusInternalServerError, gin.H{"error":"db error"})
+            return
+        }
+
         // Attempt insert
-        res, err := db.Exec(`INSERT INTO submissions(form_id,version,submitted_at,locale,device,answers_json,attributes_json,idempotency_key,webhook_status) VALUES(?,?,?,?,?,?,?,?, 'pending')`,
+        res, err := tx.Exec(`INSERT INTO submissions(form_id,version,submitted_at,locale,device,answers_json,attributes_json,idempotency_key,webhook_status) VALUES(?,?,?,?,?,?,?,?, 'pending')`,
             req.FormID, req.Version, req.SubmittedAt, locale, device, string(answersJSON), string(attrsJSON), nullIfEmpty(idemKey))
         if err != nil {
+            _ = tx.Rollback()
             // Unique constraint hit -> fetch existing
             row := db.QueryRow("SELECT id, webhook_status FROM submissions WHERE form_id=? AND version=? AND idempotency_key=?", req.FormID, req.Version, idemKey)
             var id uint64; var ws string
@@ -90,12 +98,26 @@ func SubmitHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.HandlerF
                 c.JSON(http.StatusOK, gin.H{"id": id, "webhook_status": ws, "idempotent": true})
                 return
             }
+            log.Error("insert submission", zap.Error(err))
+            c.JSON(http.StatusInternalServerError, gin.H{"error":"insert failed"})
+            return
         }
 
-        // Enqueue webhooks (fire-and-forget)
+        // Enqueue webhooks in the outbox; the dispatcher delivers them
         var insertedID uint64
         if rid, _ := res.LastInsertId(); rid > 0 { insertedID = uint64(rid) }
-        go dispatchWebhooks(db, cfg, log, req.FormID, req.Version, insertedID, raw)
+        if _, err := enqueueWebhookDeliveries(tx, req.FormID, req.Version, insertedID, raw, emailActionOf(&pipeline)); err != nil {
+            _ = tx.Rollback()
+            log.Error("enqueue webhook deliveries", zap.Error(err), zap.Uint64("submissionId", insertedID))
+            c.JSON(http.StatusInternalServerError, gin.H{"error":"insert failed"})
+            return
+        }
+        if err := tx.Commit(); err != nil {
+            log.Error("commit submission tx", zap.Error(err))
+            c.JSON(http.StatusInternalServerError, gin.H{"error":"insert failed"})
+            return
+        }
+        disp.Notify()
 
         c.JSON(http.StatusOK, gin.H{"ok": true, "id": insertedID, "submissionId": insertedID})
     }
@@ -216,32 +238,126 @@ func transformAnswersToArray(answers map[string]any, fieldLabels map[string]stri
     return result
 }
 
-func dispatchWebhooks(db *sql.DB, cfg *config.Config, log *zap.Logger, formId string, version int, submissionId uint64, body []byte) {
-    // Fetch form fields to get labels
-    var fieldsJSON []byte
-    err := db.QueryRow("SELECT fields_json FROM form_snapshots WHERE form_id=? AND version=?", formId, version).Scan(&fieldsJSON)
+
+// webhookRow is a form_webhooks row as used by the dispatcher.
+type webhookRow struct {
+    ID              uint64
+    FormID          string
+    Version         int  // for form-level webhooks, the submission's version once loaded for one
+    FormLevel       bool // fires for every version of the form
+    Type            string
+    URL             string
+    Method          string
+    ContentType     string
+    Headers         map[string]string
+    Auth            *WebhookAuth
+    QueryParams     map[string]string
+    BodyTemplate    *string
+    Mapping         json.RawMessage // mapping_json, for mode "mapping"
+    SelectedFields  []string
+    RetryPolicy     *RetryPolicy
+    RateLimit       *RateLimit
+    Filter          *string
+    Mode            string
+    Enabled         bool
+    DisabledReason  *string // set when the webhook was switched off automatically
+    Position        int
+    DependsOn       []uint64            // webhooks that must succeed first
+    ResponseExtract map[string]string   // name -> path into the JSON response
+    ExternalRefs    map[string]string   // name -> path, stored on the submission
+    Digest          *types.DigestConfig // batches submissions instead of a delivery each
+    Secrets         [][]byte            // active signing secrets, newest first
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+    QueryRow(query string, args ...any) *sql.Row
+}
+
+func loadWebhook(q queryRower, id uint64) (*webhookRow, error) {
+    wh := &webhookRow{ID: id}
+    var headersRaw, authRaw, queryRaw, selectedFieldsRaw, retryRaw, rateRaw, dependsRaw, extractRaw, refsRaw, digestRaw []byte
+    err := q.QueryRow("SELECT form_id,version,type,endpoint_url,http_method,content_type,headers_json,auth_json,query_params_json,body_template,mapping_json,selected_fields_json,retry_policy_json,rate_limit_json,filter_expr,mode,enabled,disabled_reason,position,depends_on_json,response_extract_json,external_refs_json,digest_json FROM form_webhooks WHERE id=?", id).
+        Scan(&wh.FormID, &wh.Version, &wh.Type, &wh.URL, &wh.Method, &wh.ContentType, &headersRaw, &authRaw, &queryRaw, &wh.BodyTemplate, &wh.Mapping, &selectedFieldsRaw, &retryRaw, &rateRaw, &wh.Filter, &wh.Mode, &wh.Enabled, &wh.DisabledReason, &wh.Position, &dependsRaw, &extractRaw, &refsRaw, &digestRaw)
     if err != nil {
-        log.Error("failed to fetch form fields", zap.Error(err))
-        return
+        return nil, err
     }
-    
-    var fields []types.Field
-    _ = json.Unmarshal(fieldsJSON, &fields)
-    
-    // Parse base submission data
-    var base map[string]any
-    _ = json.Unmarshal(body, &base)
-    allAnswers, _ := base["answers"].(map[string]any)
-    
-    // Get locale from meta
-    locale := "en" // default
-    if meta, ok := base["meta"].(map[string]any); ok {
-        if loc, ok := meta["locale"].(string); ok {
-            locale = loc
+    wh.FormLevel = wh.Version == formLevelVersion
+    _ = json.Unmarshal(headersRaw, &wh.Headers)
+    if len(authRaw) > 0 {
+        _ = json.Unmarshal(authRaw, &wh.Auth)
+    }
+    if len(queryRaw) > 0 {
+        _ = json.Unmarshal(queryRaw, &wh.QueryParams)
+    }
+    if len(selectedFieldsRaw) > 0 {
+        _ = json.Unmarshal(selectedFieldsRaw, &wh.SelectedFields)
+    }
+    if len(retryRaw) > 0 {
+        _ = json.Unmarshal(retryRaw, &wh.RetryPolicy)
+    }
+    if len(rateRaw) > 0 {
+        _ = json.Unmarshal(rateRaw, &wh.RateLimit)
+    }
+    if len(dependsRaw) > 0 {
+        _ = json.Unmarshal(dependsRaw, &wh.DependsOn)
+    }
+    if len(extractRaw) > 0 {
+        _ = json.Unmarshal(extractRaw, &wh.ResponseExtract)
+    }
+    if len(refsRaw) > 0 {
+        _ = json.Unmarshal(refsRaw, &wh.ExternalRefs)
+    }
+    if len(digestRaw) > 0 {
+        _ = json.Unmarshal(digestRaw, &wh.Digest)
+    }
+    if wh.Method == "" { wh.Method = "POST" }
+    if wh.ContentType == "" { wh.ContentType = "application/json" }
+    if wh.Secrets, err = activeWebhookSecrets(q, id); err != nil {
+        return nil, err
+    }
+    return wh, nil
+}
+
+// enqueueWebhookDeliveries writes one outbox row per enabled webhook that fires
+// for the form version and subscribes to submission.created, form-level ones
+// first and each in position order, plus one for the email action when the
+// form has it enabled. Webhooks and email actions that send digests record
+// the submission for their next digest instead; webhook_status only follows
+// the deliveries made per submission.
+// It must run in the same transaction as the submission insert so a committed
+// submission always has its deliveries recorded.
+func enqueueWebhookDeliveries(tx *sql.Tx, formId string, version int, submissionId uint64, body []byte, email *types.EmailActionConfig) (int64, error) {
+    eventId := generateUUID()
+    res, err := tx.Exec(`INSERT INTO webhook_deliveries(submission_id,webhook_id,event_id,occurred_at,form_id,version,payload_json)
+        SELECT ?, w.id, ?, NOW(3), w.form_id, ?, ? FROM form_webhooks w WHERE `+webhookFiresSQL("?", "?")+` AND `+webhookSubscribedSQL+`
+        AND w.digest_json IS NULL ORDER BY w.version, w.position, w.id`,
+        submissionId, eventId, version, string(body), formId, version, version, eventSubmissionCreated)
+    if err != nil {
+        return 0, err
+    }
+    n, _ := res.RowsAffected()
+    if err := enqueueDigestItems(tx, formId, version, submissionId, email != nil && email.Digest != nil); err != nil {
+        return 0, err
+    }
+    if email != nil && email.Digest == nil {
+        if _, err := tx.Exec(`INSERT INTO webhook_deliveries(submission_id,webhook_id,channel,event_id,occurred_at,form_id,version,payload_json) VALUES(?,0,'email',?,NOW(3),?,?,?)`,
+            submissionId, eventId, formId, version, string(body)); err != nil {
+            return 0, err
         }
+        n++
     }
-    
-    // Create map of field name -> label (for current locale)
+    if n == 0 {
+        // Nothing to deliver
+        if _, err := tx.Exec("UPDATE submissions SET webhook_status='success' WHERE id=?", submissionId); err != nil {
+            return 0, err
+        }
+    }
+    return n, nil
+}
+
+// fieldLabelsFor maps field name -> label for the locale, falling back to English.
+func fieldLabelsFor(fields []types.Field, locale string) map[string]string {
     fieldLabels := make(map[string]string)
     for _, field := range fields {
         if field.Label != nil {
@@ -252,168 +368,228 @@ func dispatchWebhooks(db *sql.DB, cfg *config.Config, log *zap.Logger, formId st
             }
         }
     }
-    
-    rows, err := db.Query("SELECT id,type,endpoint_url,http_method,content_type,headers_json,body_template,selected_fields_json,mode,enabled FROM form_webhooks WHERE form_id=? AND version=? AND enabled=1", formId, version)
-    if err != nil { log.Error("webhooks query", zap.Error(err)); return }
-    defer rows.Close()
-    allOk := true
-    for rows.Next() {
-        var id uint64; var typ, url, method, contentType, mode string; var headersRaw []byte; var enabled bool; var bodyTpl *string; var selectedFieldsRaw []byte
-        _ = rows.Scan(&id, &typ, &url, &method, &contentType, &headersRaw, &bodyTpl, &selectedFieldsRaw, &mode, &enabled)
-        var headers map[string]string
-        _ = json.Unmarshal(headersRaw, &headers)
-        if method == "" { method = "POST" }
-        if contentType == "" { contentType = "application/json" }
-
-        // Parse selected fields
-        var selectedFields []string
-        if len(selectedFieldsRaw) > 0 {
-            _ = json.Unmarshal(selectedFieldsRaw, &selectedFields)
-        }
-
-        // Filter answers based on selected fields
-        selectedAnswers := make(map[string]any)
-        if len(selectedFields) > 0 {
-            // Only include selected fields
-            for _, field := range selectedFields {
-                if val, ok := allAnswers[field]; ok {
-                    selectedAnswers[field] = val
-                }
-            }
-        } else {
-            // If no fields selected, use all answers
-            selectedAnswers = allAnswers
-        }
-
-        // Build body: template if provided else use default array format
-        bodyToSend := body
-        if bodyTpl != nil && *bodyTpl != "" {
-            // Build template context with individual fields as top-level variables
-            ctx := map[string]any{
-                "formId": formId,
-                "version": version,
-                "submissionId": submissionId,
-                "submittedAt": base["submittedAt"],
-                "meta": base["meta"],
-                "locale": locale,
-                "device": "",
-                "sessionId": "",
-                // Individual fields as top-level variables (from selected)
-                "selected": selectedAnswers,
-                // Backward compatible - all answers
-                "answers": allAnswers,
-                // Field labels for template use
-                "fieldLabels": fieldLabels,
-            }
-            // Extract device and sessionId from meta
-            if meta, ok := base["meta"].(map[string]any); ok {
-                if d, ok := meta["device"].(string); ok {
-                    ctx["device"] = d
-                }
-                if s, ok := meta["sessionId"].(string); ok {
-                    ctx["sessionId"] = s
+    return fieldLabels
+}
+
+// webhookTemplateContext builds what body, URL and header templates see for a
+// submission. It parses the body itself since it rewrites "other" answers in place.
+func webhookTemplateContext(wh *webhookRow, fields []types.Field, submissionId uint64, body []byte) (map[string]any, string) {
+    var base map[string]any
+    _ = json.Unmarshal(body, &base)
+    allAnswers, _ := base["answers"].(map[string]any)
+
+    // Get locale from meta
+    locale := "en" // default
+    if meta, ok := base["meta"].(map[string]any); ok {
+        if loc, ok := meta["locale"].(string); ok {
+            locale = loc
+        }
+    }
+    selectedAnswers := selectAnswers(wh, allAnswers)
+    // Values extracted from dependencies keep their exact numbers: they're usually IDs
+    if _, ok := base["responses"]; ok {
+        var exact struct{ Responses map[string]any `json:"responses"` }
+        dec := json.NewDecoder(bytes.NewReader(body))
+        dec.UseNumber()
+        if dec.Decode(&exact) == nil {
+            base["responses"] = exact.Responses
+        }
+    }
+
+    // Build template context with individual fields as top-level variables
+    ctx := map[string]any{
+        "event": base["event"],
+        "eventId": base["id"],
+        "occurredAt": base["occurredAt"],
+        "formId": wh.FormID,
+        "version": wh.Version,
+        "submissionId": submissionId,
+        "submittedAt": base["submittedAt"],
+        "meta": base["meta"],
+        "locale": locale,
+        "device": "",
+        "sessionId": "",
+        // Individual fields as top-level variables (from selected)
+        "selected": selectedAnswers,
+        // Backward compatible - all answers
+        "answers": allAnswers,
+        // Field labels for template use
+        "fieldLabels": fieldLabelsFor(fields, locale),
+    }
+    // Extract device and sessionId from meta
+    if meta, ok := base["meta"].(map[string]any); ok {
+        if d, ok := meta["device"].(string); ok {
+            ctx["device"] = d
+        }
+        if s, ok := meta["sessionId"].(string); ok {
+            ctx["sessionId"] = s
+        }
+    }
+    // Add each selected field as a top-level variable
+    for field, value := range selectedAnswers {
+        // Transform "other" values to show the custom text in .value
+        if valMap, ok := value.(map[string]any); ok {
+            if v, _ := valMap["value"].(string); v == "other" {
+                if otherText, ok := valMap["other"].(string); ok && otherText != "" {
+                    // Replace .value with the "other" text for easier template access
+                    valMap["value"] = otherText
                 }
             }
-            // Add each selected field as a top-level variable
-            for field, value := range selectedAnswers {
-                // Transform "other" values to show the custom text in .value
-                if valMap, ok := value.(map[string]any); ok {
-                    if v, _ := valMap["value"].(string); v == "other" {
-                        if otherText, ok := valMap["other"].(string); ok && otherText != "" {
-                            // Replace .value with the "other" text for easier template access
-                            valMap["value"] = otherText
+        } else if valArr, ok := value.([]any); ok {
+            // Handle multiselect arrays - transform "other" items
+            for _, item := range valArr {
+                if itemMap, ok := item.(map[string]any); ok {
+                    if v, _ := itemMap["value"].(string); v == "other" {
+                        if otherText, ok := itemMap["other"].(string); ok && otherText != "" {
+                            itemMap["value"] = otherText
                         }
                     }
-                } else if valArr, ok := value.([]any); ok {
-                    // Handle multiselect arrays - transform "other" items
-                    for _, item := range valArr {
-                        if itemMap, ok := item.(map[string]any); ok {
-                            if v, _ := itemMap["value"].(string); v == "other" {
-                                if otherText, ok := itemMap["other"].(string); ok && otherText != "" {
-                                    itemMap["value"] = otherText
-                                }
-                            }
-                        }
-                    }
-                }
-                ctx[field] = value
-            }
-            // Include all fields from base (for backward compatibility)
-            for k, v := range base {
-                if _, exists := ctx[k]; !exists {
-                    ctx[k] = v
-                }
-            }
-            funcMap := template.FuncMap{
-                "json": func(v any) string { b, _ := json.Marshal(v); return string(b) },
-                "formatAnswer": func(v any) string { return formatAnswer(v, locale) },
-            }
-            if t, err := template.New("wh").Funcs(funcMap).Parse(*bodyTpl); err == nil {
-                var buf bytes.Buffer
-                if execErr := t.Execute(&buf, ctx); execErr == nil {
-                    bodyToSend = buf.Bytes()
-                }
-            }
-        } else {
-            // No template: use default array format
-            transformedAnswers := transformAnswersToArray(selectedAnswers, fieldLabels, locale)
-            
-            // Build default payload structure
-            payload := map[string]any{
-                "submissionId": submissionId,
-                "formId":       formId,
-                "version":      version,
-                "submittedAt":  base["submittedAt"],
-                "locale":       locale,
-                "answers":      transformedAnswers,
-            }
-            
-            // Add device and sessionId from meta if available
-            if meta, ok := base["meta"].(map[string]any); ok {
-                if device, ok := meta["device"].(string); ok {
-                    payload["device"] = device
-                }
-                if sessionId, ok := meta["sessionId"].(string); ok && sessionId != "" {
-                    payload["sessionId"] = sessionId
                 }
             }
-            
-            bodyToSend, _ = json.Marshal(payload)
         }
+        ctx[field] = value
+    }
+    // Include all fields from base (for backward compatibility)
+    for k, v := range base {
+        if _, exists := ctx[k]; !exists {
+            ctx[k] = v
+        }
+    }
+    return ctx, locale
+}
+
+// selectAnswers filters answers down to the webhook's selected fields, if any.
+func selectAnswers(wh *webhookRow, allAnswers map[string]any) map[string]any {
+    if len(wh.SelectedFields) == 0 {
+        // If no fields selected, use all answers
+        return allAnswers
+    }
+    selectedAnswers := make(map[string]any)
+    for _, field := range wh.SelectedFields {
+        if val, ok := allAnswers[field]; ok {
+            selectedAnswers[field] = val
+        }
+    }
+    return selectedAnswers
+}
 
-        // HMAC header
-        mac := hmac.New(sha256.New, []byte(cfg.WebhookSigningKey))
-        mac.Write(bodyToSend)
-        sig := hex.EncodeToString(mac.Sum(nil))
+// renderWebhookBody builds the request body for one webhook from the original submission body.
+// Template errors are returned rather than papered over: sending the raw
+// submission to an endpoint expecting a different shape helps nobody.
+func renderWebhookBody(wh *webhookRow, fields []types.Field, submissionId uint64, body []byte) ([]byte, error) {
+    if usesBodyTemplate(wh) {
+        ctx, locale := webhookTemplateContext(wh, fields, submissionId, body)
+        t, err := parseWebhookTemplate(*wh.BodyTemplate, fields, locale)
+        if err != nil {
+            return nil, err
+        }
+        var buf bytes.Buffer
+        if err := t.Execute(&buf, ctx); err != nil {
+            return nil, toTemplateError(*wh.BodyTemplate, err)
+        }
+        return buf.Bytes(), nil
+    }
 
-        req, _ := http.NewRequest(method, url, bytes.NewReader(bodyToSend))
-        req.Header.Set("Content-Type", contentType)
-        req.Header.Set("X-Form-Id", formId)
-        req.Header.Set("X-Form-Version", fmt.Sprintf("%d", version))
-        req.Header.Set("X-Signature", "sha256="+sig)
-        for k, v := range headers { req.Header.Set(k, v) }
+    // Parse base submission data
+    var base map[string]any
+    _ = json.Unmarshal(body, &base)
 
-        ok := tryWithRetry(req, cfg, log)
-        if !ok { allOk = false }
+    // Get locale from meta
+    locale := "en" // default
+    if meta, ok := base["meta"].(map[string]any); ok {
+        if loc, ok := meta["locale"].(string); ok {
+            locale = loc
+        }
+    }
+    if wh.Mode == "mapping" {
+        return buildMappedBody(wh.Mapping, fields, mappingEnv(body, submissionId, locale), locale)
+    }
+    if chatModes[wh.Mode] {
+        return buildChatBody(wh, fields, submissionId, body)
+    }
+    if webhookMediaType(wh.ContentType) == formURLEncoded {
+        return newFormBody(wh, fields, submissionId, body, false).urlEncoded(), nil
     }
-    status := "success"
-    if !allOk { status = "partial" }
-    _, _ = db.Exec("UPDATE submissions SET webhook_status=? WHERE form_id=? AND version=? ORDER BY id DESC LIMIT 1", status, formId, version)
+
+    // No template: use default array format
+    return json.Marshal(defaultPayload(wh, fields, submissionId, base, locale))
 }
 
-func tryWithRetry(req *http.Request, cfg *config.Config, log *zap.Logger) bool {
-    client := &http.Client{ Timeout: time.Duration(cfg.WebhookTimeout()) * time.Millisecond }
-    retries := cfg.WebhookMaxRetries
-    backoff := time.Duration(cfg.WebhookRetryBackoffMs) * time.Millisecond
-    for attempt := 0; attempt <= retries; attempt++ {
-        resp, err := client.Do(req)
-        if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-            io.Copy(io.Discard, resp.Body); resp.Body.Close(); return true
+// defaultPayload is the body a webhook without a template sends for a
+// submission: its metadata and selected answers as labelled entries.
+func defaultPayload(wh *webhookRow, fields []types.Field, submissionId uint64, base map[string]any, locale string) map[string]any {
+    allAnswers, _ := base["answers"].(map[string]any)
+    transformedAnswers := transformAnswersToArray(selectAnswers(wh, allAnswers), fieldLabelsFor(fields, locale), locale)
+
+    // Build default payload structure, led by the event envelope
+    payload := map[string]any{
+        "event":        base["event"],
+        "id":           base["id"],
+        "occurredAt":   base["occurredAt"],
+        "submissionId": submissionId,
+        "formId":       wh.FormID,
+        "version":      wh.Version,
+        "submittedAt":  base["submittedAt"],
+        "locale":       locale,
+        "answers":      transformedAnswers,
+    }
+
+    // Add device and sessionId from meta if available
+    if meta, ok := base["meta"].(map[string]any); ok {
+        if device, ok := meta["device"].(string); ok {
+            payload["device"] = device
         }
-        if resp != nil { io.Copy(io.Discard, resp.Body); resp.Body.Close() }
-        time.Sleep(backoff)
+        if sessionId, ok := meta["sessionId"].(string); ok && sessionId != "" {
+            payload["sessionId"] = sessionId
+        }
+    }
+    return payload
+}
+
+// newWebhookRequest builds the signed outbound request for a rendered webhook.
+// Multipart bodies with files are spooled to disk first, fetching each file
+// with files (unused otherwise, so callers without files may pass nil); the
+// caller must close the request body if it never sends the request.
+func newWebhookRequest(ctx context.Context, cfg *config.Config, files *http.Client, wh *webhookRow, r *renderedWebhook) (*http.Request, error) {
+    if r.Multipart != nil && len(r.Multipart.Files) > 0 {
+        return newSpooledWebhookRequest(ctx, cfg, files, wh, r)
+    }
+    bodyToSend := r.Body
+    req, err := http.NewRequestWithContext(ctx, wh.Method, r.URL, bytes.NewReader(bodyToSend))
+    if err != nil {
+        return nil, err
     }
-    return false
+    setWebhookHeaders(req, wh, r)
+    signWebhookRequest(req, cfg, wh.Secrets, bodyToSend)
+    return req, nil
 }
 
+func newSpooledWebhookRequest(ctx context.Context, cfg *config.Config, files *http.Client, wh *webhookRow, r *renderedWebhook) (*http.Request, error) {
+    body, err := spoolMultipart(ctx, cfg, files, r.Multipart)
+    if err != nil {
+        return nil, err
+    }
+    req, err := http.NewRequestWithContext(ctx, wh.Method, r.URL, body)
+    if err != nil {
+        body.Close()
+        return nil, err
+    }
+    req.ContentLength = body.size
+    setWebhookHeaders(req, wh, r)
+    if err := signWebhookStream(req, cfg, wh.Secrets, body.File); err != nil {
+        body.Close()
+        return nil, err
+    }
+    return req, nil
+}
 
+func setWebhookHeaders(req *http.Request, wh *webhookRow, r *renderedWebhook) {
+    if r.ContentType != "" {
+        req.Header.Set("Content-Type", r.ContentType)
+    } else {
+        req.Header.Set("Content-Type", wh.ContentType)
+    }
+    req.Header.Set("X-Form-Id", wh.FormID)
+    req.Header.Set("X-Form-Version", fmt.Sprintf("%d", wh.Version))
+    for k, v := range r.Headers { req.Header.Set(k, v) }
+}
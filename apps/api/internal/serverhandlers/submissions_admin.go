@@ -1,13 +1,16 @@
 package serverhandlers
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/example/formrepo/apps/api/internal/types"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
@@ -23,9 +26,13 @@ type Submission struct {
 	Attributes     map[string]interface{} `json:"attributes"`
 	IdempotencyKey *string                `json:"idempotencyKey"`
 	WebhookStatus  string                 `json:"webhookStatus"`
+	ExternalRefs   map[string]interface{} `json:"externalRefs"` // IDs returned by webhook endpoints
 	CreatedAt      string                 `json:"createdAt"`
 }
 
+// submissionColumns are the columns scanned by scanSubmission, in order.
+const submissionColumns = "id, form_id, version, submitted_at, locale, device, answers_json, attributes_json, idempotency_key, webhook_status, external_refs, created_at"
+
 func ListSubmissionsHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		formId := c.Query("formId")
@@ -46,25 +53,43 @@ func ListSubmissionsHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 			offset = 0
 		}
 
-		var query string
+		var where []string
 		var args []interface{}
 
-		if formId != "" && versionStr != "" {
-			version, err := strconv.Atoi(versionStr)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		if formId != "" {
+			where = append(where, "form_id=?")
+			args = append(args, formId)
+			if versionStr != "" {
+				version, err := strconv.Atoi(versionStr)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+					return
+				}
+				where = append(where, "version=?")
+				args = append(args, version)
+			}
+		}
+		// ref.<name>=<value> matches submissions whose external ref has that value
+		for key, values := range c.Request.URL.Query() {
+			name, ok := strings.CutPrefix(key, "ref.")
+			if !ok {
+				continue
+			}
+			if !extractNamePattern.MatchString(name) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid external ref name", "details": []string{key}})
 				return
 			}
-			query = "SELECT id, form_id, version, submitted_at, locale, device, answers_json, attributes_json, idempotency_key, webhook_status, created_at FROM submissions WHERE form_id=? AND version=? ORDER BY submitted_at DESC LIMIT ? OFFSET ?"
-			args = []interface{}{formId, version, limit, offset}
-		} else if formId != "" {
-			query = "SELECT id, form_id, version, submitted_at, locale, device, answers_json, attributes_json, idempotency_key, webhook_status, created_at FROM submissions WHERE form_id=? ORDER BY submitted_at DESC LIMIT ? OFFSET ?"
-			args = []interface{}{formId, limit, offset}
-		} else {
-			query = "SELECT id, form_id, version, submitted_at, locale, device, answers_json, attributes_json, idempotency_key, webhook_status, created_at FROM submissions ORDER BY submitted_at DESC LIMIT ? OFFSET ?"
-			args = []interface{}{limit, offset}
+			where = append(where, "JSON_UNQUOTE(JSON_EXTRACT(external_refs, ?))=?")
+			args = append(args, "$."+name, values[0])
 		}
 
+		query := "SELECT " + submissionColumns + " FROM submissions"
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+		query += " ORDER BY submitted_at DESC LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+
 		rows, err := db.Query(query, args...)
 		if err != nil {
 			log.Error("failed to query submissions", zap.Error(err))
@@ -78,6 +103,7 @@ func ListSubmissionsHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 			var s Submission
 			var answersJSON, attributesJSON string
 			var idempotencyKey sql.NullString
+			var externalRefs []byte
 
 			err := rows.Scan(
 				&s.ID,
@@ -90,6 +116,7 @@ func ListSubmissionsHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 				&attributesJSON,
 				&idempotencyKey,
 				&s.WebhookStatus,
+				&externalRefs,
 				&s.CreatedAt,
 			)
 			if err != nil {
@@ -110,6 +137,7 @@ func ListSubmissionsHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 			if idempotencyKey.Valid {
 				s.IdempotencyKey = &idempotencyKey.String
 			}
+			s.ExternalRefs = decodeExternalRefs(externalRefs)
 
 			submissions = append(submissions, s)
 		}
@@ -138,9 +166,10 @@ func GetSubmissionHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 		var s Submission
 		var answersJSON, attributesJSON string
 		var idempotencyKey sql.NullString
+		var externalRefs []byte
 
 		err = db.QueryRow(
-			"SELECT id, form_id, version, submitted_at, locale, device, answers_json, attributes_json, idempotency_key, webhook_status, created_at FROM submissions WHERE id=?",
+			"SELECT "+submissionColumns+" FROM submissions WHERE id=?",
 			id,
 		).Scan(
 			&s.ID,
@@ -153,6 +182,7 @@ func GetSubmissionHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 			&attributesJSON,
 			&idempotencyKey,
 			&s.WebhookStatus,
+			&externalRefs,
 			&s.CreatedAt,
 		)
 
@@ -180,6 +210,7 @@ func GetSubmissionHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 		if idempotencyKey.Valid {
 			s.IdempotencyKey = &idempotencyKey.String
 		}
+		s.ExternalRefs = decodeExternalRefs(externalRefs)
 
 		// If format=array, transform answers to array format
 		if format == "array" {
@@ -250,6 +281,17 @@ func GetSubmissionHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 	}
 }
 
+// decodeExternalRefs returns the stored refs, or an empty object when there are none.
+func decodeExternalRefs(raw []byte) map[string]interface{} {
+	refs := map[string]interface{}{}
+	if len(raw) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		_ = dec.Decode(&refs)
+	}
+	return refs
+}
+
 // transformAnswersToArrayAdmin transforms answers map to array format with question labels, attributes, and maps URLs
 func transformAnswersToArrayAdmin(answers map[string]interface{}, fieldLabels map[string]string, fieldAttributes map[string]string, fieldTypes map[string]string, locale string) []map[string]interface{} {
 	result := []map[string]interface{}{}
@@ -415,3 +457,164 @@ func formatAnswerForArray(value interface{}, fieldType string, locale string) (s
 		return fmt.Sprintf("%v", v), ""
 	}
 }
+
+type updateSubmissionReq struct {
+	// Answers to change; a null value removes the answer
+	Answers map[string]any `json:"answers"`
+}
+
+// UpdateSubmissionHandler corrects a submission's answers, validated against
+// its form version like a new submission, and announces the change as
+// submission.updated.
+func UpdateSubmissionHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid submission id"})
+			return
+		}
+		var req updateSubmissionReq
+		if err := c.BindJSON(&req); err != nil || len(req.Answers) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "answers required"})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update submission"})
+			return
+		}
+		defer tx.Rollback()
+		var formId string
+		var version int
+		var answersJSON, fieldsJSON []byte
+		err = tx.QueryRow(`SELECT s.form_id, s.version, s.answers_json, f.fields_json FROM submissions s
+			JOIN form_snapshots f ON f.form_id=s.form_id AND f.version=s.version WHERE s.id=? FOR UPDATE`, id).
+			Scan(&formId, &version, &answersJSON, &fieldsJSON)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "submission not found"})
+			return
+		}
+		if err != nil {
+			log.Error("failed to query submission", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query submission"})
+			return
+		}
+		answers := map[string]any{}
+		_ = json.Unmarshal(answersJSON, &answers)
+		var changed []string
+		for name, v := range req.Answers {
+			old, had := answers[name]
+			if v == nil {
+				if had {
+					delete(answers, name)
+					changed = append(changed, name)
+				}
+				continue
+			}
+			a, _ := json.Marshal(old)
+			b, _ := json.Marshal(v)
+			if !had || !bytes.Equal(a, b) {
+				answers[name] = v
+				changed = append(changed, name)
+			}
+		}
+		if len(changed) == 0 {
+			c.JSON(http.StatusOK, gin.H{"id": id, "changed": []string{}})
+			return
+		}
+		sort.Strings(changed)
+		var fields []types.Field
+		_ = json.Unmarshal(fieldsJSON, &fields)
+		if verrs := validateSubmission(fields, answers); len(verrs) > 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"errors": verrs})
+			return
+		}
+		newJSON, _ := json.Marshal(answers)
+		if _, err := tx.Exec("UPDATE submissions SET answers_json=? WHERE id=?", string(newJSON), id); err != nil {
+			log.Error("failed to update submission", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update submission"})
+			return
+		}
+		data := gin.H{"submissionId": id, "formId": formId, "version": version, "answers": answers, "changed": changed}
+		queued, err := enqueueEvent(tx, formId, version, id, eventSubmissionUpdated, data)
+		if err != nil {
+			log.Error("failed to queue submission.updated", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update submission"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update submission"})
+			return
+		}
+		if queued > 0 {
+			disp.Notify()
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id, "changed": changed})
+	}
+}
+
+// DeleteSubmissionHandler deletes a submission, cancelling its deliveries
+// still waiting in the outbox, and announces it as submission.deleted with
+// the answers it had. Past deliveries stay in the log.
+func DeleteSubmissionHandler(db *sql.DB, disp *Dispatcher, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid submission id"})
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete submission"})
+			return
+		}
+		defer tx.Rollback()
+		var formId string
+		var version int
+		var submittedAt int64
+		var answersJSON []byte
+		err = tx.QueryRow("SELECT form_id, version, submitted_at, answers_json FROM submissions WHERE id=? FOR UPDATE", id).
+			Scan(&formId, &version, &submittedAt, &answersJSON)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "submission not found"})
+			return
+		}
+		if err != nil {
+			log.Error("failed to query submission", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query submission"})
+			return
+		}
+		if _, err := tx.Exec(`UPDATE webhook_deliveries SET status='cancelled', completed_at=NOW(3), last_error='submission deleted'
+			WHERE submission_id=? AND status='pending'`, id); err != nil {
+			log.Error("failed to cancel submission deliveries", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete submission"})
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM webhook_digest_items WHERE submission_id=? AND digest_id IS NULL", id); err != nil {
+			log.Error("failed to remove submission from digests", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete submission"})
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM submissions WHERE id=?", id); err != nil {
+			log.Error("failed to delete submission", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete submission"})
+			return
+		}
+		data := gin.H{"submissionId": id, "formId": formId, "version": version, "submittedAt": submittedAt, "answers": json.RawMessage(answersJSON)}
+		queued, err := enqueueEvent(tx, formId, version, id, eventSubmissionDeleted, data)
+		if err != nil {
+			log.Error("failed to queue submission.deleted", zap.Error(err), zap.Uint64("id", id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete submission"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete submission"})
+			return
+		}
+		if queued > 0 {
+			disp.Notify()
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,408 @@
+package serverhandlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/outbound"
+	"github.com/example/formrepo/apps/api/internal/secrets"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// WebhookAuth authenticates outbound requests beyond static headers. Client
+// secrets and private keys are usually ${secret:name} references; plaintext
+// values are masked in admin reads like credential headers.
+type WebhookAuth struct {
+	OAuth2 *OAuth2Auth `json:"oauth2,omitempty"`
+	MTLS   *MTLSAuth   `json:"mtls,omitempty"`
+}
+
+// OAuth2Auth fetches a bearer token with the client-credentials grant.
+type OAuth2Auth struct {
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes,omitempty"`
+	Audience     string   `json:"audience,omitempty"`
+	AuthStyle    string   `json:"auth_style,omitempty"` // "header" (HTTP Basic, default) or "body"
+}
+
+// MTLSAuth presents a client certificate, and optionally trusts a private CA
+// instead of the system roots.
+type MTLSAuth struct {
+	ClientCert string `json:"client_cert"` // PEM
+	ClientKey  string `json:"client_key"`  // PEM
+	CABundle   string `json:"ca_bundle,omitempty"`
+}
+
+// tokenExpiryMargin is how long before expiry a cached token is replaced.
+const tokenExpiryMargin = 30 * time.Second
+
+// maxTokenResponseBytes caps how much of a token endpoint response is read.
+const maxTokenResponseBytes = 64 << 10
+
+// validate returns admin-facing errors for an explicitly configured auth block.
+func (a *WebhookAuth) validate() []string {
+	if a == nil {
+		return nil
+	}
+	var errs []string
+	if o := a.OAuth2; o != nil {
+		u, err := url.Parse(o.TokenURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, "/auth/oauth2/token_url: must be an absolute http(s) URL")
+		}
+		if strings.TrimSpace(o.ClientID) == "" {
+			errs = append(errs, "/auth/oauth2/client_id: required")
+		}
+		if o.ClientSecret == "" {
+			errs = append(errs, "/auth/oauth2/client_secret: required")
+		}
+		for i, s := range o.Scopes {
+			if s == "" || strings.ContainsAny(s, " \t\r\n") {
+				errs = append(errs, fmt.Sprintf("/auth/oauth2/scopes/%d: must be a single scope without spaces", i))
+			}
+		}
+		if o.AuthStyle != "" && o.AuthStyle != "header" && o.AuthStyle != "body" {
+			errs = append(errs, "/auth/oauth2/auth_style: must be header or body")
+		}
+	}
+	if m := a.MTLS; m != nil {
+		if strings.TrimSpace(m.ClientCert) == "" {
+			errs = append(errs, "/auth/mtls/client_cert: required")
+		}
+		if strings.TrimSpace(m.ClientKey) == "" {
+			errs = append(errs, "/auth/mtls/client_key: required")
+		}
+	}
+	return errs
+}
+
+// secretValues lists the settings that may hold secret references.
+func (a *WebhookAuth) secretValues() []string {
+	var out []string
+	if a == nil {
+		return out
+	}
+	if a.OAuth2 != nil {
+		out = append(out, a.OAuth2.ClientID, a.OAuth2.ClientSecret)
+	}
+	if a.MTLS != nil {
+		out = append(out, a.MTLS.ClientCert, a.MTLS.ClientKey, a.MTLS.CABundle)
+	}
+	return out
+}
+
+// maskAuth hides plaintext client secrets and private keys in admin reads.
+func maskAuth(a *WebhookAuth) *WebhookAuth {
+	if a == nil {
+		return nil
+	}
+	out := &WebhookAuth{}
+	if a.OAuth2 != nil {
+		o := *a.OAuth2
+		if !secrets.HasReference(o.ClientSecret) {
+			o.ClientSecret = secrets.Mask(o.ClientSecret)
+		}
+		out.OAuth2 = &o
+	}
+	if a.MTLS != nil {
+		m := *a.MTLS
+		if !secrets.HasReference(m.ClientKey) {
+			m.ClientKey = secrets.Mask(m.ClientKey)
+		}
+		out.MTLS = &m
+	}
+	return out
+}
+
+// unmaskAuth puts back stored values the admin UI echoed in masked form.
+func unmaskAuth(a, stored *WebhookAuth) {
+	if a == nil || stored == nil {
+		return
+	}
+	if a.OAuth2 != nil && stored.OAuth2 != nil {
+		old := stored.OAuth2.ClientSecret
+		if !secrets.HasReference(old) && a.OAuth2.ClientSecret == secrets.Mask(old) {
+			a.OAuth2.ClientSecret = old
+		}
+	}
+	if a.MTLS != nil && stored.MTLS != nil {
+		old := stored.MTLS.ClientKey
+		if !secrets.HasReference(old) && a.MTLS.ClientKey == secrets.Mask(old) {
+			a.MTLS.ClientKey = old
+		}
+	}
+}
+
+// checkWebhookAuth validates a webhook's auth block, its secret references and
+// its client certificate, writing the error response itself on failure.
+func checkWebhookAuth(c *gin.Context, store *secrets.Store, log *zap.Logger, a *WebhookAuth) bool {
+	if verrs := a.validate(); len(verrs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid auth", "details": verrs})
+		return false
+	}
+	if !checkSecretReferences(c, store, log, "/auth", a.secretValues()) {
+		return false
+	}
+	if a == nil || a.MTLS == nil {
+		return true
+	}
+	ctx := c.Request.Context()
+	m := a.MTLS
+	cert, err := store.Resolve(ctx, m.ClientCert)
+	var key, ca string
+	if err == nil {
+		key, err = store.Resolve(ctx, m.ClientKey)
+	}
+	if err == nil {
+		ca, err = store.Resolve(ctx, m.CABundle)
+	}
+	if err != nil {
+		secretStoreError(c, log, err, "failed to resolve secrets")
+		return false
+	}
+	if _, err := mtlsConfig(cert, key, ca); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid auth", "details": []string{"/auth/mtls/" + err.Error()}})
+		return false
+	}
+	return true
+}
+
+// mtlsConfig builds the TLS config for a client certificate. Errors name the
+// setting at fault.
+func mtlsConfig(cert, key, ca string) (*tls.Config, error) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("client_key: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}
+	if strings.TrimSpace(ca) != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, fmt.Errorf("ca_bundle: no PEM certificates found")
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func authJSON(a *WebhookAuth) any {
+	if a == nil || (a.OAuth2 == nil && a.MTLS == nil) {
+		return nil
+	}
+	b, _ := json.Marshal(a)
+	return string(b)
+}
+
+// webhookAuthenticator sends webhook requests with their auth applied. It
+// caches OAuth2 tokens until shortly before they expire and keeps one HTTP
+// client per client certificate so connections are reused. All clients follow
+// the outbound policy.
+type webhookAuthenticator struct {
+	store   *secrets.Store
+	policy  outbound.Policy
+	timeout time.Duration
+	plain   *http.Client
+	mu      sync.Mutex
+	clients map[string]*http.Client
+	tokens  map[string]*oauthToken
+}
+
+type oauthToken struct {
+	mu      sync.Mutex // held while fetching, so concurrent senders wait for one request
+	value   string
+	expires time.Time // zero when the endpoint didn't say; kept until rejected
+}
+
+func newWebhookAuthenticator(store *secrets.Store, policy outbound.Policy, timeout time.Duration) *webhookAuthenticator {
+	return &webhookAuthenticator{
+		store:   store,
+		policy:  policy,
+		timeout: timeout,
+		plain:   policy.Client(timeout, nil),
+		clients: map[string]*http.Client{},
+		tokens:  map[string]*oauthToken{},
+	}
+}
+
+// do sends req with the webhook's auth applied. When the endpoint rejects a
+// token with 401 the token is replaced, and the request is sent once more if
+// its body can be replayed; otherwise the next attempt uses the new token.
+func (a *webhookAuthenticator) do(req *http.Request, auth *WebhookAuth) (*http.Response, error) {
+	ctx := req.Context()
+	client, certId, err := a.client(ctx, auth)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil || auth.OAuth2 == nil {
+		return client.Do(req)
+	}
+	token, err := a.token(ctx, client, certId, auth.OAuth2, "")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	fresh, err := a.token(ctx, client, certId, auth.OAuth2, token)
+	if err != nil || req.GetBody == nil {
+		return resp, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	retry := req.Clone(ctx)
+	retry.Body = body
+	retry.Header.Set("Authorization", "Bearer "+fresh)
+	return client.Do(retry)
+}
+
+// client returns the HTTP client for the webhook's client certificate, and an
+// id for the certificate ("" without mTLS).
+func (a *webhookAuthenticator) client(ctx context.Context, auth *WebhookAuth) (*http.Client, string, error) {
+	if auth == nil || auth.MTLS == nil {
+		return a.plain, "", nil
+	}
+	m := auth.MTLS
+	cert, err := a.store.Resolve(ctx, m.ClientCert)
+	var key, ca string
+	if err == nil {
+		key, err = a.store.Resolve(ctx, m.ClientKey)
+	}
+	if err == nil {
+		ca, err = a.store.Resolve(ctx, m.CABundle)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256([]byte(cert + "\x00" + key + "\x00" + ca))
+	id := hex.EncodeToString(sum[:])
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c := a.clients[id]; c != nil {
+		return c, id, nil
+	}
+	cfg, err := mtlsConfig(cert, key, ca)
+	if err != nil {
+		return nil, "", fmt.Errorf("mtls %s", err)
+	}
+	c := a.policy.Client(a.timeout, cfg)
+	a.clients[id] = c
+	return c, id, nil
+}
+
+// token returns a cached token, fetching one when there is none, it expired,
+// or it is the stale one the endpoint just rejected.
+func (a *webhookAuthenticator) token(ctx context.Context, client *http.Client, certId string, o *OAuth2Auth, stale string) (string, error) {
+	key := strings.Join([]string{o.TokenURL, o.ClientID, strings.Join(o.Scopes, " "), o.Audience, certId}, "\x00")
+	a.mu.Lock()
+	t := a.tokens[key]
+	if t == nil {
+		t = &oauthToken{}
+		a.tokens[key] = t
+	}
+	a.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.value != "" && t.value != stale && (t.expires.IsZero() || time.Now().Before(t.expires)) {
+		return t.value, nil
+	}
+	value, ttl, err := fetchOAuthToken(ctx, client, a.store, o)
+	if err != nil {
+		t.value = ""
+		return "", err
+	}
+	t.value, t.expires = value, time.Time{}
+	if ttl > 0 {
+		margin := tokenExpiryMargin
+		if ttl <= 2*margin {
+			margin = ttl / 2
+		}
+		t.expires = time.Now().Add(ttl - margin)
+	}
+	return value, nil
+}
+
+// fetchOAuthToken runs the client-credentials grant against the token endpoint.
+func fetchOAuthToken(ctx context.Context, client *http.Client, store *secrets.Store, o *OAuth2Auth) (string, time.Duration, error) {
+	clientId, err := store.Resolve(ctx, o.ClientID)
+	if err != nil {
+		return "", 0, err
+	}
+	secret, err := store.Resolve(ctx, o.ClientSecret)
+	if err != nil {
+		return "", 0, err
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+	if o.Audience != "" {
+		form.Set("audience", o.Audience)
+	}
+	if o.AuthStyle == "body" {
+		form.Set("client_id", clientId)
+		form.Set("client_secret", secret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token: %w", err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	req.Header.Set("Accept", "application/json")
+	if o.AuthStyle != "body" {
+		req.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(secret))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseBytes))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		snippet := strings.TrimSpace(string(body))
+		if len(snippet) > 200 {
+			snippet = snippet[:200]
+		}
+		return "", 0, fmt.Errorf("oauth2 token: unexpected status %d: %s", resp.StatusCode, snippet)
+	}
+	var tr struct {
+		AccessToken string      `json:"access_token"`
+		TokenType   string      `json:"token_type"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, fmt.Errorf("oauth2 token: response is not JSON: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, fmt.Errorf("oauth2 token: response has no access_token")
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("oauth2 token: unsupported token_type %q", tr.TokenType)
+	}
+	var ttl time.Duration
+	if secs, err := tr.ExpiresIn.Float64(); err == nil && secs > 0 {
+		ttl = time.Duration(secs * float64(time.Second))
+	}
+	return tr.AccessToken, ttl, nil
+}
@@ -0,0 +1,304 @@
+package serverhandlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/example/formrepo/apps/api/internal/types"
+)
+
+// Publishing a new version of a form copies the previous version's webhooks,
+// since webhooks belong to a (form, version) pair and partners shouldn't stop
+// receiving deliveries because the form changed. Selected fields are mapped to
+// the new version's fields through their attribute key; fields the new version
+// no longer has are dropped. answers.<field> references in body templates,
+// mappings and filters are renamed the same way; a copy that still references
+// a dropped field is disabled rather than rendering it empty or no longer
+// matching.
+
+// webhookCarryReport tells the publisher what a new version inherited.
+type webhookCarryReport struct {
+	FromVersion int              `json:"fromVersion"`
+	Copied      []carriedWebhook `json:"copied"`
+}
+
+type carriedWebhook struct {
+	FromID         uint64            `json:"fromId"`
+	ID             uint64            `json:"id"`
+	EndpointURL    string            `json:"endpointUrl"`
+	Enabled        bool              `json:"enabled"`
+	RemappedFields map[string]string `json:"remappedFields,omitempty"` // old name -> new name
+	DroppedFields  []string          `json:"droppedFields,omitempty"`
+	DisabledReason string            `json:"disabledReason,omitempty"`
+	FieldErrors    []string          `json:"fieldErrors,omitempty"` // references the new version can't satisfy
+}
+
+// answerRefPattern matches answers.<field> in templates, mapping paths and filters.
+var answerRefPattern = regexp.MustCompile(`\banswers\.([A-Za-z_][A-Za-z0-9_-]*)`)
+
+// carryWebhooks copies the webhooks of version from to version to within tx,
+// along with their active signing secrets so receivers keep verifying.
+// Dependencies are pointed at the copies.
+func carryWebhooks(tx *sql.Tx, formId string, from, to int, newFields []types.Field) (*webhookCarryReport, error) {
+	report := &webhookCarryReport{FromVersion: from, Copied: []carriedWebhook{}}
+	oldFields, err := loadFormFields(tx, formId, from)
+	if err == sql.ErrNoRows {
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT id, endpoint_url, enabled, selected_fields_json, depends_on_json, mode, body_template, mapping_json, filter_expr FROM form_webhooks WHERE form_id=? AND version=? ORDER BY position, id", formId, from)
+	if err != nil {
+		return nil, err
+	}
+	type source struct {
+		id        uint64
+		url       string
+		enabled   bool
+		selected  []string
+		dependsOn []uint64
+		mode      string
+		template  sql.NullString
+		mapping   []byte
+		filter    sql.NullString
+	}
+	var sources []source
+	for rows.Next() {
+		var s source
+		var selectedRaw, depsRaw []byte
+		if err := rows.Scan(&s.id, &s.url, &s.enabled, &selectedRaw, &depsRaw, &s.mode, &s.template, &s.mapping, &s.filter); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(selectedRaw) > 0 {
+			_ = json.Unmarshal(selectedRaw, &s.selected)
+		}
+		if len(depsRaw) > 0 {
+			_ = json.Unmarshal(depsRaw, &s.dependsOn)
+		}
+		sources = append(sources, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Renames and drops across every field, for references outside the selection
+	oldNames := make([]string, len(oldFields))
+	for i, f := range oldFields {
+		oldNames[i] = f.Name
+	}
+	_, renamed, droppedAll := remapSelectedFields(oldNames, oldFields, newFields)
+	gone := make(map[string]bool, len(droppedAll))
+	for _, name := range droppedAll {
+		gone[name] = true
+	}
+
+	newIds := map[uint64]uint64{}
+	for _, s := range sources {
+		selected, remapped, dropped := remapSelectedFields(s.selected, oldFields, newFields)
+		cw := carriedWebhook{FromID: s.id, EndpointURL: s.url, Enabled: s.enabled, RemappedFields: remapped, DroppedFields: dropped}
+		refs := &answerRefRewrite{renamed: renamed, gone: gone}
+		// Only what the webhook's mode uses can break the copy
+		if s.template.Valid {
+			s.template.String = refs.text("/body_template", s.template.String, s.mode == "raw" || s.mode == "")
+		}
+		if s.filter.Valid {
+			s.filter.String = refs.text("/filter", s.filter.String, true)
+		}
+		if len(s.mapping) > 0 {
+			s.mapping = refs.mapping(s.mapping)
+			if s.mode == "mapping" {
+				refs.errs = append(refs.errs, validateMapping(s.mapping, newFields)...)
+			}
+		}
+		for from, to := range refs.used {
+			if cw.RemappedFields == nil {
+				cw.RemappedFields = map[string]string{}
+			}
+			cw.RemappedFields[from] = to
+		}
+		cw.FieldErrors = refs.errs
+		if len(s.selected) > 0 && len(selected) == 0 {
+			// No selection means "all answers"; don't widen what the endpoint receives
+			cw.Enabled = false
+			cw.DisabledReason = fmt.Sprintf("none of the selected fields exist in version %d", to)
+		} else if len(cw.FieldErrors) > 0 {
+			cw.Enabled = false
+			cw.DisabledReason = fmt.Sprintf("references fields version %d doesn't have", to)
+		}
+		selectedJSON, _ := json.Marshal(selected)
+		var reason any
+		if cw.DisabledReason != "" {
+			reason = cw.DisabledReason
+		}
+		var mapping any
+		if len(s.mapping) > 0 {
+			mapping = string(s.mapping)
+		}
+		// Everything else is copied as is; dependencies are set once all copies exist
+		res, err := tx.Exec(`INSERT INTO form_webhooks(form_id,version,type,endpoint_url,http_method,content_type,headers_json,auth_json,query_params_json,body_template,mapping_json,selected_fields_json,retry_policy_json,rate_limit_json,filter_expr,position,response_extract_json,external_refs_json,mode,events_json,digest_json,enabled,disabled_reason,disabled_at)
+			SELECT form_id,?,type,endpoint_url,http_method,content_type,headers_json,auth_json,query_params_json,?,?,?,retry_policy_json,rate_limit_json,?,position,response_extract_json,external_refs_json,mode,events_json,digest_json,?,COALESCE(?,disabled_reason),IF(? IS NULL,disabled_at,NOW())
+			FROM form_webhooks WHERE id=?`,
+			to, s.template, mapping, nullIfEmptySelectedFields(string(selectedJSON)), s.filter, cw.Enabled, reason, reason, s.id)
+		if err != nil {
+			return nil, err
+		}
+		id, _ := res.LastInsertId()
+		cw.ID = uint64(id)
+		newIds[s.id] = cw.ID
+		if _, err := tx.Exec(`INSERT INTO webhook_secrets(webhook_id, secret, expires_at)
+			SELECT ?, secret, expires_at FROM webhook_secrets WHERE webhook_id=? AND (expires_at IS NULL OR expires_at > NOW(3)) ORDER BY id`, cw.ID, s.id); err != nil {
+			return nil, err
+		}
+		report.Copied = append(report.Copied, cw)
+	}
+
+	for _, s := range sources {
+		if len(s.dependsOn) == 0 {
+			continue
+		}
+		deps := make([]uint64, 0, len(s.dependsOn))
+		for _, dep := range s.dependsOn {
+			if id, ok := newIds[dep]; ok {
+				deps = append(deps, id)
+			}
+		}
+		if _, err := tx.Exec("UPDATE form_webhooks SET depends_on_json=? WHERE id=?", dependsOnJSON(deps), newIds[s.id]); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// remapSelectedFields maps field names selected in the old version to the new
+// version's names. A name the new version still has is kept; otherwise the
+// field is found by its attribute key, or dropped.
+func remapSelectedFields(selected []string, oldFields, newFields []types.Field) (out []string, remapped map[string]string, dropped []string) {
+	if len(selected) == 0 {
+		return nil, nil, nil
+	}
+	newNames := map[string]bool{}
+	newByKey := map[string]string{}
+	for _, f := range newFields {
+		newNames[f.Name] = true
+		newByKey[f.AttributeKey] = f.Name
+	}
+	oldKey := map[string]string{}
+	for _, f := range oldFields {
+		oldKey[f.Name] = f.AttributeKey
+	}
+	seen := map[string]bool{}
+	for _, name := range selected {
+		target := name
+		if !newNames[name] {
+			target = newByKey[oldKey[name]]
+			if oldKey[name] == "" || target == "" {
+				dropped = append(dropped, name)
+				continue
+			}
+			if remapped == nil {
+				remapped = map[string]string{}
+			}
+			remapped[name] = target
+		}
+		if !seen[target] {
+			seen[target] = true
+			out = append(out, target)
+		}
+	}
+	return out, remapped, dropped
+}
+
+// answerRefRewrite renames answers.<field> references for a new version,
+// collecting the renames it applied and references to dropped fields.
+type answerRefRewrite struct {
+	renamed map[string]string
+	gone    map[string]bool
+	used    map[string]string
+	errs    []string
+}
+
+func (r *answerRefRewrite) rename(src string) (string, []string) {
+	var missing []string
+	out := answerRefPattern.ReplaceAllStringFunc(src, func(ref string) string {
+		name := ref[len("answers."):]
+		if to, ok := r.renamed[name]; ok {
+			if r.used == nil {
+				r.used = map[string]string{}
+			}
+			r.used[name] = to
+			return "answers." + to
+		}
+		if r.gone[name] {
+			missing = append(missing, name)
+		}
+		return ref
+	})
+	return out, missing
+}
+
+// text renames the references in a template or filter. Dropped fields are
+// reported at at when report is set, i.e. when the webhook uses the text.
+func (r *answerRefRewrite) text(at, src string, report bool) string {
+	out, missing := r.rename(src)
+	if !report {
+		return out
+	}
+	sort.Strings(missing)
+	for i, name := range missing {
+		if i == 0 || missing[i-1] != name {
+			r.errs = append(r.errs, fmt.Sprintf("%s: field %q no longer exists", at, name))
+		}
+	}
+	return out
+}
+
+// mapping renames the source paths of a mapping document. Dropped fields are
+// left for validateMapping to report.
+func (r *answerRefRewrite) mapping(raw []byte) []byte {
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return raw
+	}
+	changed := false
+	var walk func(v any) any
+	walk = func(v any) any {
+		switch x := v.(type) {
+		case string:
+			out, _ := r.rename(x)
+			changed = changed || out != x
+			return out
+		case []any:
+			for i := range x {
+				x[i] = walk(x[i])
+			}
+		case map[string]any:
+			if _, ok := x["const"]; ok {
+				return x
+			}
+			if p, ok := x["path"]; ok {
+				x["path"] = walk(p)
+				return x
+			}
+			for k := range x {
+				x[k] = walk(x[k])
+			}
+		}
+		return v
+	}
+	doc = walk(doc)
+	if !changed {
+		return raw
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return raw
+	}
+	return out
+}
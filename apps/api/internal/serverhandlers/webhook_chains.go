@@ -0,0 +1,358 @@
+package serverhandlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Webhooks of a form version are queued in position order and may depend on
+// other webhooks of the same version. A dependent waits until its
+// dependencies have succeeded for the submission and is skipped if any of them
+// didn't. Values extracted from a dependency's JSON response are available to
+// the dependent's templates as .responses.<name> and to mappings as
+// responses.<name>.
+
+// dependencyWaitReason marks deliveries waiting on their dependencies.
+const dependencyWaitReason = "waiting for dependencies"
+
+// dependencyPollInterval is how long a waiting delivery sleeps before checking
+// again; dependencies finishing wake it sooner.
+const dependencyPollInterval = time.Minute
+
+// maxResponseBytes caps how much of a response is read for extraction.
+const maxResponseBytes = 1 << 20
+
+// mockResponseValue stands in for every extracted value in previews, tests
+// and template validation. A number fits both quoted and bare uses.
+const mockResponseValue = 1001
+
+var extractNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// chainNode is a webhook's place in its version's dependency graph.
+type chainNode struct {
+	DependsOn       []uint64
+	ResponseExtract map[string]string
+	Digest          bool // sends digests, so there is no delivery per submission to wait for
+}
+
+// loadWebhookChain returns the dependency graph of a form version's webhooks.
+func loadWebhookChain(db *sql.DB, formId string, version int) (map[uint64]*chainNode, error) {
+	rows, err := db.Query("SELECT id, depends_on_json, response_extract_json, digest_json IS NOT NULL FROM form_webhooks WHERE form_id=? AND version=?", formId, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	graph := map[uint64]*chainNode{}
+	for rows.Next() {
+		var id uint64
+		var depsRaw, extractRaw []byte
+		var digest bool
+		if err := rows.Scan(&id, &depsRaw, &extractRaw, &digest); err != nil {
+			return nil, err
+		}
+		n := &chainNode{Digest: digest}
+		if len(depsRaw) > 0 {
+			_ = json.Unmarshal(depsRaw, &n.DependsOn)
+		}
+		if len(extractRaw) > 0 {
+			_ = json.Unmarshal(extractRaw, &n.ResponseExtract)
+		}
+		graph[id] = n
+	}
+	return graph, rows.Err()
+}
+
+// validateWebhookChain checks a webhook's dependencies and response
+// extraction against the other webhooks of its version. selfId is 0 for a
+// webhook that doesn't exist yet.
+func validateWebhookChain(graph map[uint64]*chainNode, selfId uint64, dependsOn []uint64, extract map[string]string) []string {
+	var errs []string
+	seen := map[uint64]bool{}
+	for i, dep := range dependsOn {
+		at := fmt.Sprintf("/depends_on/%d", i)
+		switch {
+		case dep == selfId:
+			errs = append(errs, at+": a webhook can't depend on itself")
+		case graph[dep] == nil:
+			errs = append(errs, fmt.Sprintf("%s: webhook %d is not a webhook of this form version", at, dep))
+		case seen[dep]:
+			errs = append(errs, fmt.Sprintf("%s: webhook %d is listed twice", at, dep))
+		case graph[dep].Digest:
+			errs = append(errs, fmt.Sprintf("%s: webhook %d sends digests, not a delivery per submission", at, dep))
+		}
+		seen[dep] = true
+	}
+	if selfId != 0 && len(errs) == 0 {
+		if path := dependencyCycle(graph, selfId, dependsOn); path != nil {
+			errs = append(errs, "/depends_on: dependency cycle "+path.String())
+		}
+	}
+
+	names := make([]string, 0, len(extract))
+	for name := range extract {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		at := "/response_extract/" + name
+		if !extractNamePattern.MatchString(name) {
+			errs = append(errs, at+": name must be letters, digits and underscores, not starting with a digit")
+		}
+		if !validResponsePath(extract[name]) {
+			errs = append(errs, fmt.Sprintf("%s: invalid path %q", at, extract[name]))
+		}
+	}
+
+	// Values from all dependencies share .responses, so names must not clash
+	owner := map[string]uint64{}
+	for _, dep := range dependsOn {
+		n := graph[dep]
+		if n == nil {
+			continue
+		}
+		for name := range n.ResponseExtract {
+			if other, ok := owner[name]; ok && other != dep {
+				errs = append(errs, fmt.Sprintf("/depends_on: webhooks %d and %d both extract %q", other, dep, name))
+			}
+			owner[name] = dep
+		}
+	}
+	return errs
+}
+
+type chainPath []uint64
+
+func (p chainPath) String() string {
+	parts := make([]string, len(p))
+	for i, id := range p {
+		parts[i] = fmt.Sprintf("%d", id)
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// dependencyCycle returns the cycle the new dependencies of selfId would
+// create, or nil.
+func dependencyCycle(graph map[uint64]*chainNode, selfId uint64, dependsOn []uint64) chainPath {
+	visited := map[uint64]bool{}
+	var walk func(id uint64, path chainPath) chainPath
+	walk = func(id uint64, path chainPath) chainPath {
+		deps := dependsOn
+		if id != selfId {
+			if graph[id] == nil {
+				return nil
+			}
+			deps = graph[id].DependsOn
+		}
+		for _, dep := range deps {
+			if dep == selfId {
+				return append(path, dep)
+			}
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			if cycle := walk(dep, append(path, dep)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return walk(selfId, chainPath{selfId})
+}
+
+// dependentsOf lists the webhooks that depend on id.
+func dependentsOf(graph map[uint64]*chainNode, id uint64) []uint64 {
+	var out []uint64
+	for other, n := range graph {
+		for _, dep := range n.DependsOn {
+			if dep == id {
+				out = append(out, other)
+				break
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// digestDependentErrors reports the webhooks depending on selfId, which
+// can't switch to digests while they wait on its deliveries.
+func digestDependentErrors(graph map[uint64]*chainNode, selfId uint64) []string {
+	var errs []string
+	for _, id := range dependentsOf(graph, selfId) {
+		errs = append(errs, fmt.Sprintf("/digest: webhook %d depends on this webhook's deliveries", id))
+	}
+	return errs
+}
+
+// sampleResponses stands in for the values a webhook's dependencies would
+// extract, for previews, tests and template validation.
+func sampleResponses(graph map[uint64]*chainNode, dependsOn []uint64) map[string]any {
+	if len(dependsOn) == 0 {
+		return nil
+	}
+	out := map[string]any{}
+	for _, dep := range dependsOn {
+		if n := graph[dep]; n != nil {
+			for name := range n.ResponseExtract {
+				out[name] = mockResponseValue
+			}
+		}
+	}
+	return out
+}
+
+// withResponses adds the values extracted from dependencies to a submission
+// body under "responses", where templates and mappings pick them up.
+func withResponses(body []byte, values map[string]any) []byte {
+	if values == nil {
+		return body
+	}
+	// Numbers are kept as written so re-encoding doesn't round large IDs
+	var base map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&base); err != nil || base == nil {
+		return body
+	}
+	base["responses"] = values
+	out, err := json.Marshal(base)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// extractResponseValues pulls the configured paths out of a JSON response.
+// A missing value is an error: dependents can't do their job without it.
+func extractResponseValues(extract map[string]string, body []byte) (map[string]any, error) {
+	lookup, err := lookupResponse(body)
+	if err != nil {
+		return nil, fmt.Errorf("response_extract: response is not JSON: %w", err)
+	}
+	names := make([]string, 0, len(extract))
+	for name := range extract {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make(map[string]any, len(extract))
+	for _, name := range names {
+		v := lookup(extract[name])
+		if v == nil {
+			return nil, fmt.Errorf("response_extract %s: %s not found in response", name, extract[name])
+		}
+		values[name] = v
+	}
+	return values, nil
+}
+
+// dependencyState is where a delivery's dependencies stand for its submission.
+type dependencyState struct {
+	Wait   bool           // some dependency is still being delivered
+	Skip   string         // why the delivery won't be sent, if it won't
+	Values map[string]any // extracted values, once all dependencies succeeded
+}
+
+// checkDependencies looks at the latest delivery of each dependency for the
+// submission; redeliveries supersede earlier outcomes.
+func (d *Dispatcher) checkDependencies(dl *outboxDelivery, wh *webhookRow) (*dependencyState, error) {
+	st := &dependencyState{}
+	if len(wh.DependsOn) == 0 {
+		return st, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(wh.DependsOn)), ",")
+	args := []any{dl.SubmissionID}
+	for _, dep := range wh.DependsOn {
+		args = append(args, dep)
+	}
+	rows, err := d.db.Query(`SELECT webhook_id, status, last_error, response_values_json FROM webhook_deliveries
+        WHERE submission_id=? AND channel='webhook' AND event='submission.created' AND webhook_id IN (`+placeholders+`) ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type outcome struct {
+		status string
+		err    sql.NullString
+		values []byte
+	}
+	latest := map[uint64]outcome{}
+	for rows.Next() {
+		var id uint64
+		var o outcome
+		if err := rows.Scan(&id, &o.status, &o.err, &o.values); err != nil {
+			return nil, err
+		}
+		latest[id] = o
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	st.Values = map[string]any{}
+	for _, dep := range wh.DependsOn {
+		o, ok := latest[dep]
+		switch {
+		case !ok:
+			st.Skip = fmt.Sprintf("dependency webhook %d was not queued for this submission (disabled or added later)", dep)
+		case o.status == "pending" || o.status == "processing":
+			st.Wait = true
+		case o.status == "succeeded":
+			var values map[string]any
+			if len(o.values) > 0 {
+				dec := json.NewDecoder(bytes.NewReader(o.values))
+				dec.UseNumber()
+				_ = dec.Decode(&values)
+			}
+			for k, v := range values {
+				st.Values[k] = v
+			}
+		default:
+			st.Skip = fmt.Sprintf("dependency webhook %d %s", dep, o.status)
+			if o.err.Valid && o.err.String != "" {
+				st.Skip += ": " + o.err.String
+			}
+		}
+		if st.Skip != "" {
+			// One broken dependency settles it, even if others are still running
+			st.Wait = false
+			st.Values = nil
+			return st, nil
+		}
+	}
+	if st.Wait {
+		st.Values = nil
+	}
+	return st, nil
+}
+
+// saveResponseValues stores what a delivery extracted for its dependents.
+func (d *Dispatcher) saveResponseValues(dl *outboxDelivery, values map[string]any) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("UPDATE webhook_deliveries SET response_values_json=? WHERE id=?", string(b), dl.ID)
+	return err
+}
+
+// wakeDependents makes the submission's deliveries that wait on dependencies
+// due now, once one of its deliveries has finished.
+func (d *Dispatcher) wakeDependents(submissionId uint64) {
+	r, err := d.db.Exec("UPDATE webhook_deliveries SET next_attempt_at=NOW(3) WHERE submission_id=? AND status='pending' AND last_error=?", submissionId, dependencyWaitReason)
+	if err != nil {
+		d.log.Error("wake dependent deliveries", zap.Error(err), zap.Uint64("submissionId", submissionId))
+		return
+	}
+	if n, _ := r.RowsAffected(); n > 0 {
+		d.Notify()
+	}
+}
@@ -0,0 +1,290 @@
+package serverhandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/types"
+)
+
+// Chat modes render a submission as a ready-made chat message instead of a
+// hand-written body_template: a Slack Block Kit message, a Microsoft Teams
+// Adaptive Card or a Discord embed.
+var chatModes = map[string]bool{"slack": true, "teams": true, "discord": true}
+
+// usesBodyTemplate reports whether the webhook's body_template is in effect.
+func usesBodyTemplate(wh *webhookRow) bool {
+	return (wh.Mode == "raw" || wh.Mode == "") && wh.BodyTemplate != nil && *wh.BodyTemplate != ""
+}
+
+// chatLink is a labelled URL; each platform renders links its own way.
+type chatLink struct{ Text, URL string }
+
+// chatAnswer is one answer as shown in a chat message.
+type chatAnswer struct {
+	Label string
+	Text  string     // plain text, when there are no links
+	Links []chatLink // maps link for location, one per file for file_upload
+}
+
+type chatMessage struct {
+	Title       string
+	Footer      string
+	Locale      string
+	SubmittedAt time.Time
+	Answers     []chatAnswer
+}
+
+var chatTitles = map[string]string{"en": "New submission", "ar": "طلب جديد"}
+
+func chatTitle(locale, formId string) string {
+	t, ok := chatTitles[locale]
+	if !ok {
+		t = chatTitles["en"]
+	}
+	return t + ": " + formId
+}
+
+// newChatMessage collects the selected answers in form order with localized
+// question and option labels.
+func newChatMessage(wh *webhookRow, fields []types.Field, submissionId uint64, body []byte) *chatMessage {
+	var base map[string]any
+	_ = json.Unmarshal(body, &base)
+	allAnswers, _ := base["answers"].(map[string]any)
+	locale := "en"
+	if meta, ok := base["meta"].(map[string]any); ok {
+		if loc, ok := meta["locale"].(string); ok && loc != "" {
+			locale = loc
+		}
+	}
+	msg := &chatMessage{
+		Title:  chatTitle(locale, wh.FormID),
+		Footer: fmt.Sprintf("#%d · %s v%d · %s", submissionId, wh.FormID, wh.Version, locale),
+		Locale: locale,
+	}
+	if ms, ok := base["submittedAt"].(float64); ok {
+		msg.SubmittedAt = time.UnixMilli(int64(ms)).UTC()
+	}
+
+	answers := selectAnswers(wh, allAnswers)
+	labels := fieldLabelsFor(fields, locale)
+	byName := make(map[string]types.Field, len(fields))
+	names := make([]string, 0, len(answers))
+	for _, f := range fields {
+		byName[f.Name] = f
+		if _, ok := answers[f.Name]; ok {
+			names = append(names, f.Name)
+		}
+	}
+	var rest []string
+	for name := range answers {
+		if _, known := byName[name]; !known {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	for _, name := range append(names, rest...) {
+		label := labels[name]
+		if label == "" {
+			label = name
+		}
+		a := chatAnswer{Label: label}
+		v := answers[name]
+		switch byName[name].Type {
+		case "select", "radio", "multiselect":
+			a.Text = optionLabel(fields, locale, name, v)
+		case "location":
+			if link, ok := locationLink(v); ok {
+				a.Links = []chatLink{link}
+			}
+		case "file_upload":
+			a.Links = fileLinks(v)
+		}
+		if a.Text == "" && len(a.Links) == 0 {
+			a.Text = formatAnswer(v, locale)
+		}
+		msg.Answers = append(msg.Answers, a)
+	}
+	return msg
+}
+
+func locationLink(v any) (chatLink, bool) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return chatLink{}, false
+	}
+	lat, okLat := m["lat"].(float64)
+	lng, okLng := m["lng"].(float64)
+	if !okLat || !okLng {
+		return chatLink{}, false
+	}
+	// The submitted url isn't used: only the coordinates are checked
+	u := fmt.Sprintf("https://www.google.com/maps?q=%f,%f", lat, lng)
+	return chatLink{Text: fmt.Sprintf("%.6f, %.6f", lat, lng), URL: u}, true
+}
+
+// linkURLEscaper percent-encodes the characters that end a link in Slack
+// (<url|text>) or markdown ([text](url)) markup.
+var linkURLEscaper = strings.NewReplacer("<", "%3C", ">", "%3E", "|", "%7C", "(", "%28", ")", "%29", " ", "%20")
+
+// chatLinkURL returns u made safe to put in link markup, or false unless it
+// is an absolute http(s) URL.
+func chatLinkURL(u string) (string, bool) {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", false
+	}
+	return linkURLEscaper.Replace(u), true
+}
+
+func fileLinks(v any) []chatLink {
+	var items []any
+	switch x := v.(type) {
+	case []any:
+		items = x
+	case map[string]any:
+		items = []any{x}
+	}
+	var links []chatLink
+	for _, item := range items {
+		m, _ := item.(map[string]any)
+		raw, _ := m["url"].(string)
+		u, ok := chatLinkURL(raw)
+		if !ok {
+			continue
+		}
+		name, _ := m["name"].(string)
+		if name == "" {
+			if parsed, err := url.Parse(raw); err == nil {
+				name = path.Base(parsed.Path)
+			}
+		}
+		links = append(links, chatLink{Text: name, URL: u})
+	}
+	return links
+}
+
+// buildChatBody renders the submission for the webhook's chat mode.
+func buildChatBody(wh *webhookRow, fields []types.Field, submissionId uint64, body []byte) ([]byte, error) {
+	msg := newChatMessage(wh, fields, submissionId, body)
+	switch wh.Mode {
+	case "slack":
+		return json.Marshal(slackMessage(msg))
+	case "teams":
+		return json.Marshal(teamsMessage(msg))
+	case "discord":
+		return json.Marshal(discordMessage(msg))
+	}
+	return nil, fmt.Errorf("unknown chat mode %q", wh.Mode)
+}
+
+func chatText(a chatAnswer, link func(chatLink) string) string {
+	if len(a.Links) == 0 {
+		return a.Text
+	}
+	parts := make([]string, len(a.Links))
+	for i, l := range a.Links {
+		parts[i] = link(l)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// truncateChat shortens s to at most n characters, marking the cut.
+func truncateChat(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// markdownLinkText escapes the text of a [text](url) link.
+var markdownLinkText = strings.NewReplacer("\\", "\\\\", "[", "\\[", "]", "\\]")
+
+// Slack limits: 10 fields per section, 2000 characters per field, 50 blocks.
+func slackMessage(msg *chatMessage) map[string]any {
+	blocks := []any{
+		map[string]any{"type": "header", "text": map[string]any{"type": "plain_text", "text": truncateChat(msg.Title, 150)}},
+	}
+	var section []any
+	for _, a := range msg.Answers {
+		text := chatText(a, func(l chatLink) string {
+			return "<" + l.URL + "|" + slackEscaper.Replace(l.Text) + ">"
+		})
+		if len(a.Links) == 0 {
+			text = slackEscaper.Replace(text)
+		}
+		if text == "" {
+			text = "—"
+		}
+		section = append(section, map[string]any{"type": "mrkdwn", "text": truncateChat("*"+slackEscaper.Replace(a.Label)+"*\n"+text, 2000)})
+		if len(section) == 10 {
+			blocks = append(blocks, map[string]any{"type": "section", "fields": section})
+			section = nil
+		}
+	}
+	if len(section) > 0 {
+		blocks = append(blocks, map[string]any{"type": "section", "fields": section})
+	}
+	if len(blocks) > 49 {
+		blocks = blocks[:49]
+	}
+	blocks = append(blocks, map[string]any{"type": "context", "elements": []any{map[string]any{"type": "mrkdwn", "text": slackEscaper.Replace(msg.Footer)}}})
+	return map[string]any{"text": msg.Title, "blocks": blocks}
+}
+
+func teamsMessage(msg *chatMessage) map[string]any {
+	facts := make([]any, 0, len(msg.Answers))
+	for _, a := range msg.Answers {
+		text := chatText(a, func(l chatLink) string { return "[" + markdownLinkText.Replace(l.Text) + "](" + l.URL + ")" })
+		facts = append(facts, map[string]any{"title": a.Label, "value": text})
+	}
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"rtl":     msg.Locale == "ar",
+		"body": []any{
+			map[string]any{"type": "TextBlock", "text": msg.Title, "weight": "Bolder", "size": "Medium", "wrap": true},
+			map[string]any{"type": "FactSet", "facts": facts},
+			map[string]any{"type": "TextBlock", "text": msg.Footer, "isSubtle": true, "size": "Small", "wrap": true},
+		},
+	}
+	return map[string]any{
+		"type": "message",
+		"attachments": []any{
+			map[string]any{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}
+
+// Discord limits: 25 fields per embed, 256 characters per name, 1024 per value.
+func discordMessage(msg *chatMessage) map[string]any {
+	fields := make([]any, 0, len(msg.Answers))
+	for _, a := range msg.Answers {
+		if len(fields) == 25 {
+			break
+		}
+		text := chatText(a, func(l chatLink) string { return "[" + markdownLinkText.Replace(l.Text) + "](" + l.URL + ")" })
+		if text == "" {
+			text = "—"
+		}
+		fields = append(fields, map[string]any{"name": truncateChat(a.Label, 256), "value": truncateChat(text, 1024)})
+	}
+	embed := map[string]any{
+		"title":  truncateChat(msg.Title, 256),
+		"fields": fields,
+		"footer": map[string]any{"text": msg.Footer},
+	}
+	if !msg.SubmittedAt.IsZero() {
+		embed["timestamp"] = msg.SubmittedAt.Format(time.RFC3339)
+	}
+	return map[string]any{"embeds": []any{embed}}
+}
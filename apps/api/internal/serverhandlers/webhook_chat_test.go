@@ -0,0 +1,36 @@
+package serverhandlers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestChatLinksFromAnswers(t *testing.T) {
+	link, ok := locationLink(map[string]any{"lat": 52.5, "lng": 13.4, "url": "https://evil.example.com/|<!channel>"})
+	if !ok || link.URL != "https://www.google.com/maps?q=52.500000,13.400000" {
+		t.Errorf("location link = %+v, want one built from the coordinates", link)
+	}
+
+	links := fileLinks([]any{
+		map[string]any{"url": "javascript:alert(1)", "name": "a.txt"},
+		map[string]any{"url": "//res.cloudinary.com/x.pdf", "name": "b.pdf"},
+		map[string]any{"url": "https://res.cloudinary.com/x.pdf?a=<b>|c (d)", "name": "c].pdf"},
+	})
+	if len(links) != 1 {
+		t.Fatalf("got %d links, want only the http(s) one: %+v", len(links), links)
+	}
+	if want := "https://res.cloudinary.com/x.pdf?a=%3Cb%3E%7Cc%20%28d%29"; links[0].URL != want {
+		t.Errorf("url = %q, want %q", links[0].URL, want)
+	}
+
+	msg := &chatMessage{Answers: []chatAnswer{{Label: "File", Links: links}}}
+	slack := slackMessage(msg)["blocks"].([]any)[1].(map[string]any)["fields"].([]any)[0].(map[string]any)["text"].(string)
+	if !strings.HasSuffix(slack, "<"+links[0].URL+"|c].pdf>") {
+		t.Errorf("slack text = %q", slack)
+	}
+	discord, _ := json.Marshal(discordMessage(msg))
+	if !strings.Contains(string(discord), `[c\\].pdf](`+links[0].URL+")") {
+		t.Errorf("discord message = %s", discord)
+	}
+}
@@ -0,0 +1,683 @@
+package serverhandlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/types"
+	"go.uber.org/zap"
+)
+
+// Webhooks and the email action can send digests instead of a delivery per
+// submission: at the top of every hour or daily at a time of day (in the
+// digest's timezone), or once every N submissions. A new submission is
+// recorded as a digest item of each digest webhook that fires for it, and of
+// the email action if it sends digests. The dispatcher periodically cuts the
+// items that are due into a digest, in the same transaction that queues its
+// submission.digest delivery, so a submission goes out in exactly one digest
+// per webhook. Periods without submissions send nothing. Submissions that
+// commit after their period was cut go out with the next one.
+
+const eventSubmissionDigest = "submission.digest"
+
+const (
+	digestHourly = "hourly"
+	digestDaily  = "daily"
+	digestCount  = "count"
+)
+
+// maxDigestEvery caps count schedules.
+const maxDigestEvery = 1000
+
+// validateDigest checks a digest schedule.
+func validateDigest(at string, d *types.DigestConfig) []string {
+	var errs []string
+	switch d.Schedule {
+	case digestHourly, digestDaily:
+		if d.Timezone != "" {
+			if _, err := time.LoadLocation(d.Timezone); err != nil {
+				errs = append(errs, fmt.Sprintf("%s/timezone: unknown timezone %q", at, d.Timezone))
+			}
+		}
+		if d.Every != 0 {
+			errs = append(errs, at+"/every: only applies to count schedules")
+		}
+	case digestCount:
+		if d.Every < 1 || d.Every > maxDigestEvery {
+			errs = append(errs, fmt.Sprintf("%s/every: must be between 1 and %d", at, maxDigestEvery))
+		}
+		if d.Timezone != "" {
+			errs = append(errs, at+"/timezone: only applies to hourly and daily schedules")
+		}
+	default:
+		errs = append(errs, at+"/schedule: must be hourly, daily or count")
+	}
+	if d.Schedule == digestDaily {
+		if _, err := time.Parse("15:04", d.At); err != nil {
+			errs = append(errs, at+"/at: must be a time of day as HH:MM")
+		}
+	} else if d.At != "" {
+		errs = append(errs, at+"/at: only applies to daily schedules")
+	}
+	if d.Format != "" && d.Format != "json" && d.Format != "csv" {
+		errs = append(errs, at+"/format: must be json or csv")
+	}
+	return errs
+}
+
+// validateWebhookDigest checks a webhook's digest and that the rest of its
+// configuration makes sense for one. Digests have their own payload and
+// aren't sent per submission, so what shapes or gates a single submission's
+// delivery doesn't apply.
+func validateWebhookDigest(req webhookReq) []string {
+	d := req.Digest
+	if d == nil {
+		return nil
+	}
+	errs := validateDigest("/digest", d)
+	if req.Mode != "" && req.Mode != "raw" {
+		errs = append(errs, fmt.Sprintf("/mode: digests are sent as JSON or CSV, not in %s mode", req.Mode))
+	}
+	if req.BodyTemplate != "" {
+		errs = append(errs, "/body_template: digests have their own payload")
+	}
+	if strings.TrimSpace(req.Filter) != "" {
+		errs = append(errs, "/filter: not supported on digests")
+	}
+	if len(req.DependsOn) > 0 {
+		errs = append(errs, "/depends_on: digests don't wait on other webhooks")
+	}
+	if len(req.ResponseExtract) > 0 {
+		errs = append(errs, "/response_extract: not supported on digests")
+	}
+	if len(req.ExternalRefs) > 0 {
+		errs = append(errs, "/external_refs: not supported on digests")
+	}
+	for i, e := range req.Events {
+		if e != eventSubmissionCreated {
+			errs = append(errs, fmt.Sprintf("/events/%d: digests only batch %s", i, eventSubmissionCreated))
+		}
+	}
+	if digestCSV(d) {
+		if webhookMediaType(req.ContentType) != multipartForm {
+			errs = append(errs, "/content_type: csv digests are sent as multipart/form-data")
+		}
+	} else if !isJSONContentType(req.ContentType) {
+		errs = append(errs, "/content_type: json digests are sent as application/json")
+	}
+	return errs
+}
+
+func digestCSV(d *types.DigestConfig) bool {
+	return d != nil && d.Format == "csv"
+}
+
+// digestPeriodEnd returns the end of the latest hourly or daily period that
+// has ended by now.
+func digestPeriodEnd(d *types.DigestConfig, now time.Time) time.Time {
+	loc := time.UTC
+	if d.Timezone != "" {
+		if l, err := time.LoadLocation(d.Timezone); err == nil {
+			loc = l
+		}
+	}
+	t := now.In(loc)
+	if d.Schedule == digestHourly {
+		// From t's own offset, so the hour repeated when clocks go back is a period too
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	}
+	at, _ := time.Parse("15:04", d.At)
+	end := digestTime(t.Year(), t.Month(), t.Day(), at.Hour(), at.Minute(), loc)
+	if end.After(t) {
+		end = digestTime(t.Year(), t.Month(), t.Day()-1, at.Hour(), at.Minute(), loc)
+	}
+	return end
+}
+
+// digestTime is hour:min on the given day in loc. A time skipped when clocks
+// go forward moves forward by the size of the gap, as with cron.
+func digestTime(year int, month time.Month, day, hour, min int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, min, 0, 0, loc)
+	want := time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	if gap := want.Sub(got); gap > 0 {
+		t = t.Add(gap)
+	}
+	return t
+}
+
+// enqueueDigestItems records a new submission for every digest webhook that
+// fires for the form version, and for the email action when email is set.
+// Like enqueueWebhookDeliveries it runs in the submission's transaction.
+func enqueueDigestItems(tx *sql.Tx, formId string, version int, submissionId uint64, email bool) error {
+	if _, err := tx.Exec(`INSERT INTO webhook_digest_items(channel,webhook_id,form_id,version,submission_id,created_at)
+		SELECT 'webhook', w.id, w.form_id, w.version, ?, UTC_TIMESTAMP(3) FROM form_webhooks w WHERE `+webhookFiresSQL("?", "?")+` AND w.digest_json IS NOT NULL`,
+		submissionId, formId, version, version); err != nil {
+		return err
+	}
+	if email {
+		if _, err := tx.Exec(`INSERT INTO webhook_digest_items(channel,webhook_id,form_id,version,submission_id,created_at) VALUES('email',0,?,?,?,UTC_TIMESTAMP(3))`,
+			formId, version, submissionId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digestGroup is the submissions waiting for one webhook's or email action's
+// next digest. Version is the webhook's, 0 for form-level ones.
+type digestGroup struct {
+	Channel   string
+	WebhookID uint64
+	FormID    string
+	Version   int
+	Pending   int
+	Oldest    time.Time
+}
+
+// digestData is the data of a submission.digest event. It is stored as the
+// delivery's payload when the digest is cut; the submissions are loaded when
+// it is sent.
+type digestData struct {
+	DigestID  uint64 `json:"digestId"`
+	FormID    string `json:"formId"`
+	Version   int    `json:"version"`
+	Count     int    `json:"count"`
+	PeriodEnd string `json:"periodEnd,omitempty"` // hourly and daily schedules
+}
+
+// digester cuts due digests until shutdown.
+func (d *Dispatcher) digester() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(time.Duration(d.cfg.WebhookDigestPollInterval()) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if d.cutDigests(time.Now()) > 0 {
+			d.Notify()
+		}
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cutDigests cuts every digest that is due and returns how many it queued.
+func (d *Dispatcher) cutDigests(now time.Time) int {
+	rows, err := d.db.Query(`SELECT channel, webhook_id, form_id, version, COUNT(*), MIN(created_at) FROM webhook_digest_items
+		WHERE digest_id IS NULL GROUP BY channel, webhook_id, form_id, version`)
+	if err != nil {
+		d.log.Error("query webhook digest items", zap.Error(err))
+		return 0
+	}
+	var groups []digestGroup
+	for rows.Next() {
+		var g digestGroup
+		if err := rows.Scan(&g.Channel, &g.WebhookID, &g.FormID, &g.Version, &g.Pending, &g.Oldest); err != nil {
+			rows.Close()
+			d.log.Error("scan webhook digest items", zap.Error(err))
+			return 0
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		d.log.Error("query webhook digest items", zap.Error(err))
+		return 0
+	}
+
+	queued := 0
+	for _, g := range groups {
+		log := d.log.With(zap.String("channel", g.Channel), zap.Uint64("webhookId", g.WebhookID), zap.String("formId", g.FormID), zap.Int("version", g.Version))
+		cfg, wait, err := d.digestConfig(g)
+		if err != nil {
+			log.Error("load digest config", zap.Error(err))
+			continue
+		}
+		if wait {
+			continue
+		}
+		for {
+			n, err := d.cutDigest(g, cfg, now)
+			if err != nil {
+				log.Error("cut webhook digest", zap.Error(err))
+			}
+			if n == 0 {
+				break
+			}
+			queued++
+			g.Pending -= n
+			// Count schedules may have several digests' worth waiting
+			if cfg == nil || cfg.Schedule != digestCount {
+				break
+			}
+		}
+	}
+	return queued
+}
+
+// digestConfig returns the group's digest schedule. It is nil when digests
+// were switched off since, so the waiting submissions go out right away.
+// Submissions of a disabled webhook wait for it to be enabled again; those
+// of a deleted webhook or email action are dropped.
+func (d *Dispatcher) digestConfig(g digestGroup) (*types.DigestConfig, bool, error) {
+	var cfg *types.DigestConfig
+	if g.Channel == "email" {
+		ea, _, err := loadEmailAction(d.db, g.FormID, g.Version)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, false, err
+		}
+		if ea == nil {
+			return nil, true, d.dropDigestItems(g, "email action removed or disabled")
+		}
+		cfg = ea.Digest
+	} else {
+		var enabled bool
+		var raw []byte
+		err := d.db.QueryRow("SELECT enabled, digest_json FROM form_webhooks WHERE id=?", g.WebhookID).Scan(&enabled, &raw)
+		if err == sql.ErrNoRows {
+			return nil, true, d.dropDigestItems(g, "webhook removed")
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if !enabled {
+			return nil, true, nil
+		}
+		if len(raw) > 0 {
+			_ = json.Unmarshal(raw, &cfg)
+		}
+	}
+	return cfg, false, nil
+}
+
+func (d *Dispatcher) dropDigestItems(g digestGroup, reason string) error {
+	res, err := d.db.Exec("DELETE FROM webhook_digest_items WHERE channel=? AND webhook_id=? AND form_id=? AND version=? AND digest_id IS NULL",
+		g.Channel, g.WebhookID, g.FormID, g.Version)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	d.log.Info("dropping waiting digest submissions", zap.String("reason", reason), zap.Uint64("webhookId", g.WebhookID), zap.String("formId", g.FormID), zap.Int64("submissions", n))
+	return nil
+}
+
+// cutDigest assigns the group's due submissions to a new digest and queues
+// its delivery, returning how many submissions it took. Another process
+// cutting the same digest at the same time makes it take none.
+func (d *Dispatcher) cutDigest(g digestGroup, cfg *types.DigestConfig, now time.Time) (int, error) {
+	var periodEnd *time.Time
+	limit := 0
+	switch {
+	case cfg == nil:
+	case cfg.Schedule == digestCount:
+		if g.Pending < cfg.Every {
+			return 0, nil
+		}
+		limit = cfg.Every
+	default:
+		end := digestPeriodEnd(cfg, now).UTC()
+		if !g.Oldest.Before(end) {
+			return 0, nil
+		}
+		var last sql.NullTime
+		if err := d.db.QueryRow("SELECT MAX(period_end) FROM webhook_digests WHERE channel=? AND webhook_id=? AND form_id=? AND version=?",
+			g.Channel, g.WebhookID, g.FormID, g.Version).Scan(&last); err != nil {
+			return 0, err
+		}
+		if last.Valid && !last.Time.Before(end) {
+			// Submissions that committed after this period was cut wait for the next
+			return 0, nil
+		}
+		periodEnd = &end
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// A period's digest is unique, so a second process cutting it fails here
+	res, err := tx.Exec("INSERT INTO webhook_digests(channel,webhook_id,form_id,version,period_end,created_at) VALUES(?,?,?,?,?,UTC_TIMESTAMP(3))",
+		g.Channel, g.WebhookID, g.FormID, g.Version, periodEnd)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	q := "UPDATE webhook_digest_items SET digest_id=? WHERE channel=? AND webhook_id=? AND form_id=? AND version=? AND digest_id IS NULL"
+	args := []any{id, g.Channel, g.WebhookID, g.FormID, g.Version}
+	if periodEnd != nil {
+		q += " AND created_at < ?"
+		args = append(args, *periodEnd)
+	}
+	q += " ORDER BY id"
+	if limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
+	if res, err = tx.Exec(q, args...); err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 || n < int64(limit) {
+		return 0, nil
+	}
+	if _, err := tx.Exec("UPDATE webhook_digests SET submission_count=? WHERE id=?", n, id); err != nil {
+		return 0, err
+	}
+	data := digestData{DigestID: uint64(id), FormID: g.FormID, Version: g.Version, Count: int(n)}
+	if periodEnd != nil {
+		data.PeriodEnd = formatOccurredAt(*periodEnd)
+	}
+	payload, _ := json.Marshal(data)
+	env := newEventEnvelope(eventSubmissionDigest)
+	if _, err := tx.Exec(`INSERT INTO webhook_deliveries(submission_id,webhook_id,channel,event,event_id,occurred_at,form_id,version,payload_json) VALUES(0,?,?,?,?,NOW(3),?,?,?)`,
+		g.WebhookID, g.Channel, eventSubmissionDigest, env.ID, g.FormID, g.Version, string(payload)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// digestSubmission is a submission in a digest, with the body it was
+// submitted with.
+type digestSubmission struct {
+	ID      uint64
+	Version int
+	Body    []byte
+}
+
+// loadDigestSubmissions returns a digest's submissions in the order they were
+// submitted. Ones deleted since it was cut are left out, and the digest's
+// count follows.
+func loadDigestSubmissions(db *sql.DB, digestId uint64) ([]digestSubmission, error) {
+	rows, err := db.Query(`SELECT s.id, s.version, `+redeliveryPayloadSQL+` FROM webhook_digest_items i
+		JOIN submissions s ON s.id=i.submission_id WHERE i.digest_id=? ORDER BY i.id`, digestId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []digestSubmission
+	for rows.Next() {
+		var s digestSubmission
+		if err := rows.Scan(&s.ID, &s.Version, &s.Body); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// digestFields returns the fields of each version a digest's submissions
+// were made on, loading each version once.
+func digestFields(db *sql.DB, formId string) func(version int) ([]types.Field, error) {
+	cache := map[int][]types.Field{}
+	return func(version int) ([]types.Field, error) {
+		if fields, ok := cache[version]; ok {
+			return fields, nil
+		}
+		fields, err := loadFormFields(db, formId, version)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		cache[version] = fields
+		return fields, nil
+	}
+}
+
+// digestEntries renders each submission as the default payload of wh, without
+// an envelope of its own.
+func digestEntries(wh *webhookRow, subs []digestSubmission, fieldsFor func(int) ([]types.Field, error)) ([]map[string]any, error) {
+	entries := make([]map[string]any, 0, len(subs))
+	for _, s := range subs {
+		fields, err := fieldsFor(s.Version)
+		if err != nil {
+			return nil, err
+		}
+		var base map[string]any
+		_ = json.Unmarshal(s.Body, &base)
+		locale := "en"
+		if meta, ok := base["meta"].(map[string]any); ok {
+			if loc, ok := meta["locale"].(string); ok && loc != "" {
+				locale = loc
+			}
+		}
+		v := *wh
+		v.Version = s.Version
+		entry := defaultPayload(&v, fields, s.ID, base, locale)
+		delete(entry, "event")
+		delete(entry, "id")
+		delete(entry, "occurredAt")
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// digestTable renders the submissions as CSV: one row per submission with its
+// id, version, submission time and locale, then a column per selected answer,
+// in form order and headed by the question's English label.
+func digestTable(wh *webhookRow, subs []digestSubmission, fieldsFor func(int) ([]types.Field, error)) ([]byte, error) {
+	header := []string{"submissionId", "version", "submittedAt", "locale"}
+	var columns []string
+	seen := map[string]bool{}
+	type row struct {
+		meta    []string
+		answers map[string]string
+	}
+	rows := make([]row, 0, len(subs))
+	for _, s := range subs {
+		fields, err := fieldsFor(s.Version)
+		if err != nil {
+			return nil, err
+		}
+		var base map[string]any
+		_ = json.Unmarshal(s.Body, &base)
+		locale := "en"
+		if meta, ok := base["meta"].(map[string]any); ok {
+			if loc, ok := meta["locale"].(string); ok && loc != "" {
+				locale = loc
+			}
+		}
+		allAnswers, _ := base["answers"].(map[string]any)
+		answers := selectAnswers(wh, allAnswers)
+		labels := fieldLabelsFor(fields, "en")
+		known := map[string]bool{}
+		var rest []string
+		for _, f := range fields {
+			known[f.Name] = true
+		}
+		for name := range answers {
+			if !known[name] {
+				rest = append(rest, name)
+			}
+		}
+		sort.Strings(rest)
+		for _, f := range fields {
+			if _, ok := answers[f.Name]; ok && !seen[f.Name] {
+				seen[f.Name] = true
+				columns = append(columns, f.Name)
+				label := labels[f.Name]
+				if label == "" {
+					label = f.Name
+				}
+				header = append(header, label)
+			}
+		}
+		for _, name := range rest {
+			if !seen[name] {
+				seen[name] = true
+				columns = append(columns, name)
+				header = append(header, name)
+			}
+		}
+		var submittedAt string
+		if ms, ok := base["submittedAt"].(float64); ok {
+			submittedAt = formatOccurredAt(time.UnixMilli(int64(ms)))
+		}
+		r := row{meta: []string{fmt.Sprintf("%d", s.ID), fmt.Sprintf("%d", s.Version), submittedAt, locale}, answers: map[string]string{}}
+		for name, v := range answers {
+			r.answers[name] = formatAnswer(v, locale)
+		}
+		rows = append(rows, r)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(header)
+	for _, r := range rows {
+		record := r.meta
+		for _, name := range columns {
+			record = append(record, r.answers[name])
+		}
+		_ = w.Write(record)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// renderDigestWebhook renders a submission.digest delivery from its stored
+// data.
+func renderDigestWebhook(db *sql.DB, wh *webhookRow, env eventEnvelope, payload []byte) (*renderedWebhook, error) {
+	var data digestData
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, err
+	}
+	subs, err := loadDigestSubmissions(db, data.DigestID)
+	if err != nil {
+		return nil, err
+	}
+	data.Count = len(subs)
+	return renderDigest(wh, env, data, subs, digestFields(db, wh.FormID))
+}
+
+// renderDigest renders a digest as the event envelope with the submissions
+// under data.submissions, or for csv digests as a multipart form with the
+// envelope and digest fields and the submissions as a submissions.csv file.
+// Digests switched back to per-submission deliveries since are sent as JSON.
+func renderDigest(wh *webhookRow, env eventEnvelope, data digestData, subs []digestSubmission, fieldsFor func(int) ([]types.Field, error)) (*renderedWebhook, error) {
+	meta, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if !digestCSV(wh.Digest) {
+		entries, err := digestEntries(wh, subs, fieldsFor)
+		if err != nil {
+			return nil, err
+		}
+		body, err := json.Marshal(struct {
+			digestData
+			Submissions []map[string]any `json:"submissions"`
+		}{data, entries})
+		if err != nil {
+			return nil, err
+		}
+		return renderEventWebhook(wh, env, body)
+	}
+
+	table, err := digestTable(wh, subs, fieldsFor)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fields := []formField{{"event", env.Event}, {"id", env.ID}, {"occurredAt", env.OccurredAt},
+		{"digestId", fmt.Sprintf("%d", data.DigestID)}, {"formId", data.FormID}, {"version", fmt.Sprintf("%d", data.Version)}, {"count", fmt.Sprintf("%d", data.Count)}}
+	if data.PeriodEnd != "" {
+		fields = append(fields, formField{"periodEnd", data.PeriodEnd})
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f.Name, f.Value); err != nil {
+			return nil, err
+		}
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="submissions"; filename="submissions.csv"`)
+	h.Set("Content-Type", "text/csv; charset=utf-8")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(table); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	r := &renderedWebhook{URL: wh.URL, Headers: make(map[string]string, len(wh.Headers)), Body: buf.Bytes(), ContentType: mw.FormDataContentType()}
+	if err := renderEventTarget(wh, r, env, meta); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// renderSampleWebhook renders a webhook for a sample submission, as a digest
+// of just that submission for digest webhooks.
+func renderSampleWebhook(wh *webhookRow, fields []types.Field, submissionId uint64, sample []byte) (*renderedWebhook, error) {
+	if wh.Digest == nil {
+		return renderWebhook(wh, fields, submissionId, sample)
+	}
+	env := eventEnvelope{Event: eventSubmissionDigest, ID: mockEventID, OccurredAt: formatOccurredAt(time.Now())}
+	data := digestData{DigestID: mockSubmissionID, FormID: wh.FormID, Version: wh.chainVersion(), Count: 1}
+	if wh.Digest.Schedule != digestCount {
+		data.PeriodEnd = formatOccurredAt(digestPeriodEnd(wh.Digest, time.Now()))
+	}
+	subs := []digestSubmission{{ID: submissionId, Version: wh.Version, Body: sample}}
+	return renderDigest(wh, env, data, subs, func(int) ([]types.Field, error) { return fields, nil })
+}
+
+const digestSubject = "Submissions digest"
+
+// renderDigestEmail builds the email for a digest: a summary followed by each
+// submission's answer table, or with the submissions attached as CSV for csv
+// digests. Subject and body templates are written for a single submission,
+// so they don't apply; nor does to_field.
+func renderDigestEmail(ea *types.EmailActionConfig, data digestData, subs []digestSubmission, fieldsFor func(int) ([]types.Field, error)) (*emailMessage, error) {
+	if len(ea.To) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	msg := &emailMessage{To: append([]string(nil), ea.To...), HTML: true}
+	msg.Subject = fmt.Sprintf("%s: %s (%d)", digestSubject, data.FormID, len(subs))
+
+	var b strings.Builder
+	b.WriteString(`<div style="font-family:sans-serif">`)
+	fmt.Fprintf(&b, "<p>%d submissions to %s v%d", len(subs), html.EscapeString(data.FormID), data.Version)
+	if data.PeriodEnd != "" {
+		fmt.Fprintf(&b, " up to %s", html.EscapeString(data.PeriodEnd))
+	}
+	b.WriteString(".</p></div>\n")
+	wh := &webhookRow{FormID: data.FormID, Version: data.Version}
+	if digestCSV(ea.Digest) {
+		table, err := digestTable(wh, subs, fieldsFor)
+		if err != nil {
+			return nil, err
+		}
+		msg.Attachments = []emailAttachment{{Name: fmt.Sprintf("%s-digest-%d.csv", data.FormID, data.DigestID), ContentType: "text/csv; charset=utf-8", Data: table}}
+	} else {
+		for _, s := range subs {
+			fields, err := fieldsFor(s.Version)
+			if err != nil {
+				return nil, err
+			}
+			v := *wh
+			v.Version = s.Version
+			b.WriteString("<hr>\n")
+			b.WriteString(emailAnswerTable(newChatMessage(&v, fields, s.ID, s.Body)))
+			b.WriteString("\n")
+		}
+	}
+	msg.Body = b.String()
+	return msg, nil
+}
@@ -0,0 +1,275 @@
+package serverhandlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/types"
+	"go.uber.org/zap"
+)
+
+func mustTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	v, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDigestPeriodEnd(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  types.DigestConfig
+		now  string
+		want string
+	}{
+		{"hourly UTC", types.DigestConfig{Schedule: digestHourly}, "2026-06-01T10:45:12Z", "2026-06-01T10:00:00Z"},
+		{"hourly on the hour", types.DigestConfig{Schedule: digestHourly}, "2026-06-01T10:00:00Z", "2026-06-01T10:00:00Z"},
+		{"hourly half-hour offset", types.DigestConfig{Schedule: digestHourly, Timezone: "Asia/Kolkata"}, "2026-06-01T10:45:00Z", "2026-06-01T10:30:00Z"},
+		// 01:00-02:00 happens twice in New York on 2026-11-01; each is its own period
+		{"hourly first repeated hour", types.DigestConfig{Schedule: digestHourly, Timezone: "America/New_York"}, "2026-11-01T05:30:00Z", "2026-11-01T05:00:00Z"},
+		{"hourly second repeated hour", types.DigestConfig{Schedule: digestHourly, Timezone: "America/New_York"}, "2026-11-01T06:30:00Z", "2026-11-01T06:00:00Z"},
+		{"daily later today", types.DigestConfig{Schedule: digestDaily, At: "09:00"}, "2026-06-01T08:59:59Z", "2026-05-31T09:00:00Z"},
+		{"daily at the time", types.DigestConfig{Schedule: digestDaily, At: "09:00"}, "2026-06-01T09:00:00Z", "2026-06-01T09:00:00Z"},
+		{"daily in timezone", types.DigestConfig{Schedule: digestDaily, At: "09:00", Timezone: "Asia/Kuwait"}, "2026-06-01T07:00:00Z", "2026-06-01T06:00:00Z"},
+		{"daily across month", types.DigestConfig{Schedule: digestDaily, At: "23:30", Timezone: "Asia/Kuwait"}, "2026-03-01T10:00:00Z", "2026-02-28T20:30:00Z"},
+		// London moves to BST at 01:00 UTC on 2026-03-29 and back at 01:00 UTC on 2026-10-25
+		{"daily after clocks go forward", types.DigestConfig{Schedule: digestDaily, At: "09:00", Timezone: "Europe/London"}, "2026-03-29T12:00:00Z", "2026-03-29T08:00:00Z"},
+		{"daily before clocks went forward", types.DigestConfig{Schedule: digestDaily, At: "09:00", Timezone: "Europe/London"}, "2026-03-29T07:30:00Z", "2026-03-28T09:00:00Z"},
+		{"daily after clocks go back", types.DigestConfig{Schedule: digestDaily, At: "09:00", Timezone: "Europe/London"}, "2026-10-25T10:00:00Z", "2026-10-25T09:00:00Z"},
+		{"daily before clocks went back", types.DigestConfig{Schedule: digestDaily, At: "09:00", Timezone: "Europe/London"}, "2026-10-25T08:30:00Z", "2026-10-24T08:00:00Z"},
+		// 02:30 doesn't exist in New York on 2026-03-08; the digest goes at 03:30 EDT
+		{"daily in the skipped hour", types.DigestConfig{Schedule: digestDaily, At: "02:30", Timezone: "America/New_York"}, "2026-03-08T12:00:00Z", "2026-03-08T07:30:00Z"},
+		{"daily before the skipped hour", types.DigestConfig{Schedule: digestDaily, At: "02:30", Timezone: "America/New_York"}, "2026-03-08T07:00:00Z", "2026-03-07T07:30:00Z"},
+	}
+	for _, tc := range cases {
+		got := digestPeriodEnd(&tc.cfg, mustTime(t, tc.now))
+		if want := mustTime(t, tc.want); !got.Equal(want) {
+			t.Errorf("%s: got %s, want %s", tc.name, got.UTC().Format(time.RFC3339), tc.want)
+		}
+	}
+}
+
+func TestValidateDigest(t *testing.T) {
+	cases := []struct {
+		cfg  types.DigestConfig
+		errs int
+	}{
+		{types.DigestConfig{Schedule: digestHourly}, 0},
+		{types.DigestConfig{Schedule: digestDaily, At: "17:30", Timezone: "Europe/Paris", Format: "csv"}, 0},
+		{types.DigestConfig{Schedule: digestCount, Every: 50}, 0},
+		{types.DigestConfig{Schedule: "weekly"}, 1},
+		{types.DigestConfig{Schedule: digestDaily}, 1},
+		{types.DigestConfig{Schedule: digestDaily, At: "25:00"}, 1},
+		{types.DigestConfig{Schedule: digestHourly, At: "09:00", Every: 5}, 2},
+		{types.DigestConfig{Schedule: digestHourly, Timezone: "Mars/Olympus"}, 1},
+		{types.DigestConfig{Schedule: digestCount}, 1},
+		{types.DigestConfig{Schedule: digestCount, Every: maxDigestEvery + 1, Timezone: "UTC"}, 2},
+		{types.DigestConfig{Schedule: digestHourly, Format: "xml"}, 1},
+	}
+	for _, tc := range cases {
+		if errs := validateDigest("/digest", &tc.cfg); len(errs) != tc.errs {
+			t.Errorf("%+v: got %v, want %d errors", tc.cfg, errs, tc.errs)
+		}
+	}
+}
+
+// fakeDB is a database/sql driver that hands every statement to handle and
+// records it, along with BEGIN, COMMIT and ROLLBACK.
+type fakeDB struct {
+	log    []string
+	args   map[string][]driver.NamedValue // last arguments per statement prefix
+	handle func(query string, args []driver.NamedValue) (*fakeResult, error)
+}
+
+type fakeResult struct {
+	cols     []string
+	rows     [][]driver.Value
+	lastID   int64
+	affected int64
+}
+
+func (r *fakeResult) LastInsertId() (int64, error) { return r.lastID, nil }
+func (r *fakeResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+func (r *fakeResult) Columns() []string { return r.cols }
+func (r *fakeResult) Close() error      { return nil }
+func (r *fakeResult) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return f, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+func (f *fakeDB) Prepare(string) (driver.Stmt, error)          { return nil, errors.New("not supported") }
+func (f *fakeDB) Close() error                                 { return nil }
+func (f *fakeDB) Begin() (driver.Tx, error)                    { f.log = append(f.log, "BEGIN"); return f, nil }
+func (f *fakeDB) Commit() error                                { f.log = append(f.log, "COMMIT"); return nil }
+func (f *fakeDB) Rollback() error                              { f.log = append(f.log, "ROLLBACK"); return nil }
+
+func (f *fakeDB) run(query string, args []driver.NamedValue) (*fakeResult, error) {
+	query = strings.Join(strings.Fields(query), " ")
+	f.log = append(f.log, query)
+	if f.args == nil {
+		f.args = map[string][]driver.NamedValue{}
+	}
+	f.args[strings.SplitN(query, " WHERE ", 2)[0]] = args
+	if f.handle == nil {
+		return &fakeResult{}, nil
+	}
+	return f.handle(query, args)
+}
+
+func (f *fakeDB) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return f.run(query, args)
+}
+
+func (f *fakeDB) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return f.run(query, args)
+}
+
+// has reports whether a statement starting with prefix ran.
+func (f *fakeDB) has(prefix string) bool {
+	for _, q := range f.log {
+		if strings.HasPrefix(q, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// digestDB answers cutDigest's statements: lastCut as the latest period end,
+// and assigned as the items the UPDATE takes.
+func digestDB(lastCut any, assigned int64) *fakeDB {
+	return &fakeDB{handle: func(query string, args []driver.NamedValue) (*fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT MAX(period_end)"):
+			return &fakeResult{cols: []string{"max"}, rows: [][]driver.Value{{lastCut}}}, nil
+		case strings.HasPrefix(query, "INSERT INTO webhook_digests"):
+			return &fakeResult{lastID: 7, affected: 1}, nil
+		case strings.HasPrefix(query, "UPDATE webhook_digest_items"):
+			return &fakeResult{affected: assigned}, nil
+		}
+		return &fakeResult{affected: 1}, nil
+	}}
+}
+
+func TestCutDigest(t *testing.T) {
+	now := mustTime(t, "2026-06-01T10:20:00Z")
+	hourly := &types.DigestConfig{Schedule: digestHourly}
+	count := &types.DigestConfig{Schedule: digestCount, Every: 5}
+	group := func(pending int, oldest string) digestGroup {
+		return digestGroup{Channel: "webhook", WebhookID: 3, FormID: "f", Version: 2, Pending: pending, Oldest: mustTime(t, oldest)}
+	}
+	cases := []struct {
+		name     string
+		cfg      *types.DigestConfig
+		g        digestGroup
+		lastCut  any
+		assigned int64
+		want     int
+		commit   bool
+		began    bool
+	}{
+		{"count not reached", count, group(4, "2026-06-01T09:00:00Z"), nil, 0, 0, false, false},
+		{"count reached", count, group(7, "2026-06-01T09:00:00Z"), nil, 5, 5, true, true},
+		// Another process took some of the items first: the partial digest is rolled back
+		{"count partly taken", count, group(5, "2026-06-01T09:00:00Z"), nil, 3, 0, false, true},
+		{"period not over", hourly, group(2, "2026-06-01T10:05:00Z"), nil, 0, 0, false, false},
+		{"period due", hourly, group(2, "2026-06-01T09:30:00Z"), mustTime(t, "2026-06-01T09:00:00Z"), 2, 2, true, true},
+		{"first period", hourly, group(2, "2026-06-01T09:30:00Z"), nil, 2, 2, true, true},
+		// Items that committed after 10:00 was cut wait for 11:00
+		{"period already cut", hourly, group(1, "2026-06-01T09:59:59Z"), mustTime(t, "2026-06-01T10:00:00Z"), 1, 0, false, false},
+		{"nothing left to take", hourly, group(1, "2026-06-01T09:30:00Z"), nil, 0, 0, false, true},
+		{"digests switched off", nil, group(3, "2026-06-01T10:10:00Z"), nil, 3, 3, true, true},
+	}
+	for _, tc := range cases {
+		f := digestDB(tc.lastCut, tc.assigned)
+		d := &Dispatcher{db: sql.OpenDB(f), log: zap.NewNop()}
+		n, err := d.cutDigest(tc.g, tc.cfg, now)
+		d.db.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if n != tc.want {
+			t.Errorf("%s: took %d, want %d", tc.name, n, tc.want)
+		}
+		if f.has("BEGIN") != tc.began || f.has("COMMIT") != tc.commit {
+			t.Errorf("%s: statements %q", tc.name, f.log)
+		}
+		if f.has("INSERT INTO webhook_deliveries") != tc.commit {
+			t.Errorf("%s: delivery queued = %v, want %v", tc.name, !tc.commit, tc.commit)
+		}
+		if tc.began && !tc.commit && !f.has("ROLLBACK") {
+			t.Errorf("%s: not rolled back: %q", tc.name, f.log)
+		}
+	}
+}
+
+func TestCutDigestStatements(t *testing.T) {
+	now := mustTime(t, "2026-06-01T10:20:00Z")
+
+	// Count digests take the oldest Every items
+	f := digestDB(nil, 5)
+	d := &Dispatcher{db: sql.OpenDB(f), log: zap.NewNop()}
+	g := digestGroup{Channel: "webhook", WebhookID: 3, FormID: "f", Version: 2, Pending: 9, Oldest: now}
+	if _, err := d.cutDigest(g, &types.DigestConfig{Schedule: digestCount, Every: 5}, now); err != nil {
+		t.Fatal(err)
+	}
+	update := f.args["UPDATE webhook_digest_items SET digest_id=?"]
+	if q := f.log[2]; !strings.HasSuffix(q, "ORDER BY id LIMIT ?") || strings.Contains(q, "created_at") {
+		t.Errorf("count update: %s", q)
+	}
+	if got := update[len(update)-1].Value; got != int64(5) {
+		t.Errorf("count limit = %v, want 5", got)
+	}
+	var data digestData
+	delivery := f.args["INSERT INTO webhook_deliveries(submission_id,webhook_id,channel,event,event_id,occurred_at,form_id,version,payload_json) VALUES(0,?,?,?,?,NOW(3),?,?,?)"]
+	if err := json.Unmarshal([]byte(delivery[len(delivery)-1].Value.(string)), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data != (digestData{DigestID: 7, FormID: "f", Version: 2, Count: 5}) {
+		t.Errorf("count payload = %+v", data)
+	}
+	d.db.Close()
+
+	// Period digests take what was created before the period ended
+	f = digestDB(nil, 2)
+	d = &Dispatcher{db: sql.OpenDB(f), log: zap.NewNop()}
+	g.Oldest = mustTime(t, "2026-06-01T09:30:00Z")
+	if _, err := d.cutDigest(g, &types.DigestConfig{Schedule: digestHourly}, now); err != nil {
+		t.Fatal(err)
+	}
+	end := mustTime(t, "2026-06-01T10:00:00Z")
+	if got := f.args["INSERT INTO webhook_digests(channel,webhook_id,form_id,version,period_end,created_at) VALUES(?,?,?,?,?,UTC_TIMESTAMP(3))"][4].Value; got != end {
+		t.Errorf("period_end = %v, want %v", got, end)
+	}
+	update = f.args["UPDATE webhook_digest_items SET digest_id=?"]
+	if q := f.log[3]; !strings.HasSuffix(q, "AND created_at < ? ORDER BY id") {
+		t.Errorf("period update: %s", q)
+	}
+	if got := update[len(update)-1].Value; got != end {
+		t.Errorf("created_at bound = %v, want %v", got, end)
+	}
+	delivery = f.args["INSERT INTO webhook_deliveries(submission_id,webhook_id,channel,event,event_id,occurred_at,form_id,version,payload_json) VALUES(0,?,?,?,?,NOW(3),?,?,?)"]
+	if err := json.Unmarshal([]byte(delivery[len(delivery)-1].Value.(string)), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.PeriodEnd != "2026-06-01T10:00:00.000Z" || data.Count != 2 {
+		t.Errorf("period payload = %+v", data)
+	}
+	d.db.Close()
+}
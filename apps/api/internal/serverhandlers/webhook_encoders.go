@@ -0,0 +1,308 @@
+package serverhandlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/config"
+	"github.com/example/formrepo/apps/api/internal/outbound"
+	"github.com/example/formrepo/apps/api/internal/types"
+)
+
+// Webhooks without a body template whose content_type is one of these get a
+// form body instead of the default JSON payload: the submission metadata
+// followed by one field per selected answer, in form order.
+const (
+	formURLEncoded = "application/x-www-form-urlencoded"
+	multipartForm  = "multipart/form-data"
+)
+
+// maxWebhookFileBytes caps each uploaded file streamed into a multipart body.
+const maxWebhookFileBytes = 25 << 20
+
+// webhookFileTimeout bounds fetching one uploaded file for a multipart body.
+const webhookFileTimeout = 60 * time.Second
+
+// newWebhookFileClient returns the client that fetches uploaded files for
+// multipart bodies, limited to the upload hosts.
+func newWebhookFileClient(cfg *config.Config) *http.Client {
+	return outboundPolicy(cfg, outbound.Uploads).Client(webhookFileTimeout, nil)
+}
+
+func webhookMediaType(ct string) string {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(ct))
+	}
+	return mt
+}
+
+// usesMultipartEncoder reports whether the webhook's body is built by the
+// multipart encoder rather than a template or mapping.
+func usesMultipartEncoder(wh *webhookRow) bool {
+	return (wh.Mode == "raw" || wh.Mode == "") && !usesBodyTemplate(wh) &&
+		webhookMediaType(wh.ContentType) == multipartForm
+}
+
+type formField struct{ Name, Value string }
+
+// formFile is an uploaded file sent as its own multipart part.
+type formFile struct{ Field, Filename, URL string }
+
+// formBody is a submission flattened into form fields.
+type formBody struct {
+	Fields   []formField
+	Files    []formFile // multipart only, fetched when the request is built
+	Boundary string
+}
+
+// newFormBody flattens a submission for the form encoders. With withFiles set,
+// file_upload answers become file parts; otherwise they are sent as their URLs.
+func newFormBody(wh *webhookRow, fields []types.Field, submissionId uint64, body []byte, withFiles bool) *formBody {
+	var base map[string]any
+	_ = json.Unmarshal(body, &base)
+	allAnswers, _ := base["answers"].(map[string]any)
+	locale := "en"
+	if meta, ok := base["meta"].(map[string]any); ok {
+		if loc, ok := meta["locale"].(string); ok && loc != "" {
+			locale = loc
+		}
+	}
+
+	fb := &formBody{}
+	if event, _ := base["event"].(string); event != "" {
+		fb.add("event", event)
+		fb.add("id", formatAnswer(base["id"], locale))
+		fb.add("occurredAt", formatAnswer(base["occurredAt"], locale))
+	}
+	fb.add("submissionId", fmt.Sprintf("%d", submissionId))
+	fb.add("formId", wh.FormID)
+	fb.add("version", fmt.Sprintf("%d", wh.Version))
+	fb.add("submittedAt", formatAnswer(base["submittedAt"], locale))
+	fb.add("locale", locale)
+
+	answers := selectAnswers(wh, allAnswers)
+	fieldTypes := make(map[string]string, len(fields))
+	order := make([]string, 0, len(answers))
+	for _, f := range fields {
+		fieldTypes[f.Name] = f.Type
+		if _, ok := answers[f.Name]; ok {
+			order = append(order, f.Name)
+		}
+	}
+	var rest []string
+	for name := range answers {
+		if _, known := fieldTypes[name]; !known {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	for _, name := range append(order, rest...) {
+		v := answers[name]
+		if withFiles && fieldTypes[name] == "file_upload" {
+			if fb.addFiles(name, v) {
+				continue
+			}
+		}
+		fb.add(name, formatAnswer(v, locale))
+	}
+	if withFiles {
+		fb.Boundary = multipart.NewWriter(io.Discard).Boundary()
+	}
+	return fb
+}
+
+func (fb *formBody) add(name, value string) {
+	fb.Fields = append(fb.Fields, formField{name, value})
+}
+
+// addFiles adds a part per uploaded file in a file_upload answer.
+func (fb *formBody) addFiles(field string, v any) bool {
+	var items []any
+	switch x := v.(type) {
+	case []any:
+		items = x
+	case map[string]any:
+		items = []any{x}
+	default:
+		return false
+	}
+	added := false
+	for _, item := range items {
+		m, _ := item.(map[string]any)
+		u, _ := m["url"].(string)
+		if u == "" {
+			continue
+		}
+		name, _ := m["name"].(string)
+		if name == "" {
+			if parsed, err := url.Parse(u); err == nil {
+				name = path.Base(parsed.Path)
+			}
+		}
+		fb.Files = append(fb.Files, formFile{Field: field, Filename: name, URL: u})
+		added = true
+	}
+	return added
+}
+
+// urlEncoded encodes the fields in order; url.Values would sort them.
+func (fb *formBody) urlEncoded() []byte {
+	var b strings.Builder
+	for i, f := range fb.Fields {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(url.QueryEscape(f.Name))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(f.Value))
+	}
+	return []byte(b.String())
+}
+
+func (fb *formBody) contentType() string {
+	return mime.FormatMediaType(multipartForm, map[string]string{"boundary": fb.Boundary})
+}
+
+// placeholder renders the multipart body with each file part holding a note
+// instead of the file, for previews, validation and test sends.
+func (fb *formBody) placeholder() []byte {
+	var buf bytes.Buffer
+	_ = fb.write(&buf, func(f formFile) (io.ReadCloser, string, error) {
+		return io.NopCloser(strings.NewReader("[file " + f.URL + "]")), "application/octet-stream", nil
+	})
+	return buf.Bytes()
+}
+
+// write writes the multipart body, calling open for each file part's contents
+// and content type. Files are copied straight into their part, never held in memory.
+func (fb *formBody) write(w io.Writer, open func(formFile) (io.ReadCloser, string, error)) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(fb.Boundary); err != nil {
+		return err
+	}
+	for _, f := range fb.Fields {
+		if err := mw.WriteField(f.Name, f.Value); err != nil {
+			return err
+		}
+	}
+	for _, f := range fb.Files {
+		if err := fb.writeFile(mw, f, open); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func (fb *formBody) writeFile(mw *multipart.Writer, f formFile, open func(formFile) (io.ReadCloser, string, error)) error {
+	rc, ct, err := open(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, quoteEscaper.Replace(f.Field), quoteEscaper.Replace(f.Filename)))
+	h.Set("Content-Type", ct)
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(part, io.LimitReader(rc, maxWebhookFileBytes+1))
+	if err != nil {
+		return &webhookFileError{URL: f.URL, Err: err}
+	}
+	if n > maxWebhookFileBytes {
+		return fmt.Errorf("file %s is larger than %d MB", f.URL, maxWebhookFileBytes>>20)
+	}
+	return nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// webhookFileError is a failure fetching an uploaded file; unlike the rest of
+// building a request it is worth retrying.
+type webhookFileError struct {
+	URL string
+	Err error
+}
+
+func (e *webhookFileError) Error() string { return "fetch " + e.URL + ": " + e.Err.Error() }
+
+func (e *webhookFileError) Unwrap() error { return e.Err }
+
+// openWebhookFile fetches an uploaded file with client. Only files in the
+// configured Cloudinary account are fetched, and client only reaches the
+// upload hosts: the URLs come from the submission, so anything else could
+// point the API at an arbitrary host.
+func openWebhookFile(ctx context.Context, cfg *config.Config, client *http.Client) func(formFile) (io.ReadCloser, string, error) {
+	return func(f formFile) (io.ReadCloser, string, error) {
+		u, err := url.Parse(f.URL)
+		if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Path, "/"+cfg.CloudName+"/") {
+			return nil, "", fmt.Errorf("file %s is not a Cloudinary upload", f.URL)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, "", &webhookFileError{URL: f.URL, Err: err}
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, "", &webhookFileError{URL: f.URL, Err: fmt.Errorf("unexpected status %d", resp.StatusCode)}
+		}
+		ct := resp.Header.Get("Content-Type")
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		return resp.Body, ct, nil
+	}
+}
+
+// spooledBody is a request body written to a temp file so it can be signed
+// before sending; closing it removes the file.
+type spooledBody struct {
+	*os.File
+	size int64
+}
+
+func (s *spooledBody) Close() error {
+	err := s.File.Close()
+	os.Remove(s.File.Name())
+	return err
+}
+
+// spoolMultipart writes the multipart body, files included, to a temp file.
+func spoolMultipart(ctx context.Context, cfg *config.Config, files *http.Client, fb *formBody) (*spooledBody, error) {
+	f, err := os.CreateTemp("", "webhook-*.multipart")
+	if err != nil {
+		return nil, err
+	}
+	s := &spooledBody{File: f}
+	if err := fb.write(f, openWebhookFile(ctx, cfg, files)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.size, err = f.Seek(0, io.SeekCurrent); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,198 @@
+package serverhandlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Webhooks subscribe to a set of event types, submission.created when they
+// don't say. Every delivery carries an envelope: the event, an id that stays
+// the same across retries, redeliveries and replays, and when it occurred.
+// submission.created keeps the submission body the webhook is configured to
+// send, with the envelope's keys added to the default payload and available to
+// templates and mappings. Other events are sent as the JSON envelope with the
+// event's details under "data"; body templates, mappings, filters and
+// dependencies are about submissions and don't apply to them.
+
+const (
+	eventSubmissionCreated = "submission.created"
+	eventSubmissionUpdated = "submission.updated"
+	eventSubmissionDeleted = "submission.deleted"
+	eventFormPublished     = "form.published"
+	eventFormDeleted       = "form.deleted"
+	eventQuestionUpdated   = "question.updated"
+	eventDeliveryFailed    = "webhook.delivery_failed"
+)
+
+var webhookEvents = map[string]bool{
+	eventSubmissionCreated: true,
+	eventSubmissionUpdated: true,
+	eventSubmissionDeleted: true,
+	eventFormPublished:     true,
+	eventFormDeleted:       true,
+	eventQuestionUpdated:   true,
+	eventDeliveryFailed:    true,
+}
+
+// webhookSubscribedSQL is the condition that webhook w subscribes to the event
+// bound to its placeholder.
+const webhookSubscribedSQL = `JSON_CONTAINS(COALESCE(w.events_json, JSON_ARRAY('submission.created')), JSON_QUOTE(?))`
+
+// eventEnvelope is common to every payload.
+type eventEnvelope struct {
+	Event      string `json:"event"`
+	ID         string `json:"id"`
+	OccurredAt string `json:"occurredAt"`
+}
+
+func newEventEnvelope(event string) eventEnvelope {
+	return eventEnvelope{Event: event, ID: generateUUID(), OccurredAt: formatOccurredAt(time.Now())}
+}
+
+func formatOccurredAt(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// validateWebhookEvents checks the event types a webhook subscribes to. Chat
+// messages are built from a submission, so chat webhooks only take new ones.
+func validateWebhookEvents(events []string, mode string) []string {
+	var errs []string
+	seen := map[string]bool{}
+	for i, e := range events {
+		switch {
+		case !webhookEvents[e]:
+			errs = append(errs, fmt.Sprintf("/events/%d: unknown event type %q", i, e))
+		case seen[e]:
+			errs = append(errs, fmt.Sprintf("/events/%d: %s is listed twice", i, e))
+		case chatModes[mode] && e != eventSubmissionCreated:
+			errs = append(errs, fmt.Sprintf("/events/%d: %s webhooks only support %s", i, mode, eventSubmissionCreated))
+		}
+		seen[e] = true
+	}
+	return errs
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// enqueueEvent queues a delivery of event to every enabled webhook that fires
+// for the form version and subscribes to it. submissionId is 0 for events
+// that aren't about a submission.
+func enqueueEvent(q sqlExecer, formId string, version int, submissionId uint64, event string, data any) (int64, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	env := newEventEnvelope(event)
+	res, err := q.Exec(`INSERT INTO webhook_deliveries(submission_id,webhook_id,event,event_id,occurred_at,form_id,version,payload_json)
+		SELECT ?, w.id, ?, ?, NOW(3), w.form_id, ?, ? FROM form_webhooks w WHERE `+webhookFiresSQL("?", "?")+` AND `+webhookSubscribedSQL+`
+		ORDER BY w.version, w.position, w.id`,
+		submissionId, event, env.ID, version, string(payload), formId, version, version, event)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// withEnvelope adds the envelope's keys to a submission body, where the
+// default payload, templates and mappings pick them up.
+func withEnvelope(body []byte, env eventEnvelope) []byte {
+	var base map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&base); err != nil || base == nil {
+		return body
+	}
+	base["event"] = env.Event
+	base["id"] = env.ID
+	base["occurredAt"] = env.OccurredAt
+	out, err := json.Marshal(base)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// renderEventWebhook renders the delivery of an event other than
+// submission.created: the envelope with data, as JSON. Templates in the URL,
+// query parameters and headers see the envelope's fields, formId, version
+// and data.
+func renderEventWebhook(wh *webhookRow, env eventEnvelope, data []byte) (*renderedWebhook, error) {
+	body, err := json.Marshal(struct {
+		eventEnvelope
+		Data json.RawMessage `json:"data"`
+	}{env, data})
+	if err != nil {
+		return nil, err
+	}
+	r := &renderedWebhook{URL: wh.URL, Headers: make(map[string]string, len(wh.Headers)), Body: body, ContentType: "application/json"}
+	if err := renderEventTarget(wh, r, env, data); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// renderEventTarget renders the URL, query parameters and headers of an event
+// delivery.
+func renderEventTarget(wh *webhookRow, r *renderedWebhook, env eventEnvelope, data []byte) error {
+	var details any
+	_ = json.Unmarshal(data, &details)
+	ctx := map[string]any{
+		"event":      env.Event,
+		"eventId":    env.ID,
+		"occurredAt": env.OccurredAt,
+		"formId":     wh.FormID,
+		"version":    wh.Version,
+		"data":       details,
+	}
+	return renderWebhookTarget(wh, r, nil, "en", ctx)
+}
+
+// setEventHeaders identifies the event on every delivery, whatever its body.
+func setEventHeaders(r *renderedWebhook, env eventEnvelope) {
+	r.Headers["X-Webhook-Event"] = env.Event
+	r.Headers["X-Webhook-Event-Id"] = env.ID
+}
+
+// enqueueQuestionUpdated queues question.updated for every form whose latest
+// version has a field bound to the question's attribute. Published versions
+// keep their copy of the question until the form is republished.
+func enqueueQuestionUpdated(tx *sql.Tx, attributeKey string, question map[string]any) (int64, error) {
+	rows, err := tx.Query(`SELECT s.form_id, s.version FROM form_snapshots s
+		WHERE s.version=(SELECT MAX(m.version) FROM form_snapshots m WHERE m.form_id=s.form_id)
+		AND JSON_CONTAINS(JSON_EXTRACT(s.fields_json, '$[*].attribute_key'), JSON_QUOTE(?))`, attributeKey)
+	if err != nil {
+		return 0, err
+	}
+	type formVersion struct {
+		id      string
+		version int
+	}
+	var forms []formVersion
+	for rows.Next() {
+		var f formVersion
+		if err := rows.Scan(&f.id, &f.version); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		forms = append(forms, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	var queued int64
+	for _, f := range forms {
+		n, err := enqueueEvent(tx, f.id, f.version, 0, eventQuestionUpdated, map[string]any{"formId": f.id, "version": f.version, "question": question})
+		if err != nil {
+			return 0, err
+		}
+		queued += n
+	}
+	return queued, nil
+}
@@ -0,0 +1,48 @@
+package serverhandlers
+
+import (
+	"encoding/json"
+
+	"github.com/example/formrepo/apps/api/internal/filterexpr"
+)
+
+// validateFilter checks a webhook's filter expression; blank means "always fire".
+func validateFilter(expr string) []string {
+	if expr == "" {
+		return nil
+	}
+	if _, err := filterexpr.Parse(expr); err != nil {
+		return []string{"/filter: " + err.Error()}
+	}
+	return nil
+}
+
+// filterEnv is what filter expressions see: the submission body as sent by the
+// renderer, with locale, device and attributes lifted out of meta for brevity.
+func filterEnv(body []byte) map[string]any {
+	env := map[string]any{}
+	_ = json.Unmarshal(body, &env)
+	if meta, ok := env["meta"].(map[string]any); ok {
+		for _, k := range []string{"locale", "device", "attributes"} {
+			if _, taken := env[k]; !taken {
+				env[k] = meta[k]
+			}
+		}
+	}
+	return env
+}
+
+// webhookFilterMatches reports whether the webhook should fire for the
+// submission body. A filter that no longer parses (it was validated on save,
+// so only a hand-edited row gets here) lets the delivery through rather than
+// silently dropping it.
+func webhookFilterMatches(wh *webhookRow, body []byte) (bool, error) {
+	if wh.Filter == nil || *wh.Filter == "" {
+		return true, nil
+	}
+	expr, err := filterexpr.Parse(*wh.Filter)
+	if err != nil {
+		return true, err
+	}
+	return expr.Match(filterEnv(body)), nil
+}
@@ -0,0 +1,325 @@
+package serverhandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/example/formrepo/apps/api/internal/types"
+)
+
+// A mapping document describes the JSON body of a "mapping" mode webhook.
+// Each output key maps to one of:
+//
+//	"answers.phone_number.e164"                    a source path
+//	42, true, null                                 a constant
+//	{"const": "lead"}                              a constant of any type, strings included
+//	{"path": "answers.city", "transform": "label"} a path with transforms applied in order
+//	{"contact": {"phone": "answers.phone.e164"}}   a nested object
+//	["answers.a", "answers.b"]                     an array
+//
+// Path specs may also set "default" (used when the value is missing or empty),
+// "separator" (for join) and "locale" (for label).
+
+// mappingRoots are the names a source path may start with.
+var mappingRoots = map[string]bool{
+	"formId": true, "version": true, "submissionId": true, "submittedAt": true,
+	"locale": true, "device": true, "sessionId": true, "attributes": true,
+	"answers": true, "meta": true, "responses": true,
+}
+
+var mappingTransforms = map[string]bool{
+	"label": true, "join": true, "lowercase": true, "uppercase": true,
+	"trim": true, "string": true, "number": true,
+}
+
+var mappingSpecKeys = map[string]bool{"path": true, "transform": true, "default": true, "separator": true, "locale": true}
+
+// validateMapping checks a mapping document against the form's fields.
+func validateMapping(raw json.RawMessage, fields []types.Field) []string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return []string{"/mapping: required in mapping mode"}
+	}
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return []string{"/mapping: invalid JSON: " + err.Error()}
+	}
+	if _, ok := doc.(map[string]any); !ok {
+		return []string{"/mapping: must be an object"}
+	}
+	names := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		names[f.Name] = true
+	}
+	var errs []string
+	checkMappingNode("/mapping", doc, names, &errs)
+	return errs
+}
+
+func checkMappingNode(at string, v any, fields map[string]bool, errs *[]string) {
+	switch x := v.(type) {
+	case string:
+		checkMappingPath(at, x, fields, errs)
+	case []any:
+		for i, item := range x {
+			checkMappingNode(at+"/"+strconv.Itoa(i), item, fields, errs)
+		}
+	case map[string]any:
+		if _, ok := x["const"]; ok {
+			if len(x) > 1 {
+				*errs = append(*errs, at+": const can't be combined with other keys")
+			}
+			return
+		}
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		p, ok := x["path"]
+		if !ok {
+			for _, k := range keys {
+				checkMappingNode(at+"/"+k, x[k], fields, errs)
+			}
+			return
+		}
+		for _, k := range keys {
+			if !mappingSpecKeys[k] {
+				*errs = append(*errs, fmt.Sprintf("%s: unknown key %q", at, k))
+			}
+		}
+		path, ok := p.(string)
+		if !ok {
+			*errs = append(*errs, at+"/path: must be a string")
+			return
+		}
+		checkMappingPath(at+"/path", path, fields, errs)
+		transforms, err := mappingTransformList(x["transform"])
+		if err != nil {
+			*errs = append(*errs, at+"/transform: "+err.Error())
+		}
+		for _, t := range transforms {
+			if !mappingTransforms[t] {
+				*errs = append(*errs, fmt.Sprintf("%s/transform: unknown transform %q", at, t))
+			}
+		}
+		for _, k := range []string{"separator", "locale"} {
+			if v, ok := x[k]; ok {
+				if _, isStr := v.(string); !isStr {
+					*errs = append(*errs, at+"/"+k+": must be a string")
+				}
+			}
+		}
+	}
+}
+
+func checkMappingPath(at, path string, fields map[string]bool, errs *[]string) {
+	segs := strings.Split(path, ".")
+	if !mappingRoots[segs[0]] {
+		*errs = append(*errs, fmt.Sprintf("%s: unknown source %q", at, path))
+		return
+	}
+	for _, s := range segs {
+		if s == "" {
+			*errs = append(*errs, fmt.Sprintf("%s: invalid path %q", at, path))
+			return
+		}
+	}
+	if segs[0] == "answers" && len(segs) > 1 && len(fields) > 0 && !fields[segs[1]] {
+		*errs = append(*errs, fmt.Sprintf("%s: unknown field %q", at, segs[1]))
+	}
+}
+
+func mappingTransformList(v any) ([]string, error) {
+	switch x := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{x}, nil
+	case []any:
+		out := make([]string, 0, len(x))
+		for _, t := range x {
+			s, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("must be a string or a list of strings")
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("must be a string or a list of strings")
+}
+
+// mappingEnv is what source paths resolve against.
+func mappingEnv(body []byte, submissionId uint64, locale string) map[string]any {
+	env := filterEnv(body)
+	env["submissionId"] = submissionId
+	env["locale"] = locale
+	if meta, ok := env["meta"].(map[string]any); ok {
+		env["sessionId"] = meta["sessionId"]
+	}
+	return env
+}
+
+func lookupPath(env map[string]any, path string) any {
+	var cur any = env
+	for _, seg := range strings.Split(path, ".") {
+		switch v := cur.(type) {
+		case map[string]any:
+			cur = v[seg]
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			cur = v[i]
+		default:
+			return nil
+		}
+	}
+	return cur
+}
+
+// buildMappedBody renders a mapping document into a JSON body.
+func buildMappedBody(raw json.RawMessage, fields []types.Field, env map[string]any, locale string) ([]byte, error) {
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("mapping: %w", err)
+	}
+	out, err := evalMapping(doc, fields, env, locale)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(out)
+}
+
+func evalMapping(v any, fields []types.Field, env map[string]any, locale string) (any, error) {
+	switch x := v.(type) {
+	case string:
+		return lookupPath(env, x), nil
+	case []any:
+		out := make([]any, len(x))
+		for i, item := range x {
+			val, err := evalMapping(item, fields, env, locale)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = val
+		}
+		return out, nil
+	case map[string]any:
+		if c, ok := x["const"]; ok {
+			return c, nil
+		}
+		if _, ok := x["path"]; ok {
+			return evalMappingSpec(x, fields, env, locale)
+		}
+		out := make(map[string]any, len(x))
+		for k, child := range x {
+			val, err := evalMapping(child, fields, env, locale)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = val
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+func evalMappingSpec(spec map[string]any, fields []types.Field, env map[string]any, locale string) (any, error) {
+	path, _ := spec["path"].(string)
+	val := lookupPath(env, path)
+	transforms, err := mappingTransformList(spec["transform"])
+	if err != nil {
+		return nil, fmt.Errorf("mapping %s: %w", path, err)
+	}
+	for _, t := range transforms {
+		if val == nil {
+			break
+		}
+		switch t {
+		case "label":
+			loc := locale
+			if l, ok := spec["locale"].(string); ok && l != "" {
+				loc = l
+			}
+			field := ""
+			if segs := strings.Split(path, "."); len(segs) > 1 && segs[0] == "answers" {
+				field = segs[1]
+			}
+			val = optionLabel(fields, loc, field, val)
+		case "join":
+			sep, ok := spec["separator"].(string)
+			if !ok {
+				sep = ", "
+			}
+			if list, ok := val.([]any); ok {
+				parts := make([]string, len(list))
+				for i, item := range list {
+					parts[i] = formatAnswer(item, locale)
+				}
+				val = strings.Join(parts, sep)
+			} else {
+				val = formatAnswer(val, locale)
+			}
+		case "lowercase":
+			val = strings.ToLower(mappingString(val, locale))
+		case "uppercase":
+			val = strings.ToUpper(mappingString(val, locale))
+		case "trim":
+			val = strings.TrimSpace(mappingString(val, locale))
+		case "string":
+			val = mappingString(val, locale)
+		case "number":
+			n, ok := number(val)
+			if !ok {
+				val = nil
+			} else {
+				val = n
+			}
+		default:
+			return nil, fmt.Errorf("mapping %s: unknown transform %q", path, t)
+		}
+	}
+	if def, ok := spec["default"]; ok && isEmptyValue(val) {
+		return def, nil
+	}
+	return val, nil
+}
+
+func mappingString(v any, locale string) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return formatAnswer(v, locale)
+}
+
+func number(v any) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return f, err == nil
+	case map[string]any:
+		return number(x["value"])
+	}
+	return 0, false
+}
+
+func isEmptyValue(v any) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case string:
+		return x == ""
+	case []any:
+		return len(x) == 0
+	case map[string]any:
+		return len(x) == 0
+	}
+	return false
+}
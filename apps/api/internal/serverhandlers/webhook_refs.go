@@ -0,0 +1,107 @@
+package serverhandlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A webhook's external_refs maps names to paths in its successful JSON
+// responses, e.g. {"crm_ticket_id": "$.data.ticket_id"}. The values are merged
+// into the submission's external_refs so support can find the record the
+// submission created elsewhere. Refs are bookkeeping: a missing one is logged,
+// it doesn't fail the delivery.
+
+var responseIndexPattern = regexp.MustCompile(`\[(\d+)\]`)
+
+// responsePath normalizes a response path to the dot form lookupPath takes:
+// "$.data.items[0].id" and "data.items.0.id" are the same path.
+func responsePath(p string) string {
+	p = strings.TrimSpace(p)
+	p = strings.TrimPrefix(p, "$")
+	p = responseIndexPattern.ReplaceAllString(p, ".$1")
+	return strings.TrimPrefix(p, ".")
+}
+
+func validResponsePath(p string) bool {
+	p = responsePath(p)
+	return p != "" && !strings.Contains("."+p+".", "..") && !strings.ContainsAny(p, "[]*")
+}
+
+// lookupResponse decodes a JSON response and returns a lookup for paths in it.
+// Numbers are kept as written so long IDs aren't rounded.
+func lookupResponse(body []byte) (func(path string) any, error) {
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	env := map[string]any{"$": doc}
+	return func(path string) any { return lookupPath(env, "$."+responsePath(path)) }, nil
+}
+
+// validateExternalRefs checks ref names and paths.
+func validateExternalRefs(refs map[string]string) []string {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []string
+	for _, name := range names {
+		at := "/external_refs/" + name
+		if !extractNamePattern.MatchString(name) {
+			errs = append(errs, at+": name must be letters, digits and underscores, not starting with a digit")
+		}
+		if !validResponsePath(refs[name]) {
+			errs = append(errs, fmt.Sprintf("%s: invalid path %q", at, refs[name]))
+		}
+	}
+	return errs
+}
+
+// extractExternalRefs pulls the configured refs out of a response, returning
+// the names it couldn't find.
+func extractExternalRefs(refs map[string]string, body []byte) (map[string]any, []string) {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lookup, err := lookupResponse(body)
+	if err != nil {
+		return nil, names
+	}
+	found := make(map[string]any, len(refs))
+	var missing []string
+	for _, name := range names {
+		v := lookup(refs[name])
+		switch v.(type) {
+		case nil, map[string]any, []any:
+			// Only scalars make useful references
+			missing = append(missing, name)
+		default:
+			found[name] = v
+		}
+	}
+	return found, missing
+}
+
+// saveExternalRefs merges refs into the submission's external_refs; a later
+// webhook extracting the same name overwrites it.
+func saveExternalRefs(db *sql.DB, submissionId uint64, refs map[string]any) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE submissions SET external_refs=JSON_MERGE_PATCH(COALESCE(external_refs, JSON_OBJECT()), CAST(? AS JSON)) WHERE id=?", string(b), submissionId)
+	return err
+}
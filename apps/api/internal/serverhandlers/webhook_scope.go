@@ -0,0 +1,60 @@
+package serverhandlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Webhooks belong either to one version of a form or to the form itself.
+// Form-level webhooks are stored with version 0 and fire for every version.
+// A version's own webhooks take precedence: one with the same endpoint URL and
+// method as a form-level webhook replaces it for that version. That holds for
+// disabled ones too, so a disabled copy mutes the form-level webhook there.
+// Dependencies stay within a scope.
+
+// formLevelVersion is the version of form-level webhooks. Published versions
+// start at 1.
+const formLevelVersion = 0
+
+// webhookFiresSQL is the condition selecting the webhooks w that fire for a
+// submission of form and version (SQL expressions), applying the precedence
+// above. Order by w.version, w.position, w.id to queue form-level webhooks
+// first. Auto-disabled webhooks still fire: their deliveries wait for a
+// breaker reset.
+func webhookFiresSQL(form, version string) string {
+	return `w.form_id=` + form + ` AND (w.enabled=1 OR w.disabled_reason LIKE '` + autoDisabledPrefix + `%') AND (w.version=` + version + ` OR (w.version=0 AND NOT EXISTS (
+		SELECT 1 FROM form_webhooks o WHERE o.form_id=w.form_id AND o.version=` + version + ` AND o.endpoint_url=w.endpoint_url AND o.http_method=w.http_method)))`
+}
+
+// webhookVersionParam returns the :version of a webhook route, or
+// formLevelVersion on the /forms/:formId/webhooks routes, writing the error
+// response itself when it is invalid.
+func webhookVersionParam(c *gin.Context) (int, bool) {
+	s := c.Param("version")
+	if s == "" {
+		return formLevelVersion, true
+	}
+	version, err := strconv.Atoi(s)
+	if err != nil || version <= formLevelVersion {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return 0, false
+	}
+	return version, true
+}
+
+// latestFormVersion returns the newest published version of a form.
+func latestFormVersion(q queryRower, formId string) (int, error) {
+	var version int
+	err := q.QueryRow("SELECT version FROM form_snapshots WHERE form_id=? ORDER BY version DESC LIMIT 1", formId).Scan(&version)
+	return version, err
+}
+
+// chainVersion is the version whose webhooks wh may depend on.
+func (wh *webhookRow) chainVersion() int {
+	if wh.FormLevel {
+		return formLevelVersion
+	}
+	return wh.Version
+}
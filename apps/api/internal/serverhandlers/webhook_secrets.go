@@ -0,0 +1,229 @@
+package serverhandlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/formrepo/apps/api/internal/config"
+	"github.com/example/formrepo/apps/api/pkg/webhooksig"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// defaultRotationGrace is how long the previous secrets keep signing after a rotation.
+const defaultRotationGrace = 24 * time.Hour
+
+type WebhookSecret struct {
+	ID        uint64     `json:"id"`
+	Secret    string     `json:"secret"` // masked except in the create/rotate response
+	Active    bool       `json:"active"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	CreatedAt string     `json:"createdAt"`
+}
+
+type rotateSecretReq struct {
+	// Seconds the current secrets stay valid; 0 revokes them immediately
+	GraceSeconds *int `json:"grace_seconds,omitempty"`
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// maskSecret keeps the prefix and the last four characters.
+func maskSecret(s string) string {
+	if len(s) <= 10 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:6] + strings.Repeat("*", 8) + s[len(s)-4:]
+}
+
+// createWebhookSecret stores a fresh secret for the webhook and returns it in the clear.
+func createWebhookSecret(db interface {
+	Exec(string, ...any) (sql.Result, error)
+}, webhookId uint64) (WebhookSecret, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return WebhookSecret{}, err
+	}
+	res, err := db.Exec("INSERT INTO webhook_secrets(webhook_id, secret) VALUES(?,?)", webhookId, secret)
+	if err != nil {
+		return WebhookSecret{}, err
+	}
+	id, _ := res.LastInsertId()
+	return WebhookSecret{ID: uint64(id), Secret: secret, Active: true, CreatedAt: time.Now().UTC().Format(time.RFC3339)}, nil
+}
+
+// activeWebhookSecrets returns the secrets currently signing for a webhook, newest first.
+func activeWebhookSecrets(q queryRower, webhookId uint64) ([][]byte, error) {
+	var joined sql.NullString
+	err := q.QueryRow("SELECT GROUP_CONCAT(secret ORDER BY id DESC SEPARATOR ',') FROM webhook_secrets WHERE webhook_id=? AND (expires_at IS NULL OR expires_at > NOW(3))", webhookId).Scan(&joined)
+	if err != nil || !joined.Valid {
+		return nil, err
+	}
+	var out [][]byte
+	for _, s := range strings.Split(joined.String, ",") {
+		out = append(out, []byte(s))
+	}
+	return out, nil
+}
+
+// signWebhookRequest sets both signature headers. X-Webhook-Signature carries a
+// timestamp and one v1 signature per active secret; webhooks without secrets of
+// their own are signed with the global key. The legacy X-Signature header is
+// kept for receivers that haven't moved over yet.
+func signWebhookRequest(req *http.Request, cfg *config.Config, secrets [][]byte, body []byte) {
+	mac := hmac.New(sha256.New, []byte(cfg.WebhookSigningKey))
+	mac.Write(body)
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	if len(secrets) == 0 {
+		secrets = [][]byte{[]byte(cfg.WebhookSigningKey)}
+	}
+	req.Header.Set(webhooksig.HeaderName, webhooksig.Header(time.Now(), body, secrets...))
+}
+
+// signWebhookStream signs a body spooled to disk the same way, reading it once
+// and rewinding it for sending.
+func signWebhookStream(req *http.Request, cfg *config.Config, secrets [][]byte, body io.ReadSeeker) error {
+	mac := hmac.New(sha256.New, []byte(cfg.WebhookSigningKey))
+	if len(secrets) == 0 {
+		secrets = [][]byte{[]byte(cfg.WebhookSigningKey)}
+	}
+	header, err := webhooksig.HeaderFrom(time.Now(), io.TeeReader(body, mac), secrets...)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set(webhooksig.HeaderName, header)
+	return nil
+}
+
+// ListWebhookSecretsHandler lists a webhook's secrets, masked, newest first.
+func ListWebhookSecretsHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookId, ok := webhookParams(c, db, log)
+		if !ok {
+			return
+		}
+		rows, err := db.Query("SELECT id, secret, expires_at IS NULL OR expires_at > NOW(3), expires_at, created_at FROM webhook_secrets WHERE webhook_id=? ORDER BY id DESC", webhookId)
+		if err != nil {
+			log.Error("failed to query webhook secrets", zap.Error(err), zap.Uint64("webhookId", webhookId))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query secrets"})
+			return
+		}
+		defer rows.Close()
+
+		out := []WebhookSecret{}
+		for rows.Next() {
+			var s WebhookSecret
+			if err := rows.Scan(&s.ID, &s.Secret, &s.Active, &s.ExpiresAt, &s.CreatedAt); err != nil {
+				log.Error("failed to scan webhook secret", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query secrets"})
+				return
+			}
+			s.Secret = maskSecret(s.Secret)
+			out = append(out, s)
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// RotateWebhookSecretHandler issues a new secret. The secrets active until now
+// keep signing for the grace period (24h by default) so receivers can switch
+// over without dropping deliveries.
+func RotateWebhookSecretHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookId, ok := webhookParams(c, db, log)
+		if !ok {
+			return
+		}
+		var req rotateSecretReq
+		if c.Request.ContentLength > 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+				return
+			}
+		}
+		grace := defaultRotationGrace
+		if req.GraceSeconds != nil {
+			if *req.GraceSeconds < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "grace_seconds must be >= 0"})
+				return
+			}
+			grace = time.Duration(*req.GraceSeconds) * time.Second
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Error("failed to begin tx", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate secret"})
+			return
+		}
+		defer tx.Rollback()
+		// Only shorten lifetimes, never extend a secret that already expires sooner
+		_, err = tx.Exec(`UPDATE webhook_secrets SET expires_at=NOW(3) + INTERVAL ? MICROSECOND
+			WHERE webhook_id=? AND (expires_at IS NULL OR expires_at > NOW(3) + INTERVAL ? MICROSECOND)`,
+			grace.Microseconds(), webhookId, grace.Microseconds())
+		if err != nil {
+			log.Error("failed to expire webhook secrets", zap.Error(err), zap.Uint64("webhookId", webhookId))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate secret"})
+			return
+		}
+		secret, err := createWebhookSecret(tx, webhookId)
+		if err != nil {
+			log.Error("failed to create webhook secret", zap.Error(err), zap.Uint64("webhookId", webhookId))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate secret"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Error("failed to commit secret rotation", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate secret"})
+			return
+		}
+		log.Info("webhook secret rotated", zap.Uint64("webhookId", webhookId), zap.Duration("grace", grace))
+		c.JSON(http.StatusCreated, secret)
+	}
+}
+
+// RevokeWebhookSecretHandler stops a secret from signing immediately.
+func RevokeWebhookSecretHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookId, ok := webhookParams(c, db, log)
+		if !ok {
+			return
+		}
+		secretId, err := strconv.ParseUint(c.Param("secretId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret id"})
+			return
+		}
+		res, err := db.Exec("UPDATE webhook_secrets SET expires_at=NOW(3) WHERE id=? AND webhook_id=? AND (expires_at IS NULL OR expires_at > NOW(3))", secretId, webhookId)
+		if err != nil {
+			log.Error("failed to revoke webhook secret", zap.Error(err), zap.Uint64("secretId", secretId))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke secret"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "active secret not found"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
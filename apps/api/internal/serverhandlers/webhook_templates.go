@@ -0,0 +1,557 @@
+package serverhandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+
+	"github.com/example/formrepo/apps/api/internal/secrets"
+	"github.com/example/formrepo/apps/api/internal/types"
+)
+
+// templateError is a body template problem with its position in the template.
+type templateError struct {
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *templateError) Error() string {
+	if e.Col > 0 {
+		return fmt.Sprintf("line %d, col %d: %s", e.Line, e.Col, e.Msg)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// text/template reports "template: wh:3: msg" for parse errors and
+// "template: wh:3:14: executing "wh" at <.x>: msg" for execution errors.
+var templateErrPattern = regexp.MustCompile(`^template: wh:(\d+)(?::(\d+))?: (?:executing "wh" at <[^>]*>: )?(.*)$`)
+
+func toTemplateError(src string, err error) error {
+	if err == nil {
+		return nil
+	}
+	m := templateErrPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return &templateError{Line: 1, Msg: err.Error()}
+	}
+	te := &templateError{Msg: m[3]}
+	te.Line, _ = strconv.Atoi(m[1])
+	if m[2] != "" {
+		te.Col, _ = strconv.Atoi(m[2])
+	} else {
+		te.Col = locateParseError(src, te.Line)
+	}
+	return te
+}
+
+// locateParseError finds the column of the first action on the line that
+// already fails to parse when the template is cut right after it. Parse errors
+// only carry a line number, and a line often holds several actions.
+func locateParseError(src string, line int) int {
+	start := 0
+	for i := 1; i < line; i++ {
+		nl := strings.IndexByte(src[start:], '\n')
+		if nl < 0 {
+			return 0
+		}
+		start += nl + 1
+	}
+	end := len(src)
+	if nl := strings.IndexByte(src[start:], '\n'); nl >= 0 {
+		end = start + nl
+	}
+	for i := start; i < end; {
+		open := strings.Index(src[i:end], "{{")
+		if open < 0 {
+			break
+		}
+		open += i
+		close := strings.Index(src[open:], "}}")
+		if close < 0 {
+			return open - start + 1
+		}
+		stop := open + close + 2
+		_, err := template.New("wh").Funcs(webhookTemplateFuncs(nil, "en")).Parse(src[:stop])
+		if err != nil && !strings.Contains(err.Error(), "unexpected EOF") {
+			return open - start + 1
+		}
+		i = stop
+	}
+	return 0
+}
+
+// parseWebhookTemplate compiles a body template with the helper library.
+func parseWebhookTemplate(src string, fields []types.Field, locale string) (*template.Template, error) {
+	t, err := template.New("wh").Funcs(webhookTemplateFuncs(fields, locale)).Parse(src)
+	if err != nil {
+		return nil, toTemplateError(src, err)
+	}
+	return t, nil
+}
+
+// webhookTemplateFuncs is the helper library available to body templates.
+// Helpers take the piped value last, so {{.name.value | truncate 50}} works.
+func webhookTemplateFuncs(fields []types.Field, locale string) template.FuncMap {
+	return template.FuncMap{
+		"json":         func(v any) string { b, _ := json.Marshal(v); return string(b) },
+		"jsonEscape":   jsonEscape,
+		"formatAnswer": func(v any) string { return formatAnswer(v, locale) },
+		"optionLabel": func(field string, v any) string {
+			return optionLabel(fields, locale, field, v)
+		},
+		"optionLabelIn": func(loc, field string, v any) string {
+			return optionLabel(fields, loc, field, v)
+		},
+		"formatDate": formatDate,
+		"truncate":   truncate,
+		"default":    defaultValue,
+		// Added automatically to actions in endpoint URLs
+		"urlPathEscape":  func(v any) string { return url.PathEscape(mappingString(v, locale)) },
+		"urlQueryEscape": func(v any) string { return url.QueryEscape(mappingString(v, locale)) },
+	}
+}
+
+// jsonEscape returns v as the inside of a JSON string, without the quotes, for
+// templates like {"note": "{{jsonEscape .notes}}"}.
+func jsonEscape(v any) string {
+	s, ok := v.(string)
+	if !ok {
+		s = formatAnswer(v, "en")
+	}
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// optionLabel maps a select/radio/multiselect answer to its option label(s)
+// in the given locale, falling back to English and then to the raw value.
+func optionLabel(fields []types.Field, locale, field string, v any) string {
+	var options []any
+	for _, f := range fields {
+		if f.Name == field {
+			if props, ok := f.Props.(map[string]any); ok {
+				options, _ = props["options"].([]any)
+			}
+			break
+		}
+	}
+	label := func(val any) string {
+		if m, ok := val.(map[string]any); ok {
+			if m["value"] == "other" {
+				if other, ok := m["other"].(string); ok && other != "" {
+					return other
+				}
+			}
+			val = m["value"]
+		}
+		s := formatAnswer(val, locale)
+		for _, o := range options {
+			opt, _ := o.(map[string]any)
+			if opt == nil || formatAnswer(opt["value"], locale) != s {
+				continue
+			}
+			labels, _ := opt["label"].(map[string]any)
+			if l, ok := labels[locale].(string); ok && l != "" {
+				return l
+			}
+			if l, ok := labels["en"].(string); ok && l != "" {
+				return l
+			}
+		}
+		return s
+	}
+	if list, ok := v.([]any); ok {
+		out := make([]string, 0, len(list))
+		for _, item := range list {
+			out = append(out, label(item))
+		}
+		return strings.Join(out, ", ")
+	}
+	return label(v)
+}
+
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", "15:04"}
+
+// formatDate renders a date answer or timestamp (RFC 3339 or date strings,
+// Unix milliseconds like submittedAt) with a Go layout in the named timezone.
+// An empty timezone means UTC.
+func formatDate(layout, tz string, v any) (string, error) {
+	loc := time.UTC
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return "", fmt.Errorf("formatDate: unknown timezone %q", tz)
+		}
+	}
+	var t time.Time
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case time.Time:
+		t = x
+	case float64:
+		t = time.UnixMilli(int64(x))
+	case int64:
+		t = time.UnixMilli(x)
+	case int:
+		t = time.UnixMilli(int64(x))
+	case string:
+		if x == "" {
+			return "", nil
+		}
+		parsed := false
+		for _, l := range dateLayouts {
+			if p, err := time.Parse(l, x); err == nil {
+				t, parsed = p, true
+				break
+			}
+		}
+		if !parsed {
+			return "", fmt.Errorf("formatDate: can't parse %q as a date", x)
+		}
+	default:
+		return "", fmt.Errorf("formatDate: unsupported value %T", v)
+	}
+	return t.In(loc).Format(layout), nil
+}
+
+// truncate shortens v to at most n characters.
+func truncate(n int, v any) string {
+	s, ok := v.(string)
+	if !ok {
+		s = formatAnswer(v, "en")
+	}
+	if n < 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// defaultValue returns def when v is missing or empty.
+func defaultValue(def, v any) any {
+	if isEmptyValue(v) {
+		return def
+	}
+	return v
+}
+
+// mockSubmissionBody builds a plausible submission for previews, tests and
+// template validation, with one answer per field.
+func mockSubmissionBody(formId string, version int, fields []types.Field) []byte {
+	answers := make(map[string]any)
+	for _, f := range fields {
+		props, _ := f.Props.(map[string]any)
+		allowOther, _ := props["allow_other"].(bool)
+		firstOption := "test_option"
+		if options, _ := props["options"].([]any); len(options) > 0 {
+			if opt, ok := options[0].(map[string]any); ok {
+				if v, ok := opt["value"].(string); ok && v != "" {
+					firstOption = v
+				}
+			}
+		}
+		switch f.Type {
+		case "text", "textarea", "email":
+			answers[f.Name] = "test_value"
+		case "number":
+			answers[f.Name] = 123
+		case "phone":
+			answers[f.Name] = map[string]any{"e164": "+96550000000", "country": "KW"}
+		case "radio", "select":
+			// If allow_other is enabled, mock an "other" selection with text
+			if allowOther {
+				answers[f.Name] = map[string]any{"value": "other", "other": "Mock other details"}
+			} else {
+				answers[f.Name] = map[string]any{"value": firstOption}
+			}
+		case "multiselect":
+			if allowOther {
+				answers[f.Name] = []map[string]any{{"value": firstOption}, {"value": "other", "other": "Mock other details"}}
+			} else {
+				answers[f.Name] = []map[string]any{{"value": firstOption}, {"value": "test_option_2"}}
+			}
+		case "date", "time":
+			answers[f.Name] = time.Now().Format(time.RFC3339)
+		case "location":
+			answers[f.Name] = map[string]any{"lat": 29.3759, "lng": 47.9774, "accuracy": 10, "url": "https://www.google.com/maps?q=29.3759,47.9774"} // Kuwait coordinates
+		case "file_upload":
+			answers[f.Name] = []map[string]any{{"id": "test_file_id", "url": "https://example.com/test.jpg"}}
+		case "checkbox", "switch":
+			answers[f.Name] = true
+		}
+	}
+	b, _ := json.Marshal(map[string]any{
+		"event":       eventSubmissionCreated,
+		"id":          mockEventID,
+		"occurredAt":  formatOccurredAt(time.Now()),
+		"formId":      formId,
+		"version":     version,
+		"submittedAt": time.Now().UnixMilli(),
+		"answers":     answers,
+		"meta": map[string]any{
+			"locale":     "en",
+			"device":     "web",
+			"attributes": []string{},
+		},
+	})
+	return b
+}
+
+// mockSubmissionID stands in for the submission id in previews and tests.
+const mockSubmissionID = 999999
+
+// mockEventID stands in for the event id in previews and tests.
+const mockEventID = "00000000-0000-4000-8000-000000000000"
+
+// webhookFieldError ties a template error to the webhook setting it came from.
+type webhookFieldError struct {
+	Path string // e.g. "body_template", "headers/X-Idempotency-Key"
+	Err  error
+}
+
+func (e *webhookFieldError) Error() string { return e.Path + ": " + e.Err.Error() }
+
+// renderedWebhook is a webhook's request rendered for one submission.
+type renderedWebhook struct {
+	URL         string
+	Headers     map[string]string
+	Body        []byte
+	ContentType string    // overrides the webhook's, e.g. to carry a multipart boundary
+	Multipart   *formBody // set for multipart bodies; Body then has placeholder file parts
+}
+
+// renderWebhook renders the URL, query parameters, header values and body of
+// a webhook with the same template context.
+func renderWebhook(wh *webhookRow, fields []types.Field, submissionId uint64, submission []byte) (*renderedWebhook, error) {
+	r := &renderedWebhook{URL: wh.URL, Headers: make(map[string]string, len(wh.Headers))}
+	if usesMultipartEncoder(wh) {
+		r.Multipart = newFormBody(wh, fields, submissionId, submission, true)
+		r.Body = r.Multipart.placeholder()
+		r.ContentType = r.Multipart.contentType()
+	} else {
+		body, err := renderWebhookBody(wh, fields, submissionId, submission)
+		if err != nil {
+			path := "body_template"
+			if wh.Mode == "mapping" {
+				path = "mapping"
+			} else if chatModes[wh.Mode] {
+				path = "mode"
+			}
+			return nil, &webhookFieldError{path, err}
+		}
+		r.Body = body
+	}
+	if !strings.Contains(wh.URL, "{{") && len(wh.QueryParams) == 0 && !headersTemplated(wh.Headers) {
+		for k, v := range wh.Headers {
+			r.Headers[k] = v
+		}
+		return r, nil
+	}
+
+	ctx, locale := webhookTemplateContext(wh, fields, submissionId, submission)
+	if err := renderWebhookTarget(wh, r, fields, locale, ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// renderWebhookTarget renders the URL, query parameters and header values of
+// a webhook into r.
+func renderWebhookTarget(wh *webhookRow, r *renderedWebhook, fields []types.Field, locale string, ctx map[string]any) error {
+	var err error
+	if r.URL, err = renderURLTemplate(wh.URL, fields, locale, ctx); err != nil {
+		return &webhookFieldError{"endpoint_url", err}
+	}
+	if len(wh.QueryParams) > 0 {
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			return &webhookFieldError{"endpoint_url", err}
+		}
+		q := u.Query()
+		for k, v := range wh.QueryParams {
+			val, err := renderTextTemplate(v, fields, locale, ctx)
+			if err != nil {
+				return &webhookFieldError{"query_params/" + k, err}
+			}
+			q.Set(k, val)
+		}
+		u.RawQuery = q.Encode()
+		r.URL = u.String()
+	}
+	for k, v := range wh.Headers {
+		// Secret references are resolved at send time, so only those written
+		// in the header itself may survive rendering, never one in an answer
+		val, err := secrets.RenderProtected(v, func(src string) (string, error) {
+			return renderTextTemplate(src, fields, locale, ctx)
+		})
+		if err != nil {
+			return &webhookFieldError{"headers/" + k, err}
+		}
+		// A rendered answer must not be able to start a new header
+		r.Headers[k] = headerBreaks.Replace(val)
+	}
+	return nil
+}
+
+var headerBreaks = strings.NewReplacer("\r", "", "\n", "")
+
+func headersTemplated(h map[string]string) bool {
+	for _, v := range h {
+		if strings.Contains(v, "{{") {
+			return true
+		}
+	}
+	return false
+}
+
+func renderTextTemplate(src string, fields []types.Field, locale string, ctx map[string]any) (string, error) {
+	if !strings.Contains(src, "{{") {
+		return src, nil
+	}
+	t, err := parseWebhookTemplate(src, fields, locale)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := t.Execute(&buf, ctx); err != nil {
+		return "", toTemplateError(src, err)
+	}
+	return buf.String(), nil
+}
+
+// renderURLTemplate renders an endpoint URL, escaping every action's output
+// for where it lands: path segments before the '?', query values after it.
+func renderURLTemplate(src string, fields []types.Field, locale string, ctx map[string]any) (string, error) {
+	if !strings.Contains(src, "{{") {
+		return src, nil
+	}
+	t, err := parseWebhookTemplate(src, fields, locale)
+	if err != nil {
+		return "", err
+	}
+	escapeURLActions(t, queryStart(src))
+	var buf strings.Builder
+	if err := t.Execute(&buf, ctx); err != nil {
+		return "", toTemplateError(src, err)
+	}
+	return buf.String(), nil
+}
+
+// queryStart is the offset of the first '?' outside template actions, or -1.
+func queryStart(src string) int {
+	for i := 0; i < len(src); i++ {
+		if strings.HasPrefix(src[i:], "{{") {
+			end := strings.Index(src[i:], "}}")
+			if end < 0 {
+				return -1
+			}
+			i += end + 1
+			continue
+		}
+		if src[i] == '?' {
+			return i
+		}
+	}
+	return -1
+}
+
+// escapeURLActions appends an escaper to the pipeline of every action that
+// produces output, so {{.city.value}} in a path can't add segments or a query.
+func escapeURLActions(t *template.Template, query int) {
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch x := n.(type) {
+		case *parse.ListNode:
+			if x == nil {
+				return
+			}
+			for _, c := range x.Nodes {
+				walk(c)
+			}
+		case *parse.IfNode:
+			walk(x.List)
+			walk(x.ElseList)
+		case *parse.RangeNode:
+			walk(x.List)
+			walk(x.ElseList)
+		case *parse.WithNode:
+			walk(x.List)
+			walk(x.ElseList)
+		case *parse.ActionNode:
+			if len(x.Pipe.Decl) > 0 {
+				return
+			}
+			fn := "urlPathEscape"
+			if query >= 0 && int(x.Pos) > query {
+				fn = "urlQueryEscape"
+			}
+			x.Pipe.Cmds = append(x.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      x.Pos,
+				Args:     []parse.Node{parse.NewIdentifier(fn).SetTree(t.Tree).SetPos(x.Pos)},
+			})
+		}
+	}
+	walk(t.Tree.Root)
+}
+
+// validateWebhookTemplates renders the webhook against a sample submission,
+// with responses as the values extracted by its dependencies: every template
+// must compile and execute, templated URLs must come out as absolute http(s)
+// URLs, and JSON webhooks must render valid JSON.
+func validateWebhookTemplates(wh *webhookRow, fields []types.Field, responses map[string]any) []string {
+	sample := withResponses(mockSubmissionBody(wh.FormID, wh.Version, fields), responses)
+	r, err := renderSampleWebhook(wh, fields, mockSubmissionID, sample)
+	if err != nil {
+		return []string{"/" + err.Error()}
+	}
+	var errs []string
+	if strings.Contains(wh.URL, "{{") || len(wh.QueryParams) > 0 {
+		if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("/endpoint_url: sample render %q is not an absolute http(s) URL", r.URL))
+		}
+	}
+	templated := usesBodyTemplate(wh) && strings.TrimSpace(*wh.BodyTemplate) != ""
+	if templated && isJSONContentType(wh.ContentType) {
+		var v any
+		if err := json.Unmarshal(r.Body, &v); err != nil {
+			msg := err.Error()
+			var se *json.SyntaxError
+			if errors.As(err, &se) {
+				line, col := lineCol(r.Body, int(se.Offset))
+				msg = fmt.Sprintf("line %d, col %d of the output: %s", line, col, se.Error())
+			}
+			errs = append(errs, "/body_template: sample render is not valid JSON: "+msg)
+		}
+	}
+	return errs
+}
+
+func isJSONContentType(ct string) bool {
+	ct = strings.ToLower(strings.TrimSpace(strings.SplitN(ct, ";", 2)[0]))
+	return ct == "" || ct == "application/json" || strings.HasSuffix(ct, "+json")
+}
+
+// lineCol converts a byte offset to a 1-based line and column.
+func lineCol(b []byte, offset int) (int, int) {
+	if offset > len(b) {
+		offset = len(b)
+	}
+	line, col := 1, 1
+	for _, c := range b[:offset] {
+		if c == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
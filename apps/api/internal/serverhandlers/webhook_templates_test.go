@@ -0,0 +1,58 @@
+package serverhandlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/example/formrepo/apps/api/internal/secrets"
+)
+
+func TestRenderWebhookHeaderSecrets(t *testing.T) {
+	wh := &webhookRow{
+		ID:     1,
+		FormID: "f1",
+		Type:   "http",
+		Mode:   "raw",
+		URL:    "https://hooks.example.com/in",
+		Method: "POST",
+		Headers: map[string]string{
+			"X-Customer":  "{{.answers.name}}",
+			"X-Spliced":   "{{.answers.a}}{{.answers.b}}",
+			"X-Escaped":   "{{.answers.escaped}}",
+			"X-Api-Key":   "${secret:tok}",
+			"X-Mixed":     "${secret:tok}/{{.answers.name}}",
+			"X-Price":     "$${secret:tok}",
+			"X-Templated": "Bearer ${secret:tok} {{.answers.a}}",
+		},
+	}
+	submission := []byte(`{"answers":{"name":"${secret:tok}","a":"${secr","b":"et:tok}","escaped":"$${secret:tok}"}}`)
+	r, err := renderWebhook(wh, nil, 7, submission)
+	if err != nil {
+		t.Fatalf("renderWebhook: %v", err)
+	}
+
+	// A disabled store resolves nothing: a reference left in a header fails
+	// with ErrDisabled, anything else must come back as plain text.
+	store := &secrets.Store{}
+	literal := map[string]string{
+		"X-Customer": "${secret:tok}",
+		"X-Spliced":  "${secret:tok}",
+		"X-Escaped":  "$${secret:tok}",
+		"X-Price":    "${secret:tok}",
+	}
+	for k, want := range literal {
+		got, err := store.Resolve(context.Background(), r.Headers[k])
+		if err != nil || got != want {
+			t.Errorf("%s: resolved %q to %q, %v; want %q sent literally", k, r.Headers[k], got, err, want)
+		}
+	}
+	for _, k := range []string{"X-Api-Key", "X-Mixed", "X-Templated"} {
+		if refs := secrets.References(r.Headers[k]); len(refs) != 1 || refs[0] != "tok" {
+			t.Errorf("%s: configured reference lost, got %q", k, r.Headers[k])
+		}
+		if _, err := store.Resolve(context.Background(), r.Headers[k]); !errors.Is(err, secrets.ErrDisabled) {
+			t.Errorf("%s: configured reference not resolved, err %v", k, err)
+		}
+	}
+}
@@ -1,53 +1,60 @@
 package serverhandlers
 
 import (
-    "bytes"
-    "crypto/hmac"
-    "crypto/sha256"
     "database/sql"
-    "encoding/hex"
     "encoding/json"
-    "fmt"
     "io"
     "net/http"
+    "strconv"
     "strings"
     "time"
-    "text/template"
 
     "github.com/example/formrepo/apps/api/internal/config"
+    "github.com/example/formrepo/apps/api/internal/outbound"
+    "github.com/example/formrepo/apps/api/internal/secrets"
+    "github.com/example/formrepo/apps/api/internal/types"
     "github.com/gin-gonic/gin"
     "go.uber.org/zap"
 )
 
 type webhookReq struct {
-    Type           string            `json:"type"`
-    Endpoint       string            `json:"endpoint_url"`
-    Method         string            `json:"http_method"`
-    ContentType    string            `json:"content_type"`
-    Headers        map[string]string `json:"headers"`
-    Mode           string            `json:"mode"`
-    Enabled        bool              `json:"enabled"`
-    BodyTemplate   string            `json:"body_template"`
-    SelectedFields []string          `json:"selected_fields"`
+    Type            string              `json:"type"`
+    Endpoint        string              `json:"endpoint_url"`
+    Method          string              `json:"http_method"`
+    ContentType     string              `json:"content_type"`
+    Headers         map[string]string   `json:"headers"`
+    Auth            *WebhookAuth        `json:"auth,omitempty"`
+    QueryParams     map[string]string   `json:"query_params"`
+    Mode            string              `json:"mode"`
+    Events          []string            `json:"events,omitempty"` // event types subscribed to; submission.created when empty
+    Digest          *types.DigestConfig `json:"digest,omitempty"` // batch submissions instead of a delivery each
+    Enabled         bool                `json:"enabled"`
+    BodyTemplate    string              `json:"body_template"`
+    Mapping         json.RawMessage     `json:"mapping,omitempty"`
+    SelectedFields  []string            `json:"selected_fields"`
+    RetryPolicy     *RetryPolicy        `json:"retry_policy,omitempty"`
+    RateLimit       *RateLimit          `json:"rate_limit,omitempty"`
+    Filter          string              `json:"filter"`
+    Position        int                 `json:"position"`
+    DependsOn       []uint64            `json:"depends_on"`
+    ResponseExtract map[string]string   `json:"response_extract"`
+    ExternalRefs    map[string]string   `json:"external_refs"`
 }
 
 func ListWebhooksHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         formId := c.Param("formId")
-        versionStr := c.Param("version")
-        var version int
-        if _, err := fmt.Sscanf(versionStr, "%d", &version); err != nil {
-            log.Error("invalid version parameter", zap.String("version", versionStr), zap.Error(err))
-            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid version"})
+        version, ok := webhookVersionParam(c)
+        if !ok {
             return
         }
         // Try new schema first (with content_type, body_template, selected_fields_json)
-        rows, err := db.Query("SELECT id,type,endpoint_url,http_method,content_type,headers_json,body_template,selected_fields_json,mode,enabled FROM form_webhooks WHERE form_id=? AND version=?", formId, version)
+        rows, err := db.Query("SELECT id,type,endpoint_url,http_method,content_type,headers_json,auth_json,query_params_json,body_template,mapping_json,selected_fields_json,retry_policy_json,rate_limit_json,filter_expr,mode,events_json,digest_json,enabled,disabled_reason,position,depends_on_json,response_extract_json,external_refs_json FROM form_webhooks WHERE form_id=? AND version=? ORDER BY position, id", formId, version)
         if err != nil {
             // If columns don't exist, fallback to old schema
             if strings.Contains(err.Error(), "Unknown column") {
                 log.Warn("list webhooks: new schema failed, trying old schema", zap.Error(err))
-                rows, err = db.Query("SELECT id,type,endpoint_url,http_method,'application/json' as content_type,headers_json,NULL as body_template,NULL as selected_fields_json,mode,enabled FROM form_webhooks WHERE form_id=? AND version=?", formId, version)
+                rows, err = db.Query("SELECT id,type,endpoint_url,http_method,'application/json' as content_type,headers_json,NULL as auth_json,NULL as query_params_json,NULL as body_template,NULL as mapping_json,NULL as selected_fields_json,NULL as retry_policy_json,NULL as rate_limit_json,NULL as filter_expr,mode,NULL as events_json,NULL as digest_json,enabled,NULL as disabled_reason,0 as position,NULL as depends_on_json,NULL as response_extract_json,NULL as external_refs_json FROM form_webhooks WHERE form_id=? AND version=? ORDER BY id", formId, version)
             }
             if err != nil {
                 log.Error("failed to query webhooks", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
@@ -58,8 +65,8 @@ func ListWebhooksHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
         defer rows.Close()
         out := []gin.H{}
         for rows.Next() {
-            var id uint64; var typ, url, method, contentType, mode string; var headersRaw []byte; var enabled bool; var bodyTpl *string; var selectedFieldsRaw []byte
-            if err := rows.Scan(&id, &typ, &url, &method, &contentType, &headersRaw, &bodyTpl, &selectedFieldsRaw, &mode, &enabled); err != nil {
+            var id uint64; var typ, url, method, contentType, mode string; var headersRaw, authRaw []byte; var enabled bool; var bodyTpl *string; var queryRaw, mappingRaw, selectedFieldsRaw, retryRaw, rateRaw, eventsRaw, digestRaw, dependsRaw, extractRaw, refsRaw []byte; var filter, disabledReason *string; var position int
+            if err := rows.Scan(&id, &typ, &url, &method, &contentType, &headersRaw, &authRaw, &queryRaw, &bodyTpl, &mappingRaw, &selectedFieldsRaw, &retryRaw, &rateRaw, &filter, &mode, &eventsRaw, &digestRaw, &enabled, &disabledReason, &position, &dependsRaw, &extractRaw, &refsRaw); err != nil {
                 log.Error("failed to scan webhook", zap.Error(err))
                 continue
             }
@@ -72,6 +79,18 @@ func ListWebhooksHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
             } else {
                 headers = map[string]string{}
             }
+            var auth *WebhookAuth
+            if len(authRaw) > 0 {
+                if err := json.Unmarshal(authRaw, &auth); err != nil {
+                    log.Error("failed to unmarshal auth", zap.Error(err))
+                }
+            }
+            queryParams := map[string]string{}
+            if len(queryRaw) > 0 {
+                if err := json.Unmarshal(queryRaw, &queryParams); err != nil {
+                    log.Error("failed to unmarshal query_params", zap.Error(err))
+                }
+            }
             var selectedFields []string
             if len(selectedFieldsRaw) > 0 {
                 if err := json.Unmarshal(selectedFieldsRaw, &selectedFields); err != nil {
@@ -83,7 +102,49 @@ func ListWebhooksHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
             if selectedFields == nil {
                 selectedFields = []string{}
             }
-            out = append(out, gin.H{"id": id, "type": typ, "endpoint_url": url, "http_method": method, "content_type": contentType, "headers": headers, "body_template": nullSafe(bodyTpl), "selected_fields": selectedFields, "mode": mode, "enabled": enabled})
+            var retryPolicy *RetryPolicy
+            if len(retryRaw) > 0 {
+                if err := json.Unmarshal(retryRaw, &retryPolicy); err != nil {
+                    log.Error("failed to unmarshal retry_policy", zap.Error(err))
+                }
+            }
+            var rateLimit *RateLimit
+            if len(rateRaw) > 0 {
+                if err := json.Unmarshal(rateRaw, &rateLimit); err != nil {
+                    log.Error("failed to unmarshal rate_limit", zap.Error(err))
+                }
+            }
+            events := []string{eventSubmissionCreated}
+            if len(eventsRaw) > 0 {
+                if err := json.Unmarshal(eventsRaw, &events); err != nil {
+                    log.Error("failed to unmarshal events", zap.Error(err))
+                }
+            }
+            var digest *types.DigestConfig
+            if len(digestRaw) > 0 {
+                if err := json.Unmarshal(digestRaw, &digest); err != nil {
+                    log.Error("failed to unmarshal digest", zap.Error(err))
+                }
+            }
+            dependsOn := []uint64{}
+            if len(dependsRaw) > 0 {
+                if err := json.Unmarshal(dependsRaw, &dependsOn); err != nil {
+                    log.Error("failed to unmarshal depends_on", zap.Error(err))
+                }
+            }
+            responseExtract := map[string]string{}
+            if len(extractRaw) > 0 {
+                if err := json.Unmarshal(extractRaw, &responseExtract); err != nil {
+                    log.Error("failed to unmarshal response_extract", zap.Error(err))
+                }
+            }
+            externalRefs := map[string]string{}
+            if len(refsRaw) > 0 {
+                if err := json.Unmarshal(refsRaw, &externalRefs); err != nil {
+                    log.Error("failed to unmarshal external_refs", zap.Error(err))
+                }
+            }
+            out = append(out, gin.H{"id": id, "type": typ, "endpoint_url": url, "http_method": method, "content_type": contentType, "headers": maskHeaders(headers), "auth": maskAuth(auth), "query_params": queryParams, "body_template": nullSafe(bodyTpl), "mapping": rawJSONOrNil(mappingRaw), "selected_fields": selectedFields, "retry_policy": retryPolicy, "rate_limit": rateLimit, "filter": nullSafe(filter), "mode": mode, "events": events, "digest": digest, "enabled": enabled, "disabled_reason": disabledReason, "position": position, "depends_on": dependsOn, "response_extract": responseExtract, "external_refs": externalRefs})
         }
         if err := rows.Err(); err != nil {
             log.Error("error iterating webhooks", zap.Error(err))
@@ -94,34 +155,107 @@ func ListWebhooksHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
     }
 }
 
-func CreateWebhookHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+// checkWebhookKind validates type and mode, writing the error response itself.
+func checkWebhookKind(c *gin.Context, log *zap.Logger, req webhookReq) bool {
+    if req.Type != "http" {
+        log.Error("invalid webhook type", zap.String("type", req.Type))
+        c.JSON(http.StatusBadRequest, gin.H{"error":"invalid type, must be 'http'"})
+        return false
+    }
+    if req.Mode != "raw" && req.Mode != "mapping" && !chatModes[req.Mode] {
+        log.Error("invalid webhook mode", zap.String("mode", req.Mode))
+        c.JSON(http.StatusBadRequest, gin.H{"error":"invalid mode, must be 'raw', 'mapping', 'slack', 'teams' or 'discord'"})
+        return false
+    }
+    return true
+}
+
+func CreateWebhookHandler(db *sql.DB, cfg *config.Config, store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         formId := c.Param("formId")
-        versionStr := c.Param("version")
-        var version int
-        if _, err := fmt.Sscanf(versionStr, "%d", &version); err != nil {
-            log.Error("invalid version parameter", zap.String("version", versionStr), zap.Error(err))
-            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid version"})
+        version, ok := webhookVersionParam(c)
+        if !ok {
             return
         }
+        if version == formLevelVersion {
+            // Previews and template checks need a published version's fields
+            if _, err := latestFormVersion(db, formId); err == sql.ErrNoRows {
+                c.JSON(http.StatusNotFound, gin.H{"error":"form not found"})
+                return
+            } else if err != nil {
+                log.Error("failed to query form", zap.Error(err), zap.String("formId", formId))
+                c.JSON(http.StatusInternalServerError, gin.H{"error":"db"})
+                return
+            }
+        }
         var req webhookReq
         if err := c.BindJSON(&req); err != nil {
             log.Error("invalid json", zap.Error(err))
             c.JSON(http.StatusBadRequest, gin.H{"error":"json"})
             return
         }
+        if !checkWebhookKind(c, log, req) {
+            return
+        }
+        if verrs := req.RetryPolicy.validate(); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid retry_policy", "details": verrs})
+            return
+        }
+        if verrs := req.RateLimit.validate(); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid rate_limit", "details": verrs})
+            return
+        }
+        if verrs := webhookDestinationErrors(cfg, req); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"destination not allowed", "details": verrs})
+            return
+        }
+        req.Filter = strings.TrimSpace(req.Filter)
+        if verrs := validateFilter(req.Filter); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid filter", "details": verrs})
+            return
+        }
+        if verrs := validateExternalRefs(req.ExternalRefs); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid external_refs", "details": verrs})
+            return
+        }
+        if verrs := validateWebhookEvents(req.Events, req.Mode); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid events", "details": verrs})
+            return
+        }
+        if verrs := validateWebhookDigest(req); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid digest", "details": verrs})
+            return
+        }
+        if !checkHeaderSecrets(c, store, log, req.Headers) || !checkWebhookAuth(c, store, log, req.Auth) {
+            return
+        }
         hdrs, _ := json.Marshal(req.Headers)
         selectedFieldsJSON, _ := json.Marshal(req.SelectedFields)
         if req.Method == "" { req.Method = "POST" }
         if req.ContentType == "" { req.ContentType = "application/json" }
+        chain, ok := checkWebhookChain(c, db, log, formId, version, 0, req)
+        if !ok {
+            return
+        }
+        if !checkBodyTemplate(c, db, log, formId, version, req, sampleResponses(chain, req.DependsOn)) {
+            return
+        }
         
-        // Try INSERT with new schema first (with content_type, body_template, selected_fields_json)
-        _, err := db.Exec("INSERT INTO form_webhooks(form_id,version,type,endpoint_url,http_method,content_type,headers_json,body_template,selected_fields_json,mode,enabled) VALUES(?,?,?,?,?,?,?,?,?,?,?)", formId, version, req.Type, req.Endpoint, req.Method, req.ContentType, string(hdrs), emptyIf(req.BodyTemplate), nullIfEmptySelectedFields(string(selectedFieldsJSON)), req.Mode, req.Enabled)
+        // The webhook and its first signing secret go in together so it never signs with the global key
+        tx, err := db.Begin()
+        if err != nil {
+            log.Error("failed to begin transaction", zap.Error(err))
+            c.JSON(http.StatusInternalServerError, gin.H{"error":"db"})
+            return
+        }
+        defer tx.Rollback()
+        // Try INSERT with new schema first (with content_type, body_template, selected_fields_json, retry_policy_json)
+        res, err := tx.Exec("INSERT INTO form_webhooks(form_id,version,type,endpoint_url,http_method,content_type,headers_json,auth_json,query_params_json,body_template,mapping_json,selected_fields_json,retry_policy_json,rate_limit_json,filter_expr,position,depends_on_json,response_extract_json,external_refs_json,mode,events_json,digest_json,enabled) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", formId, version, req.Type, req.Endpoint, req.Method, req.ContentType, string(hdrs), authJSON(req.Auth), queryParamsJSON(req.QueryParams), emptyIf(req.BodyTemplate), mappingJSON(req.Mapping), nullIfEmptySelectedFields(string(selectedFieldsJSON)), retryPolicyJSON(req.RetryPolicy), rateLimitJSON(req.RateLimit), emptyIf(req.Filter), req.Position, dependsOnJSON(req.DependsOn), stringMapJSON(req.ResponseExtract), stringMapJSON(req.ExternalRefs), req.Mode, eventsJSON(req.Events), digestJSON(req.Digest), req.Enabled)
         if err != nil {
             // If columns don't exist, try old schema
             if strings.Contains(err.Error(), "Unknown column") {
                 log.Warn("insert with new schema failed (missing columns), trying old schema", zap.Error(err))
-                _, err = db.Exec("INSERT INTO form_webhooks(form_id,version,type,endpoint_url,http_method,headers_json,mode,enabled) VALUES(?,?,?,?,?,?,?,?)", formId, version, req.Type, req.Endpoint, req.Method, string(hdrs), req.Mode, req.Enabled)
+                res, err = tx.Exec("INSERT INTO form_webhooks(form_id,version,type,endpoint_url,http_method,headers_json,mode,enabled) VALUES(?,?,?,?,?,?,?,?)", formId, version, req.Type, req.Endpoint, req.Method, string(hdrs), req.Mode, req.Enabled)
             }
             if err != nil {
                 log.Error("failed to insert webhook", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
@@ -129,11 +263,24 @@ func CreateWebhookHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
                 return
             }
         }
-        c.Status(http.StatusCreated)
+        id, _ := res.LastInsertId()
+        // The signing secret is only ever returned in full here and on rotation
+        secret, err := createWebhookSecret(tx, uint64(id))
+        if err != nil {
+            log.Error("failed to create webhook secret", zap.Error(err), zap.Int64("id", id))
+            c.JSON(http.StatusInternalServerError, gin.H{"error":"failed to create webhook secret"})
+            return
+        }
+        if err := tx.Commit(); err != nil {
+            log.Error("failed to commit webhook", zap.Error(err), zap.Int64("id", id))
+            c.JSON(http.StatusInternalServerError, gin.H{"error":"db"})
+            return
+        }
+        c.JSON(http.StatusCreated, gin.H{"id": id, "signing_secret": secret.Secret})
     }
 }
 
-func UpdateWebhookHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
+func UpdateWebhookHandler(db *sql.DB, cfg *config.Config, store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         id := c.Param("id")
         var req webhookReq
@@ -142,25 +289,78 @@ func UpdateWebhookHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
             c.JSON(http.StatusBadRequest, gin.H{"error":"json"})
             return
         }
+        if !checkWebhookKind(c, log, req) {
+            return
+        }
+        if verrs := req.RetryPolicy.validate(); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid retry_policy", "details": verrs})
+            return
+        }
+        if verrs := req.RateLimit.validate(); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid rate_limit", "details": verrs})
+            return
+        }
+        if verrs := webhookDestinationErrors(cfg, req); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"destination not allowed", "details": verrs})
+            return
+        }
+        req.Filter = strings.TrimSpace(req.Filter)
+        if verrs := validateFilter(req.Filter); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid filter", "details": verrs})
+            return
+        }
+        if verrs := validateExternalRefs(req.ExternalRefs); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid external_refs", "details": verrs})
+            return
+        }
+        if verrs := validateWebhookEvents(req.Events, req.Mode); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid events", "details": verrs})
+            return
+        }
+        if verrs := validateWebhookDigest(req); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid digest", "details": verrs})
+            return
+        }
+        // Headers and auth come back masked from the list endpoint; keep the stored values for those
+        var storedRaw, storedAuthRaw []byte
+        var formId string
+        var version int
+        err := db.QueryRow("SELECT form_id, version, headers_json, auth_json FROM form_webhooks WHERE id=?", id).Scan(&formId, &version, &storedRaw, &storedAuthRaw)
+        if err == sql.ErrNoRows {
+            c.JSON(http.StatusNotFound, gin.H{"error":"webhook not found"})
+            return
+        }
+        if err == nil {
+            var stored map[string]string
+            _ = json.Unmarshal(storedRaw, &stored)
+            unmaskHeaders(req.Headers, stored)
+            var storedAuth *WebhookAuth
+            if len(storedAuthRaw) > 0 {
+                _ = json.Unmarshal(storedAuthRaw, &storedAuth)
+            }
+            unmaskAuth(req.Auth, storedAuth)
+        }
+        if !checkHeaderSecrets(c, store, log, req.Headers) || !checkWebhookAuth(c, store, log, req.Auth) {
+            return
+        }
         hdrs, _ := json.Marshal(req.Headers)
         selectedFieldsJSON, _ := json.Marshal(req.SelectedFields)
         if req.Method == "" { req.Method = "POST" }
         if req.ContentType == "" { req.ContentType = "application/json" }
-        
-        // Validate type and mode (should only be 'http' and 'raw' now)
-        if req.Type != "http" {
-            log.Error("invalid webhook type", zap.String("type", req.Type))
-            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid type, must be 'http'"})
+
+        selfId, _ := strconv.ParseUint(id, 10, 64)
+        chain, ok := checkWebhookChain(c, db, log, formId, version, selfId, req)
+        if !ok {
             return
         }
-        if req.Mode != "raw" {
-            log.Error("invalid webhook mode", zap.String("mode", req.Mode))
-            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid mode, must be 'raw'"})
+        if !checkBodyTemplate(c, db, log, formId, version, req, sampleResponses(chain, req.DependsOn)) {
             return
         }
         
         // Try UPDATE with content_type, body_template, and selected_fields_json first (new schema)
-        _, err := db.Exec("UPDATE form_webhooks SET type=?, endpoint_url=?, http_method=?, content_type=?, headers_json=?, body_template=?, selected_fields_json=?, mode=?, enabled=? WHERE id=?", req.Type, req.Endpoint, req.Method, req.ContentType, string(hdrs), emptyIf(req.BodyTemplate), nullIfEmptySelectedFields(string(selectedFieldsJSON)), req.Mode, req.Enabled, id)
+        // Saving sets enabled by hand, so it always clears an auto-disable
+        // reason: held deliveries are then sent, or cancelled if it stays off
+        _, err = db.Exec("UPDATE form_webhooks SET type=?, endpoint_url=?, http_method=?, content_type=?, headers_json=?, auth_json=?, query_params_json=?, body_template=?, mapping_json=?, selected_fields_json=?, retry_policy_json=?, rate_limit_json=?, filter_expr=?, position=?, depends_on_json=?, response_extract_json=?, external_refs_json=?, mode=?, events_json=?, digest_json=?, enabled=?, disabled_reason=NULL, disabled_at=IF(?, NULL, disabled_at) WHERE id=?", req.Type, req.Endpoint, req.Method, req.ContentType, string(hdrs), authJSON(req.Auth), queryParamsJSON(req.QueryParams), emptyIf(req.BodyTemplate), mappingJSON(req.Mapping), nullIfEmptySelectedFields(string(selectedFieldsJSON)), retryPolicyJSON(req.RetryPolicy), rateLimitJSON(req.RateLimit), emptyIf(req.Filter), req.Position, dependsOnJSON(req.DependsOn), stringMapJSON(req.ResponseExtract), stringMapJSON(req.ExternalRefs), req.Mode, eventsJSON(req.Events), digestJSON(req.Digest), req.Enabled, req.Enabled, id)
         if err != nil {
             // Check if error is due to missing columns
             errStr := err.Error()
@@ -184,11 +384,85 @@ func UpdateWebhookHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
     }
 }
 
+// checkBodyTemplate renders the webhook's URL, query params, headers and body
+// against a sample submission and rejects anything that doesn't compile, fails
+// to execute, or (for JSON webhooks) doesn't render valid JSON. In mapping mode
+// the mapping document is checked first. responses stands in for the values
+// extracted by the webhook's dependencies.
+func checkBodyTemplate(c *gin.Context, db *sql.DB, log *zap.Logger, formId string, version int, req webhookReq, responses map[string]any) bool {
+    if req.Mode == "mapping" && !isJSONContentType(req.ContentType) {
+        c.JSON(http.StatusBadRequest, gin.H{"error":"invalid mapping", "details": []string{"/content_type: mapping mode sends application/json"}})
+        return false
+    }
+    if chatModes[req.Mode] && !isJSONContentType(req.ContentType) {
+        c.JSON(http.StatusBadRequest, gin.H{"error":"invalid mode", "details": []string{"/content_type: " + req.Mode + " mode sends application/json"}})
+        return false
+    }
+    fields, err := loadFormFields(db, formId, version)
+    if err != nil && err != sql.ErrNoRows {
+        log.Error("failed to load form fields", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
+        c.JSON(http.StatusInternalServerError, gin.H{"error":"failed to query form"})
+        return false
+    }
+    if req.Mode == "mapping" {
+        if verrs := validateMapping(req.Mapping, fields); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid mapping", "details": verrs})
+            return false
+        }
+    }
+    wh := &webhookRow{FormID: formId, Version: version, URL: req.Endpoint, Method: req.Method, ContentType: req.ContentType, Headers: req.Headers, QueryParams: req.QueryParams, Mapping: req.Mapping, Mode: req.Mode, SelectedFields: req.SelectedFields, Digest: req.Digest}
+    if req.BodyTemplate != "" { wh.BodyTemplate = &req.BodyTemplate }
+    if verrs := validateWebhookTemplates(wh, fields, responses); len(verrs) > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error":"invalid template", "details": verrs})
+        return false
+    }
+    return true
+}
+
+// checkWebhookChain validates the webhook's dependencies and response
+// extraction, returning its version's dependency graph.
+func checkWebhookChain(c *gin.Context, db *sql.DB, log *zap.Logger, formId string, version int, selfId uint64, req webhookReq) (map[uint64]*chainNode, bool) {
+    chain, err := loadWebhookChain(db, formId, version)
+    if err != nil {
+        log.Error("failed to load webhook dependencies", zap.Error(err), zap.String("formId", formId), zap.Int("version", version))
+        c.JSON(http.StatusInternalServerError, gin.H{"error":"db"})
+        return nil, false
+    }
+    if verrs := validateWebhookChain(chain, selfId, req.DependsOn, req.ResponseExtract); len(verrs) > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error":"invalid dependencies", "details": verrs})
+        return nil, false
+    }
+    if req.Digest != nil && selfId != 0 {
+        if verrs := digestDependentErrors(chain, selfId); len(verrs) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error":"invalid dependencies", "details": verrs})
+            return nil, false
+        }
+    }
+    return chain, true
+}
+
 func DeleteWebhookHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
     return func(c *gin.Context) {
         id := c.Param("id")
+        // Dependents would be skipped forever; they have to drop the dependency first
+        var formId string
+        var version int
+        if err := db.QueryRow("SELECT form_id, version FROM form_webhooks WHERE id=?", id).Scan(&formId, &version); err == nil {
+            selfId, _ := strconv.ParseUint(id, 10, 64)
+            chain, err := loadWebhookChain(db, formId, version)
+            if err != nil {
+                log.Error("failed to load webhook dependencies", zap.Error(err), zap.String("id", id))
+                c.JSON(http.StatusInternalServerError, gin.H{"error":"db"})
+                return
+            }
+            if dependents := dependentsOf(chain, selfId); len(dependents) > 0 {
+                c.JSON(http.StatusConflict, gin.H{"error":"webhook has dependents", "dependents": dependents})
+                return
+            }
+        }
         _, err := db.Exec("DELETE FROM form_webhooks WHERE id=?", id)
         if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"delete"}); return }
+        _, _ = db.Exec("DELETE FROM webhook_secrets WHERE webhook_id=?", id)
         c.Status(http.StatusNoContent)
     }
 }
@@ -196,6 +470,15 @@ func DeleteWebhookHandler(db *sql.DB, log *zap.Logger) gin.HandlerFunc {
 func nullSafe(s *string) string { if s == nil { return "" }; return *s }
 func emptyIf(s string) any { if s == "" { return nil }; return s }
 func nullIfEmptySelectedFields(s string) any { if s == "" || s == "null" || s == "[]" { return nil }; return s }
+func queryParamsJSON(q map[string]string) any { if len(q) == 0 { return nil }; b, _ := json.Marshal(q); return string(b) }
+func dependsOnJSON(ids []uint64) any { if len(ids) == 0 { return nil }; b, _ := json.Marshal(ids); return string(b) }
+func eventsJSON(events []string) any { if len(events) == 0 { return nil }; b, _ := json.Marshal(events); return string(b) }
+func digestJSON(d *types.DigestConfig) any { if d == nil { return nil }; b, _ := json.Marshal(d); return string(b) }
+func stringMapJSON(m map[string]string) any { if len(m) == 0 { return nil }; b, _ := json.Marshal(m); return string(b) }
+func mappingJSON(m json.RawMessage) any { if len(m) == 0 || string(m) == "null" { return nil }; return string(m) }
+func rawJSONOrNil(b []byte) any { if len(b) == 0 { return nil }; return json.RawMessage(b) }
+func retryPolicyJSON(p *RetryPolicy) any { if p == nil { return nil }; b, _ := json.Marshal(p); return string(b) }
+func rateLimitJSON(l *RateLimit) any { if l == nil { return nil }; b, _ := json.Marshal(l); return string(b) }
 
 type TestWebhookResponse struct {
 	Success         bool              `json:"success"`
@@ -210,251 +493,49 @@ type TestWebhookResponse struct {
 	RequestBody     string            `json:"requestBody"`
 }
 
-func TestWebhookHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.HandlerFunc {
+func TestWebhookHandler(db *sql.DB, cfg *config.Config, store *secrets.Store, log *zap.Logger) gin.HandlerFunc {
+	// Shared across tests so tokens are cached between them
+	auth := newWebhookAuthenticator(store, outboundPolicy(cfg, outbound.Webhooks), time.Duration(cfg.WebhookTimeout())*time.Millisecond)
 	return func(c *gin.Context) {
-		formId := c.Param("formId")
-		versionStr := c.Param("version")
-		webhookId := c.Param("id")
-		
-		var version int
-		if _, err := fmt.Sscanf(versionStr, "%d", &version); err != nil {
-			log.Error("invalid version parameter", zap.String("version", versionStr), zap.Error(err))
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		webhookId, ok := webhookParams(c, db, log)
+		if !ok {
 			return
 		}
-
-		// Fetch webhook configuration (with schema compatibility)
-		var typ, url, method, contentType, mode string
-		var headersRaw []byte
-		var enabled bool
-		var bodyTpl sql.NullString
-		var selectedFieldsRaw []byte
-		// Try new schema first (with content_type, body_template, selected_fields_json)
-		err := db.QueryRow("SELECT type,endpoint_url,http_method,content_type,headers_json,body_template,selected_fields_json,mode,enabled FROM form_webhooks WHERE id=? AND form_id=? AND version=?", webhookId, formId, version).Scan(&typ, &url, &method, &contentType, &headersRaw, &bodyTpl, &selectedFieldsRaw, &mode, &enabled)
-		if err != nil {
-			// If columns don't exist, try old schema
-			if strings.Contains(err.Error(), "Unknown column") {
-				bodyTpl = sql.NullString{Valid: false}
-				selectedFieldsRaw = nil
-				err = db.QueryRow("SELECT type,endpoint_url,http_method,'application/json' as content_type,headers_json,NULL as body_template,NULL as selected_fields_json,mode,enabled FROM form_webhooks WHERE id=? AND form_id=? AND version=?", webhookId, formId, version).Scan(&typ, &url, &method, &contentType, &headersRaw, &bodyTpl, &selectedFieldsRaw, &mode, &enabled)
-			}
-			if err != nil {
-				if err == sql.ErrNoRows {
-					c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
-					return
-				}
-				log.Error("failed to query webhook", zap.Error(err))
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query webhook", "details": err.Error()})
-				return
-			}
-		}
-
-		// Convert NullString to *string
-		var bodyTplPtr *string
-		if bodyTpl.Valid {
-			bodyTplPtr = &bodyTpl.String
-		}
-
-		// Parse selected fields
-		var selectedFields []string
-		if len(selectedFieldsRaw) > 0 {
-			if err := json.Unmarshal(selectedFieldsRaw, &selectedFields); err != nil {
-				log.Error("failed to unmarshal selected_fields", zap.Error(err))
-				selectedFields = []string{}
-			}
+		// Rendered and signed exactly like real deliveries, from a mock submission
+		wh, fields, ok := loadWebhookForPreview(c, db, webhookId, log)
+		if !ok {
+			return
 		}
-
-		// Fetch form fields to build mock submission
-		var fieldsRaw []byte
-		err = db.QueryRow("SELECT fields_json FROM form_snapshots WHERE form_id=? AND version=?", formId, version).Scan(&fieldsRaw)
+		chain, err := loadWebhookChain(db, wh.FormID, wh.chainVersion())
 		if err != nil {
-			log.Error("failed to query form", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query form"})
+			log.Error("failed to load webhook dependencies", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query webhook"})
 			return
 		}
-
-		var fields []map[string]any
-		if err := json.Unmarshal(fieldsRaw, &fields); err != nil {
-			log.Error("failed to unmarshal fields", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to parse form fields"})
+		sample := withResponses(mockSubmissionBody(wh.FormID, wh.Version, fields), sampleResponses(chain, wh.DependsOn))
+		rendered, err := renderSampleWebhook(wh, fields, mockSubmissionID, sample)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "template error", "details": []string{"/" + err.Error()}})
 			return
 		}
+		bodyToSend := rendered.Body
+		// Mock uploads don't exist, so multipart tests send the placeholder parts
+		rendered.Multipart = nil
 
-		// Build mock answers based on form fields
-		mockAnswers := make(map[string]any)
-		for _, f := range fields {
-			name, _ := f["name"].(string)
-			fieldType, _ := f["type"].(string)
-			switch fieldType {
-			case "text", "textarea", "email":
-				mockAnswers[name] = "test_value"
-			case "number":
-				mockAnswers[name] = 123
-			case "phone":
-				mockAnswers[name] = map[string]any{"e164": "+96550000000", "country": "KW"}
-			case "radio":
-				// If allow_other is enabled, mock an "other" selection with text
-				if props, ok := f["props"].(map[string]any); ok {
-					if allowOther, _ := props["allow_other"].(bool); allowOther {
-						mockAnswers[name] = map[string]any{"value": "other", "other": "Mock other details"}
-					} else {
-						mockAnswers[name] = map[string]any{"value": "test_option"}
-					}
-				} else {
-					mockAnswers[name] = map[string]any{"value": "test_option"}
-				}
-			case "select":
-				// If allow_other is enabled, mock an "other" selection with text
-				if props, ok := f["props"].(map[string]any); ok {
-					if allowOther, _ := props["allow_other"].(bool); allowOther {
-						mockAnswers[name] = map[string]any{"value": "other", "other": "Mock other details"}
-					} else {
-						mockAnswers[name] = map[string]any{"value": "test_option"}
-					}
-				} else {
-					mockAnswers[name] = map[string]any{"value": "test_option"}
-				}
-			case "multiselect":
-				// If allow_other is enabled, mock an "other" selection with text
-				if props, ok := f["props"].(map[string]any); ok {
-					if allowOther, _ := props["allow_other"].(bool); allowOther {
-						mockAnswers[name] = []map[string]any{{"value": "test_option_1"}, {"value": "other", "other": "Mock other details"}}
-					} else {
-						mockAnswers[name] = []map[string]any{{"value": "test_option_1"}, {"value": "test_option_2"}}
-					}
-				} else {
-					mockAnswers[name] = []map[string]any{{"value": "test_option_1"}, {"value": "test_option_2"}}
-				}
-			case "date":
-				mockAnswers[name] = time.Now().Format(time.RFC3339)
-			case "time":
-				mockAnswers[name] = time.Now().Format(time.RFC3339)
-			case "location":
-				mockAnswers[name] = map[string]any{"lat": 29.3759, "lng": 47.9774, "accuracy": 10, "url": "https://www.google.com/maps?q=29.3759,47.9774"} // Kuwait coordinates
-			case "file_upload":
-				mockAnswers[name] = []map[string]any{{"id": "test_file_id", "url": "https://example.com/test.jpg"}}
-			case "checkbox", "switch":
-				mockAnswers[name] = true
-			}
-		}
-
-		// Filter answers based on selected fields
-		selectedAnswers := make(map[string]any)
-		if len(selectedFields) > 0 {
-			for _, field := range selectedFields {
-				if val, ok := mockAnswers[field]; ok {
-					selectedAnswers[field] = val
-				}
-			}
-		} else {
-			// If no fields selected, use all mock answers for testing
-			selectedAnswers = mockAnswers
-		}
-
-		// Build mock submission payload
-		mockSubmission := map[string]any{
-			"formId":      formId,
-			"version":     version,
-			"submittedAt": time.Now().UnixMilli(),
-			"answers":     selectedAnswers,
-			"meta": map[string]any{
-				"locale":     "en",
-				"device":     "web",
-				"attributes": []string{},
-			},
-		}
-
-
-		// Parse headers
-		var headers map[string]string
-		if len(headersRaw) > 0 {
-			if err := json.Unmarshal(headersRaw, &headers); err != nil {
-				headers = make(map[string]string)
-			}
-		} else {
-			headers = make(map[string]string)
-		}
-
-		if method == "" {
-			method = "POST"
-		}
-		if contentType == "" {
-			contentType = "application/json"
-		}
-
-		// Build body: template if provided else empty
-		var bodyToSend []byte
-		// Check if template exists and is not empty (after trimming whitespace)
-		hasTemplate := bodyTplPtr != nil && *bodyTplPtr != "" && strings.TrimSpace(*bodyTplPtr) != ""
-		if hasTemplate {
-			log.Info("webhook test: using template", zap.String("template", *bodyTplPtr))
-			ctx := map[string]any{
-				"formId":        formId,
-				"version":       version,
-				"submissionId":  999999, // Mock submission ID
-				"submittedAt":   mockSubmission["submittedAt"],
-				"answers":       mockAnswers, // All answers for backward compatibility
-				"selected":      selectedAnswers,
-				"meta":          mockSubmission["meta"],
-			}
-			// Add each selected field as a top-level variable
-			for field, value := range selectedAnswers {
-				ctx[field] = value
-			}
-			funcMap := template.FuncMap{
-				"json": func(v any) string {
-					b, _ := json.Marshal(v)
-					return string(b)
-				},
-			}
-			if t, err := template.New("wh").Funcs(funcMap).Parse(*bodyTplPtr); err == nil {
-				var buf bytes.Buffer
-				if execErr := t.Execute(&buf, ctx); execErr == nil {
-					bodyToSend = buf.Bytes()
-				} else {
-					// If template execution fails, send empty body
-					log.Warn("webhook test: template execution failed", zap.Error(execErr))
-					bodyToSend = []byte("{}")
-				}
-			} else {
-				// If template parsing fails, send empty body
-				log.Warn("webhook test: template parsing failed", zap.Error(err))
-				bodyToSend = []byte("{}")
-			}
-		} else {
-			// No template: send empty body by default
-			bodyTplValue := "<nil>"
-			if bodyTplPtr != nil {
-				bodyTplValue = fmt.Sprintf("'%s'", *bodyTplPtr)
-			}
-			log.Info("webhook test: no template, sending empty body", zap.Bool("bodyTplPtr_nil", bodyTplPtr == nil), zap.String("bodyTpl_value", bodyTplValue))
-			bodyToSend = []byte("{}")
-		}
-
-		// HMAC signature
-		mac := hmac.New(sha256.New, []byte(cfg.WebhookSigningKey))
-		mac.Write(bodyToSend)
-		sig := hex.EncodeToString(mac.Sum(nil))
-
-		// Create request
 		startTime := time.Now()
-		req, err := http.NewRequest(method, url, bytes.NewReader(bodyToSend))
+		req, err := newWebhookRequest(c.Request.Context(), cfg, nil, wh, rendered)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
 			return
 		}
-
-		req.Header.Set("Content-Type", contentType)
-		req.Header.Set("X-Form-Id", formId)
-		req.Header.Set("X-Form-Version", fmt.Sprintf("%d", version))
-		req.Header.Set("X-Signature", "sha256="+sig)
-		for k, v := range headers {
-			req.Header.Set(k, v)
+		if err := resolveRequestSecrets(c.Request.Context(), store, req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to resolve secrets", "details": err.Error()})
+			return
 		}
+		url, method := req.URL.String(), wh.Method
 
-		// Send request (no retries for test)
-		client := &http.Client{Timeout: time.Duration(cfg.WebhookTimeout()) * time.Millisecond}
-		resp, err := client.Do(req)
+		// Send request (no retries for test), authenticated like real deliveries
+		resp, err := auth.do(req, wh.Auth)
 		duration := time.Since(startTime)
 
 		response := TestWebhookResponse{
@@ -493,3 +574,136 @@ func TestWebhookHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.Han
 
 
 
+
+// loadFormFields returns the fields of a form version, or of the latest
+// version for formLevelVersion.
+func loadFormFields(q queryRower, formId string, version int) ([]types.Field, error) {
+	var raw []byte
+	var err error
+	if version == formLevelVersion {
+		err = q.QueryRow("SELECT fields_json FROM form_snapshots WHERE form_id=? ORDER BY version DESC LIMIT 1", formId).Scan(&raw)
+	} else {
+		err = q.QueryRow("SELECT fields_json FROM form_snapshots WHERE form_id=? AND version=?", formId, version).Scan(&raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fields []types.Field
+	err = json.Unmarshal(raw, &fields)
+	return fields, err
+}
+
+// loadWebhookForPreview loads a webhook and its form's fields, writing the
+// error response itself on failure.
+func loadWebhookForPreview(c *gin.Context, db *sql.DB, webhookId uint64, log *zap.Logger) (*webhookRow, []types.Field, bool) {
+	wh, err := loadWebhook(db, webhookId)
+	if err != nil {
+		log.Error("failed to query webhook", zap.Error(err), zap.Uint64("webhookId", webhookId))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query webhook"})
+		return nil, nil, false
+	}
+	if wh.FormLevel {
+		// Form-level webhooks are previewed and tested against the latest version
+		if wh.Version, err = latestFormVersion(db, wh.FormID); err != nil {
+			log.Error("failed to query form", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query form"})
+			return nil, nil, false
+		}
+	}
+	fields, err := loadFormFields(db, wh.FormID, wh.Version)
+	if err != nil {
+		log.Error("failed to query form", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query form"})
+		return nil, nil, false
+	}
+	return wh, fields, true
+}
+
+type previewWebhookReq struct {
+	// Sample submission; a mock built from the form's fields is used when answers are omitted
+	Answers      map[string]any `json:"answers"`
+	Meta         map[string]any `json:"meta"`
+	SubmissionID uint64         `json:"submissionId"`
+	// Values the webhook's dependencies would have extracted; placeholders when omitted
+	Responses map[string]any `json:"responses"`
+}
+
+type WebhookPreview struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body"`
+	ValidJSON *bool             `json:"validJson,omitempty"` // only for JSON content types
+}
+
+// PreviewWebhookHandler renders the request a webhook would send for a sample
+// submission without sending it. Secret references stay unresolved and
+// credential headers are masked.
+func PreviewWebhookHandler(db *sql.DB, cfg *config.Config, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookId, ok := webhookParams(c, db, log)
+		if !ok {
+			return
+		}
+		var req previewWebhookReq
+		if c.Request.ContentLength > 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+				return
+			}
+		}
+		wh, fields, ok := loadWebhookForPreview(c, db, webhookId, log)
+		if !ok {
+			return
+		}
+		sample := mockSubmissionBody(wh.FormID, wh.Version, fields)
+		if req.Answers != nil {
+			if req.Meta == nil {
+				req.Meta = map[string]any{"locale": "en", "device": "web"}
+			}
+			sample, _ = json.Marshal(map[string]any{"event": eventSubmissionCreated, "id": mockEventID, "occurredAt": formatOccurredAt(time.Now()),
+				"formId": wh.FormID, "version": wh.Version, "submittedAt": time.Now().UnixMilli(), "answers": req.Answers, "meta": req.Meta})
+		}
+		if req.SubmissionID == 0 {
+			req.SubmissionID = mockSubmissionID
+		}
+		if req.Responses == nil {
+			chain, err := loadWebhookChain(db, wh.FormID, wh.chainVersion())
+			if err != nil {
+				log.Error("failed to load webhook dependencies", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query webhook"})
+				return
+			}
+			req.Responses = sampleResponses(chain, wh.DependsOn)
+		}
+		sample = withResponses(sample, req.Responses)
+
+		rendered, err := renderSampleWebhook(wh, fields, req.SubmissionID, sample)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "template error", "details": []string{"/" + err.Error()}})
+			return
+		}
+		body := rendered.Body
+		// Previews show file parts as placeholders instead of fetching them
+		rendered.Multipart = nil
+		httpReq, err := newWebhookRequest(c.Request.Context(), cfg, nil, wh, rendered)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid request", "details": []string{err.Error()}})
+			return
+		}
+		headers := make(map[string]string, len(httpReq.Header))
+		for k := range httpReq.Header {
+			headers[k] = httpReq.Header.Get(k)
+		}
+		out := WebhookPreview{Method: httpReq.Method, URL: httpReq.URL.String(), Headers: maskHeaders(headers), Body: string(body)}
+		if wh.Auth != nil && wh.Auth.OAuth2 != nil {
+			// The token is only fetched when sending
+			out.Headers["Authorization"] = "Bearer <oauth2 token>"
+		}
+		if isJSONContentType(wh.ContentType) {
+			valid := json.Valid(body)
+			out.ValidJSON = &valid
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
@@ -48,11 +48,32 @@ type PurchaseAuthConfig struct {
     AdditionalWebhooks   []any               `json:"additional_webhooks,omitempty"`
 }
 
+// EmailActionConfig configures the "email" submit action. Subject and body
+// are templates per locale; empty ones fall back to the built-in answer table.
+type EmailActionConfig struct {
+    To      []string      `json:"to,omitempty"`       // static recipients
+    ToField string        `json:"to_field,omitempty"` // answer holding a recipient address
+    Subject LocaleString  `json:"subject,omitempty"`
+    Body    LocaleString  `json:"body,omitempty"`
+    Digest  *DigestConfig `json:"digest,omitempty"` // batch submissions instead of one email each
+}
+
+// DigestConfig batches submissions into one delivery on a schedule: at the
+// top of every hour, daily at a time of day, or every N submissions.
+type DigestConfig struct {
+    Schedule string `json:"schedule"`           // hourly, daily or count
+    At       string `json:"at,omitempty"`       // daily: HH:MM
+    Timezone string `json:"timezone,omitempty"` // IANA name for hourly and daily, UTC when empty
+    Every    int    `json:"every,omitempty"`    // count: submissions per digest
+    Format   string `json:"format,omitempty"`   // json (default) or csv
+}
+
 type SubmitAction struct {
     Type               string             `json:"type"`
     Enabled            bool               `json:"enabled"`
     URL                string             `json:"url,omitempty"`
     PurchaseAuthConfig *PurchaseAuthConfig `json:"purchase_auth_config,omitempty"`
+    Email              *EmailActionConfig `json:"email,omitempty"`
 }
 
 type IdempotencyCfg struct {
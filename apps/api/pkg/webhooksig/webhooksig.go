@@ -0,0 +1,160 @@
+// Package webhooksig signs and verifies form webhook deliveries.
+//
+// Every delivery carries an X-Webhook-Signature header of the form
+//
+//	t=1700000000,v1=5257a869...,v1=9a0f11c2...
+//
+// where t is the Unix time the request was signed and each v1 is the hex
+// HMAC-SHA256 of "<t>.<body>" under one of the webhook's active secrets.
+// While a secret is being rotated both the old and the new secret sign the
+// request, so a receiver holding either one keeps working.
+//
+// Receivers typically only need VerifyRequest:
+//
+//	body, err := webhooksig.VerifyRequest(r, webhooksig.DefaultTolerance, []byte(secret))
+//	if err != nil {
+//		http.Error(w, "bad signature", http.StatusUnauthorized)
+//		return
+//	}
+package webhooksig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderName is the request header carrying the signature.
+const HeaderName = "X-Webhook-Signature"
+
+// DefaultTolerance is how far the signature timestamp may drift from the
+// receiver's clock before the request is treated as a replay.
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	ErrMissingHeader       = errors.New("webhooksig: missing signature header")
+	ErrInvalidHeader       = errors.New("webhooksig: malformed signature header")
+	ErrTimestampOutOfRange = errors.New("webhooksig: timestamp outside tolerance")
+	ErrNoValidSignature    = errors.New("webhooksig: no signature matches")
+)
+
+// ComputeSignature returns the hex v1 signature of payload signed at t.
+func ComputeSignature(t time.Time, payload, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(t.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Header builds the header value with one v1 entry per secret.
+func Header(t time.Time, payload []byte, secrets ...[]byte) string {
+	var b strings.Builder
+	b.WriteString("t=")
+	b.WriteString(strconv.FormatInt(t.Unix(), 10))
+	for _, s := range secrets {
+		b.WriteString(",v1=")
+		b.WriteString(ComputeSignature(t, payload, s))
+	}
+	return b.String()
+}
+
+// HeaderFrom is Header for a payload too large to hold in memory; it reads r
+// once, signing with every secret as it goes.
+func HeaderFrom(t time.Time, r io.Reader, secrets ...[]byte) (string, error) {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	macs := make([]io.Writer, len(secrets))
+	for i, s := range secrets {
+		mac := hmac.New(sha256.New, s)
+		mac.Write([]byte(ts + "."))
+		macs[i] = mac
+	}
+	if _, err := io.Copy(io.MultiWriter(macs...), r); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString("t=")
+	b.WriteString(ts)
+	for _, m := range macs {
+		b.WriteString(",v1=")
+		b.WriteString(hex.EncodeToString(m.(hash.Hash).Sum(nil)))
+	}
+	return b.String(), nil
+}
+
+// Verify checks header against payload. It succeeds if any v1 signature
+// matches any of the given secrets and the timestamp is within tolerance
+// (tolerance <= 0 skips the timestamp check).
+func Verify(payload []byte, header string, tolerance time.Duration, secrets ...[]byte) error {
+	return verifyAt(payload, header, tolerance, time.Now(), secrets...)
+}
+
+func verifyAt(payload []byte, header string, tolerance time.Duration, now time.Time, secrets ...[]byte) error {
+	if header == "" {
+		return ErrMissingHeader
+	}
+	var ts int64 = -1
+	var sigs [][]byte
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrInvalidHeader
+		}
+		switch k {
+		case "t":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return ErrInvalidHeader
+			}
+			ts = n
+		case "v1":
+			sig, err := hex.DecodeString(v)
+			if err != nil {
+				continue
+			}
+			sigs = append(sigs, sig)
+		}
+		// Unknown schemes are ignored so new ones can be added later
+	}
+	if ts < 0 || len(sigs) == 0 {
+		return ErrInvalidHeader
+	}
+	t := time.Unix(ts, 0)
+	if tolerance > 0 {
+		if d := now.Sub(t); d > tolerance || d < -tolerance {
+			return ErrTimestampOutOfRange
+		}
+	}
+	for _, secret := range secrets {
+		expected, _ := hex.DecodeString(ComputeSignature(t, payload, secret))
+		for _, sig := range sigs {
+			if hmac.Equal(expected, sig) {
+				return nil
+			}
+		}
+	}
+	return ErrNoValidSignature
+}
+
+// VerifyRequest reads the request body, verifies it and returns it. The body
+// is restored on r so later handlers can read it again.
+func VerifyRequest(r *http.Request, tolerance time.Duration, secrets ...[]byte) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err := Verify(body, r.Header.Get(HeaderName), tolerance, secrets...); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,77 @@
+package webhooksig
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	payload := []byte(`{"formId":"f","version":1}`)
+	oldKey, newKey := []byte("whsec_old"), []byte("whsec_new")
+	now := time.Unix(1700000000, 0)
+	header := Header(now, payload, newKey, oldKey)
+
+	cases := []struct {
+		name    string
+		payload []byte
+		header  string
+		now     time.Time
+		secrets [][]byte
+		want    error
+	}{
+		{"new secret", payload, header, now, [][]byte{newKey}, nil},
+		{"old secret during rotation", payload, header, now, [][]byte{oldKey}, nil},
+		{"either of receiver's secrets", payload, header, now, [][]byte{[]byte("other"), oldKey}, nil},
+		{"wrong secret", payload, header, now, [][]byte{[]byte("other")}, ErrNoValidSignature},
+		{"tampered body", []byte(`{"formId":"g","version":1}`), header, now, [][]byte{newKey}, ErrNoValidSignature},
+		{"replayed later", payload, header, now.Add(DefaultTolerance + time.Second), [][]byte{newKey}, ErrTimestampOutOfRange},
+		{"future timestamp", payload, header, now.Add(-DefaultTolerance - time.Second), [][]byte{newKey}, ErrTimestampOutOfRange},
+		{"missing header", payload, "", now, [][]byte{newKey}, ErrMissingHeader},
+		{"no timestamp", payload, "v1=abcd", now, [][]byte{newKey}, ErrInvalidHeader},
+		{"no signatures", payload, "t=1700000000", now, [][]byte{newKey}, ErrInvalidHeader},
+		{"unknown scheme ignored", payload, header + ",v0=zz", now, [][]byte{newKey}, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := verifyAt(tc.payload, tc.header, DefaultTolerance, tc.now, tc.secrets...); got != tc.want {
+				t.Fatalf("verifyAt() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	payload := `{"ok":true}`
+	secret := []byte("whsec_test")
+	r := httptest.NewRequest("POST", "/hook", strings.NewReader(payload))
+	r.Header.Set(HeaderName, Header(time.Now(), []byte(payload), secret))
+
+	body, err := VerifyRequest(r, DefaultTolerance, secret)
+	if err != nil {
+		t.Fatalf("VerifyRequest() error = %v", err)
+	}
+	if string(body) != payload {
+		t.Fatalf("body = %q, want %q", body, payload)
+	}
+	// Body stays readable for the next handler
+	rest, _ := io.ReadAll(r.Body)
+	if string(rest) != payload {
+		t.Fatalf("restored body = %q, want %q", rest, payload)
+	}
+}
+
+func TestHeaderFrom(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := []byte("--b\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1\r\n--b--\r\n")
+	got, err := HeaderFrom(now, bytes.NewReader(payload), []byte("one"), []byte("two"))
+	if err != nil {
+		t.Fatalf("HeaderFrom() error = %v", err)
+	}
+	if want := Header(now, payload, []byte("one"), []byte("two")); got != want {
+		t.Fatalf("HeaderFrom() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,23 @@
+-- Durable outbox for webhook deliveries.
+-- One row per (submission, webhook) is written in the same transaction as the
+-- submission insert and drained by the API's dispatcher workers.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `submission_id` BIGINT UNSIGNED NOT NULL,
+  `webhook_id` BIGINT UNSIGNED NOT NULL,
+  `form_id` VARCHAR(191) NOT NULL,
+  `version` INT NOT NULL,
+  `payload_json` JSON NOT NULL,
+  `status` ENUM('pending','processing','succeeded','failed','cancelled') NOT NULL DEFAULT 'pending',
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` DATETIME(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+  `locked_until` DATETIME(3) NULL,
+  `last_status_code` INT NULL,
+  `last_error` TEXT NULL,
+  `completed_at` DATETIME(3) NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  KEY `idx_webhook_deliveries_due` (`status`,`next_attempt_at`),
+  KEY `idx_webhook_deliveries_submission` (`submission_id`),
+  KEY `idx_webhook_deliveries_webhook` (`webhook_id`)
+);
@@ -0,0 +1,16 @@
+-- One row per HTTP attempt made for a webhook delivery
+CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+  `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `delivery_id` BIGINT UNSIGNED NOT NULL,
+  `webhook_id` BIGINT UNSIGNED NOT NULL,
+  `submission_id` BIGINT UNSIGNED NOT NULL,
+  `attempt` INT NOT NULL,
+  `status_code` INT NULL,
+  `duration_ms` INT NOT NULL DEFAULT 0,
+  `response_body` TEXT NULL,
+  `error` TEXT NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `idx_delivery_attempts_submission` (`submission_id`,`id`),
+  KEY `idx_delivery_attempts_webhook` (`webhook_id`,`id`),
+  KEY `idx_delivery_attempts_delivery` (`delivery_id`)
+);
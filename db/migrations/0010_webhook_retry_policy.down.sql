@@ -0,0 +1,2 @@
+ALTER TABLE form_webhooks
+  DROP COLUMN `retry_policy_json`;
@@ -0,0 +1,3 @@
+-- Per-webhook retry policy (NULL = server defaults)
+ALTER TABLE form_webhooks
+  ADD COLUMN `retry_policy_json` JSON NULL AFTER `selected_fields_json`;
@@ -0,0 +1,5 @@
+ALTER TABLE form_webhooks
+  DROP COLUMN `disabled_at`,
+  DROP COLUMN `disabled_reason`;
+
+DROP TABLE IF EXISTS webhook_breakers;
@@ -0,0 +1,15 @@
+-- Circuit breaker state per webhook endpoint
+CREATE TABLE IF NOT EXISTS webhook_breakers (
+  `webhook_id` BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+  `state` ENUM('closed','open','half_open') NOT NULL DEFAULT 'closed',
+  `consecutive_failures` INT NOT NULL DEFAULT 0,
+  `opened_at` DATETIME(3) NULL,
+  `next_probe_at` DATETIME(3) NULL,
+  `last_error` TEXT NULL,
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+-- Why a webhook was switched off automatically
+ALTER TABLE form_webhooks
+  ADD COLUMN `disabled_reason` TEXT NULL AFTER `enabled`,
+  ADD COLUMN `disabled_at` DATETIME NULL AFTER `disabled_reason`;
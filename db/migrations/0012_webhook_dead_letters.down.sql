@@ -0,0 +1,5 @@
+ALTER TABLE webhook_deliveries
+  DROP KEY `idx_webhook_deliveries_dead_letter`,
+  DROP COLUMN `dead_letter_id`;
+
+DROP TABLE IF EXISTS webhook_dead_letters;
@@ -0,0 +1,28 @@
+-- Deliveries that exhausted their retries, with the exact request that was sent
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+  `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `delivery_id` BIGINT UNSIGNED NOT NULL,
+  `webhook_id` BIGINT UNSIGNED NOT NULL,
+  `submission_id` BIGINT UNSIGNED NOT NULL,
+  `form_id` VARCHAR(191) NOT NULL,
+  `version` INT NOT NULL,
+  `request_method` VARCHAR(16) NOT NULL,
+  `request_url` TEXT NOT NULL,
+  `request_headers_json` JSON NOT NULL,
+  `request_body` MEDIUMTEXT NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `last_status_code` INT NULL,
+  `last_error` TEXT NULL,
+  `status` ENUM('dead','replaying','replayed') NOT NULL DEFAULT 'dead',
+  `replayed_at` DATETIME(3) NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  UNIQUE KEY `uq_webhook_dead_letters_delivery` (`delivery_id`),
+  KEY `idx_webhook_dead_letters_form` (`form_id`,`version`,`status`),
+  KEY `idx_webhook_dead_letters_webhook` (`webhook_id`)
+);
+
+-- Replays go through the outbox but resend the stored request as-is
+ALTER TABLE webhook_deliveries
+  ADD COLUMN `dead_letter_id` BIGINT UNSIGNED NULL AFTER `webhook_id`,
+  ADD KEY `idx_webhook_deliveries_dead_letter` (`dead_letter_id`);
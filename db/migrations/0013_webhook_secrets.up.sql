@@ -0,0 +1,10 @@
+-- Per-webhook signing secrets. More than one can be active while a rotation's
+-- grace period runs; expired rows are kept for the audit trail.
+CREATE TABLE IF NOT EXISTS webhook_secrets (
+  `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `webhook_id` BIGINT UNSIGNED NOT NULL,
+  `secret` VARCHAR(128) NOT NULL,
+  `expires_at` DATETIME(3) NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `idx_webhook_secrets_webhook` (`webhook_id`,`expires_at`)
+);
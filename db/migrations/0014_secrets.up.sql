@@ -0,0 +1,8 @@
+-- Named secrets, AES-GCM encrypted with SECRETS_MASTER_KEY (nonce || ciphertext)
+CREATE TABLE IF NOT EXISTS secrets (
+  `name` VARCHAR(191) NOT NULL PRIMARY KEY,
+  `value_enc` VARBINARY(8192) NOT NULL,
+  `description` TEXT NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
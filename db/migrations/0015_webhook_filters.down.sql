@@ -0,0 +1,6 @@
+UPDATE webhook_deliveries SET status='cancelled' WHERE status='skipped';
+ALTER TABLE webhook_deliveries
+  MODIFY COLUMN `status` ENUM('pending','processing','succeeded','failed','cancelled') NOT NULL DEFAULT 'pending';
+
+ALTER TABLE form_webhooks
+  DROP COLUMN `filter_expr`;
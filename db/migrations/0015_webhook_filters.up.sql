@@ -0,0 +1,7 @@
+-- Optional expression deciding whether a webhook fires for a submission
+ALTER TABLE form_webhooks
+  ADD COLUMN `filter_expr` TEXT NULL AFTER `retry_policy_json`;
+
+-- Deliveries whose filter didn't match are recorded as skipped
+ALTER TABLE webhook_deliveries
+  MODIFY COLUMN `status` ENUM('pending','processing','succeeded','failed','cancelled','skipped') NOT NULL DEFAULT 'pending';
@@ -0,0 +1,4 @@
+UPDATE form_webhooks SET mode='raw' WHERE mode='mapping';
+ALTER TABLE form_webhooks
+  DROP COLUMN `mapping_json`,
+  MODIFY COLUMN `mode` ENUM('raw') NOT NULL DEFAULT 'raw';
@@ -0,0 +1,4 @@
+-- Declarative field mapping as an alternative to body templates
+ALTER TABLE form_webhooks
+  MODIFY COLUMN `mode` ENUM('raw','mapping') NOT NULL DEFAULT 'raw',
+  ADD COLUMN `mapping_json` JSON NULL AFTER `body_template`;
@@ -0,0 +1,3 @@
+-- Templated query parameters appended to the endpoint URL
+ALTER TABLE form_webhooks
+  ADD COLUMN `query_params_json` JSON NULL AFTER `headers_json`;
@@ -0,0 +1,3 @@
+UPDATE form_webhooks SET mode='raw' WHERE mode IN ('slack','teams','discord');
+ALTER TABLE form_webhooks
+  MODIFY COLUMN `mode` ENUM('raw','mapping') NOT NULL DEFAULT 'raw';
@@ -0,0 +1,3 @@
+-- Built-in Slack, Teams and Discord message formats
+ALTER TABLE form_webhooks
+  MODIFY COLUMN `mode` ENUM('raw','mapping','slack','teams','discord') NOT NULL DEFAULT 'raw';
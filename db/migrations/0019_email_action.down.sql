@@ -0,0 +1,3 @@
+DELETE FROM webhook_deliveries WHERE channel='email';
+ALTER TABLE webhook_deliveries
+  DROP COLUMN `channel`;
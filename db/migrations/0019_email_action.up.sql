@@ -0,0 +1,3 @@
+-- Email notifications go through the webhook outbox; their rows have webhook_id 0
+ALTER TABLE webhook_deliveries
+  ADD COLUMN `channel` ENUM('webhook','email') NOT NULL DEFAULT 'webhook' AFTER `webhook_id`;
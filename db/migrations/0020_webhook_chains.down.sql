@@ -0,0 +1,7 @@
+ALTER TABLE webhook_deliveries
+  DROP COLUMN `response_values_json`;
+
+ALTER TABLE form_webhooks
+  DROP COLUMN `response_extract_json`,
+  DROP COLUMN `depends_on_json`,
+  DROP COLUMN `position`;
@@ -0,0 +1,9 @@
+-- Webhook order within a form version, dependencies on earlier webhooks and
+-- values extracted from their responses for later webhooks to use
+ALTER TABLE form_webhooks
+  ADD COLUMN `position` INT NOT NULL DEFAULT 0 AFTER `filter_expr`,
+  ADD COLUMN `depends_on_json` JSON NULL AFTER `position`,
+  ADD COLUMN `response_extract_json` JSON NULL AFTER `depends_on_json`;
+
+ALTER TABLE webhook_deliveries
+  ADD COLUMN `response_values_json` JSON NULL AFTER `last_error`;
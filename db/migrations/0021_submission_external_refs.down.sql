@@ -0,0 +1,5 @@
+ALTER TABLE submissions
+  DROP COLUMN `external_refs`;
+
+ALTER TABLE form_webhooks
+  DROP COLUMN `external_refs_json`;
@@ -0,0 +1,7 @@
+-- IDs that webhook endpoints returned for a submission (CRM ticket, lead...),
+-- extracted per webhook by external_refs_json
+ALTER TABLE form_webhooks
+  ADD COLUMN `external_refs_json` JSON NULL AFTER `response_extract_json`;
+
+ALTER TABLE submissions
+  ADD COLUMN `external_refs` JSON NULL AFTER `webhook_status`;
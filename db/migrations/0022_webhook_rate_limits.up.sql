@@ -0,0 +1,3 @@
+-- Per-webhook concurrency and requests-per-second limits for the dispatcher
+ALTER TABLE form_webhooks
+  ADD COLUMN `rate_limit_json` JSON NULL AFTER `retry_policy_json`;
@@ -0,0 +1,3 @@
+-- OAuth2 client-credentials and mutual TLS settings for outbound webhooks
+ALTER TABLE form_webhooks
+  ADD COLUMN `auth_json` JSON NULL AFTER `headers_json`;
@@ -0,0 +1,7 @@
+ALTER TABLE webhook_deliveries
+  DROP COLUMN `occurred_at`,
+  DROP COLUMN `event_id`,
+  DROP COLUMN `event`;
+
+ALTER TABLE form_webhooks
+  DROP COLUMN `events_json`;
@@ -0,0 +1,11 @@
+-- Event types a webhook subscribes to; NULL means just submission.created.
+-- Deliveries record their event; those not about a submission have submission_id 0
+ALTER TABLE form_webhooks
+  ADD COLUMN `events_json` JSON NULL AFTER `mode`;
+
+ALTER TABLE webhook_deliveries
+  ADD COLUMN `event` VARCHAR(64) NOT NULL DEFAULT 'submission.created' AFTER `channel`,
+  ADD COLUMN `event_id` CHAR(36) NULL AFTER `event`,
+  ADD COLUMN `occurred_at` DATETIME(3) NULL AFTER `event_id`;
+
+UPDATE webhook_deliveries SET event_id=UUID(), occurred_at=created_at WHERE event_id IS NULL;
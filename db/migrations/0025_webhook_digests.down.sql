@@ -0,0 +1,7 @@
+DELETE FROM webhook_deliveries WHERE event='submission.digest';
+
+DROP TABLE IF EXISTS webhook_digest_items;
+DROP TABLE IF EXISTS webhook_digests;
+
+ALTER TABLE form_webhooks
+  DROP COLUMN `digest_json`;
@@ -0,0 +1,34 @@
+-- Digest schedule of a webhook; NULL sends a delivery per submission
+ALTER TABLE form_webhooks
+  ADD COLUMN `digest_json` JSON NULL AFTER `events_json`;
+
+-- One digest per schedule period (period_end is NULL for count schedules),
+-- sent as a single submission.digest delivery
+CREATE TABLE IF NOT EXISTS webhook_digests (
+  `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `channel` ENUM('webhook','email') NOT NULL DEFAULT 'webhook',
+  `webhook_id` BIGINT UNSIGNED NOT NULL,
+  `form_id` VARCHAR(191) NOT NULL,
+  `version` INT NOT NULL,
+  `period_end` DATETIME(3) NULL,
+  `submission_count` INT NOT NULL DEFAULT 0,
+  `created_at` DATETIME(3) NOT NULL,
+  UNIQUE KEY `uq_webhook_digests_period` (`channel`,`webhook_id`,`form_id`,`version`,`period_end`)
+);
+
+-- Submissions waiting for (digest_id NULL) or included in a digest. A
+-- submission is only ever recorded once per webhook or email action.
+-- created_at is UTC, compared against schedule boundaries
+CREATE TABLE IF NOT EXISTS webhook_digest_items (
+  `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `channel` ENUM('webhook','email') NOT NULL DEFAULT 'webhook',
+  `webhook_id` BIGINT UNSIGNED NOT NULL,
+  `form_id` VARCHAR(191) NOT NULL,
+  `version` INT NOT NULL,
+  `submission_id` BIGINT UNSIGNED NOT NULL,
+  `digest_id` BIGINT UNSIGNED NULL,
+  `created_at` DATETIME(3) NOT NULL,
+  UNIQUE KEY `uq_webhook_digest_items_submission` (`channel`,`webhook_id`,`form_id`,`version`,`submission_id`),
+  KEY `idx_webhook_digest_items_pending` (`digest_id`,`channel`,`webhook_id`,`form_id`,`version`,`created_at`),
+  KEY `idx_webhook_digest_items_submission_id` (`submission_id`)
+);
@@ -1,5 +1,7 @@
 export type AuthConfig = {
   baseUrl: string;
+  // When set, login goes through this proxy, which adds the device id server-side
+  loginUrl?: string;
   listingsApiBaseUrl?: string;
   deviceId: string;
   appSignature: string;
@@ -108,7 +110,7 @@ export async function validateToken(token: string, config: AuthConfig): Promise<
 
 export async function login(credentials: LoginCredentials, config: AuthConfig): Promise<LoginResponse> {
   try {
-    const response = await fetch(`${config.baseUrl}/users/auth/login`, {
+    const response = await fetch(config.loginUrl || `${config.baseUrl}/users/auth/login`, {
       method: 'POST',
       headers: {
         'Accept': 'application/json',
@@ -683,6 +683,7 @@ export const FormView: React.FC<{
 
       const authCfg: AuthConfig = {
         baseUrl: config.auth_api_base_url,
+        loginUrl: `/api/forms/${encodeURIComponent(form.formId)}/${form.version}/auth/login`,
         listingsApiBaseUrl: config.listings_api_base_url,
         deviceId: config.device_id || `web_${Date.now()}`,
         appSignature: config.app_signature || '',
@@ -546,6 +546,7 @@ async function purchaseAuthenticated(
   
   const authConfig: AuthConfig = {
     baseUrl: config.auth_api_base_url,
+    loginUrl: `/api/forms/${encodeURIComponent(payload.formId)}/${payload.version}/auth/login`,
     deviceId: config.device_id || `web_${Date.now()}`,
     appSignature: config.app_signature || '',
     versionNumber: config.version_number || '26.0.0',
@@ -622,8 +623,8 @@ async function purchaseAuthenticated(
   console.log('[PurchaseAuth] Purchase payload items.id:', purchasePayload.items[0].id);
 
   // Call pre-purchase webhook if configured (before purchase API)
-  if (config.pre_purchase_webhook?.url) {
-    console.log('[PurchaseAuth] Calling pre-purchase webhook:', config.pre_purchase_webhook.url);
+  if (config.pre_purchase_webhook) {
+    console.log('[PurchaseAuth] Calling pre-purchase webhook');
     console.log('[PurchaseAuth] userData in payload:', JSON.stringify(payload.userData));
     
     // Find the selected listing data
@@ -660,11 +661,11 @@ async function purchaseAuthenticated(
     console.log('[PurchaseAuth] Pre-purchase webhook payload:', JSON.stringify(webhookPayload));
     
     try {
-      const webhookResponse = await fetch(config.pre_purchase_webhook.url, {
+      // Sent through the API, which adds the (possibly secret-backed) API key
+      const webhookResponse = await fetch(`/api/forms/${encodeURIComponent(payload.formId)}/${payload.version}/pre-purchase`, {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
-          'X-API-Key': config.pre_purchase_webhook.api_key,
         },
         body: JSON.stringify(webhookPayload),
       });
@@ -705,31 +706,22 @@ async function purchaseAuthenticated(
   
   callbacks?.onPurchaseSuccess?.(purchaseResult.transactionId);
 
-  if (config.additional_webhooks && config.additional_webhooks.length > 0) {
-    console.log('[PurchaseAuth] Calling additional webhooks');
-    for (const webhook of config.additional_webhooks) {
-      try {
-        const webhookPayload = {
-          ...payload,
-          purchase_transaction_id: purchaseResult.transactionId,
-          purchase_data: purchaseResult.data,
-        };
-
-        const headers: Record<string, string> = {
-          'Content-Type': 'application/json',
-          ...webhook.headers,
-        };
-
-        await fetch(webhook.url, {
-          method: webhook.method || 'POST',
-          headers,
-          body: JSON.stringify(webhookPayload),
-        });
-        console.log('[PurchaseAuth] Webhook called:', webhook.url);
-      } catch (webhookError) {
-        console.error('[PurchaseAuth] Webhook error:', webhook.url, webhookError);
-      }
-    }
+  // Additional webhooks are called by the API so their URLs and headers stay private
+  try {
+    const webhookPayload = {
+      ...payload,
+      purchase_transaction_id: purchaseResult.transactionId,
+      purchase_data: purchaseResult.data,
+    };
+    await fetch(`/api/forms/${encodeURIComponent(payload.formId)}/${payload.version}/purchase-webhooks`, {
+      method: 'POST',
+      keepalive: true,
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(webhookPayload),
+    });
+    console.log('[PurchaseAuth] Additional webhooks called');
+  } catch (webhookError) {
+    console.error('[PurchaseAuth] Additional webhooks error:', webhookError);
   }
 
   return {
@@ -761,6 +753,7 @@ export async function runSubmitPipeline(form: FormConfig, payload: Payload): Pro
       return result;
     },
     webhooks: async () => true,
+    email: async () => true,
     redirect: async () => true,
     nextjs_post: (p) => nextjsPost(p, form, submissionId),
     purchase_authenticated: async (p) => {